@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/juju/ratelimit"
+)
+
+// ErrDeniedAddress is emitted when a connection from a denied or not allowed
+// address has been rejected.
+var ErrDeniedAddress = errors.New("connection from denied address")
+
+// ErrTooManyConnections is emitted when a connection has been rejected because
+// the maximum number of connections has been reached.
+var ErrTooManyConnections = errors.New("too many connections")
+
+// ErrTooManyConnectionsPerIP is emitted when a connection has been rejected
+// because the maximum number of connections from the same IP has been reached.
+var ErrTooManyConnectionsPerIP = errors.New("too many connections from the same ip")
+
+// ErrConnectRateExceeded is emitted when a connection has been rejected because
+// the connect rate limit has been exceeded.
+var ErrConnectRateExceeded = errors.New("connect rate exceeded")
+
+// ErrTooManyPendingConnects is emitted when a connection has been rejected
+// because too many connections have not yet sent a ConnectPacket.
+var ErrTooManyPendingConnects = errors.New("too many pending connects")
+
+// admission keeps track of the active and pending connections of an engine.
+type admission struct {
+	bucket  *ratelimit.Bucket
+	total   int
+	pending int
+	perIP   map[string]int
+	mutex   sync.Mutex
+}
+
+// returns a new admission
+func newAdmission() *admission {
+	return &admission{
+		perIP: make(map[string]int),
+	}
+}
+
+// checks the limits of the engine and reserves a slot for the connection
+func (a *admission) admit(e *Engine, ip net.IP) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// check denied networks
+	if len(e.DeniedNetworks) > 0 && (ip == nil || containsIP(e.DeniedNetworks, ip)) {
+		return ErrDeniedAddress
+	}
+
+	// check allowed networks
+	if len(e.AllowedNetworks) > 0 && (ip == nil || !containsIP(e.AllowedNetworks, ip)) {
+		return ErrDeniedAddress
+	}
+
+	// check total connections
+	if e.MaxConnections > 0 && a.total >= e.MaxConnections {
+		return ErrTooManyConnections
+	}
+
+	// get key
+	key := ip.String()
+
+	// check connections per ip
+	if e.MaxConnectionsPerIP > 0 && ip != nil && a.perIP[key] >= e.MaxConnectionsPerIP {
+		return ErrTooManyConnectionsPerIP
+	}
+
+	// check pending connects
+	if e.MaxPendingConnects > 0 && a.pending >= e.MaxPendingConnects {
+		return ErrTooManyPendingConnects
+	}
+
+	// check connect rate
+	if e.ConnectRate > 0 {
+		// create bucket lazily
+		if a.bucket == nil {
+			burst := e.ConnectBurst
+			if burst <= 0 {
+				burst = 1
+			}
+
+			a.bucket = ratelimit.NewBucketWithRate(e.ConnectRate, burst)
+		}
+
+		// take token
+		if a.bucket.TakeAvailable(1) == 0 {
+			return ErrConnectRateExceeded
+		}
+	}
+
+	// reserve slot
+	a.total++
+	a.pending++
+	a.perIP[key]++
+
+	return nil
+}
+
+// marks a connection as no longer pending
+func (a *admission) connected() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.pending--
+}
+
+// releases the slot of a connection
+func (a *admission) release(ip net.IP) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	// get key
+	key := ip.String()
+
+	// decrement counters
+	a.total--
+	a.perIP[key]--
+
+	// remove empty entries
+	if a.perIP[key] <= 0 {
+		delete(a.perIP, key)
+	}
+}
+
+// returns the ip of the specified address
+func addressIP(addr net.Addr) net.IP {
+	// check address
+	if addr == nil {
+		return nil
+	}
+
+	// check tcp address
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+
+	// otherwise parse string
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
+
+// returns whether one of the networks contains the ip
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
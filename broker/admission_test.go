@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmission(t *testing.T) {
+	engine := NewEngine(nil)
+	engine.MaxConnections = 2
+	engine.MaxConnectionsPerIP = 1
+
+	a := newAdmission()
+	ip1 := net.ParseIP("10.0.0.1")
+	ip2 := net.ParseIP("10.0.0.2")
+	ip3 := net.ParseIP("10.0.0.3")
+
+	assert.NoError(t, a.admit(engine, ip1))
+	assert.Equal(t, ErrTooManyConnectionsPerIP, a.admit(engine, ip1))
+	assert.NoError(t, a.admit(engine, ip2))
+	assert.Equal(t, ErrTooManyConnections, a.admit(engine, ip3))
+
+	a.release(ip1)
+	assert.NoError(t, a.admit(engine, ip3))
+}
+
+func TestAdmissionPendingConnects(t *testing.T) {
+	engine := NewEngine(nil)
+	engine.MaxPendingConnects = 1
+
+	a := newAdmission()
+	ip := net.ParseIP("10.0.0.1")
+
+	assert.NoError(t, a.admit(engine, ip))
+	assert.Equal(t, ErrTooManyPendingConnects, a.admit(engine, ip))
+
+	a.connected()
+	assert.NoError(t, a.admit(engine, ip))
+}
+
+func TestAdmissionConnectRate(t *testing.T) {
+	engine := NewEngine(nil)
+	engine.ConnectRate = 1
+	engine.ConnectBurst = 2
+
+	a := newAdmission()
+	ip := net.ParseIP("10.0.0.1")
+
+	assert.NoError(t, a.admit(engine, ip))
+	assert.NoError(t, a.admit(engine, ip))
+	assert.Equal(t, ErrConnectRateExceeded, a.admit(engine, ip))
+}
+
+func TestAdmissionNetworks(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	_, denied, _ := net.ParseCIDR("10.1.0.0/16")
+
+	engine := NewEngine(nil)
+	engine.AllowedNetworks = []*net.IPNet{allowed}
+	engine.DeniedNetworks = []*net.IPNet{denied}
+
+	a := newAdmission()
+
+	assert.NoError(t, a.admit(engine, net.ParseIP("10.0.0.1")))
+	assert.Equal(t, ErrDeniedAddress, a.admit(engine, net.ParseIP("10.1.0.1")))
+	assert.Equal(t, ErrDeniedAddress, a.admit(engine, net.ParseIP("192.168.0.1")))
+	assert.Equal(t, ErrDeniedAddress, a.admit(engine, nil))
+}
+
+func TestEngineMaxConnections(t *testing.T) {
+	engine := NewEngine(NewMemoryBackend())
+	engine.MaxConnections = 1
+
+	sub := engine.Events.Subscribe(100)
+
+	port, quit, done := Run(engine, "tcp")
+
+	c1 := client.New()
+	cf, err := c1.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	conn, err := transport.Dial("tcp://localhost:" + port)
+	assert.NoError(t, err)
+
+	pkt, err := conn.Receive()
+	assert.Nil(t, pkt)
+	assert.Error(t, err)
+
+	for event := range sub.Events() {
+		if event.Type == ConnectionRejected {
+			assert.Equal(t, ErrTooManyConnections, event.Error)
+			assert.NotEmpty(t, event.RemoteAddr)
+			assert.Nil(t, event.Client)
+			break
+		}
+	}
+
+	sub.Close()
+
+	assert.NoError(t, c1.Disconnect())
+
+	time.Sleep(50 * time.Millisecond)
+
+	c2 := client.New()
+	cf, err = c2.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+	assert.NoError(t, c2.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+}
@@ -0,0 +1,228 @@
+package broker
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/client/future"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/scram"
+	"github.com/256dpi/gomqtt/transport"
+	"github.com/stretchr/testify/assert"
+)
+
+func scramBackend(passwords map[string]string) (*MemoryBackend, *int32) {
+	backend := NewMemoryBackend()
+
+	var authentications int32
+	backend.StartAuthCB = SCRAMAuth(func(username string) (*scram.Credentials, error) {
+		atomic.AddInt32(&authentications, 1)
+
+		password, ok := passwords[username]
+		if !ok {
+			return nil, nil
+		}
+
+		return scram.NewCredentials(password, []byte("salt"), scram.DefaultIterations), nil
+	})
+
+	backend.AuthenticateCB = func(c *Client, username string, password string) (bool, error) {
+		return false, nil
+	}
+
+	return backend, &authentications
+}
+
+func TestEnhancedAuth(t *testing.T) {
+	backend, authentications := scramBackend(map[string]string{
+		"user": "secret",
+	})
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	c := client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.Fail(t, "should not be called")
+		return nil
+	}
+
+	config := client.NewConfig("tcp://localhost:" + port)
+	config.Authenticator = scram.NewClient("user", "secret")
+
+	cf, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+	assert.Equal(t, packet.ConnectionAccepted, cf.ReturnCode())
+	assert.Equal(t, int32(1), atomic.LoadInt32(authentications))
+
+	af, err := c.Reauthenticate()
+	assert.NoError(t, err)
+	assert.NoError(t, af.Wait(10*time.Second))
+	assert.Equal(t, int32(2), atomic.LoadInt32(authentications))
+
+	sf, err := c.Subscribe("test", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestEnhancedAuthFailure(t *testing.T) {
+	backend, _ := scramBackend(map[string]string{
+		"user": "secret",
+	})
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	for _, authenticator := range []client.Authenticator{
+		scram.NewClient("user", "wrong"),
+		scram.NewClient("unknown", "secret"),
+	} {
+		c := client.New()
+		wait := make(chan struct{})
+		c.Callback = func(msg *packet.Message, err error) error {
+			assert.Equal(t, client.ErrClientConnectionDenied, err)
+			close(wait)
+			return nil
+		}
+
+		config := client.NewConfig("tcp://localhost:" + port)
+		config.Authenticator = authenticator
+
+		cf, err := c.Connect(config)
+		assert.NoError(t, err)
+		assert.Equal(t, future.ErrCanceled, cf.Wait(10*time.Second))
+		assert.Equal(t, packet.ErrNotAuthorized, cf.ReturnCode())
+
+		safeReceive(wait)
+	}
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestEnhancedAuthUsername(t *testing.T) {
+	backend, _ := scramBackend(map[string]string{
+		"user":  "secret",
+		"other": "secret",
+	})
+
+	var username string
+	backend.AuthorizeSubscribeCB = func(c *Client, pkt *packet.SubscribePacket) (bool, error) {
+		username = c.Username()
+		return true, nil
+	}
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	c := client.New()
+	config := client.NewConfig("tcp://other@localhost:" + port)
+	config.Authenticator = scram.NewClient("user", "secret")
+
+	cf, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.Equal(t, future.ErrCanceled, cf.Wait(10*time.Second))
+	assert.Equal(t, packet.ErrNotAuthorized, cf.ReturnCode())
+
+	c = client.New()
+	config = client.NewConfig("tcp://user@localhost:" + port)
+	config.Authenticator = scram.NewClient("user", "secret")
+
+	cf, err = c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("test", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+	assert.Equal(t, "user", username)
+
+	wait := make(chan struct{})
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.Error(t, err)
+		close(wait)
+		return nil
+	}
+
+	config.Authenticator = scram.NewClient("other", "secret")
+
+	af, err := c.Reauthenticate()
+	assert.NoError(t, err)
+	assert.Equal(t, future.ErrCanceled, af.Wait(10*time.Second))
+
+	safeReceive(wait)
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestEnhancedAuthVersion(t *testing.T) {
+	port, quit, done := Run(NewEngine(NewMemoryBackend()), "tcp")
+
+	conn, err := transport.Dial("tcp://localhost:" + port)
+	assert.NoError(t, err)
+
+	err = conn.Send(packet.NewConnectPacket())
+	assert.NoError(t, err)
+
+	pkt, err := conn.Receive()
+	assert.NoError(t, err)
+	assert.Equal(t, packet.CONNACK, pkt.Type())
+
+	auth := packet.NewAuthPacket()
+	auth.ReasonCode = packet.ReAuthenticate
+	auth.Method = scram.Method
+
+	err = conn.Send(auth)
+	assert.NoError(t, err)
+
+	_, err = conn.Receive()
+	assert.Error(t, err)
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestReauthenticationFailure(t *testing.T) {
+	var password atomic.Value
+	password.Store("secret")
+
+	backend := NewMemoryBackend()
+	backend.StartAuthCB = SCRAMAuth(func(username string) (*scram.Credentials, error) {
+		return scram.NewCredentials(password.Load().(string), []byte("salt"), scram.DefaultIterations), nil
+	})
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	c := client.New()
+	wait := make(chan struct{})
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.Error(t, err)
+		close(wait)
+		return nil
+	}
+
+	config := client.NewConfig("tcp://localhost:" + port)
+	config.Authenticator = scram.NewClient("user", "secret")
+
+	cf, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	password.Store("changed")
+
+	af, err := c.Reauthenticate()
+	assert.NoError(t, err)
+	assert.Equal(t, future.ErrCanceled, af.Wait(10*time.Second))
+
+	safeReceive(wait)
+
+	close(quit)
+	safeReceive(done)
+}
@@ -1,9 +1,14 @@
 package broker
 
 import (
+	"errors"
+	"io"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/scram"
 	"github.com/256dpi/gomqtt/session"
 	"github.com/256dpi/gomqtt/topic"
 )
@@ -60,6 +65,36 @@ type Session interface {
 	Reset() error
 }
 
+// A SubscriptionMatcher is a Session that can return all stored subscriptions
+// that match a topic. The first matching subscription returned by
+// LookupSubscription is used for sessions that do not implement the interface.
+type SubscriptionMatcher interface {
+	// MatchSubscriptions should match a topic against the stored subscriptions
+	// and return all found subscriptions.
+	MatchSubscriptions(topic string) ([]*packet.Subscription, error)
+}
+
+// An AuthExchange performs the server side of a single enhanced
+// authentication.
+type AuthExchange interface {
+	// Step is called with the authentication data received from the client.
+	// It should return the data that is sent back to the client and whether
+	// the authentication has been completed successfully. An error fails the
+	// authentication.
+	Step(data []byte) ([]byte, bool, error)
+}
+
+// A UserAuthExchange is an AuthExchange that authenticates a user. The username
+// is bound to the client and connections or re-authentications that specify a
+// different username are rejected.
+type UserAuthExchange interface {
+	AuthExchange
+
+	// Username should return the authenticated username once the
+	// authentication has been completed.
+	Username() string
+}
+
 // A Backend provides the effective brokering functionality to its clients.
 type Backend interface {
 	// Authenticate should authenticate the client using the user and password
@@ -117,6 +152,10 @@ type Backend interface {
 	// Publish should forward the passed message to all other clients that hold
 	// a subscription that matches the messages topic. It should also add the
 	// message to all sessions that have a matching offline subscription.
+	//
+	// The retain flag is cleared unless the backend implements the
+	// RetainAsPublishedBackend interface. Messages should not be forwarded to
+	// the publishing client if its subscription requests no local messages.
 	Publish(*Client, *packet.Message) error
 
 	// Terminate is called when the client goes offline. Terminate should
@@ -129,19 +168,129 @@ type Backend interface {
 	Terminate(*Client) error
 }
 
+// An AuthBackend is a Backend that supports enhanced authentications.
+type AuthBackend interface {
+	// StartAuth is called when a client begins an enhanced authentication or
+	// a re-authentication using the specified method. It should return an
+	// exchange that performs the authentication or nil if the method is not
+	// supported. Clients that use an enhanced authentication are not
+	// authenticated using Authenticate.
+	StartAuth(client *Client, method string) (AuthExchange, error)
+}
+
+// A DelayBackend is a Backend that supports delayed messages. Messages
+// published to delayed topics are published immediately if the backend does
+// not implement the interface.
+type DelayBackend interface {
+	// Delay should hold back the passed message and publish it at the
+	// specified time. The message should be retained or cleared at that time
+	// if the retain flag is set. Pending messages should be persisted together
+	// with the other backend state.
+	Delay(client *Client, msg *packet.Message, at time.Time) error
+}
+
+// A RetainAsPublishedBackend is a Backend that supports the retain as
+// published subscription option.
+type RetainAsPublishedBackend interface {
+	// RetainAsPublished should return whether the retain flag of messages
+	// passed to Publish is kept as published. The backend must then clear the
+	// flag for all subscriptions that do not request retain as published.
+	RetainAsPublished() bool
+}
+
+// A ReleaseBackend is a Backend that publishes delayed messages itself.
+type ReleaseBackend interface {
+	// SetReleaser should set the function that is used to publish delayed
+	// messages when they are due. Wrapping backends use it to process the
+	// released messages like published ones.
+	SetReleaser(func(msg *packet.Message))
+
+	// Releaser should return the currently set function, if any. Wrapping
+	// backends use it to chain their releaser to an already set one.
+	Releaser() func(msg *packet.Message)
+}
+
+// ErrRetainedMessageTooLarge is returned by the MemoryBackend if a retained
+// message exceeds the configured maximum size.
+var ErrRetainedMessageTooLarge = errors.New("retained message too large")
+
+// ErrRetainedStoreFull is returned by the MemoryBackend if storing a retained
+// message would exceed the configured maximum count or bytes.
+var ErrRetainedStoreFull = errors.New("retained message store full")
+
 // A MemoryBackend stores everything in memory.
 type MemoryBackend struct {
 	AuthenticateCB       func(c *Client, username string, password string) (bool, error)
 	AuthorizeSubscribeCB func(c *Client, pkt *packet.SubscribePacket) (bool, error)
 	AuthorizePublishCB   func(c *Client, msg *packet.Message) (bool, error)
 
+	// StartAuthCB is called to start enhanced authentications. By default no
+	// methods are supported.
+	StartAuthCB func(c *Client, method string) (AuthExchange, error)
+
+	// MaxRetainedMessages, MaxRetainedBytes and MaxRetainedMessageSize limit
+	// the number of retained messages, their total size and the size of a
+	// single retained message. The size of a message is the length of its
+	// topic and payload. A client that publishes a retained message which
+	// exceeds the limits is disconnected. A value of zero disables the limit.
+	MaxRetainedMessages    int
+	MaxRetainedBytes       int
+	MaxRetainedMessageSize int
+
+	// OfflineQueueLimits are the limits of the queues that store messages for
+	// offline clients. The limits of individual clients can be set using the
+	// OfflineQueueLimitsCB.
+	OfflineQueueLimits   QueueLimits
+	OfflineQueueLimitsCB func(c *Client) QueueLimits
+
+	// OfflineQueueCB can be set to create custom offline queues, e.g. durable
+	// file queues. By default an in-memory queue is used.
+	OfflineQueueCB func(c *Client) (OfflineQueue, error)
+
+	// OfflineOverflowCB is called with every message that is dropped for an
+	// offline client. The error is ErrQueueFull if the queue exceeded its
+	// limits or the error returned by the queue.
+	//
+	// Note: The callback is called synchronously and should therefore not
+	// block.
+	OfflineOverflowCB func(clientID string, msg *packet.Message, err error)
+
+	// StreamLog can be set to record the messages of the topics matching the
+	// patterns of the log. Clients can replay the recorded messages using
+	// filters with the ReplayPrefix. Replays only deliver recorded messages
+	// and restart from their start position when a session is resumed.
+	StreamLog *StreamLog
+
+	// SessionExpiry is the interval after which the persistent session of a
+	// disconnected client is removed together with its offline subscriptions
+	// and queued messages. The interval of individual clients can be set using
+	// the SessionExpiryCB. An interval of zero keeps sessions forever. MQTT 5
+	// clients may request a shorter interval using the session expiry interval
+	// property, which is then used instead.
+	SessionExpiry   time.Duration
+	SessionExpiryCB func(c *Client) time.Duration
+
+	// SessionReapInterval is the interval in which expired sessions are
+	// removed by the background reaper.
+	SessionReapInterval time.Duration
+
 	queues               map[*Client]chan *packet.Message
 	subscribedQueues     *topic.Tree
 	retainedMessages     *topic.Tree
+	retainedCount        int
+	retainedBytes        int
+	retainedMutex        sync.Mutex
 	storedSessions       sync.Map
 	activeClients        map[string]*Client
 	offlineQueues        sync.Map
 	offlineSubscriptions *topic.Tree
+	replays              map[*Client]map[string]*replay
+	sessionExpiries      map[string]time.Time
+	sessionReaper        sync.Once
+	delayedMessages      *DelayQueue
+	releaser             func(msg *packet.Message)
+	delayWakeup          chan struct{}
+	delayScheduler       sync.Once
 	mutex                sync.Mutex
 	shutdown             chan bool
 }
@@ -154,7 +303,15 @@ func NewMemoryBackend() *MemoryBackend {
 		retainedMessages:     topic.NewTree(),
 		activeClients:        make(map[string]*Client),
 		offlineSubscriptions: topic.NewTree(),
-		shutdown:             make(chan bool),
+		replays:              make(map[*Client]map[string]*replay),
+		sessionExpiries:      make(map[string]time.Time),
+		OfflineQueueLimits: QueueLimits{
+			MaxMessages: 1000,
+		},
+		SessionReapInterval: time.Minute,
+		delayedMessages:     NewDelayQueue(),
+		delayWakeup:         make(chan struct{}, 1),
+		shutdown:            make(chan bool),
 	}
 }
 
@@ -167,6 +324,27 @@ func (m *MemoryBackend) Authenticate(client *Client, username, password string)
 	return m.AuthenticateCB(client, username, password)
 }
 
+// StartAuth will call StartAuthCB to start an enhanced authentication.
+func (m *MemoryBackend) StartAuth(client *Client, method string) (AuthExchange, error) {
+	if m.StartAuthCB == nil {
+		return nil, nil
+	}
+
+	return m.StartAuthCB(client, method)
+}
+
+// SCRAMAuth returns a callback for StartAuthCB that performs SCRAM-SHA-256
+// authentications using the specified credentials lookup.
+func SCRAMAuth(lookup scram.Lookup) func(*Client, string) (AuthExchange, error) {
+	return func(c *Client, method string) (AuthExchange, error) {
+		if method != scram.Method {
+			return nil, nil
+		}
+
+		return scram.NewServer(lookup), nil
+	}
+}
+
 // AuthorizeSubscribe will call AuthorizeSubscribeCB to authorize client subcribe
 func (m *MemoryBackend) AuthorizeSubscribe(client *Client, pkt *packet.SubscribePacket) (bool, error) {
 	if m.AuthorizeSubscribeCB == nil {
@@ -204,12 +382,21 @@ func (m *MemoryBackend) Setup(client *Client, id string) (Session, bool, error)
 	// close existing client
 	existingClient, ok := m.activeClients[id]
 	if ok {
+		m.stopReplays(existingClient, "")
 		close(m.queues[existingClient])
 	}
 
 	// store new client
 	m.activeClients[id] = client
 
+	// cancel session expiry
+	delete(m.sessionExpiries, id)
+
+	// remove offline queue if clean is true
+	if client.CleanSession() {
+		m.removeOfflineQueue(id)
+	}
+
 	// retrieve stored session
 	s, ok := m.storedSessions.Load(id)
 
@@ -224,7 +411,7 @@ func (m *MemoryBackend) Setup(client *Client, id string) (Session, bool, error)
 		val, ok := m.offlineQueues.Load(client.ClientID())
 		if ok {
 			// clear offline subscriptions
-			queue := val.(*MessageQueue)
+			queue := val.(*offlineQueue)
 			m.offlineSubscriptions.Clear(queue)
 		}
 
@@ -257,18 +444,28 @@ func (m *MemoryBackend) QueueOffline(client *Client) error {
 			}
 
 			// cast queue
-			queue := val.(*MessageQueue)
+			queue := val.(*offlineQueue)
 
 			// get next missed message
-			msg := queue.Pop()
-			if msg == nil {
+			msg, token, err := queue.peek()
+			if err != nil || msg == nil {
 				return
 			}
 
-			// add message
-			m.queues[client] <- msg
+			// add message unless the client has been closed
+			select {
+			case m.queues[client] <- msg:
+			case <-client.Closed():
+				return
+			case <-m.shutdown:
+				return
+			}
 
-			// TODO: What happens if the client dies?
+			// remove message
+			err = queue.commit(token)
+			if err != nil {
+				return
+			}
 		}
 	}()
 
@@ -276,22 +473,33 @@ func (m *MemoryBackend) QueueOffline(client *Client) error {
 }
 
 // Subscribe will subscribe the passed client to the specified topic and
-// begin to forward messages by calling the clients Publish method.
+// begin to forward messages by calling the clients Publish method. Replay
+// filters will start a replay of the stream log.
 func (m *MemoryBackend) Subscribe(client *Client, sub *packet.Subscription) error {
-	// mutex locking not needed
+	// start replay
+	if position, filter, ok := ParseReplayTopic(sub.Topic); ok {
+		return m.replay(client, sub, position, filter)
+	}
 
 	// add subscription
-	m.subscribedQueues.Add(sub.Topic, m.queues[client])
+	m.subscribedQueues.Add(sub.Topic, client)
 
 	return nil
 }
 
 // Unsubscribe will unsubscribe the passed client from the specified topic.
 func (m *MemoryBackend) Unsubscribe(client *Client, topic string) error {
-	// mutex locking not needed
+	// stop replay
+	if _, _, ok := ParseReplayTopic(topic); ok {
+		m.mutex.Lock()
+		m.stopReplays(client, topic)
+		m.mutex.Unlock()
+
+		return nil
+	}
 
 	// remove subscription
-	m.subscribedQueues.Remove(topic, m.queues[client])
+	m.subscribedQueues.Remove(topic, client)
 
 	return nil
 }
@@ -308,26 +516,94 @@ func (m *MemoryBackend) Receive(client *Client) (*packet.Message, error) {
 	}
 }
 
-// StoreRetained will store the specified message.
+// StoreRetained will store the specified message. It returns an error if the
+// message exceeds the configured limits.
 func (m *MemoryBackend) StoreRetained(client *Client, msg *packet.Message) error {
-	// mutex locking not needed
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	// check message size
+	size := messageSize(msg)
+	if m.MaxRetainedMessageSize > 0 && size > m.MaxRetainedMessageSize {
+		return ErrRetainedMessageTooLarge
+	}
+
+	// get replaced message
+	count, bytes := m.retainedCount+1, m.retainedBytes+size
+	if existing := m.retainedMessages.Get(msg.Topic); len(existing) > 0 {
+		count--
+		bytes -= messageSize(existing[0].(*packet.Message))
+	}
+
+	// check limits
+	if (m.MaxRetainedMessages > 0 && count > m.MaxRetainedMessages) ||
+		(m.MaxRetainedBytes > 0 && bytes > m.MaxRetainedBytes) {
+		return ErrRetainedStoreFull
+	}
 
 	// set retained message
 	m.retainedMessages.Set(msg.Topic, msg.Copy())
+	m.retainedCount, m.retainedBytes = count, bytes
 
 	return nil
 }
 
 // ClearRetained will remove the stored messages for the given topic.
 func (m *MemoryBackend) ClearRetained(client *Client, topic string) error {
-	// mutex locking not needed
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	// get existing message
+	existing := m.retainedMessages.Get(topic)
+	if len(existing) == 0 {
+		return nil
+	}
 
 	// clear retained message
 	m.retainedMessages.Empty(topic)
+	m.retainedCount--
+	m.retainedBytes -= messageSize(existing[0].(*packet.Message))
 
 	return nil
 }
 
+// RetainedStats returns the number and total size of the retained messages.
+func (m *MemoryBackend) RetainedStats() (int, int) {
+	m.retainedMutex.Lock()
+	defer m.retainedMutex.Unlock()
+
+	return m.retainedCount, m.retainedBytes
+}
+
+// QueryRetained returns the retained messages that match the specified filter
+// ordered by topic. Only messages with a topic after the specified cursor
+// topic are returned and the result is limited to the specified number of
+// messages. The second return value indicates whether more messages are
+// available, which can be queried using the topic of the last message as the
+// cursor. A limit of zero returns all messages.
+func (m *MemoryBackend) QueryRetained(filter, after string, limit int) ([]*packet.Message, bool) {
+	// get matching messages
+	var list []*packet.Message
+	for _, value := range m.retainedMessages.Search(filter) {
+		msg := value.(*packet.Message)
+		if msg.Topic > after {
+			list = append(list, msg.Copy())
+		}
+	}
+
+	// sort messages
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Topic < list[j].Topic
+	})
+
+	// apply limit
+	if limit > 0 && len(list) > limit {
+		return list[:limit], true
+	}
+
+	return list, false
+}
+
 // QueueRetained will queue all retained messages matching the given topic.
 func (m *MemoryBackend) QueueRetained(client *Client, topic string) error {
 	// mutex locking not needed
@@ -345,44 +621,168 @@ func (m *MemoryBackend) QueueRetained(client *Client, topic string) error {
 
 // Publish will forward the passed message to all other subscribed clients. It
 // will also add the message to all sessions that have a matching offline
-// subscription.
+// subscription. Messages are not forwarded to the publishing client if all its
+// matching subscriptions request no local messages. The retain flag is only
+// kept for subscriptions that request retain as published.
 func (m *MemoryBackend) Publish(client *Client, msg *packet.Message) error {
 	// mutex locking not needed
 
+	// record message
+	if m.StreamLog != nil && m.StreamLog.Matches(msg.Topic) {
+		_, err := m.StreamLog.Append(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	// prepare message without retain flag
+	live := msg
+	if msg.Retain {
+		live = msg.Copy()
+		live.Retain = false
+	}
+
 	// publish directly to clients
 	for _, v := range m.subscribedQueues.Match(msg.Topic) {
-		v.(chan *packet.Message) <- msg
+		subscriber := v.(*Client)
+		fwd := live
+
+		// check subscription options if necessary
+		if subscriber == client || msg.Retain {
+			noLocal, retainAsPublished, err := matchOptions(subscriber, msg.Topic)
+			if err != nil {
+				return err
+			}
+
+			// skip own messages
+			if subscriber == client && noLocal {
+				continue
+			}
+
+			// keep retain flag
+			if retainAsPublished {
+				fwd = msg
+			}
+		}
+
+		m.queue(subscriber) <- fwd
 	}
 
 	// queue for offline clients
 	for _, v := range m.offlineSubscriptions.Match(msg.Topic) {
-		v.(*MessageQueue).Push(msg)
+		v.(*offlineQueue).push(live, m.OfflineOverflowCB)
 	}
 
 	return nil
 }
 
+// RetainAsPublished returns true as the backend clears the retain flag of
+// messages for all subscriptions that do not request retain as published.
+func (m *MemoryBackend) RetainAsPublished() bool {
+	return true
+}
+
+// Delay will hold back the passed message and publish it at the specified
+// time. A running scheduler will publish all due messages.
+func (m *MemoryBackend) Delay(client *Client, msg *packet.Message, at time.Time) error {
+	// mutex locking not needed
+
+	// queue message
+	m.delayedMessages.Push(&DelayedMessage{
+		Message: msg.Copy(),
+		Time:    at,
+	})
+
+	// ensure scheduler
+	m.schedule()
+
+	return nil
+}
+
+// DelayedMessages returns all messages that are currently held back. The list
+// can be persisted and later restored using RestoreDelayed.
+func (m *MemoryBackend) DelayedMessages() []*DelayedMessage {
+	return m.delayedMessages.All()
+}
+
+// RestoreDelayed will add the previously persisted delayed messages. Messages
+// that are already due will be published immediately.
+func (m *MemoryBackend) RestoreDelayed(msgs []*DelayedMessage) {
+	// queue messages
+	for _, msg := range msgs {
+		m.delayedMessages.Push(msg)
+	}
+
+	// ensure scheduler
+	m.schedule()
+}
+
+// SetReleaser will set the function that is used to publish delayed messages
+// when they are due. By default the messages are published using Publish.
+func (m *MemoryBackend) SetReleaser(fn func(msg *packet.Message)) {
+	m.mutex.Lock()
+	m.releaser = fn
+	m.mutex.Unlock()
+}
+
+// Releaser will return the function that has been set using SetReleaser.
+func (m *MemoryBackend) Releaser() func(msg *packet.Message) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.releaser
+}
+
+// RestoreOfflineQueues will add the previously persisted offline queues, e.g.
+// loaded using LoadFileQueues. The queued messages are delivered when the
+// clients reconnect with a persistent session. Until then, the queues expire
+// like the sessions of disconnected clients using the SessionExpiry.
+func (m *MemoryBackend) RestoreOfflineQueues(queues map[string]OfflineQueue) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, queue := range queues {
+		// store queue
+		m.offlineQueues.Store(id, &offlineQueue{
+			clientID: id,
+			queue:    queue,
+			limits:   m.OfflineQueueLimits,
+		})
+
+		// schedule expiry if the client is not connected
+		if _, ok := m.activeClients[id]; !ok {
+			m.scheduleExpiry(id, m.SessionExpiry)
+		}
+	}
+}
+
 // Terminate will unsubscribe the passed client from all previously subscribed
 // topics. If the client connect with clean=true it will also clean the session.
 // Otherwise it will create offline subscriptions for all QOS 1 and QOS 2
-// subscriptions.
+// subscriptions and queue all QOS 1 and QOS 2 messages that have not yet been
+// forwarded to the client.
 func (m *MemoryBackend) Terminate(client *Client) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	// clear all subscriptions
+	// clear all subscriptions and replays
 	m.subscribedQueues.Clear(client)
+	m.stopReplays(client, "")
 
 	// remove client from list if an id is available
+	replaced := false
 	if len(client.ClientID()) > 0 {
 		// check if the client is still the same as it might be already replaced
 		if storedClient := m.activeClients[client.ClientID()]; storedClient == client {
 			delete(m.activeClients, client.ClientID())
+		} else {
+			replaced = true
 		}
 	}
 
-	// return if the client requested a clean session
-	if client.CleanSession() {
+	// return if the client requested a clean session or has been replaced by
+	// a client that now owns the session and offline queue
+	if client.CleanSession() || replaced {
 		return nil
 	}
 
@@ -392,8 +792,11 @@ func (m *MemoryBackend) Terminate(client *Client) error {
 		return err
 	}
 
-	// create offline queue
-	queue := NewMessageQueue(1000)
+	// get offline queue
+	queue, err := m.offlineQueue(client)
+	if err != nil {
+		return err
+	}
 
 	// iterate through stored subscriptions
 	for _, sub := range subscriptions {
@@ -403,13 +806,438 @@ func (m *MemoryBackend) Terminate(client *Client) error {
 		}
 	}
 
+	// move messages that have not yet been forwarded to the offline queue
+	for {
+		var msg *packet.Message
+		select {
+		case msg = <-m.queues[client]:
+		default:
+		}
+
+		// check message
+		if msg == nil {
+			break
+		}
+
+		// get subscription
+		sub, err := client.Session().LookupSubscription(msg.Topic)
+		if err != nil {
+			return err
+		}
+
+		// queue message if at least qos 1
+		if msg.QOS >= 1 && sub != nil && sub.QOS >= 1 {
+			queue.push(msg, m.OfflineOverflowCB)
+		}
+	}
+
 	// store offline queue
 	m.offlineQueues.Store(client.ClientID(), queue)
 
+	// schedule session expiry
+	m.expireSession(client)
+
 	return nil
 }
 
+// ExpireSessions will remove all sessions that have expired until now along
+// with their offline subscriptions and queued messages. It returns the number
+// of removed sessions. The method is called periodically by the background
+// reaper.
+func (m *MemoryBackend) ExpireSessions() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// get now
+	now := time.Now()
+
+	// remove expired sessions
+	var removed int
+	for id, expiry := range m.sessionExpiries {
+		// check expiry
+		if expiry.After(now) {
+			continue
+		}
+
+		// remove expiry and session
+		delete(m.sessionExpiries, id)
+		m.storedSessions.Delete(id)
+
+		// remove offline subscriptions and queue
+		m.removeOfflineQueue(id)
+
+		removed++
+	}
+
+	return removed
+}
+
+// OfflineQueueStats returns the stats of the offline queue of the specified
+// client and whether a queue exists.
+func (m *MemoryBackend) OfflineQueueStats(clientID string) (QueueStats, bool) {
+	// get offline queue
+	val, ok := m.offlineQueues.Load(clientID)
+	if !ok {
+		return QueueStats{}, false
+	}
+
+	return val.(*offlineQueue).stats(), true
+}
+
 // Close will close the backend and make all clients go away.
 func (m *MemoryBackend) Close() {
 	close(m.shutdown)
 }
+
+// returns the queue of a client
+func (m *MemoryBackend) queue(client *Client) chan *packet.Message {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.queues[client]
+}
+
+// a running replay of the stream log
+type replay struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// starts a replay of the stream log for the specified subscription
+func (m *MemoryBackend) replay(client *Client, sub *packet.Subscription, position StreamPosition, filter string) error {
+	// check log
+	log := m.StreamLog
+	if log == nil {
+		return ErrMissingStreamLog
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// get queue
+	queue := m.queues[client]
+	if queue == nil {
+		return nil
+	}
+
+	// stop a running replay of the same subscription
+	m.stopReplays(client, sub.Topic)
+
+	// register replay
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	if m.replays[client] == nil {
+		m.replays[client] = make(map[string]*replay)
+	}
+	m.replays[client][sub.Topic] = &replay{
+		stop: stop,
+		done: done,
+	}
+
+	// get start offset
+	offset := position.Offset
+	if !position.Time.IsZero() {
+		offset = log.Seek(position.Time)
+	}
+
+	// prepare matcher
+	matcher := topic.NewTree()
+	matcher.Add(filter, true)
+
+	// get maximum qos
+	qos := sub.QOS
+
+	// forward recorded messages and wait for new ones
+	go func() {
+		defer close(done)
+
+		for {
+			// get notification before reading to not miss any records
+			notify := log.Notify()
+
+			// read next records
+			records, err := log.Read(offset, 100)
+			if err != nil {
+				return
+			}
+
+			// forward matching messages
+			for _, record := range records {
+				offset = record.Offset + 1
+
+				// check topic
+				if matcher.MatchFirst(record.Message.Topic) == nil {
+					continue
+				}
+
+				// prepare message
+				msg := record.Message
+				msg.Retain = false
+				if msg.QOS > qos {
+					msg.QOS = qos
+				}
+
+				select {
+				case queue <- msg:
+				case <-stop:
+					return
+				case <-m.shutdown:
+					return
+				}
+			}
+
+			// wait for new records if caught up
+			if len(records) == 0 {
+				select {
+				case <-notify:
+				case <-stop:
+					return
+				case <-m.shutdown:
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// stops the replays of the client with the specified topic or all replays if
+// the topic is empty and waits until they have returned
+func (m *MemoryBackend) stopReplays(client *Client, topic string) {
+	for t, r := range m.replays[client] {
+		if topic == "" || t == topic {
+			close(r.stop)
+			<-r.done
+			delete(m.replays[client], t)
+		}
+	}
+
+	// remove empty map
+	if len(m.replays[client]) == 0 {
+		delete(m.replays, client)
+	}
+}
+
+// returns the existing offline queue of a client or creates a new one
+func (m *MemoryBackend) offlineQueue(client *Client) (*offlineQueue, error) {
+	// get limits
+	limits := m.OfflineQueueLimits
+	if m.OfflineQueueLimitsCB != nil {
+		limits = m.OfflineQueueLimitsCB(client)
+	}
+
+	// reuse existing queue that has not yet been drained
+	if val, ok := m.offlineQueues.Load(client.ClientID()); ok {
+		queue := val.(*offlineQueue)
+		queue.mutex.Lock()
+		queue.limits = limits
+		queue.mutex.Unlock()
+
+		return queue, nil
+	}
+
+	// create queue
+	var queue OfflineQueue
+	if m.OfflineQueueCB != nil {
+		var err error
+		queue, err = m.OfflineQueueCB(client)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		queue = NewMemoryQueue()
+	}
+
+	return &offlineQueue{
+		clientID: client.ClientID(),
+		queue:    queue,
+		limits:   limits,
+	}, nil
+}
+
+// removes the offline subscriptions and queue of a client and removes or closes
+// the queue if possible, the mutex must be held
+func (m *MemoryBackend) removeOfflineQueue(id string) {
+	// get offline queue
+	val, ok := m.offlineQueues.Load(id)
+	if !ok {
+		return
+	}
+
+	// remove offline subscriptions and queue
+	queue := val.(*offlineQueue)
+	m.offlineSubscriptions.Clear(queue)
+	m.offlineQueues.Delete(id)
+
+	// remove or close queue if possible
+	if remover, ok := queue.queue.(QueueRemover); ok {
+		remover.Remove()
+	} else if closer, ok := queue.queue.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// schedules the expiry of the clients session, the mutex must be held
+func (m *MemoryBackend) expireSession(client *Client) {
+	// get interval
+	interval := m.SessionExpiry
+	if m.SessionExpiryCB != nil {
+		interval = m.SessionExpiryCB(client)
+	}
+
+	// use requested interval if shorter
+	requested := client.SessionExpiry()
+	if requested > 0 && (interval <= 0 || requested < interval) {
+		interval = requested
+	}
+
+	// schedule expiry
+	m.scheduleExpiry(client.ClientID(), interval)
+}
+
+// schedules the expiry of the session with the specified id, the mutex must be
+// held
+func (m *MemoryBackend) scheduleExpiry(id string, interval time.Duration) {
+	// check interval
+	if interval <= 0 {
+		return
+	}
+
+	// set expiry
+	m.sessionExpiries[id] = time.Now().Add(interval)
+
+	// start reaper
+	m.sessionReaper.Do(func() {
+		go m.reaper()
+	})
+}
+
+// periodically removes expired sessions
+func (m *MemoryBackend) reaper() {
+	// prepare ticker
+	ticker := time.NewTicker(m.SessionReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.ExpireSessions()
+		case <-m.shutdown:
+			return
+		}
+	}
+}
+
+// starts the scheduler if not yet running and wakes it up
+func (m *MemoryBackend) schedule() {
+	// start scheduler
+	m.delayScheduler.Do(func() {
+		go m.scheduler()
+	})
+
+	// wakeup scheduler
+	select {
+	case m.delayWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// publishes delayed messages when they are due
+func (m *MemoryBackend) scheduler() {
+	for {
+		// publish due messages
+		for _, delayed := range m.delayedMessages.Due(time.Now()) {
+			m.release(delayed.Message)
+		}
+
+		// prepare timer for next message
+		var timer *time.Timer
+		var due <-chan time.Time
+		if next, ok := m.delayedMessages.Next(); ok {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+
+		// wait for next message, wakeup or shutdown
+		select {
+		case <-due:
+		case <-m.delayWakeup:
+		case <-m.shutdown:
+			if timer != nil {
+				timer.Stop()
+			}
+
+			return
+		}
+
+		// stop timer
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// publishes a delayed message
+func (m *MemoryBackend) release(msg *packet.Message) {
+	// check retain flag
+	if msg.Retain {
+		if len(msg.Payload) > 0 {
+			m.StoreRetained(nil, msg)
+		} else {
+			m.ClearRetained(nil, msg.Topic)
+		}
+	}
+
+	// get releaser
+	m.mutex.Lock()
+	releaser := m.releaser
+	m.mutex.Unlock()
+
+	// publish message
+	if releaser != nil {
+		releaser(msg)
+	} else {
+		m.Publish(nil, msg)
+	}
+}
+
+// returns whether all subscriptions of the client that match the topic request
+// no local messages and whether any requests retain as published
+func matchOptions(client *Client, topic string) (bool, bool, error) {
+	// get matching subscriptions
+	subs, err := matchSubscriptions(client.Session(), topic)
+	if err != nil {
+		return false, false, err
+	}
+
+	// check options
+	noLocal, retainAsPublished := true, false
+	for _, sub := range subs {
+		noLocal = noLocal && sub.NoLocal
+		retainAsPublished = retainAsPublished || sub.RetainAsPublished
+	}
+
+	return noLocal, retainAsPublished, nil
+}
+
+// returns all subscriptions of the session that match the topic
+func matchSubscriptions(s Session, topic string) ([]*packet.Subscription, error) {
+	// match all subscriptions if supported
+	if matcher, ok := s.(SubscriptionMatcher); ok {
+		return matcher.MatchSubscriptions(topic)
+	}
+
+	// otherwise lookup first subscription
+	sub, err := s.LookupSubscription(topic)
+	if err != nil || sub == nil {
+		return nil, err
+	}
+
+	return []*packet.Subscription{sub}, nil
+}
+
+// returns the size of a message
+func messageSize(msg *packet.Message) int {
+	return len(msg.Topic) + len(msg.Payload)
+}
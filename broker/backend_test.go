@@ -1,10 +1,15 @@
 package broker
 
 import (
+	"io/ioutil"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/spec"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestBrokerWithMemoryBackend(t *testing.T) {
@@ -30,3 +35,536 @@ func TestBrokerWithMemoryBackend(t *testing.T) {
 
 	safeReceive(done)
 }
+
+func TestMemoryBackendRetainedLimits(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.MaxRetainedMessages = 2
+	backend.MaxRetainedBytes = 15
+	backend.MaxRetainedMessageSize = 10
+
+	msg1 := &packet.Message{Topic: "a", Payload: []byte("1234")}
+	msg2 := &packet.Message{Topic: "b", Payload: []byte("12345678")}
+	msg3 := &packet.Message{Topic: "c", Payload: []byte("1")}
+
+	assert.NoError(t, backend.StoreRetained(nil, msg1))
+	assert.NoError(t, backend.StoreRetained(nil, msg2))
+	assert.Equal(t, ErrRetainedStoreFull, backend.StoreRetained(nil, msg3))
+
+	count, bytes := backend.RetainedStats()
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 14, bytes)
+
+	assert.Equal(t, ErrRetainedMessageTooLarge, backend.StoreRetained(nil, &packet.Message{
+		Topic:   "a",
+		Payload: []byte("1234567890"),
+	}))
+
+	assert.NoError(t, backend.StoreRetained(nil, &packet.Message{Topic: "a", Payload: []byte("12345")}))
+	assert.Equal(t, ErrRetainedStoreFull, backend.StoreRetained(nil, &packet.Message{
+		Topic:   "a",
+		Payload: []byte("123456"),
+	}))
+
+	assert.NoError(t, backend.ClearRetained(nil, "a"))
+	assert.NoError(t, backend.ClearRetained(nil, "a"))
+	assert.NoError(t, backend.StoreRetained(nil, msg3))
+
+	count, bytes = backend.RetainedStats()
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 11, bytes)
+}
+
+func TestMemoryBackendQueryRetained(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	for _, topic := range []string{"foo/c", "foo/a", "bar/a", "foo/b"} {
+		assert.NoError(t, backend.StoreRetained(nil, &packet.Message{Topic: topic, Payload: []byte("x")}))
+	}
+
+	list, more := backend.QueryRetained("foo/+", "", 2)
+	assert.True(t, more)
+	assert.Len(t, list, 2)
+	assert.Equal(t, "foo/a", list[0].Topic)
+	assert.Equal(t, "foo/b", list[1].Topic)
+
+	list, more = backend.QueryRetained("foo/+", list[1].Topic, 2)
+	assert.False(t, more)
+	assert.Len(t, list, 1)
+	assert.Equal(t, "foo/c", list[0].Topic)
+
+	list, more = backend.QueryRetained("#", "", 0)
+	assert.False(t, more)
+	assert.Len(t, list, 4)
+}
+
+func TestMemoryBackendOfflineQueueLimits(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.OfflineQueueLimitsCB = func(c *Client) QueueLimits {
+		return QueueLimits{MaxMessages: 2}
+	}
+
+	var dropped []string
+	backend.OfflineOverflowCB = func(clientID string, msg *packet.Message, err error) {
+		assert.Equal(t, "offline", clientID)
+		assert.Equal(t, ErrQueueFull, err)
+		dropped = append(dropped, string(msg.Payload))
+	}
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	config := client.NewConfigWithClientID("tcp://localhost:"+port, "offline")
+	config.CleanSession = false
+
+	c := client.New()
+	cf, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("test", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+	assert.NoError(t, c.Disconnect())
+
+	time.Sleep(50 * time.Millisecond)
+
+	publisher := client.New()
+	cf, err = publisher.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	for _, payload := range []string{"1", "2", "3"} {
+		pf, err := publisher.Publish("test", []byte(payload), 1, false)
+		assert.NoError(t, err)
+		assert.NoError(t, pf.Wait(10*time.Second))
+	}
+
+	assert.NoError(t, publisher.Disconnect())
+
+	stats, ok := backend.OfflineQueueStats("offline")
+	assert.True(t, ok)
+	assert.Equal(t, QueueStats{Messages: 2, Bytes: 10, Dropped: 1}, stats)
+	assert.Equal(t, []string{"1"}, dropped)
+
+	received := make(chan string, 2)
+	c = client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		received <- string(msg.Payload)
+		return nil
+	}
+
+	cf, err = c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+	assert.Equal(t, "2", <-received)
+	assert.Equal(t, "3", <-received)
+	assert.NoError(t, c.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestOfflineQueueCommit(t *testing.T) {
+	queue := &offlineQueue{
+		queue:  NewMemoryQueue(),
+		limits: QueueLimits{MaxMessages: 2},
+	}
+
+	msg1 := &packet.Message{Topic: "m1"}
+	msg2 := &packet.Message{Topic: "m2"}
+	msg3 := &packet.Message{Topic: "m3"}
+
+	queue.push(msg1, nil)
+	queue.push(msg2, nil)
+
+	msg, token, err := queue.peek()
+	assert.NoError(t, err)
+	assert.Equal(t, msg1, msg)
+	assert.Equal(t, 2, queue.stats().Messages)
+
+	assert.NoError(t, queue.commit(token))
+	assert.Equal(t, 1, queue.stats().Messages)
+
+	msg, token, err = queue.peek()
+	assert.NoError(t, err)
+	assert.Equal(t, msg2, msg)
+
+	// the peeked message is dropped while it is forwarded
+	queue.push(msg3, nil)
+	queue.push(&packet.Message{Topic: "m4"}, nil)
+	assert.Equal(t, uint64(1), queue.stats().Dropped)
+
+	assert.NoError(t, queue.commit(token))
+	assert.Equal(t, 2, queue.stats().Messages)
+
+	msg, _, err = queue.peek()
+	assert.NoError(t, err)
+	assert.Equal(t, msg3, msg)
+}
+
+func TestMemoryBackendSubscriptionOptions(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	received := make(chan *packet.Message, 10)
+
+	c := client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		received <- msg
+		return nil
+	}
+
+	config := client.NewConfig("tcp://localhost:" + port)
+	config.ProtocolVersion = packet.Version5
+
+	cf, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	assert.NoError(t, backend.StoreRetained(nil, &packet.Message{
+		Topic:   "retained",
+		Payload: []byte("retained"),
+		Retain:  true,
+	}))
+
+	sf, err := c.SubscribeMultiple([]packet.Subscription{
+		{Topic: "local", QOS: 0, NoLocal: true},
+		{Topic: "rap", QOS: 0, RetainAsPublished: true},
+		{Topic: "retained", QOS: 0, RetainHandling: packet.DontSendRetained},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	pf, err := c.Publish("local", []byte("local"), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	pf, err = c.Publish("rap", []byte("rap"), 0, true)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	msg := <-received
+	assert.Equal(t, "rap", msg.Topic)
+	assert.True(t, msg.Retain)
+
+	sf, err = c.SubscribeMultiple([]packet.Subscription{
+		{Topic: "retained", QOS: 0, RetainHandling: packet.SendRetainedIfNew},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	sf, err = c.SubscribeMultiple([]packet.Subscription{
+		{Topic: "retained", QOS: 0},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	msg = <-received
+	assert.Equal(t, "retained", msg.Topic)
+	assert.True(t, msg.Retain)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, received)
+
+	assert.NoError(t, c.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestMemoryBackendSubscriptionIdentifiers(t *testing.T) {
+	port, quit, done := Run(NewEngine(NewMemoryBackend()), "tcp")
+
+	received := make(chan *packet.Message, 1)
+
+	c := client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		received <- msg
+		return nil
+	}
+
+	config := client.NewConfig("tcp://localhost:" + port)
+	config.ProtocolVersion = packet.Version5
+
+	cf, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	for _, sub := range []packet.Subscription{
+		{Topic: "a/#", QOS: 0, Identifier: 2},
+		{Topic: "a/+", QOS: 1, Identifier: 1},
+		{Topic: "b", QOS: 1},
+	} {
+		sf, err := c.SubscribeMultiple([]packet.Subscription{sub})
+		assert.NoError(t, err)
+		assert.NoError(t, sf.Wait(10*time.Second))
+	}
+
+	pf, err := c.Publish("a/b", []byte("test"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	msg := <-received
+	assert.Equal(t, []uint32{1, 2}, msg.SubscriptionIdentifiers)
+	assert.Equal(t, uint8(1), msg.QOS)
+
+	assert.NoError(t, c.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestMemoryBackendSessionExpiry(t *testing.T) {
+	backend := NewMemoryBackend()
+	backend.SessionExpiry = time.Hour
+	backend.SessionExpiryCB = func(c *Client) time.Duration {
+		if c.ClientID() == "forever" {
+			return 0
+		}
+
+		return backend.SessionExpiry
+	}
+	backend.SessionReapInterval = 10 * time.Millisecond
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	requests := map[string]time.Duration{
+		"expiring": time.Second,
+		"capped":   2 * time.Hour,
+		"forever":  0,
+	}
+
+	for id, expiry := range requests {
+		config := client.NewConfigWithClientID("tcp://localhost:"+port, id)
+		config.CleanSession = false
+		config.ProtocolVersion = packet.Version5
+		config.SessionExpiry = expiry
+
+		c := client.New()
+		cf, err := c.Connect(config)
+		assert.NoError(t, err)
+		assert.NoError(t, cf.Wait(10*time.Second))
+		assert.False(t, cf.SessionPresent())
+
+		sf, err := c.Subscribe("test", 1)
+		assert.NoError(t, err)
+		assert.NoError(t, sf.Wait(10*time.Second))
+		assert.NoError(t, c.Disconnect())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	publisher := client.New()
+	cf, err := publisher.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	pf, err := publisher.Publish("test", []byte("test"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+	assert.NoError(t, publisher.Disconnect())
+
+	// all sessions have been stored when the message has been queued
+	for id := range requests {
+		stats, ok := backend.OfflineQueueStats(id)
+		assert.True(t, ok, id)
+		assert.Equal(t, 1, stats.Messages, id)
+	}
+
+	backend.mutex.Lock()
+	now := time.Now()
+	assert.WithinDuration(t, now.Add(time.Second), backend.sessionExpiries["expiring"], time.Second)
+	assert.WithinDuration(t, now.Add(time.Hour), backend.sessionExpiries["capped"], time.Second)
+	assert.NotContains(t, backend.sessionExpiries, "forever")
+	backend.mutex.Unlock()
+
+	// wait for reaper
+	for i := 0; i < 300; i++ {
+		if _, ok := backend.OfflineQueueStats("expiring"); !ok {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, ok := backend.OfflineQueueStats("expiring")
+	assert.False(t, ok)
+
+	for id, present := range map[string]bool{"expiring": false, "capped": true, "forever": true} {
+		config := client.NewConfigWithClientID("tcp://localhost:"+port, id)
+		config.CleanSession = false
+
+		c := client.New()
+		cf, err := c.Connect(config)
+		assert.NoError(t, err)
+		assert.NoError(t, cf.Wait(10*time.Second))
+		assert.Equal(t, present, cf.SessionPresent(), id)
+		assert.NoError(t, c.Disconnect())
+	}
+
+	assert.Equal(t, 0, backend.ExpireSessions())
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestMemoryBackendFileQueues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backend := NewMemoryBackend()
+	backend.OfflineQueueCB = FileQueues(dir)
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	for _, id := range []string{"resumed", "expired"} {
+		config := client.NewConfigWithClientID("tcp://localhost:"+port, id)
+		config.CleanSession = false
+
+		c := client.New()
+		cf, err := c.Connect(config)
+		assert.NoError(t, err)
+		assert.NoError(t, cf.Wait(10*time.Second))
+
+		sf, err := c.Subscribe("test", 1)
+		assert.NoError(t, err)
+		assert.NoError(t, sf.Wait(10*time.Second))
+		assert.NoError(t, c.Disconnect())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	publisher := client.New()
+	cf, err := publisher.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	pf, err := publisher.Publish("test", []byte("test"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+	assert.NoError(t, publisher.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+
+	queues, err := LoadFileQueues(dir)
+	assert.NoError(t, err)
+	assert.Len(t, queues, 2)
+
+	backend = NewMemoryBackend()
+	backend.OfflineQueueCB = FileQueues(dir)
+	backend.SessionExpiry = 100 * time.Millisecond
+	backend.SessionReapInterval = 10 * time.Millisecond
+	backend.RestoreOfflineQueues(queues)
+
+	stats, ok := backend.OfflineQueueStats("resumed")
+	assert.True(t, ok)
+	assert.Equal(t, 1, stats.Messages)
+
+	port, quit, done = Run(NewEngine(backend), "tcp")
+
+	received := make(chan string, 1)
+	c := client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		received <- string(msg.Payload)
+		return nil
+	}
+
+	config := client.NewConfigWithClientID("tcp://localhost:"+port, "resumed")
+	config.CleanSession = false
+
+	cf, err = c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+	assert.Equal(t, "test", <-received)
+
+	time.Sleep(200 * time.Millisecond)
+
+	_, ok = backend.OfflineQueueStats("expired")
+	assert.False(t, ok)
+
+	_, err = os.Stat(fileQueuePath(dir, "expired"))
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NoError(t, c.Disconnect())
+
+	config.CleanSession = true
+
+	c = client.New()
+	cf, err = c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+	assert.NoError(t, c.Disconnect())
+
+	_, ok = backend.OfflineQueueStats("resumed")
+	assert.False(t, ok)
+
+	_, err = os.Stat(fileQueuePath(dir, "resumed"))
+	assert.True(t, os.IsNotExist(err))
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestMemoryBackendManualAckRedelivery(t *testing.T) {
+	port, quit, done := Run(NewEngine(NewMemoryBackend()), "tcp")
+
+	config := client.NewConfigWithClientID("tcp://localhost:"+port, "manual")
+	config.CleanSession = false
+
+	received := make(chan *packet.Message, 1)
+
+	c := client.New()
+	c.ManualAck = true
+	c.Callback = func(msg *packet.Message, err error) error {
+		if err == nil {
+			received <- msg
+		}
+
+		return nil
+	}
+
+	cf, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("test", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	pf, err := c.Publish("test", []byte("test"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	msg := <-received
+	assert.Equal(t, "test", msg.Topic)
+
+	// close without acknowledgement
+	assert.NoError(t, c.Close())
+
+	c = client.New()
+	c.ManualAck = true
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		received <- msg
+		return nil
+	}
+
+	cf, err = c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+	assert.True(t, cf.SessionPresent())
+
+	msg = <-received
+	assert.Equal(t, "test", msg.Topic)
+	assert.NoError(t, c.Acknowledge(msg))
+	assert.NoError(t, c.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+}
@@ -2,13 +2,17 @@ package broker
 
 import (
 	"errors"
+	"math"
 	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/session"
+	"github.com/256dpi/gomqtt/tracing"
 	"github.com/256dpi/gomqtt/transport"
 	tomb "gopkg.in/tomb.v2"
 )
@@ -26,6 +30,10 @@ var ErrExpectedConnect = errors.New("expected a ConnectPacket as the first packe
 // ErrNotAuthorized is returned when a client is not authorized.
 var ErrNotAuthorized = errors.New("client is not authorized")
 
+// ErrUnexpectedPacket is returned when a client sends a packet that is not
+// expected at that time.
+var ErrUnexpectedPacket = errors.New("unexpected packet")
+
 // ErrMissingSession is returned if the backend does not return a session.
 var ErrMissingSession = errors.New("no session returned from Backend")
 
@@ -42,31 +50,54 @@ type Client struct {
 	Ref interface{}
 
 	backend Backend
-	logger  Logger
+	handler EventHandler
+	engine  *Engine
+	tracker *tracker
 	conn    transport.Conn
 
-	state        uint32
-	clientID     string
-	cleanSession bool
-	session      Session
-
-	inc chan packet.GenericPacket
-	fwd chan *packet.Message
+	state         uint32
+	clientID      string
+	username      string
+	version       byte
+	cleanSession  bool
+	sessionExpiry time.Duration
+	session       Session
+	aliases       map[string]string
+	auth          AuthExchange
+	authMethod    string
+
+	inc    chan packet.GenericPacket
+	fwd    chan *packet.Message
+	closed chan struct{}
 
 	tomb   tomb.Tomb
 	mutex  sync.Mutex
 	finish sync.Once
 }
 
-// NewClient takes over a connection and returns a Client.
-func NewClient(backend Backend, logger Logger, conn transport.Conn) *Client {
+// NewClient takes over a connection and returns a Client. The optional event
+// handler is called with all events emitted by the client.
+func NewClient(backend Backend, handler EventHandler, conn transport.Conn) *Client {
+	return newClient(backend, handler, nil, conn)
+}
+
+// returns a new client that is handled by the engine of the specified tracker
+func newClient(backend Backend, handler EventHandler, tracker *tracker, conn transport.Conn) *Client {
 	c := &Client{
 		state:   clientConnecting,
 		backend: backend,
-		logger:  logger,
+		handler: handler,
+		tracker: tracker,
 		conn:    conn,
 		inc:     make(chan packet.GenericPacket),
 		fwd:     make(chan *packet.Message),
+		closed:  make(chan struct{}),
+		aliases: make(map[string]string),
+	}
+
+	// set engine
+	if tracker != nil {
+		c.engine = tracker.engine
 	}
 
 	// start processor
@@ -77,6 +108,9 @@ func NewClient(backend Backend, logger Logger, conn transport.Conn) *Client {
 
 // Session returns the current Session used by the client.
 func (c *Client) Session() Session {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
 	return c.session
 }
 
@@ -85,17 +119,49 @@ func (c *Client) CleanSession() bool {
 	return c.cleanSession
 }
 
+// SessionExpiry returns the session expiry interval requested by an MQTT 5
+// client during connect. It returns zero if no finite interval was requested.
+func (c *Client) SessionExpiry() time.Duration {
+	return c.sessionExpiry
+}
+
 // ClientID returns the supplied client id during connect.
 func (c *Client) ClientID() string {
 	return c.clientID
 }
 
+// Username returns the username the client has been authenticated with. If
+// the client used an enhanced authentication that authenticates a user, the
+// username is the authenticated username.
+func (c *Client) Username() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.username
+}
+
 // RemoteAddr returns the client's remote net address from the
 // underlying connection.
 func (c *Client) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// Close will close the client cleanly without publishing the will message.
+// The call will not wait until the client has been cleaned up. Use Closed to
+// wait for the cleanup to finish.
+func (c *Client) Close() {
+	// mark client as cleanly disconnected
+	atomic.CompareAndSwapUint32(&c.state, clientConnected, clientDisconnected)
+
+	// close underlying connection (triggers cleanup)
+	c.conn.Close()
+}
+
+// Closed returns a channel that is closed once the client has been cleaned up.
+func (c *Client) Closed() <-chan struct{} {
+	return c.closed
+}
+
 /* goroutines */
 
 // main processor
@@ -196,11 +262,33 @@ func (c *Client) processConnect(pkt *packet.ConnectPacket) error {
 	// set values
 	c.cleanSession = pkt.CleanSession
 	c.clientID = pkt.ClientID
+	c.version = pkt.Version
 
-	// authenticate
-	ok, err := c.backend.Authenticate(c, pkt.Username, pkt.Password)
-	if err != nil {
-		return c.die(BackendError, err, true)
+	// set requested session expiry
+	if pkt.Version == packet.Version5 && pkt.SessionExpiry != math.MaxUint32 {
+		c.sessionExpiry = time.Duration(pkt.SessionExpiry) * time.Second
+	}
+
+	// authenticate using an enhanced authentication or the credentials
+	var ok bool
+	var authData []byte
+	if len(pkt.AuthMethod) > 0 {
+		var err error
+		authData, ok, err = c.authenticate(pkt)
+		if err != nil {
+			return err // error has already been cleaned
+		}
+	} else {
+		var err error
+		ok, err = c.backend.Authenticate(c, pkt.Username, pkt.Password)
+		if err != nil {
+			return c.die(BackendError, err, true)
+		}
+
+		// set username
+		c.mutex.Lock()
+		c.username = pkt.Username
+		c.mutex.Unlock()
 	}
 
 	// prepare connack packet
@@ -214,7 +302,7 @@ func (c *Client) processConnect(pkt *packet.ConnectPacket) error {
 		connack.ReturnCode = packet.ErrNotAuthorized
 
 		// send connack
-		err = c.send(connack, false)
+		err := c.send(connack, false)
 		if err != nil {
 			return c.die(TransportError, err, false)
 		}
@@ -223,6 +311,10 @@ func (c *Client) processConnect(pkt *packet.ConnectPacket) error {
 		return c.die(ClientError, ErrNotAuthorized, true)
 	}
 
+	// complete enhanced authentication
+	connack.AuthMethod = pkt.AuthMethod
+	connack.AuthData = authData
+
 	// set state
 	atomic.StoreUint32(&c.state, clientConnected)
 
@@ -250,10 +342,13 @@ func (c *Client) processConnect(pkt *packet.ConnectPacket) error {
 	connack.SessionPresent = !pkt.CleanSession && resumed
 
 	// assign session
+	c.mutex.Lock()
 	c.session = s
+	c.mutex.Unlock()
 
 	// save will if present
 	if pkt.Will != nil {
+		pkt.Will.Topic = c.rewrite(pkt.Will.Topic)
 		err = c.session.SaveWill(pkt.Will)
 		if err != nil {
 			return c.die(SessionError, err, true)
@@ -297,6 +392,11 @@ func (c *Client) processConnect(pkt *packet.ConnectPacket) error {
 
 		// resubscribe subscriptions
 		for _, sub := range subs {
+			// restore alias of rewritten subscriptions
+			if filter := c.rewriter().Reverse(sub.Topic); filter != sub.Topic {
+				c.aliases[sub.Topic] = filter
+			}
+
 			err = c.backend.Subscribe(c, sub)
 			if err != nil {
 				return c.die(BackendError, err, true)
@@ -333,13 +433,15 @@ func (c *Client) processPacket(pkt packet.GenericPacket) error {
 	case *packet.PubcompPacket:
 		err = c.processPubackAndPubcomp(typedPkt.ID)
 	case *packet.PubrecPacket:
-		err = c.processPubrec(typedPkt.ID)
+		err = c.processPubrec(typedPkt.ID, typedPkt.ReasonCode)
 	case *packet.PubrelPacket:
 		err = c.processPubrel(typedPkt.ID)
 	case *packet.PingreqPacket:
 		err = c.processPingreq()
 	case *packet.DisconnectPacket:
 		err = c.processDisconnect()
+	case *packet.AuthPacket:
+		err = c.processAuth(typedPkt)
 	}
 
 	// return eventual error
@@ -350,6 +452,175 @@ func (c *Client) processPacket(pkt packet.GenericPacket) error {
 	return nil
 }
 
+// performs the enhanced authentication of a connecting client and returns the
+// final authentication data and whether the client has been authenticated
+func (c *Client) authenticate(connect *packet.ConnectPacket) ([]byte, bool, error) {
+	// check backend
+	ab, ok := c.backend.(AuthBackend)
+	if !ok {
+		return nil, false, nil
+	}
+
+	// start exchange
+	auth, err := ab.StartAuth(c, connect.AuthMethod)
+	if err != nil {
+		return nil, false, c.die(BackendError, err, true)
+	} else if auth == nil {
+		return nil, false, nil
+	}
+
+	// set method
+	c.authMethod = connect.AuthMethod
+
+	// perform steps
+	data := connect.AuthData
+	for {
+		// perform step
+		res, done, err := auth.Step(data)
+		if err != nil {
+			return nil, false, nil
+		}
+
+		// bind username when done
+		if done {
+			return res, c.bindUsername(auth, connect.Username), nil
+		}
+
+		// prepare auth packet
+		pkt := packet.NewAuthPacket()
+		pkt.ReasonCode = packet.ContinueAuthentication
+		pkt.Method = c.authMethod
+		pkt.Data = res
+
+		// send auth packet
+		err = c.send(pkt, false)
+		if err != nil {
+			return nil, false, c.die(TransportError, err, false)
+		}
+
+		// get next packet from connection
+		var next packet.GenericPacket
+		select {
+		case next = <-c.inc:
+			// continue
+		case <-c.tomb.Dying():
+			return nil, false, tomb.ErrDying
+		}
+
+		// check packet
+		step, ok := next.(*packet.AuthPacket)
+		if !ok {
+			return nil, false, c.die(ClientError, ErrUnexpectedPacket, true)
+		}
+
+		c.log(PacketReceived, c, step, nil, nil)
+
+		// check reason code and method
+		if step.ReasonCode != packet.ContinueAuthentication || step.Method != c.authMethod {
+			return nil, false, nil
+		}
+
+		data = step.Data
+	}
+}
+
+// handle an incoming AuthPacket
+func (c *Client) processAuth(pkt *packet.AuthPacket) error {
+	// check version
+	if c.version != packet.Version5 {
+		return c.die(ClientError, ErrUnexpectedPacket, true)
+	}
+
+	// start a new exchange if re-authentication is requested
+	if pkt.ReasonCode == packet.ReAuthenticate {
+		// check method
+		if len(c.authMethod) == 0 || pkt.Method != c.authMethod {
+			return c.failAuth()
+		}
+
+		// check backend
+		ab, ok := c.backend.(AuthBackend)
+		if !ok {
+			return c.failAuth()
+		}
+
+		// start exchange
+		auth, err := ab.StartAuth(c, pkt.Method)
+		if err != nil {
+			return c.die(BackendError, err, true)
+		} else if auth == nil {
+			return c.failAuth()
+		}
+
+		// set exchange
+		c.auth = auth
+	} else if c.auth == nil || pkt.ReasonCode != packet.ContinueAuthentication || pkt.Method != c.authMethod {
+		return c.failAuth()
+	}
+
+	// perform step
+	data, done, err := c.auth.Step(pkt.Data)
+	if err != nil {
+		return c.failAuth()
+	}
+
+	// prepare auth packet
+	auth := packet.NewAuthPacket()
+	auth.ReasonCode = packet.ContinueAuthentication
+	auth.Method = c.authMethod
+	auth.Data = data
+
+	// finish exchange
+	if done {
+		// check username
+		if !c.bindUsername(c.auth, c.Username()) {
+			return c.failAuth()
+		}
+
+		auth.ReasonCode = packet.AuthSuccess
+		c.auth = nil
+	}
+
+	// send auth packet
+	err = c.send(auth, false)
+	if err != nil {
+		return c.die(TransportError, err, false)
+	}
+
+	return nil
+}
+
+// fail the pending re-authentication
+func (c *Client) failAuth() error {
+	// reset exchange
+	c.auth = nil
+
+	// close client
+	return c.die(ClientError, ErrNotAuthorized, true)
+}
+
+// binds the username authenticated by the exchange to the client and returns
+// false if it differs from the specified username
+func (c *Client) bindUsername(auth AuthExchange, username string) bool {
+	// get authenticated username
+	user, ok := auth.(UserAuthExchange)
+	if !ok {
+		return true
+	}
+
+	// check username
+	if len(username) > 0 && user.Username() != username {
+		return false
+	}
+
+	// set username
+	c.mutex.Lock()
+	c.username = user.Username()
+	c.mutex.Unlock()
+
+	return true
+}
+
 // handle an incoming PingreqPacket
 func (c *Client) processPingreq() error {
 	// send a pingresp packet
@@ -363,6 +634,14 @@ func (c *Client) processPingreq() error {
 
 // handle an incoming SubscribePacket
 func (c *Client) processSubscribe(pkt *packet.SubscribePacket) error {
+	// rewrite subscriptions
+	for i, sub := range pkt.Subscriptions {
+		if filter := c.rewrite(sub.Topic); filter != sub.Topic {
+			pkt.Subscriptions[i].Topic = filter
+			c.aliases[filter] = sub.Topic
+		}
+	}
+
 	// authorize subcribe
 	ok, err := c.backend.AuthorizeSubscribe(c, pkt)
 	if err != nil {
@@ -371,6 +650,12 @@ func (c *Client) processSubscribe(pkt *packet.SubscribePacket) error {
 	if !ok {
 		return c.die(ClientError, ErrNotAuthorizedSubscribe, true)
 	}
+	// get existing subscriptions
+	existing, err := c.session.AllSubscriptions()
+	if err != nil {
+		return c.die(SessionError, err, true)
+	}
+
 	// prepare suback packet
 	suback := packet.NewSubackPacket()
 	suback.ReturnCodes = make([]byte, len(pkt.Subscriptions))
@@ -402,6 +687,13 @@ func (c *Client) processSubscribe(pkt *packet.SubscribePacket) error {
 
 	// queue retained messages
 	for _, sub := range pkt.Subscriptions {
+		// check retain handling
+		if sub.RetainHandling == packet.DontSendRetained {
+			continue
+		} else if sub.RetainHandling == packet.SendRetainedIfNew && hasSubscription(existing, sub.Topic) {
+			continue
+		}
+
 		err := c.backend.QueueRetained(c, sub.Topic)
 		if err != nil {
 			return c.die(BackendError, err, true)
@@ -415,6 +707,10 @@ func (c *Client) processSubscribe(pkt *packet.SubscribePacket) error {
 func (c *Client) processUnsubscribe(pkt *packet.UnsubscribePacket) error {
 	// handle contained topics
 	for _, topic := range pkt.Topics {
+		// rewrite topic and remove alias
+		topic = c.rewrite(topic)
+		delete(c.aliases, topic)
+
 		// unsubscribe client from queue
 		err := c.backend.Unsubscribe(c, topic)
 		if err != nil {
@@ -430,6 +726,7 @@ func (c *Client) processUnsubscribe(pkt *packet.UnsubscribePacket) error {
 
 	// prepare unsuback packet
 	unsuback := packet.NewUnsubackPacket()
+	unsuback.ReasonCodes = make([]byte, len(pkt.Topics))
 	unsuback.ID = pkt.ID
 
 	// send packet
@@ -443,18 +740,37 @@ func (c *Client) processUnsubscribe(pkt *packet.UnsubscribePacket) error {
 
 // handle an incoming PublishPacket
 func (c *Client) processPublish(publish *packet.PublishPacket) error {
+	// rewrite topic
+	publish.Message.Topic = c.rewrite(publish.Message.Topic)
+
+	// start span and propagate it with the message
+	span := c.startSpan("broker.receive_publish", &publish.Message)
+	publish.Message.UserProperties = tracing.Inject(span.SpanContext(), publish.Message.UserProperties)
+
+	// authorize delayed messages using the target topic
+	authMsg := &publish.Message
+	if _, topic, ok := ParseDelayedTopic(authMsg.Topic); ok {
+		authMsg = authMsg.Copy()
+		authMsg.Topic = topic
+	}
+
 	// authorize publish
-	ok, err := c.backend.AuthorizePublish(c, &publish.Message)
+	authSpan := c.startSpan("broker.authorize", &publish.Message)
+	ok, err := c.backend.AuthorizePublish(c, authMsg)
+	authSpan.Finish(err)
 	if err != nil {
+		span.Finish(err)
 		return c.die(BackendError, err, true)
 	}
 	if !ok {
+		span.Finish(ErrNotAuthorizedPublish)
 		return c.die(ClientError, ErrNotAuthorizedPublish, true)
 	}
 	// handle unacknowledged and directly acknowledged messages
 	if publish.Message.QOS <= 1 {
 		err := c.handleMessage(&publish.Message)
 		if err != nil {
+			span.Finish(err)
 			return c.die(BackendError, err, true)
 		}
 	}
@@ -465,8 +781,11 @@ func (c *Client) processPublish(publish *packet.PublishPacket) error {
 		puback.ID = publish.ID
 
 		// acknowledge qos 1 publish
+		ackSpan := c.startSpan("broker.ack", &publish.Message)
 		err := c.send(puback, true)
+		ackSpan.Finish(err)
 		if err != nil {
+			span.Finish(err)
 			return c.die(TransportError, err, false)
 		}
 	}
@@ -476,6 +795,7 @@ func (c *Client) processPublish(publish *packet.PublishPacket) error {
 		// store packet
 		err := c.session.SavePacket(session.Incoming, publish)
 		if err != nil {
+			span.Finish(err)
 			return c.die(SessionError, err, true)
 		}
 
@@ -484,17 +804,26 @@ func (c *Client) processPublish(publish *packet.PublishPacket) error {
 		pubrec.ID = publish.ID
 
 		// signal qos 2 publish
+		ackSpan := c.startSpan("broker.ack", &publish.Message)
 		err = c.send(pubrec, true)
+		ackSpan.Finish(err)
 		if err != nil {
+			span.Finish(err)
 			return c.die(TransportError, err, false)
 		}
 	}
 
+	// finish span
+	span.Finish(nil)
+
 	return nil
 }
 
 // handle an incoming PubackPacket or PubcompPacket
 func (c *Client) processPubackAndPubcomp(id packet.ID) error {
+	// trace acknowledgement
+	c.traceAck(id)
+
 	// remove packet from store
 	c.session.DeletePacket(session.Outgoing, id)
 
@@ -502,7 +831,15 @@ func (c *Client) processPubackAndPubcomp(id packet.ID) error {
 }
 
 // handle an incoming PubrecPacket
-func (c *Client) processPubrec(id packet.ID) error {
+func (c *Client) processPubrec(id packet.ID, code byte) error {
+	// end flow if the client reported a failure
+	if code >= 0x80 {
+		return c.processPubackAndPubcomp(id)
+	}
+
+	// trace acknowledgement
+	c.traceAck(id)
+
 	// allocate packet
 	pubrel := packet.NewPubrelPacket()
 	pubrel.ID = id
@@ -582,11 +919,37 @@ func (c *Client) processDisconnect() error {
 
 // handle publish messages
 func (c *Client) handleMessage(msg *packet.Message) error {
+	// hand over delayed messages to the backend
+	if delay, topic, ok := ParseDelayedTopic(msg.Topic); ok {
+		// prepare message
+		delayed := msg.Copy()
+		delayed.Topic = topic
+
+		// delay message if supported
+		if db, ok := c.backend.(DelayBackend); ok {
+			span := c.startSpan("broker.backend_delay", delayed)
+			err := db.Delay(c, delayed, time.Now().Add(delay))
+			span.Finish(err)
+
+			return err
+		}
+
+		// otherwise publish immediately
+		msg = delayed
+	}
+
 	// check retain flag
 	if msg.Retain {
 		if len(msg.Payload) > 0 {
+			// remove trace context
+			retained := msg
+			if _, ok := msg.UserProperties.Get(tracing.TraceParentKey); ok {
+				retained = msg.Copy()
+				retained.UserProperties = tracing.Strip(msg.UserProperties)
+			}
+
 			// retain message
-			err := c.backend.StoreRetained(c, msg)
+			err := c.backend.StoreRetained(c, retained)
 			if err != nil {
 				return err
 			}
@@ -599,11 +962,16 @@ func (c *Client) handleMessage(msg *packet.Message) error {
 		}
 	}
 
-	// reset an existing retain flag
-	msg.Retain = false
+	// reset an existing retain flag if the backend does not keep it for
+	// subscriptions that request retain as published
+	if rap, ok := c.backend.(RetainAsPublishedBackend); !ok || !rap.RetainAsPublished() {
+		msg.Retain = false
+	}
 
 	// publish message to others
+	span := c.startSpan("broker.backend_publish", msg)
 	err := c.backend.Publish(c, msg)
+	span.Finish(err)
 	if err != nil {
 		return err
 	}
@@ -619,17 +987,50 @@ func (c *Client) forwardMessage(msg *packet.Message) error {
 	publish := packet.NewPublishPacket()
 	publish.Message = *msg
 
-	// get stored subscription
-	sub, err := c.session.LookupSubscription(publish.Message.Topic)
+	// start span and propagate it with the message
+	span := c.startSpan("broker.forward", msg)
+	publish.Message.UserProperties = tracing.Inject(span.SpanContext(), msg.UserProperties)
+
+	// get matching subscriptions
+	subs, err := matchSubscriptions(c.session, publish.Message.Topic)
 	if err != nil {
+		span.Finish(err)
 		return c.die(SessionError, err, true)
 	}
 
-	// check subscription
-	if sub != nil {
+	// check subscriptions
+	if len(subs) > 0 {
+		// collect maximum qos, identifiers and aliases
+		var maxQOS uint8
+		var aliased bool
+		publish.Message.SubscriptionIdentifiers = nil
+		for _, sub := range subs {
+			if sub.QOS > maxQOS {
+				maxQOS = sub.QOS
+			}
+
+			if sub.Identifier > 0 {
+				publish.Message.SubscriptionIdentifiers = append(publish.Message.SubscriptionIdentifiers, sub.Identifier)
+			}
+
+			if _, ok := c.aliases[sub.Topic]; ok {
+				aliased = true
+			}
+		}
+
+		// sort identifiers
+		sort.Slice(publish.Message.SubscriptionIdentifiers, func(i, j int) bool {
+			return publish.Message.SubscriptionIdentifiers[i] < publish.Message.SubscriptionIdentifiers[j]
+		})
+
 		// respect maximum qos
-		if publish.Message.QOS > sub.QOS {
-			publish.Message.QOS = sub.QOS
+		if publish.Message.QOS > maxQOS {
+			publish.Message.QOS = maxQOS
+		}
+
+		// rewrite topic back if a subscription has been rewritten
+		if aliased {
+			publish.Message.Topic = c.rewriter().Reverse(publish.Message.Topic)
 		}
 	}
 
@@ -642,12 +1043,14 @@ func (c *Client) forwardMessage(msg *packet.Message) error {
 	if publish.Message.QOS > 0 {
 		err := c.session.SavePacket(session.Outgoing, publish)
 		if err != nil {
+			span.Finish(err)
 			return c.die(SessionError, err, true)
 		}
 	}
 
 	// send packet
 	err = c.send(publish, true)
+	span.Finish(err)
 	if err != nil {
 		return c.die(TransportError, err, false)
 	}
@@ -678,10 +1081,80 @@ func (c *Client) send(pkt packet.GenericPacket, buffered bool) error {
 	return nil
 }
 
-/* error handling and logging */
+// returns the rewriter of the engine
+func (c *Client) rewriter() *Rewriter {
+	if c.engine == nil {
+		return nil
+	}
+
+	return c.engine.Rewriter
+}
+
+// rewrite a topic or filter to the layout used by the backend
+func (c *Client) rewrite(topic string) string {
+	// get rewriter
+	rewriter := c.rewriter()
+	if rewriter == nil {
+		return topic
+	}
+
+	// rewrite target of delayed messages
+	if _, target, ok := ParseDelayedTopic(topic); ok {
+		return topic[:len(topic)-len(target)] + rewriter.Rewrite(target)
+	}
+
+	return rewriter.Rewrite(topic)
+}
+
+// returns the tracer of the engine
+func (c *Client) tracer() *tracing.Tracer {
+	if c.engine == nil {
+		return nil
+	}
+
+	return c.engine.Tracer
+}
+
+// start a span that is a child of the span propagated with the message
+func (c *Client) startSpan(name string, msg *packet.Message) *tracing.Span {
+	// get tracer
+	tracer := c.tracer()
+	if tracer == nil {
+		return nil
+	}
+
+	// start span
+	span := tracer.Start(name, tracing.Extract(msg.UserProperties))
+	span.SetAttribute("mqtt.client_id", c.clientID)
+	span.SetAttribute("mqtt.topic", msg.Topic)
+	span.SetAttribute("mqtt.qos", strconv.Itoa(int(msg.QOS)))
+
+	return span
+}
+
+// trace the acknowledgement of a forwarded message
+func (c *Client) traceAck(id packet.ID) {
+	// check tracer
+	if c.tracer() == nil {
+		return
+	}
+
+	// get stored packet
+	pkt, err := c.session.LookupPacket(session.Outgoing, id)
+	if err != nil {
+		return
+	}
+
+	// trace acknowledgement of publish packets
+	if publish, ok := pkt.(*packet.PublishPacket); ok {
+		c.startSpan("broker.receive_ack", &publish.Message).Finish(nil)
+	}
+}
+
+/* error handling and events */
 
 // will try to cleanup as many resources as possible
-func (c *Client) cleanup(event LogEvent, err error, close bool) (LogEvent, error) {
+func (c *Client) cleanup(event EventType, err error, close bool) (EventType, error) {
 	// check session
 	if c.session != nil && atomic.LoadUint32(&c.state) == clientConnected {
 		// get will
@@ -734,22 +1207,65 @@ func (c *Client) cleanup(event LogEvent, err error, close bool) (LogEvent, error
 }
 
 // used for closing and cleaning up from internal goroutines
-func (c *Client) die(event LogEvent, err error, close bool) error {
+func (c *Client) die(event EventType, err error, doClose bool) error {
 	c.finish.Do(func() {
-		event, err = c.cleanup(event, err, close)
+		event, err = c.cleanup(event, err, doClose)
 
 		// report error
 		if err != nil {
 			c.log(event, c, nil, nil, err)
 		}
+
+		// signal close
+		close(c.closed)
 	})
 
 	return err
 }
 
-// log a message
-func (c *Client) log(event LogEvent, client *Client, pkt packet.GenericPacket, msg *packet.Message, err error) {
-	if c.logger != nil {
-		c.logger(event, client, pkt, msg, err)
+// returns whether the client has no in-flight QOS 1 and 2 flows
+func (c *Client) idle() bool {
+	// get session
+	s := c.Session()
+	if s == nil {
+		return true
+	}
+
+	// check outgoing packets
+	out, err := s.AllPackets(session.Outgoing)
+	if err != nil || len(out) > 0 {
+		return false
+	}
+
+	// check incoming packets
+	inc, err := s.AllPackets(session.Incoming)
+	if err != nil || len(inc) > 0 {
+		return false
+	}
+
+	return true
+}
+
+// returns whether the list contains a subscription for the topic
+func hasSubscription(subs []*packet.Subscription, topic string) bool {
+	for _, sub := range subs {
+		if sub.Topic == topic {
+			return true
+		}
+	}
+
+	return false
+}
+
+// emit an event
+func (c *Client) log(event EventType, client *Client, pkt packet.GenericPacket, msg *packet.Message, err error) {
+	// track event
+	if c.tracker != nil {
+		c.tracker.track(event, client, pkt, msg, err)
+	}
+
+	// call handler
+	if c.handler != nil {
+		c.handler(newEvent(event, client, pkt, msg, err))
 	}
 }
@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// DelayedPrefix is the topic prefix that is used to publish delayed messages.
+// A message published to "$delayed/<seconds>/<topic>" is held back and
+// published to <topic> after the specified amount of seconds.
+const DelayedPrefix = "$delayed/"
+
+// ParseDelayedTopic will parse a delayed topic and return the delay and the
+// target topic. It returns false if the topic is not a valid delayed topic.
+func ParseDelayedTopic(topic string) (time.Duration, string, bool) {
+	// check prefix
+	if !strings.HasPrefix(topic, DelayedPrefix) {
+		return 0, "", false
+	}
+
+	// split delay and topic
+	parts := strings.SplitN(strings.TrimPrefix(topic, DelayedPrefix), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", false
+	}
+
+	// parse delay
+	seconds, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return time.Duration(seconds) * time.Second, parts[1], true
+}
+
+// A DelayedMessage is a message that is held back until a specific time.
+type DelayedMessage struct {
+	// The message to be published.
+	Message *packet.Message
+
+	// The time the message should be published.
+	Time time.Time
+}
+
+// DelayQueue is a queue for delayed messages that is ordered by time.
+type DelayQueue struct {
+	messages []*DelayedMessage
+	mutex    sync.Mutex
+}
+
+// NewDelayQueue returns a new DelayQueue.
+func NewDelayQueue() *DelayQueue {
+	return &DelayQueue{}
+}
+
+// Push adds a delayed message to the queue.
+func (q *DelayQueue) Push(msg *DelayedMessage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// find position
+	i := sort.Search(len(q.messages), func(i int) bool {
+		return q.messages[i].Time.After(msg.Time)
+	})
+
+	// insert message
+	q.messages = append(q.messages, nil)
+	copy(q.messages[i+1:], q.messages[i:])
+	q.messages[i] = msg
+}
+
+// Next returns the time of the next delayed message and whether there is one.
+func (q *DelayQueue) Next() (time.Time, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// check length
+	if len(q.messages) == 0 {
+		return time.Time{}, false
+	}
+
+	return q.messages[0].Time, true
+}
+
+// Due removes and returns all messages that are due at the specified time.
+func (q *DelayQueue) Due(now time.Time) []*DelayedMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// find first message that is not due
+	i := sort.Search(len(q.messages), func(i int) bool {
+		return q.messages[i].Time.After(now)
+	})
+
+	// check index
+	if i == 0 {
+		return nil
+	}
+
+	// remove messages
+	due := append([]*DelayedMessage(nil), q.messages[:i]...)
+	q.messages = append(q.messages[:0], q.messages[i:]...)
+
+	return due
+}
+
+// All returns all delayed messages in the order they are due.
+func (q *DelayQueue) All() []*DelayedMessage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return append([]*DelayedMessage(nil), q.messages...)
+}
+
+// Len returns the length of the queue.
+func (q *DelayQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.messages)
+}
@@ -0,0 +1,145 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDelayedTopic(t *testing.T) {
+	delay, topic, ok := ParseDelayedTopic("$delayed/10/foo/bar")
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, delay)
+	assert.Equal(t, "foo/bar", topic)
+
+	for _, topic := range []string{"foo", "$delayed/foo", "$delayed/x/foo", "$delayed/-1/foo", "$delayed/10/"} {
+		_, _, ok = ParseDelayedTopic(topic)
+		assert.False(t, ok, topic)
+	}
+}
+
+func TestDelayQueue(t *testing.T) {
+	now := time.Now()
+
+	msg1 := &DelayedMessage{Message: &packet.Message{Topic: "m1"}, Time: now.Add(time.Second)}
+	msg2 := &DelayedMessage{Message: &packet.Message{Topic: "m2"}, Time: now.Add(2 * time.Second)}
+	msg3 := &DelayedMessage{Message: &packet.Message{Topic: "m3"}, Time: now.Add(3 * time.Second)}
+
+	queue := NewDelayQueue()
+	assert.Equal(t, 0, queue.Len())
+
+	_, ok := queue.Next()
+	assert.False(t, ok)
+
+	queue.Push(msg3)
+	queue.Push(msg1)
+	queue.Push(msg2)
+	assert.Equal(t, 3, queue.Len())
+	assert.Equal(t, []*DelayedMessage{msg1, msg2, msg3}, queue.All())
+
+	next, ok := queue.Next()
+	assert.True(t, ok)
+	assert.Equal(t, msg1.Time, next)
+
+	assert.Empty(t, queue.Due(now))
+	assert.Equal(t, []*DelayedMessage{msg1, msg2}, queue.Due(now.Add(2*time.Second)))
+	assert.Equal(t, []*DelayedMessage{msg3}, queue.All())
+}
+
+func TestMemoryBackendDelay(t *testing.T) {
+	backend := NewMemoryBackend()
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	c := client.New()
+	received := make(chan *packet.Message, 1)
+
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		received <- msg
+		return nil
+	}
+
+	cf, err := c.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("test", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	start := time.Now()
+
+	pf, err := c.Publish("$delayed/1/test", []byte("test"), 0, true)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, backend.DelayedMessages(), 1)
+	assert.Empty(t, backend.retainedMessages.All())
+
+	msg := <-received
+	assert.Equal(t, "test", msg.Topic)
+	assert.Equal(t, []byte("test"), msg.Payload)
+	assert.True(t, time.Since(start) >= time.Second)
+	assert.Empty(t, backend.DelayedMessages())
+	assert.Len(t, backend.retainedMessages.All(), 1)
+
+	assert.NoError(t, c.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestDelayUnsupported(t *testing.T) {
+	backend := &struct{ Backend }{NewMemoryBackend()}
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	c := client.New()
+	received := make(chan *packet.Message, 1)
+
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		received <- msg
+		return nil
+	}
+
+	cf, err := c.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("test", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	pf, err := c.Publish("$delayed/10/test", []byte("test"), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	msg := <-received
+	assert.Equal(t, "test", msg.Topic)
+	assert.Equal(t, []byte("test"), msg.Payload)
+
+	assert.NoError(t, c.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestMemoryBackendRestoreDelayed(t *testing.T) {
+	backend1 := NewMemoryBackend()
+	assert.NoError(t, backend1.Delay(nil, &packet.Message{Topic: "test"}, time.Now().Add(time.Hour)))
+	backend1.Close()
+
+	pending := backend1.DelayedMessages()
+	assert.Len(t, pending, 1)
+
+	backend2 := NewMemoryBackend()
+	backend2.RestoreDelayed(pending)
+	assert.Equal(t, pending, backend2.DelayedMessages())
+	backend2.Close()
+}
@@ -7,68 +7,76 @@ import (
 	"time"
 
 	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/tracing"
 	"github.com/256dpi/gomqtt/transport"
 	tomb "gopkg.in/tomb.v2"
 )
 
-// LogEvent are received by a Logger.
-type LogEvent int
-
-const (
-	// NewConnection is emitted when a client comes online.
-	NewConnection LogEvent = iota
-
-	// PacketReceived is emitted when a packet has been received.
-	PacketReceived
-
-	// MessagePublished is emitted after a message has been published.
-	MessagePublished
+// The Engine handles incoming connections and connects them to the backend.
+type Engine struct {
+	Backend Backend
 
-	// MessageForwarded is emitted after a message has been forwarded.
-	MessageForwarded
+	// Events receives all events emitted by the engine and its clients.
+	Events *EventStream
 
-	// PacketSent is emitted when a packet has been sent.
-	PacketSent
+	// Tracer is used to trace the flow of messages through the engine.
+	Tracer *tracing.Tracer
 
-	// LostConnection is emitted when the connection has been terminated.
-	LostConnection
+	// Rewriter is used to rewrite the topics of published messages and the
+	// filters of subscriptions before they are passed to the backend.
+	// Forwarded messages that match a rewritten subscription are rewritten back
+	// to the layout the client has subscribed with.
+	Rewriter *Rewriter
 
-	// TransportError is emitted when an underlying transport error occurs.
-	TransportError
+	ConnectTimeout     time.Duration
+	DefaultReadLimit   int64
+	DefaultReadBuffer  int
+	DefaultWriteBuffer int
 
-	// SessionError is emitted when a call to the session fails.
-	SessionError
+	// MaxConnections limits the number of concurrent connections. A value of
+	// zero disables the limit.
+	MaxConnections int
 
-	// BackendError is emitted when a call to the backend fails.
-	BackendError
+	// MaxConnectionsPerIP limits the number of concurrent connections from the
+	// same IP. A value of zero disables the limit.
+	MaxConnectionsPerIP int
 
-	// ClientError is emitted when the client violates the protocol.
-	ClientError
-)
+	// MaxPendingConnects limits the number of connections that have not yet
+	// sent a ConnectPacket. A value of zero disables the limit.
+	MaxPendingConnects int
 
-// The Logger callback handles incoming log messages.
-type Logger func(LogEvent, *Client, packet.GenericPacket, *packet.Message, error)
+	// ConnectRate limits the number of accepted connections per second. The
+	// ConnectBurst defines how many connections can be accepted at once and
+	// defaults to one. A value of zero disables the limit.
+	ConnectRate  float64
+	ConnectBurst int64
 
-// The Engine handles incoming connections and connects them to the backend.
-type Engine struct {
-	Backend Backend
-	Logger  Logger
+	// AllowedNetworks and DeniedNetworks restrict from which networks
+	// connections are accepted. If AllowedNetworks is not empty, only
+	// connections from the listed networks are accepted. DeniedNetworks take
+	// precedence over AllowedNetworks.
+	AllowedNetworks []*net.IPNet
+	DeniedNetworks  []*net.IPNet
 
-	ConnectTimeout     time.Duration
-	DefaultReadLimit   int64
-	DefaultReadBuffer  int
-	DefaultWriteBuffer int
+	admission    *admission
+	clients      map[*Client]struct{}
+	clientsMutex sync.Mutex
 
 	closing bool
 	mutex   sync.Mutex
 	tomb    tomb.Tomb
 }
 
+// the interval in which a draining engine checks its clients
+var drainInterval = 10 * time.Millisecond
+
 // NewEngine returns a new Engine.
 func NewEngine(backend Backend) *Engine {
 	return &Engine{
 		Backend:        backend,
+		Events:         NewEventStream(),
 		ConnectTimeout: 10 * time.Second,
+		admission:      newAdmission(),
 	}
 }
 
@@ -92,6 +100,9 @@ func (e *Engine) Accept(server transport.Server) {
 
 // Handle takes over responsibility and handles a transport.Conn. It returns
 // false if the engine is closing and the connection has been closed.
+//
+// Connections that exceed one of the configured limits are closed immediately
+// and reported using the ConnectionRejected event.
 func (e *Engine) Handle(conn transport.Conn) bool {
 	e.mutex.Lock()
 	defer e.mutex.Unlock()
@@ -107,6 +118,37 @@ func (e *Engine) Handle(conn transport.Conn) bool {
 		return false
 	}
 
+	// allocate admission if missing
+	if e.admission == nil {
+		e.admission = newAdmission()
+	}
+
+	// allocate event stream if missing
+	if e.Events == nil {
+		e.Events = NewEventStream()
+	}
+
+	// get ip
+	ip := addressIP(conn.RemoteAddr())
+
+	// check limits
+	err := e.admission.admit(e, ip)
+	if err != nil {
+		// close conn
+		conn.Close()
+
+		// emit rejection
+		if e.Events.Observed() {
+			event := newEvent(ConnectionRejected, nil, nil, nil, err)
+			if addr := conn.RemoteAddr(); addr != nil {
+				event.RemoteAddr = addr.String()
+			}
+			e.Events.Emit(event)
+		}
+
+		return true
+	}
+
 	// set default read limit
 	conn.SetReadLimit(e.DefaultReadLimit)
 
@@ -120,13 +162,75 @@ func (e *Engine) Handle(conn transport.Conn) bool {
 	conn.SetReadTimeout(e.ConnectTimeout)
 
 	// handle client
-	NewClient(e.Backend, e.Logger, conn)
+	newClient(e.Backend, nil, &tracker{engine: e, ip: ip}, conn)
 
 	return true
 }
 
-// Close will stop handling incoming connections and close all current clients.
-// The call will block until all clients are properly closed.
+// a tracker follows the lifecycle of a client and emits its events to the
+// event stream of the engine
+type tracker struct {
+	engine    *Engine
+	ip        net.IP
+	connected sync.Once
+	closed    sync.Once
+}
+
+// tracks the specified event, the event is only created if the event stream
+// has subscribers
+func (t *tracker) track(typ EventType, client *Client, pkt packet.GenericPacket, msg *packet.Message, err error) {
+	e := t.engine
+
+	// add new clients
+	if typ == NewConnection {
+		e.clientsMutex.Lock()
+		if e.clients == nil {
+			e.clients = make(map[*Client]struct{})
+		}
+		e.clients[client] = struct{}{}
+		e.clientsMutex.Unlock()
+	}
+
+	// check for connect packet
+	if typ == PacketReceived && pkt != nil && pkt.Type() == packet.CONNECT {
+		t.connected.Do(e.admission.connected)
+	}
+
+	// release lost connections
+	if typ == LostConnection {
+		t.connected.Do(e.admission.connected)
+		t.closed.Do(func() {
+			e.admission.release(t.ip)
+
+			e.clientsMutex.Lock()
+			delete(e.clients, client)
+			e.clientsMutex.Unlock()
+		})
+	}
+
+	// emit event
+	if e.Events.Observed() {
+		e.Events.Emit(newEvent(typ, client, pkt, msg, err))
+	}
+}
+
+// Clients returns a list of all clients currently handled by the engine.
+func (e *Engine) Clients() []*Client {
+	e.clientsMutex.Lock()
+	defer e.clientsMutex.Unlock()
+
+	// collect clients
+	list := make([]*Client, 0, len(e.clients))
+	for client := range e.clients {
+		list = append(list, client)
+	}
+
+	return list
+}
+
+// Close will stop handling incoming connections. Current clients are closed
+// once the backend is closed. Use Drain to gracefully close the engine and all
+// of its clients.
 //
 // Note: All passed servers to Accept must be closed before calling this method.
 func (e *Engine) Close() {
@@ -141,6 +245,56 @@ func (e *Engine) Close() {
 	e.tomb.Wait()
 }
 
+// Drain will stop handling incoming connections and wait until all in-flight
+// QOS 1 and 2 flows of the current clients have been completed or the timeout
+// has been reached. Afterwards, all clients are closed cleanly without
+// publishing their will messages and the backend is able to persist their
+// sessions. The call will block until all clients are properly closed and
+// returns whether all flows have been completed in time.
+//
+// Note: All passed servers to Accept must be closed before calling this method.
+func (e *Engine) Drain(timeout time.Duration) bool {
+	// stop handling connections
+	e.Close()
+
+	// calculate deadline
+	deadline := time.Now().Add(timeout)
+
+	// wait for in-flight flows
+	drained := false
+	for {
+		// check clients
+		drained = true
+		for _, client := range e.Clients() {
+			if !client.idle() {
+				drained = false
+				break
+			}
+		}
+
+		// check state and deadline
+		if drained || time.Now().After(deadline) {
+			break
+		}
+
+		// wait some time
+		time.Sleep(drainInterval)
+	}
+
+	// close all clients
+	clients := e.Clients()
+	for _, client := range clients {
+		client.Close()
+	}
+
+	// wait for clients to be closed
+	for _, client := range clients {
+		<-client.Closed()
+	}
+
+	return drained
+}
+
 // Run runs the passed engine on a random available port and returns a channel
 // that can be closed to shutdown the engine. This method is intended to be used
 // in testing scenarios.
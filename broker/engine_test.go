@@ -6,6 +6,7 @@ import (
 
 	"github.com/256dpi/gomqtt/client"
 	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/tracing"
 	"github.com/256dpi/gomqtt/transport"
 	"github.com/stretchr/testify/assert"
 )
@@ -50,3 +51,135 @@ func TestDefaultReadLimit(t *testing.T) {
 	close(quit)
 	safeReceive(done)
 }
+
+func TestEngineDrain(t *testing.T) {
+	backend := NewMemoryBackend()
+	engine := NewEngine(backend)
+
+	server, err := transport.Launch("tcp://localhost:0")
+	assert.NoError(t, err)
+
+	engine.Accept(server)
+
+	c := client.New()
+	wait := make(chan struct{})
+
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.Nil(t, msg)
+		assert.Error(t, err)
+		close(wait)
+		return nil
+	}
+
+	config := client.NewConfigWithClientID("tcp://"+server.Addr().String(), "drain")
+	config.CleanSession = false
+
+	cf, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("test", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	assert.Len(t, engine.Clients(), 1)
+
+	assert.NoError(t, server.Close())
+	assert.True(t, engine.Drain(time.Second))
+	assert.Empty(t, engine.Clients())
+
+	safeReceive(wait)
+
+	_, ok := backend.offlineQueues.Load("drain")
+	assert.True(t, ok)
+
+	backend.Close()
+}
+
+func TestEngineTracing(t *testing.T) {
+	exporter := tracing.NewMemoryExporter()
+	tracer := tracing.NewTracer(exporter)
+
+	backend := NewMemoryBackend()
+	engine := NewEngine(backend)
+	engine.Tracer = tracer
+
+	port, quit, done := Run(engine, "tcp")
+
+	config := client.NewConfig("tcp://localhost:" + port)
+	config.ProtocolVersion = packet.Version5
+
+	subscriber := client.New()
+	subscriber.Tracer = tracer
+	wait := make(chan struct{})
+
+	subscriber.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		value, _ := msg.UserProperties.Get("foo")
+		assert.Equal(t, "bar", value)
+		close(wait)
+		return nil
+	}
+
+	cf, err := subscriber.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := subscriber.Subscribe("test", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	publisher := client.New()
+	publisher.Tracer = tracer
+
+	cf, err = publisher.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	pf, err := publisher.PublishMessage(&packet.Message{
+		Topic:          "test",
+		Payload:        []byte("test"),
+		QOS:            1,
+		Retain:         true,
+		UserProperties: packet.UserProperties{{Key: "foo", Value: "bar"}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	safeReceive(wait)
+
+	assert.NoError(t, publisher.Disconnect())
+	assert.NoError(t, subscriber.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+
+	// check trace
+	var root *tracing.Span
+	for _, span := range exporter.Spans() {
+		if span.Name == "client.publish" {
+			root = span
+		}
+	}
+	if assert.NotNil(t, root) {
+		var names []string
+		for _, span := range exporter.Trace(root.Context.TraceID) {
+			names = append(names, span.Name)
+			assert.Equal(t, "test", span.Attributes["mqtt.topic"])
+		}
+
+		assert.Contains(t, names, "client.publish")
+		assert.Contains(t, names, "broker.receive_publish")
+		assert.Contains(t, names, "broker.authorize")
+		assert.Contains(t, names, "broker.backend_publish")
+		assert.Contains(t, names, "broker.ack")
+		assert.Contains(t, names, "broker.forward")
+		assert.Contains(t, names, "client.receive_publish")
+	}
+
+	// check retained message
+	retained := backend.retainedMessages.Get("test")
+	if assert.Len(t, retained, 1) {
+		assert.Equal(t, packet.UserProperties{{Key: "foo", Value: "bar"}}, retained[0].(*packet.Message).UserProperties)
+	}
+}
@@ -0,0 +1,309 @@
+package broker
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// EventType denotes the type of an Event.
+type EventType int
+
+const (
+	// NewConnection is emitted when a client comes online.
+	NewConnection EventType = iota
+
+	// PacketReceived is emitted when a packet has been received.
+	PacketReceived
+
+	// MessagePublished is emitted after a message has been published.
+	MessagePublished
+
+	// MessageForwarded is emitted after a message has been forwarded.
+	MessageForwarded
+
+	// PacketSent is emitted when a packet has been sent.
+	PacketSent
+
+	// LostConnection is emitted when the connection has been terminated.
+	LostConnection
+
+	// TransportError is emitted when an underlying transport error occurs.
+	TransportError
+
+	// SessionError is emitted when a call to the session fails.
+	SessionError
+
+	// BackendError is emitted when a call to the backend fails.
+	BackendError
+
+	// ClientError is emitted when the client violates the protocol.
+	ClientError
+
+	// ConnectionRejected is emitted when a connection has been rejected by the
+	// admission control of the engine.
+	ConnectionRejected
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case NewConnection:
+		return "NewConnection"
+	case PacketReceived:
+		return "PacketReceived"
+	case MessagePublished:
+		return "MessagePublished"
+	case MessageForwarded:
+		return "MessageForwarded"
+	case PacketSent:
+		return "PacketSent"
+	case LostConnection:
+		return "LostConnection"
+	case TransportError:
+		return "TransportError"
+	case SessionError:
+		return "SessionError"
+	case BackendError:
+		return "BackendError"
+	case ClientError:
+		return "ClientError"
+	case ConnectionRejected:
+		return "ConnectionRejected"
+	}
+
+	return "Unknown"
+}
+
+// IsError returns whether the event type reports an error.
+func (t EventType) IsError() bool {
+	return t == TransportError || t == SessionError || t == BackendError || t == ClientError
+}
+
+// A PacketSummary describes a sent or received packet.
+type PacketSummary struct {
+	// The packet type.
+	Type packet.Type
+
+	// The packet id if available.
+	ID packet.ID
+
+	// The encoded length of the packet.
+	Length int
+}
+
+// A MessageSummary describes a published or forwarded message. The payload
+// is not included.
+type MessageSummary struct {
+	// The message topic.
+	Topic string
+
+	// The message QOS level.
+	QOS byte
+
+	// The message retain flag.
+	Retain bool
+
+	// The payload size.
+	Size int
+}
+
+// An Event is emitted by the engine and its clients to report activity.
+type Event struct {
+	// The event type.
+	Type EventType
+
+	// The time the event has been emitted.
+	Time time.Time
+
+	// The client that emitted the event. The field is nil for connections that
+	// have been rejected by the engine.
+	Client *Client
+
+	// The client id supplied during connect.
+	ClientID string
+
+	// The remote address of the connection.
+	RemoteAddr string
+
+	// A summary of the related packet if available.
+	Packet *PacketSummary
+
+	// A summary of the related message if available.
+	Message *MessageSummary
+
+	// The related error if available.
+	Error error
+}
+
+// An EventHandler is called synchronously with every emitted event.
+type EventHandler func(*Event)
+
+// newEvent will create an event and summarize the specified packet and
+// message.
+func newEvent(typ EventType, client *Client, pkt packet.GenericPacket, msg *packet.Message, err error) *Event {
+	// prepare event
+	event := &Event{
+		Type:   typ,
+		Time:   time.Now(),
+		Client: client,
+		Error:  err,
+	}
+
+	// add client metadata
+	if client != nil {
+		event.ClientID = client.ClientID()
+		if addr := client.RemoteAddr(); addr != nil {
+			event.RemoteAddr = addr.String()
+		}
+	}
+
+	// summarize packet
+	if pkt != nil {
+		id, _ := packet.GetID(pkt)
+		event.Packet = &PacketSummary{
+			Type:   pkt.Type(),
+			ID:     id,
+			Length: pkt.Len(),
+		}
+	}
+
+	// summarize message
+	if msg != nil {
+		event.Message = &MessageSummary{
+			Topic:  msg.Topic,
+			QOS:    msg.QOS,
+			Retain: msg.Retain,
+			Size:   len(msg.Payload),
+		}
+	}
+
+	return event
+}
+
+// An EventStream distributes events to its subscribers and observers.
+type EventStream struct {
+	subscribers map[*EventSubscription]struct{}
+	observers   map[*eventObserver]struct{}
+	mutex       sync.RWMutex
+}
+
+// a registered event handler
+type eventObserver struct {
+	handler EventHandler
+}
+
+// NewEventStream returns a new EventStream.
+func NewEventStream() *EventStream {
+	return &EventStream{
+		subscribers: make(map[*EventSubscription]struct{}),
+		observers:   make(map[*eventObserver]struct{}),
+	}
+}
+
+// Subscribe will return a new subscription that receives all events emitted
+// after the call. The buffer defines how many events can be queued up before
+// further events are dropped for the subscription.
+func (s *EventStream) Subscribe(buffer int) *EventSubscription {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// create subscription
+	sub := &EventSubscription{
+		stream: s,
+		events: make(chan *Event, buffer),
+	}
+
+	// add subscription
+	s.subscribers[sub] = struct{}{}
+
+	return sub
+}
+
+// Observe will register a handler that is called synchronously with all
+// events emitted after the call. Unlike subscriptions, handlers never miss an
+// event. They must therefore return quickly and must not call back into the
+// stream. The returned function removes the handler.
+func (s *EventStream) Observe(handler EventHandler) func() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// add observer
+	observer := &eventObserver{handler: handler}
+	s.observers[observer] = struct{}{}
+
+	return func() {
+		s.mutex.Lock()
+		delete(s.observers, observer)
+		s.mutex.Unlock()
+	}
+}
+
+// Observed returns whether the stream has subscribers or observers.
+func (s *EventStream) Observed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.subscribers) > 0 || len(s.observers) > 0
+}
+
+// Emit will call all observers and deliver the event to all subscribers. The
+// call will not block if a subscriber is not able to keep up, instead the
+// event is dropped for that subscriber.
+func (s *EventStream) Emit(event *Event) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// call observers
+	for observer := range s.observers {
+		observer.handler(event)
+	}
+
+	// deliver event
+	for sub := range s.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// An EventSubscription receives events from an EventStream.
+type EventSubscription struct {
+	stream  *EventStream
+	events  chan *Event
+	dropped uint64
+	once    sync.Once
+}
+
+// Events returns the channel that receives the events. The channel is closed
+// when the subscription is closed.
+//
+// Note: The events are shared between all subscribers and must not be modified.
+func (s *EventSubscription) Events() <-chan *Event {
+	return s.events
+}
+
+// Dropped returns the number of events that have been dropped because the
+// subscriber did not keep up.
+func (s *EventSubscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close will remove the subscription from the stream and close the events
+// channel.
+func (s *EventSubscription) Close() {
+	s.once.Do(func() {
+		s.stream.mutex.Lock()
+		defer s.stream.mutex.Unlock()
+
+		// remove subscription
+		delete(s.stream.subscribers, s)
+
+		// close channel
+		close(s.events)
+	})
+}
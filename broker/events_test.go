@@ -0,0 +1,135 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventStream(t *testing.T) {
+	stream := NewEventStream()
+	assert.False(t, stream.Observed())
+
+	sub1 := stream.Subscribe(1)
+	sub2 := stream.Subscribe(2)
+	assert.True(t, stream.Observed())
+
+	event1 := newEvent(BackendError, nil, nil, nil, errors.New("foo"))
+	event2 := newEvent(PacketSent, nil, packet.NewPingrespPacket(), nil, nil)
+
+	stream.Emit(event1)
+	stream.Emit(event2)
+
+	assert.Equal(t, event1, <-sub1.Events())
+	assert.Equal(t, uint64(1), sub1.Dropped())
+
+	assert.Equal(t, event1, <-sub2.Events())
+	assert.Equal(t, event2, <-sub2.Events())
+	assert.Equal(t, uint64(0), sub2.Dropped())
+
+	sub1.Close()
+	sub1.Close()
+
+	_, ok := <-sub1.Events()
+	assert.False(t, ok)
+
+	stream.Emit(event1)
+	assert.Equal(t, event1, <-sub2.Events())
+
+	sub2.Close()
+	assert.False(t, stream.Observed())
+}
+
+func TestEventStreamObserve(t *testing.T) {
+	stream := NewEventStream()
+
+	var events []*Event
+	remove := stream.Observe(func(event *Event) {
+		events = append(events, event)
+	})
+	assert.True(t, stream.Observed())
+
+	event1 := newEvent(BackendError, nil, nil, nil, errors.New("foo"))
+	event2 := newEvent(PacketSent, nil, packet.NewPingrespPacket(), nil, nil)
+
+	stream.Emit(event1)
+	stream.Emit(event2)
+	assert.Equal(t, []*Event{event1, event2}, events)
+
+	remove()
+	assert.False(t, stream.Observed())
+
+	stream.Emit(event1)
+	assert.Len(t, events, 2)
+}
+
+func TestNewEvent(t *testing.T) {
+	publish := packet.NewPublishPacket()
+	publish.ID = 7
+	publish.Message = packet.Message{
+		Topic:   "foo",
+		Payload: []byte("bar"),
+		QOS:     1,
+	}
+
+	event := newEvent(PacketReceived, nil, publish, &publish.Message, nil)
+	assert.Equal(t, PacketReceived, event.Type)
+	assert.False(t, event.Time.IsZero())
+	assert.Equal(t, &PacketSummary{
+		Type:   packet.PUBLISH,
+		ID:     7,
+		Length: publish.Len(),
+	}, event.Packet)
+	assert.Equal(t, &MessageSummary{
+		Topic: "foo",
+		QOS:   1,
+		Size:  3,
+	}, event.Message)
+	assert.Equal(t, "PacketReceived", event.Type.String())
+	assert.False(t, event.Type.IsError())
+	assert.True(t, ClientError.IsError())
+}
+
+func TestEngineEvents(t *testing.T) {
+	engine := NewEngine(NewMemoryBackend())
+	sub := engine.Events.Subscribe(100)
+
+	port, quit, done := Run(engine, "tcp")
+
+	c := client.New()
+	cf, err := c.Connect(client.NewConfigWithClientID("tcp://localhost:"+port, "events"))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+	assert.NoError(t, c.Disconnect())
+
+	var types []EventType
+	for event := range sub.Events() {
+		types = append(types, event.Type)
+
+		if event.Type == PacketSent {
+			assert.Equal(t, "events", event.ClientID)
+		}
+
+		assert.NotEmpty(t, event.RemoteAddr)
+		assert.NotNil(t, event.Client)
+
+		if event.Type == LostConnection {
+			break
+		}
+	}
+
+	assert.Equal(t, []EventType{
+		NewConnection,
+		PacketReceived,
+		PacketSent,
+	}, types[:3])
+
+	sub.Close()
+
+	close(quit)
+	safeReceive(done)
+}
@@ -0,0 +1,434 @@
+package broker
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+const (
+	fileQueuePush byte = iota + 1
+	fileQueuePop
+)
+
+// the extension of the queue files managed by FileQueues
+const fileQueueExt = ".queue"
+
+// the size of a record header (type and length)
+const fileQueueHeader = 5
+
+// the number of removed messages after which the file is compacted if they
+// outnumber the queued messages
+var fileQueueCompaction = 1000
+
+// a queued message in the file
+type fileQueueEntry struct {
+	offset int64
+	length int
+	size   int
+}
+
+// FileQueue is a durable OfflineQueue that stores messages in an append-only
+// file. Only the positions of the queued messages are kept in memory. Pushed
+// and popped messages are recorded in the file, which is truncated once the
+// queue has been drained and compacted when removed messages outnumber the
+// queued messages. An existing file is loaded when the queue is opened, which
+// allows queues to survive restarts.
+type FileQueue struct {
+	// Sync can be set to flush every write to stable storage.
+	Sync bool
+
+	path    string
+	file    *os.File
+	size    int64
+	removed int
+	entries []fileQueueEntry
+	bytes   int
+	mutex   sync.Mutex
+}
+
+// NewFileQueue opens or creates the file at the specified path and returns a
+// FileQueue that contains the messages that have been left in the file.
+func NewFileQueue(path string) (*FileQueue, error) {
+	// open file
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare queue
+	q := &FileQueue{
+		path: path,
+		file: file,
+	}
+
+	// load records
+	err = q.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// Push will append the message to the file.
+func (q *FileQueue) Push(msg *packet.Message) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// encode message
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	// write record
+	offset := q.size
+	err = q.write(fileQueuePush, data)
+	if err != nil {
+		return err
+	}
+
+	// add entry
+	q.entries = append(q.entries, fileQueueEntry{
+		offset: offset + fileQueueHeader,
+		length: len(data),
+		size:   messageSize(msg),
+	})
+	q.bytes += messageSize(msg)
+
+	return nil
+}
+
+// Peek will read the first message from the file.
+func (q *FileQueue) Peek() (*packet.Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// check entries
+	if len(q.entries) == 0 {
+		return nil, nil
+	}
+
+	return q.read(q.entries[0])
+}
+
+// Pop will read the first message from the file and record its removal.
+func (q *FileQueue) Pop() (*packet.Message, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// check entries
+	if len(q.entries) == 0 {
+		return nil, nil
+	}
+
+	// read message
+	entry := q.entries[0]
+	msg, err := q.read(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// truncate file if drained or record removal
+	if len(q.entries) == 1 {
+		err = q.truncate()
+	} else {
+		err = q.write(fileQueuePop, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// remove entry
+	q.entries = q.entries[1:]
+	q.bytes -= entry.size
+	q.removed++
+
+	// compact file (a failed compaction is retried with the next removal)
+	if q.removed >= fileQueueCompaction && q.removed > len(q.entries) {
+		q.compact()
+	}
+
+	return msg, nil
+}
+
+// Len returns the number of queued messages.
+func (q *FileQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return len(q.entries)
+}
+
+// Bytes returns the total size of the queued messages.
+func (q *FileQueue) Bytes() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.bytes
+}
+
+// Close will close the underlying file.
+func (q *FileQueue) Close() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return q.file.Close()
+}
+
+// Remove will close and delete the underlying file.
+func (q *FileQueue) Remove() error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// close file
+	q.file.Close()
+
+	// delete file
+	return os.Remove(q.path)
+}
+
+// FileQueues returns a callback for the MemoryBackend.OfflineQueueCB that
+// stores the offline queues of the clients in the specified directory. The
+// queues left in the directory can be loaded using LoadFileQueues.
+func FileQueues(dir string) func(c *Client) (OfflineQueue, error) {
+	return func(c *Client) (OfflineQueue, error) {
+		return NewFileQueue(fileQueuePath(dir, c.ClientID()))
+	}
+}
+
+// LoadFileQueues opens the queues in the specified directory that have been
+// created using FileQueues and returns them by client id. The queues can be
+// restored using MemoryBackend.RestoreOfflineQueues.
+func LoadFileQueues(dir string) (map[string]OfflineQueue, error) {
+	// read directory
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// open queues
+	queues := make(map[string]OfflineQueue)
+	for _, info := range infos {
+		// check name
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, fileQueueExt) {
+			continue
+		}
+
+		// decode client id
+		id, err := hex.DecodeString(strings.TrimSuffix(name, fileQueueExt))
+		if err != nil {
+			continue
+		}
+
+		// open queue
+		queue, err := NewFileQueue(filepath.Join(dir, name))
+		if err != nil {
+			for _, queue := range queues {
+				queue.(*FileQueue).Close()
+			}
+
+			return nil, err
+		}
+
+		queues[string(id)] = queue
+	}
+
+	return queues, nil
+}
+
+// returns the path of the queue file of the specified client
+func fileQueuePath(dir, clientID string) string {
+	return filepath.Join(dir, hex.EncodeToString([]byte(clientID))+fileQueueExt)
+}
+
+func (q *FileQueue) read(entry fileQueueEntry) (*packet.Message, error) {
+	// read record
+	data := make([]byte, entry.length)
+	_, err := q.file.ReadAt(data, entry.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	// decode message
+	var msg packet.Message
+	err = json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+func (q *FileQueue) load() error {
+	// prepare header
+	header := make([]byte, fileQueueHeader)
+
+	for {
+		// read header
+		_, err := q.file.ReadAt(header, q.size)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// get type and length
+		typ := header[0]
+		length := int(binary.BigEndian.Uint32(header[1:]))
+
+		// handle records
+		if typ == fileQueuePush {
+			// read message
+			data := make([]byte, length)
+			_, err = q.file.ReadAt(data, q.size+fileQueueHeader)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			// decode message
+			var msg packet.Message
+			err = json.Unmarshal(data, &msg)
+			if err != nil {
+				break
+			}
+
+			// add entry
+			q.entries = append(q.entries, fileQueueEntry{
+				offset: q.size + fileQueueHeader,
+				length: length,
+				size:   messageSize(&msg),
+			})
+			q.bytes += messageSize(&msg)
+		} else if typ == fileQueuePop && len(q.entries) > 0 {
+			// remove entry
+			q.bytes -= q.entries[0].size
+			q.entries = q.entries[1:]
+			q.removed++
+		} else {
+			break
+		}
+
+		// advance
+		q.size += int64(fileQueueHeader + length)
+	}
+
+	// remove incomplete records
+	return q.file.Truncate(q.size)
+}
+
+func (q *FileQueue) write(typ byte, data []byte) error {
+	// prepare record
+	record := make([]byte, fileQueueHeader+len(data))
+	record[0] = typ
+	binary.BigEndian.PutUint32(record[1:], uint32(len(data)))
+	copy(record[fileQueueHeader:], data)
+
+	// write record
+	_, err := q.file.WriteAt(record, q.size)
+	if err != nil {
+		return err
+	}
+
+	// sync file
+	if q.Sync {
+		err = q.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	// advance size
+	q.size += int64(len(record))
+
+	return nil
+}
+
+func (q *FileQueue) truncate() error {
+	// truncate file
+	err := q.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	// sync file
+	if q.Sync {
+		err = q.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	// reset size
+	q.size = 0
+	q.removed = 0
+
+	return nil
+}
+
+func (q *FileQueue) compact() error {
+	// create temporary file
+	tmp, err := os.OpenFile(q.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// copy queued messages
+	var size int64
+	entries := make([]fileQueueEntry, 0, len(q.entries))
+	for _, entry := range q.entries {
+		// copy record
+		record := make([]byte, fileQueueHeader+entry.length)
+		_, err = q.file.ReadAt(record, entry.offset-fileQueueHeader)
+		if err == nil {
+			_, err = tmp.WriteAt(record, size)
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+
+		// add entry
+		entry.offset = size + fileQueueHeader
+		entries = append(entries, entry)
+		size += int64(len(record))
+	}
+
+	// sync temporary file
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// replace file
+	err = os.Rename(q.path+".tmp", q.path)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	// close old file
+	q.file.Close()
+
+	// set state
+	q.file = tmp
+	q.size = size
+	q.entries = entries
+	q.removed = 0
+
+	return nil
+}
@@ -0,0 +1,142 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queue")
+
+	queue, err := NewFileQueue(path)
+	assert.NoError(t, err)
+
+	msg1 := &packet.Message{Topic: "m1", Payload: []byte("1"), QOS: 1}
+	msg2 := &packet.Message{Topic: "m2", Payload: []byte("22"), QOS: 2}
+	msg3 := &packet.Message{Topic: "m3", Payload: []byte("333"), QOS: 1}
+
+	assert.NoError(t, queue.Push(msg1))
+	assert.NoError(t, queue.Push(msg2))
+	assert.NoError(t, queue.Push(msg3))
+	assert.Equal(t, 3, queue.Len())
+	assert.Equal(t, 12, queue.Bytes())
+
+	msg, err := queue.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, msg1, msg)
+	assert.Equal(t, 3, queue.Len())
+
+	msg, err = queue.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, msg1, msg)
+	assert.NoError(t, queue.Close())
+
+	queue, err = NewFileQueue(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queue.Len())
+	assert.Equal(t, 9, queue.Bytes())
+
+	msg, err = queue.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, msg2, msg)
+
+	msg, err = queue.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, msg3, msg)
+
+	msg, err = queue.Pop()
+	assert.NoError(t, err)
+	assert.Nil(t, msg)
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	assert.NoError(t, queue.Close())
+}
+
+func TestFileQueueIncompleteRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queue")
+
+	queue, err := NewFileQueue(path)
+	assert.NoError(t, err)
+	assert.NoError(t, queue.Push(&packet.Message{Topic: "m1"}))
+	assert.NoError(t, queue.Push(&packet.Message{Topic: "m2"}))
+	assert.NoError(t, queue.Close())
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, info.Size()-3))
+
+	queue, err = NewFileQueue(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, queue.Len())
+
+	assert.NoError(t, queue.Push(&packet.Message{Topic: "m3"}))
+
+	msg, err := queue.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "m1", msg.Topic)
+
+	msg, err = queue.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "m3", msg.Topic)
+
+	assert.NoError(t, queue.Close())
+}
+
+func TestFileQueueCompaction(t *testing.T) {
+	fileQueueCompaction = 2
+	defer func() {
+		fileQueueCompaction = 1000
+	}()
+
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queue")
+
+	queue, err := NewFileQueue(path)
+	assert.NoError(t, err)
+
+	for _, topic := range []string{"m1", "m2", "m3", "m4"} {
+		assert.NoError(t, queue.Push(&packet.Message{Topic: topic}))
+	}
+
+	before, err := os.Stat(path)
+	assert.NoError(t, err)
+
+	for _, topic := range []string{"m1", "m2", "m3"} {
+		msg, err := queue.Pop()
+		assert.NoError(t, err)
+		assert.Equal(t, topic, msg.Topic)
+	}
+
+	after, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.True(t, after.Size() < before.Size())
+	assert.NoError(t, queue.Close())
+
+	queue, err = NewFileQueue(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, queue.Len())
+
+	msg, err := queue.Pop()
+	assert.NoError(t, err)
+	assert.Equal(t, "m4", msg.Topic)
+	assert.NoError(t, queue.Close())
+}
@@ -0,0 +1,573 @@
+package broker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/topic"
+
+	// register hash functions
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// ErrInvalidToken is returned if a token is malformed or its signature is
+// invalid.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrTokenExpired is returned if a token is expired or not yet valid.
+var ErrTokenExpired = errors.New("token expired")
+
+// ErrUnknownKey is returned if no key is available to verify a token.
+var ErrUnknownKey = errors.New("unknown key")
+
+// ErrInvalidKey is returned if a key in a key set is invalid.
+var ErrInvalidKey = errors.New("invalid key")
+
+// JWTClaims are the claims of a verified token.
+type JWTClaims map[string]interface{}
+
+// Strings returns the values of a claim that is either a string or a list of
+// strings.
+func (c JWTClaims) Strings(name string) []string {
+	switch value := c[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var list []string
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				list = append(list, str)
+			}
+		}
+
+		return list
+	}
+
+	return nil
+}
+
+// Time returns the time of a numeric date claim.
+func (c JWTClaims) Time(name string) (time.Time, bool) {
+	value, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return time.Unix(int64(value), 0), true
+}
+
+// A JWTAuthenticator authenticates clients that pass a JSON Web Token as their
+// password. Tokens signed using HS256, HS384, HS512, RS256, RS384, RS512,
+// ES256, ES384 and ES512 are verified against the configured keys. The topic
+// patterns in the publish and subscribe claims are used to authorize the
+// client and it is closed once its token expires.
+type JWTAuthenticator struct {
+	// Keys maps key ids to keys. HMAC keys are specified as byte slices, RSA
+	// and ECDSA keys as *rsa.PublicKey and *ecdsa.PublicKey. Tokens without a
+	// key id are verified against all suitable keys.
+	Keys map[string]interface{}
+
+	// Issuer and Audience are checked against the iss and aud claims if set.
+	Issuer   string
+	Audience string
+
+	// Leeway is the tolerated clock skew when checking the exp and nbf claims.
+	Leeway time.Duration
+
+	// RequireExpiry can be set to reject tokens without an exp claim.
+	RequireExpiry bool
+
+	// PublishClaim and SubscribeClaim are the names of the claims that list
+	// the topic patterns the client may publish to and subscribe to.
+	PublishClaim   string
+	SubscribeClaim string
+
+	// the clock used to check tokens
+	now func() time.Time
+
+	grants map[*Client]*jwtGrant
+	mutex  sync.Mutex
+}
+
+type jwtGrant struct {
+	publish   *topic.Tree
+	subscribe []string
+}
+
+// NewJWTAuthenticator returns a new JWTAuthenticator that uses the claims
+// "publish" and "subscribe".
+func NewJWTAuthenticator() *JWTAuthenticator {
+	return &JWTAuthenticator{
+		Keys:           make(map[string]interface{}),
+		PublishClaim:   "publish",
+		SubscribeClaim: "subscribe",
+		now:            time.Now,
+		grants:         make(map[*Client]*jwtGrant),
+	}
+}
+
+// LoadJWKS will add the keys of the JSON Web Key Set at the specified path.
+// Keys of type "oct", "RSA" and "EC" are supported. All keys must have a unique
+// key id and the algorithm of EC keys must match their curve.
+func (a *JWTAuthenticator) LoadJWKS(path string) error {
+	// read file
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// decode set
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			K   string `json:"k"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	err = json.Unmarshal(data, &set)
+	if err != nil {
+		return err
+	}
+
+	// parse keys
+	keys := make(map[string]interface{})
+	for _, jwk := range set.Keys {
+		// check key id
+		if _, ok := keys[jwk.Kid]; ok || jwk.Kid == "" {
+			return ErrInvalidKey
+		}
+
+		switch jwk.Kty {
+		case "oct":
+			// decode secret
+			secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil || len(secret) == 0 {
+				return ErrInvalidKey
+			}
+
+			keys[jwk.Kid] = secret
+		case "RSA":
+			// decode modulus and exponent
+			n, err1 := decodeBigInt(jwk.N)
+			e, err2 := decodeBigInt(jwk.E)
+			if err1 != nil || err2 != nil || !e.IsInt64() {
+				return ErrInvalidKey
+			}
+
+			keys[jwk.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			// get curve
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return ErrInvalidKey
+			}
+
+			// check algorithm
+			if jwk.Alg != "" && jwk.Alg != ecdsaAlgorithm(curve) {
+				return ErrInvalidKey
+			}
+
+			// decode point
+			x, err1 := decodeBigInt(jwk.X)
+			y, err2 := decodeBigInt(jwk.Y)
+			if err1 != nil || err2 != nil || !curve.IsOnCurve(x, y) {
+				return ErrInvalidKey
+			}
+
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		default:
+			return ErrInvalidKey
+		}
+	}
+
+	// add keys
+	a.mutex.Lock()
+	for kid, key := range keys {
+		a.Keys[kid] = key
+	}
+	a.mutex.Unlock()
+
+	return nil
+}
+
+// Verify will verify the signature and validity of the token and return its
+// claims.
+func (a *JWTAuthenticator) Verify(token string) (JWTClaims, error) {
+	// split token
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	// decode header
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// decode signature
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// get keys
+	a.mutex.Lock()
+	var keys []interface{}
+	if header.Kid != "" {
+		if key, ok := a.Keys[header.Kid]; ok {
+			keys = append(keys, key)
+		}
+	} else {
+		for _, key := range a.Keys {
+			keys = append(keys, key)
+		}
+	}
+	a.mutex.Unlock()
+
+	// check keys
+	if len(keys) == 0 {
+		return nil, ErrUnknownKey
+	}
+
+	// verify signature
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if verifySignature(header.Alg, key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidToken
+	}
+
+	// decode claims
+	var claims JWTClaims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// check issuer
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, ErrInvalidToken
+	}
+
+	// check audience
+	if a.Audience != "" && !containsString(claims.Strings("aud"), a.Audience) {
+		return nil, ErrInvalidToken
+	}
+
+	// get time
+	now := a.now()
+
+	// check expiry
+	exp, ok := claims.Time("exp")
+	if ok && !now.Before(exp.Add(a.Leeway)) {
+		return nil, ErrTokenExpired
+	} else if !ok && a.RequireExpiry {
+		return nil, ErrInvalidToken
+	}
+
+	// check not before
+	nbf, ok := claims.Time("nbf")
+	if ok && now.Add(a.Leeway).Before(nbf) {
+		return nil, ErrTokenExpired
+	}
+
+	return claims, nil
+}
+
+// Authenticate will verify the token passed as the password and grant the
+// client the topic patterns listed in the claims. The client will be closed
+// once the token expires. It can be used as the MemoryBackend.AuthenticateCB.
+func (a *JWTAuthenticator) Authenticate(client *Client, username, password string) (bool, error) {
+	// verify token
+	claims, err := a.Verify(password)
+	if err != nil {
+		return false, nil
+	}
+
+	// prepare grant
+	grant := &jwtGrant{
+		publish:   topic.NewTree(),
+		subscribe: claims.Strings(a.SubscribeClaim),
+	}
+
+	// add publish patterns
+	for _, pattern := range claims.Strings(a.PublishClaim) {
+		grant.publish.Add(pattern, true)
+	}
+
+	// save grant
+	a.mutex.Lock()
+	a.grants[client] = grant
+	a.mutex.Unlock()
+
+	// get expiry
+	exp, hasExpiry := claims.Time("exp")
+
+	// close client on expiry and remove grant once closed
+	go func() {
+		// prepare timer
+		var expired <-chan time.Time
+		if hasExpiry {
+			timer := time.NewTimer(exp.Add(a.Leeway).Sub(a.now()))
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case <-expired:
+			a.revoke(client)
+			client.Close()
+		case <-client.Closed():
+			a.revoke(client)
+		}
+	}()
+
+	return true, nil
+}
+
+// AuthorizeSubscribe will authorize subscriptions whose topic filter is
+// covered by one of the granted subscribe patterns. It can be used as the
+// MemoryBackend.AuthorizeSubscribeCB.
+func (a *JWTAuthenticator) AuthorizeSubscribe(client *Client, pkt *packet.SubscribePacket) (bool, error) {
+	// get grant
+	grant := a.grant(client)
+	if grant == nil {
+		return false, nil
+	}
+
+	// check subscriptions
+	for _, sub := range pkt.Subscriptions {
+		covered := false
+		for _, pattern := range grant.subscribe {
+			if coversFilter(pattern, sub.Topic) {
+				covered = true
+				break
+			}
+		}
+
+		if !covered {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// AuthorizePublish will authorize messages whose topic matches one of the
+// granted publish patterns. It can be used as the
+// MemoryBackend.AuthorizePublishCB.
+func (a *JWTAuthenticator) AuthorizePublish(client *Client, msg *packet.Message) (bool, error) {
+	// get grant
+	grant := a.grant(client)
+	if grant == nil {
+		return false, nil
+	}
+
+	return grant.publish.MatchFirst(msg.Topic) != nil, nil
+}
+
+// Install will set the authentication and authorization callbacks of the
+// specified backend.
+func (a *JWTAuthenticator) Install(backend *MemoryBackend) {
+	backend.AuthenticateCB = a.Authenticate
+	backend.AuthorizeSubscribeCB = a.AuthorizeSubscribe
+	backend.AuthorizePublishCB = a.AuthorizePublish
+}
+
+func (a *JWTAuthenticator) grant(client *Client) *jwtGrant {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.grants[client]
+}
+
+func (a *JWTAuthenticator) revoke(client *Client) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.grants, client)
+}
+
+// verify a signature using the specified algorithm and key
+func verifySignature(alg string, key interface{}, signed, signature []byte) bool {
+	// check algorithm
+	if len(alg) != 5 {
+		return false
+	}
+
+	// get hash
+	var hash crypto.Hash
+	switch alg[len(alg)-3:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return false
+	}
+
+	switch alg[:len(alg)-3] {
+	case "HS":
+		// check key
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+
+		// verify hmac
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case "RS":
+		// check key
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		// verify signature
+		h := hash.New()
+		h.Write(signed)
+		return rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), signature) == nil
+	case "ES":
+		// check key
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+
+		// check curve
+		if ecdsaAlgorithm(pub.Curve) != alg {
+			return false
+		}
+
+		// check signature length
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+
+		// verify signature
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, h.Sum(nil), r, s)
+	}
+
+	return false
+}
+
+// returns the algorithm that uses the specified curve
+func ecdsaAlgorithm(curve elliptic.Curve) string {
+	switch curve.Params().Name {
+	case "P-256":
+		return "ES256"
+	case "P-384":
+		return "ES384"
+	case "P-521":
+		return "ES512"
+	}
+
+	return ""
+}
+
+// check if the pattern allows subscribing to the filter
+func coversFilter(pattern, filter string) bool {
+	patternLevels := strings.Split(pattern, "/")
+	filterLevels := strings.Split(filter, "/")
+
+	for i, level := range patternLevels {
+		// a multi level wildcard covers all remaining levels
+		if level == "#" {
+			return true
+		}
+
+		// check remaining filter levels
+		if i >= len(filterLevels) {
+			return false
+		}
+
+		// a single level wildcard covers all but multi level wildcards
+		if level == "+" {
+			if filterLevels[i] == "#" {
+				return false
+			}
+
+			continue
+		}
+
+		// other levels must be equal
+		if level != filterLevels[i] {
+			return false
+		}
+	}
+
+	return len(patternLevels) == len(filterLevels)
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, value)
+}
+
+func decodeBigInt(str string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(str)
+	if err != nil || len(data) == 0 {
+		return nil, ErrInvalidKey
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
+
+func containsString(list []string, str string) bool {
+	for _, item := range list {
+		if item == str {
+			return true
+		}
+	}
+
+	return false
+}
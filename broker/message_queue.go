@@ -14,16 +14,27 @@ type MessageQueue struct {
 	head  int
 	tail  int
 	count int
+	bytes int
 
 	mutex sync.RWMutex
 }
 
+// the initial size of unbounded message queues
+const initialQueueSize = 16
+
 // NewMessageQueue returns a new MessageQueue. If size is greater than zero the
-// queue will not grow more than the defined size.
+// queue will not grow more than the defined size and drop the oldest message
+// when full. Otherwise the queue will grow as needed.
 func NewMessageQueue(size int) *MessageQueue {
+	// get initial size
+	initial := size
+	if initial <= 0 {
+		initial = initialQueueSize
+	}
+
 	return &MessageQueue{
 		size:  size,
-		nodes: make([]*packet.Message, size),
+		nodes: make([]*packet.Message, initial),
 	}
 }
 
@@ -32,14 +43,19 @@ func (q *MessageQueue) Push(msg *packet.Message) {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	// remove item if full
-	if q.count == q.size {
-		q.Pop()
+	// remove item or grow queue if full
+	if q.count == len(q.nodes) {
+		if q.size > 0 {
+			q.pop()
+		} else {
+			q.grow()
+		}
 	}
 
 	// add item
 	q.nodes[q.head] = msg
 	q.count++
+	q.bytes += messageSize(msg)
 	q.head = q.wrap(q.head + 1)
 }
 
@@ -48,17 +64,7 @@ func (q *MessageQueue) Pop() *packet.Message {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
-	if q.count == 0 {
-		return nil
-	}
-
-	// remove item
-	node := q.nodes[q.tail]
-	q.nodes[q.tail] = nil
-	q.count--
-	q.tail = q.wrap(q.tail + 1)
-
-	return node
+	return q.pop()
 }
 
 // Range will call range with the contents of the queue. If fn returns false the
@@ -68,7 +74,7 @@ func (q *MessageQueue) Range(fn func(*packet.Message) bool) {
 	defer q.mutex.RUnlock()
 
 	for i := 0; i < q.count; i++ {
-		if !fn(q.nodes[q.wrap(q.head+i)]) {
+		if !fn(q.nodes[q.wrap(q.tail+i)]) {
 			return
 		}
 	}
@@ -82,21 +88,64 @@ func (q *MessageQueue) Len() int {
 	return q.count
 }
 
+// Bytes returns the total size of the queued messages.
+func (q *MessageQueue) Bytes() int {
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+
+	return q.bytes
+}
+
 // Reset returns and removes all messages from the queue.
 func (q *MessageQueue) Reset() {
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
+	// get initial size
+	initial := q.size
+	if initial <= 0 {
+		initial = initialQueueSize
+	}
+
 	// reset state
-	q.nodes = make([]*packet.Message, q.size)
+	q.nodes = make([]*packet.Message, initial)
 	q.head = 0
 	q.tail = 0
 	q.count = 0
+	q.bytes = 0
+}
+
+func (q *MessageQueue) pop() *packet.Message {
+	if q.count == 0 {
+		return nil
+	}
+
+	// remove item
+	node := q.nodes[q.tail]
+	q.nodes[q.tail] = nil
+	q.count--
+	q.bytes -= messageSize(node)
+	q.tail = q.wrap(q.tail + 1)
+
+	return node
+}
+
+func (q *MessageQueue) grow() {
+	// copy items in order
+	nodes := make([]*packet.Message, len(q.nodes)*2)
+	for i := 0; i < q.count; i++ {
+		nodes[i] = q.nodes[q.wrap(q.tail+i)]
+	}
+
+	// set state
+	q.nodes = nodes
+	q.tail = 0
+	q.head = q.count
 }
 
 func (q *MessageQueue) wrap(i int) int {
-	if i >= q.size {
-		return i - q.size
+	if i >= len(q.nodes) {
+		return i - len(q.nodes)
 	}
 
 	return i
@@ -46,6 +46,23 @@ func TestMessageQueue(t *testing.T) {
 	assert.Equal(t, 0, queue.Len())
 }
 
+func TestMessageQueueUnbounded(t *testing.T) {
+	queue := NewMessageQueue(0)
+
+	for i := 0; i < 100; i++ {
+		queue.Push(&packet.Message{Topic: "m", Payload: []byte{byte(i)}})
+	}
+
+	assert.Equal(t, 100, queue.Len())
+	assert.Equal(t, 200, queue.Bytes())
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, []byte{byte(i)}, queue.Pop().Payload)
+	}
+
+	assert.Equal(t, 0, queue.Bytes())
+}
+
 func BenchmarkMessageQueue(b *testing.B) {
 	b.ReportAllocs()
 	q := NewMessageQueue(100)
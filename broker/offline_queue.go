@@ -0,0 +1,213 @@
+package broker
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// ErrQueueFull is passed to the overflow callback when a message has been
+// dropped because an offline queue exceeded its limits.
+var ErrQueueFull = errors.New("queue full")
+
+// An OverflowPolicy defines which message is dropped when an offline queue
+// exceeds its limits.
+type OverflowPolicy int
+
+const (
+	// DropOldest drops the oldest queued messages to make room for new ones.
+	DropOldest OverflowPolicy = iota
+
+	// DropNewest drops new messages while the queue is full.
+	DropNewest
+)
+
+// QueueLimits define the limits of an offline queue.
+type QueueLimits struct {
+	// MaxMessages limits the number of queued messages. A value of zero
+	// disables the limit.
+	MaxMessages int
+
+	// MaxBytes limits the total size of the queued messages. A value of zero
+	// disables the limit.
+	MaxBytes int
+
+	// Policy defines which message is dropped when a limit is exceeded.
+	Policy OverflowPolicy
+}
+
+// QueueStats describe the current state of an offline queue.
+type QueueStats struct {
+	// The number of queued messages.
+	Messages int
+
+	// The total size of the queued messages.
+	Bytes int
+
+	// The number of messages that have been dropped.
+	Dropped uint64
+}
+
+// An OfflineQueue stores the messages of an offline client. Limits are enforced
+// by the backend and the queue itself should not drop messages. Queues that
+// implement the QueueRemover interface are removed when the session of the
+// client is dropped, other queues are closed if they implement io.Closer.
+type OfflineQueue interface {
+	// Push should add the message to the end of the queue.
+	Push(*packet.Message) error
+
+	// Peek should return the first message of the queue without removing it.
+	// It should return no message if the queue is empty.
+	Peek() (*packet.Message, error)
+
+	// Pop should remove and return the first message of the queue. It should
+	// return no message if the queue is empty.
+	Pop() (*packet.Message, error)
+
+	// Len should return the number of queued messages.
+	Len() int
+
+	// Bytes should return the total size of the queued messages.
+	Bytes() int
+}
+
+// A QueueRemover is an OfflineQueue that removes its underlying storage.
+type QueueRemover interface {
+	// Remove should close the queue and delete its underlying storage.
+	Remove() error
+}
+
+// NewMemoryQueue returns an OfflineQueue that stores messages in an unbounded
+// MessageQueue.
+func NewMemoryQueue() OfflineQueue {
+	return &memoryQueue{
+		MessageQueue: NewMessageQueue(0),
+	}
+}
+
+type memoryQueue struct {
+	*MessageQueue
+}
+
+func (q *memoryQueue) Push(msg *packet.Message) error {
+	q.MessageQueue.Push(msg)
+	return nil
+}
+
+func (q *memoryQueue) Peek() (*packet.Message, error) {
+	var first *packet.Message
+	q.MessageQueue.Range(func(msg *packet.Message) bool {
+		first = msg
+		return false
+	})
+
+	return first, nil
+}
+
+func (q *memoryQueue) Pop() (*packet.Message, error) {
+	return q.MessageQueue.Pop(), nil
+}
+
+// an offline queue with limits
+type offlineQueue struct {
+	clientID string
+	queue    OfflineQueue
+	limits   QueueLimits
+	dropped  uint64
+	removed  uint64
+	mutex    sync.Mutex
+}
+
+// adds a message while enforcing the limits
+func (q *offlineQueue) push(msg *packet.Message, overflow func(string, *packet.Message, error)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// make room for message
+	size := messageSize(msg)
+	for q.exceeds(size) {
+		// drop new message
+		if q.limits.Policy == DropNewest || q.queue.Len() == 0 {
+			q.drop(msg, ErrQueueFull, overflow)
+			return
+		}
+
+		// drop oldest message
+		oldest, err := q.queue.Pop()
+		if err != nil {
+			q.drop(msg, err, overflow)
+			return
+		} else if oldest != nil {
+			q.removed++
+			q.drop(oldest, ErrQueueFull, overflow)
+		}
+	}
+
+	// add message
+	err := q.queue.Push(msg)
+	if err != nil {
+		q.drop(msg, err, overflow)
+	}
+}
+
+// returns the first message and a token that is used to commit its removal
+func (q *offlineQueue) peek() (*packet.Message, uint64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// get message
+	msg, err := q.queue.Peek()
+
+	return msg, q.removed, err
+}
+
+// removes the first message if it has not been removed since the token has
+// been obtained
+func (q *offlineQueue) commit(token uint64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// check token
+	if q.removed != token {
+		return nil
+	}
+
+	// remove message
+	_, err := q.queue.Pop()
+	if err != nil {
+		return err
+	}
+
+	// advance
+	q.removed++
+
+	return nil
+}
+
+// returns the stats of the queue
+func (q *offlineQueue) stats() QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return QueueStats{
+		Messages: q.queue.Len(),
+		Bytes:    q.queue.Bytes(),
+		Dropped:  q.dropped,
+	}
+}
+
+// returns whether adding a message of the specified size exceeds the limits
+func (q *offlineQueue) exceeds(size int) bool {
+	return (q.limits.MaxMessages > 0 && q.queue.Len()+1 > q.limits.MaxMessages) ||
+		(q.limits.MaxBytes > 0 && q.queue.Bytes()+size > q.limits.MaxBytes)
+}
+
+// counts a dropped message and reports it
+func (q *offlineQueue) drop(msg *packet.Message, err error, overflow func(string, *packet.Message, error)) {
+	q.dropped++
+
+	if overflow != nil {
+		overflow(q.clientID, msg, err)
+	}
+}
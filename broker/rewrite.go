@@ -0,0 +1,196 @@
+package broker
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidRewriteRule is returned when a rewrite rule is invalid.
+var ErrInvalidRewriteRule = errors.New("invalid rewrite rule")
+
+// a single rewrite rule
+type rewriteRule struct {
+	from []string
+	to   []string
+}
+
+// A Rewriter rewrites topics and subscription filters using a list of rules.
+// A rule consists of two patterns that use the same wildcard semantics as
+// topic.Tree. The wildcards of the matching pattern capture the matched
+// segments, which are then inserted at the corresponding wildcards of the
+// other pattern. Both patterns must therefore contain the same number of single
+// level wildcards and either both or none a multi level wildcard.
+//
+// The rules are applied in both directions: Rewrite maps topics from the source
+// to the target pattern while Reverse maps them back. If multiple rules match,
+// the first added rule is used.
+//
+// All methods can be called on a nil rewriter, which does not rewrite topics.
+type Rewriter struct {
+	rules []rewriteRule
+	mutex sync.RWMutex
+}
+
+// NewRewriter returns a new Rewriter.
+func NewRewriter() *Rewriter {
+	return &Rewriter{}
+}
+
+// Add will add a rule that rewrites topics matching the from pattern to the
+// to pattern, e.g. "devices/+/temp" to "site/a/+/temperature".
+func (r *Rewriter) Add(from, to string) error {
+	// split patterns
+	fromSegments := strings.Split(from, "/")
+	toSegments := strings.Split(to, "/")
+
+	// validate patterns
+	fromOne, fromSome, ok := countWildcards(fromSegments)
+	if !ok {
+		return ErrInvalidRewriteRule
+	}
+	toOne, toSome, ok := countWildcards(toSegments)
+	if !ok || fromOne != toOne || fromSome != toSome {
+		return ErrInvalidRewriteRule
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// add rule
+	r.rules = append(r.rules, rewriteRule{
+		from: fromSegments,
+		to:   toSegments,
+	})
+
+	return nil
+}
+
+// Rewrite will rewrite the topic or subscription filter using the first rule
+// with a matching source pattern. The topic is returned unchanged if no rule
+// matches.
+func (r *Rewriter) Rewrite(topic string) string {
+	return r.apply(topic, false)
+}
+
+// Reverse will rewrite the topic or subscription filter using the first rule
+// with a matching target pattern. The topic is returned unchanged if no rule
+// matches.
+func (r *Rewriter) Reverse(topic string) string {
+	return r.apply(topic, true)
+}
+
+func (r *Rewriter) apply(topic string, reverse bool) string {
+	// check rewriter
+	if r == nil {
+		return topic
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	// split topic
+	segments := strings.Split(topic, "/")
+
+	// find first matching rule
+	for _, rule := range r.rules {
+		// get patterns
+		from, to := rule.from, rule.to
+		if reverse {
+			from, to = to, from
+		}
+
+		// capture wildcards
+		captures, ok := capture(from, segments)
+		if !ok {
+			continue
+		}
+
+		return expand(to, captures)
+	}
+
+	return topic
+}
+
+// returns the number of single and multi level wildcards and whether the
+// pattern is valid
+func countWildcards(segments []string) (int, int, bool) {
+	var one, some int
+	for i, segment := range segments {
+		switch segment {
+		case "+":
+			one++
+		case "#":
+			// multi level wildcards must be the last segment
+			if i != len(segments)-1 {
+				return 0, 0, false
+			}
+
+			some++
+		}
+	}
+
+	return one, some, true
+}
+
+// matches the segments against the pattern and returns the captured segments
+func capture(pattern, segments []string) ([]string, bool) {
+	var captures []string
+	for i, p := range pattern {
+		// capture remaining segments (includes the parent level)
+		if p == "#" {
+			return append(captures, strings.Join(segments[i:], "/")), true
+		}
+
+		// check length
+		if i >= len(segments) {
+			return nil, false
+		}
+
+		// capture single segment
+		if p == "+" {
+			if segments[i] == "#" {
+				return nil, false
+			}
+
+			captures = append(captures, segments[i])
+			continue
+		}
+
+		// match segment
+		if p != segments[i] {
+			return nil, false
+		}
+	}
+
+	// check length
+	if len(pattern) != len(segments) {
+		return nil, false
+	}
+
+	return captures, true
+}
+
+// inserts the captured segments into the wildcards of the pattern
+func expand(pattern, captures []string) string {
+	// copy pattern
+	segments := make([]string, 0, len(pattern))
+
+	// replace wildcards
+	j := 0
+	for _, p := range pattern {
+		if p == "+" || p == "#" {
+			p = captures[j]
+			j++
+		}
+
+		segments = append(segments, p)
+	}
+
+	// remove empty multi level capture
+	if len(segments) > 0 && segments[len(segments)-1] == "" && pattern[len(pattern)-1] == "#" {
+		segments = segments[:len(segments)-1]
+	}
+
+	return strings.Join(segments, "/")
+}
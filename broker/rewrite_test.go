@@ -0,0 +1,96 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewriter(t *testing.T) {
+	r := NewRewriter()
+	assert.NoError(t, r.Add("devices/+/temp", "site/a/+/temperature"))
+	assert.NoError(t, r.Add("legacy/#", "site/b/#"))
+
+	assert.Equal(t, "site/a/1/temperature", r.Rewrite("devices/1/temp"))
+	assert.Equal(t, "site/a/+/temperature", r.Rewrite("devices/+/temp"))
+	assert.Equal(t, "devices/#", r.Rewrite("devices/#"))
+	assert.Equal(t, "devices/1/hum", r.Rewrite("devices/1/hum"))
+	assert.Equal(t, "site/b/foo/bar", r.Rewrite("legacy/foo/bar"))
+	assert.Equal(t, "site/b", r.Rewrite("legacy"))
+	assert.Equal(t, "site/b/#", r.Rewrite("legacy/#"))
+
+	assert.Equal(t, "devices/1/temp", r.Reverse("site/a/1/temperature"))
+	assert.Equal(t, "legacy/foo", r.Reverse("site/b/foo"))
+	assert.Equal(t, "site/c/foo", r.Reverse("site/c/foo"))
+
+	var nilRewriter *Rewriter
+	assert.Equal(t, "foo", nilRewriter.Rewrite("foo"))
+	assert.Equal(t, "foo", nilRewriter.Reverse("foo"))
+}
+
+func TestRewriterInvalidRules(t *testing.T) {
+	r := NewRewriter()
+	assert.Equal(t, ErrInvalidRewriteRule, r.Add("a/+", "b"))
+	assert.Equal(t, ErrInvalidRewriteRule, r.Add("a/#", "b/+"))
+	assert.Equal(t, ErrInvalidRewriteRule, r.Add("a/#/b", "c/#/d"))
+	assert.Equal(t, ErrInvalidRewriteRule, r.Add("a/+", "b/+/+"))
+}
+
+func TestEngineRewriter(t *testing.T) {
+	engine := NewEngine(NewMemoryBackend())
+	engine.Rewriter = NewRewriter()
+	assert.NoError(t, engine.Rewriter.Add("devices/+/temp", "site/a/+/temperature"))
+
+	port, quit, done := Run(engine, "tcp")
+
+	legacy := client.New()
+	legacyMessages := make(chan *packet.Message, 1)
+	legacy.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		legacyMessages <- msg
+		return nil
+	}
+
+	modern := client.New()
+	modernMessages := make(chan *packet.Message, 1)
+	modern.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		modernMessages <- msg
+		return nil
+	}
+
+	cf, err := legacy.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	cf, err = modern.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := legacy.Subscribe("devices/+/temp", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	sf, err = modern.Subscribe("site/a/+/temperature", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	pf, err := legacy.Publish("devices/1/temp", []byte("21"), 0, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	msg := <-legacyMessages
+	assert.Equal(t, "devices/1/temp", msg.Topic)
+
+	msg = <-modernMessages
+	assert.Equal(t, "site/a/1/temperature", msg.Topic)
+
+	assert.NoError(t, legacy.Disconnect())
+	assert.NoError(t, modern.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+}
@@ -0,0 +1,85 @@
+//go:build go1.21
+// +build go1.21
+
+package broker
+
+import (
+	"context"
+	"log/slog"
+)
+
+// LogEvents will read events from the subscription and emit them as records
+// using the specified logger until the subscription is closed. Errors are
+// logged with the error level, rejected connections with the warn level, new
+// and lost connections with the info level and all other events with the debug
+// level.
+func LogEvents(sub *EventSubscription, logger *slog.Logger) {
+	ctx := context.Background()
+
+	for event := range sub.Events() {
+		// check level
+		level := eventLevel(event)
+		if !logger.Enabled(ctx, level) {
+			continue
+		}
+
+		// log record using the event time
+		record := slog.NewRecord(event.Time, level, event.Type.String(), 0)
+		record.AddAttrs(EventAttrs(event)...)
+		_ = logger.Handler().Handle(ctx, record)
+	}
+}
+
+// EventAttrs returns the attributes that describe the specified event.
+func EventAttrs(event *Event) []slog.Attr {
+	// prepare attributes
+	var attrs []slog.Attr
+
+	// add client metadata
+	if event.ClientID != "" {
+		attrs = append(attrs, slog.String("client_id", event.ClientID))
+	}
+	if event.RemoteAddr != "" {
+		attrs = append(attrs, slog.String("remote_addr", event.RemoteAddr))
+	}
+
+	// add packet summary
+	if event.Packet != nil {
+		attrs = append(attrs, slog.Group("packet",
+			slog.String("type", event.Packet.Type.String()),
+			slog.Int("id", int(event.Packet.ID)),
+			slog.Int("length", event.Packet.Length),
+		))
+	}
+
+	// add message summary
+	if event.Message != nil {
+		attrs = append(attrs, slog.Group("message",
+			slog.String("topic", event.Message.Topic),
+			slog.Int("qos", int(event.Message.QOS)),
+			slog.Bool("retain", event.Message.Retain),
+			slog.Int("size", event.Message.Size),
+		))
+	}
+
+	// add error
+	if event.Error != nil {
+		attrs = append(attrs, slog.String("error", event.Error.Error()))
+	}
+
+	return attrs
+}
+
+// returns the level for the specified event
+func eventLevel(event *Event) slog.Level {
+	switch {
+	case event.Type.IsError():
+		return slog.LevelError
+	case event.Type == ConnectionRejected:
+		return slog.LevelWarn
+	case event.Type == NewConnection || event.Type == LostConnection:
+		return slog.LevelInfo
+	}
+
+	return slog.LevelDebug
+}
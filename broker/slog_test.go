@@ -0,0 +1,59 @@
+//go:build go1.21
+// +build go1.21
+
+package broker
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogEvents(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == "time" {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+
+	stream := NewEventStream()
+	sub := stream.Subscribe(10)
+
+	msg := &packet.Message{Topic: "foo", Payload: []byte("bar"), QOS: 1}
+	stream.Emit(newEvent(MessagePublished, nil, nil, msg, nil))
+	stream.Emit(newEvent(BackendError, nil, nil, nil, errors.New("failed")))
+	sub.Close()
+
+	LogEvents(sub, logger)
+
+	assert.Equal(t, "level=DEBUG msg=MessagePublished message.topic=foo message.qos=1 message.retain=false message.size=3\n"+
+		"level=ERROR msg=BackendError error=failed\n", buf.String())
+}
+
+func TestLogEventsTime(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	stream := NewEventStream()
+	sub := stream.Subscribe(10)
+
+	event := newEvent(NewConnection, nil, nil, nil, nil)
+	event.Time = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	stream.Emit(event)
+	stream.Emit(newEvent(PacketSent, nil, nil, nil, nil))
+	sub.Close()
+
+	LogEvents(sub, logger)
+
+	assert.Equal(t, "time=2020-01-02T03:04:05.000Z level=INFO msg=NewConnection\n", buf.String())
+}
@@ -0,0 +1,339 @@
+package broker
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/topic"
+	"github.com/256dpi/gomqtt/tracing"
+)
+
+// ReplayPrefix is the prefix of topic filters that replay a stream. A filter
+// of the form "$replay/<start>/<filter>" will first receive the recorded
+// messages matching the filter beginning with the specified start, followed
+// by new messages as they are recorded. The start is either an offset or an
+// RFC 3339 timestamp.
+const ReplayPrefix = "$replay/"
+
+// ErrStreamLogClosed is returned by the StreamLog if it has been closed.
+var ErrStreamLogClosed = errors.New("stream log closed")
+
+// ErrMissingStreamLog is returned by the MemoryBackend if a client subscribes
+// to a replay filter while no stream log has been configured.
+var ErrMissingStreamLog = errors.New("missing stream log")
+
+// A StreamPosition is the starting point of a replay. If the time is set, the
+// replay starts with the first message recorded at or after that time.
+type StreamPosition struct {
+	Offset uint64
+	Time   time.Time
+}
+
+// ParseReplayTopic will parse the specified replay filter and return the
+// start position and the contained filter.
+func ParseReplayTopic(topic string) (StreamPosition, string, bool) {
+	// check prefix
+	if !strings.HasPrefix(topic, ReplayPrefix) {
+		return StreamPosition{}, "", false
+	}
+
+	// split start and filter
+	segments := strings.SplitN(strings.TrimPrefix(topic, ReplayPrefix), "/", 2)
+	if len(segments) != 2 || segments[1] == "" {
+		return StreamPosition{}, "", false
+	}
+
+	// parse offset
+	offset, err := strconv.ParseUint(segments[0], 10, 64)
+	if err == nil {
+		return StreamPosition{Offset: offset}, segments[1], true
+	}
+
+	// parse time
+	ts, err := time.Parse(time.RFC3339, segments[0])
+	if err == nil {
+		return StreamPosition{Time: ts}, segments[1], true
+	}
+
+	return StreamPosition{}, "", false
+}
+
+// A StreamRecord is a message that has been recorded in a StreamLog.
+type StreamRecord struct {
+	Offset  uint64
+	Time    time.Time
+	Message *packet.Message
+}
+
+// the encoded record in the file
+type streamLogRecord struct {
+	Time    time.Time       `json:"time"`
+	Message *packet.Message `json:"message"`
+}
+
+// the position of a record in the file
+type streamLogEntry struct {
+	position int64
+	length   int
+	time     time.Time
+}
+
+// the size of a record header (length)
+const streamLogHeader = 4
+
+// A StreamLog records messages of selected topics in an append-only file.
+// Every recorded message is assigned a sequential offset that can be used
+// together with the record time to read the log from a specific position.
+// Only the positions of the records are kept in memory. An existing file is
+// loaded when the log is opened.
+type StreamLog struct {
+	// Sync can be set to flush every write to stable storage.
+	Sync bool
+
+	file     *os.File
+	size     int64
+	entries  []streamLogEntry
+	patterns *topic.Tree
+	notify   chan struct{}
+	closed   bool
+	mutex    sync.RWMutex
+}
+
+// NewStreamLog opens or creates the file at the specified path and returns a
+// StreamLog that records messages matching the specified topic patterns.
+func NewStreamLog(path string, patterns ...string) (*StreamLog, error) {
+	// open file
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare log
+	l := &StreamLog{
+		file:     file,
+		patterns: topic.NewTree(),
+		notify:   make(chan struct{}),
+	}
+
+	// add patterns
+	for _, pattern := range patterns {
+		l.patterns.Add(pattern, true)
+	}
+
+	// load records
+	err = l.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Matches returns whether messages with the specified topic are recorded.
+func (l *StreamLog) Matches(topic string) bool {
+	return l.patterns.MatchFirst(topic) != nil
+}
+
+// Append will record the message and return its offset. An eventual trace
+// context is not recorded.
+func (l *StreamLog) Append(msg *packet.Message) (uint64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// check state
+	if l.closed {
+		return 0, ErrStreamLogClosed
+	}
+
+	// remove trace context
+	if _, ok := msg.UserProperties.Get(tracing.TraceParentKey); ok {
+		msg = msg.Copy()
+		msg.UserProperties = tracing.Strip(msg.UserProperties)
+	}
+
+	// encode record
+	now := time.Now()
+	data, err := json.Marshal(streamLogRecord{
+		Time:    now,
+		Message: msg,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// prepare record
+	record := make([]byte, streamLogHeader+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[streamLogHeader:], data)
+
+	// write record
+	_, err = l.file.WriteAt(record, l.size)
+	if err != nil {
+		return 0, err
+	}
+
+	// sync file
+	if l.Sync {
+		err = l.file.Sync()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// add entry
+	offset := uint64(len(l.entries))
+	l.entries = append(l.entries, streamLogEntry{
+		position: l.size + streamLogHeader,
+		length:   len(data),
+		time:     now,
+	})
+	l.size += int64(len(record))
+
+	// notify readers
+	close(l.notify)
+	l.notify = make(chan struct{})
+
+	return offset, nil
+}
+
+// Read will return up to limit records beginning with the specified offset.
+func (l *StreamLog) Read(offset uint64, limit int) ([]*StreamRecord, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	// check state
+	if l.closed {
+		return nil, ErrStreamLogClosed
+	}
+
+	// read records
+	var records []*StreamRecord
+	for i := offset; i < uint64(len(l.entries)) && len(records) < limit; i++ {
+		// read data
+		entry := l.entries[i]
+		data := make([]byte, entry.length)
+		_, err := l.file.ReadAt(data, entry.position)
+		if err != nil {
+			return nil, err
+		}
+
+		// decode record
+		var record streamLogRecord
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			return nil, err
+		}
+
+		// add record
+		records = append(records, &StreamRecord{
+			Offset:  i,
+			Time:    record.Time,
+			Message: record.Message,
+		})
+	}
+
+	return records, nil
+}
+
+// Seek returns the offset of the first record that has been recorded at or
+// after the specified time.
+func (l *StreamLog) Seek(t time.Time) uint64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return uint64(sort.Search(len(l.entries), func(i int) bool {
+		return !l.entries[i].time.Before(t)
+	}))
+}
+
+// Next returns the offset that will be assigned to the next record.
+func (l *StreamLog) Next() uint64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return uint64(len(l.entries))
+}
+
+// Notify returns a channel that is closed when the next record is appended.
+func (l *StreamLog) Notify() <-chan struct{} {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.notify
+}
+
+// Close will close the underlying file.
+func (l *StreamLog) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// check state
+	if l.closed {
+		return nil
+	}
+
+	// set flag
+	l.closed = true
+
+	// notify readers
+	close(l.notify)
+
+	return l.file.Close()
+}
+
+func (l *StreamLog) load() error {
+	// prepare header
+	header := make([]byte, streamLogHeader)
+
+	for {
+		// read header
+		_, err := l.file.ReadAt(header, l.size)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// get length
+		length := int(binary.BigEndian.Uint32(header))
+
+		// read record
+		data := make([]byte, length)
+		_, err = l.file.ReadAt(data, l.size+streamLogHeader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// decode record
+		var record streamLogRecord
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			break
+		}
+
+		// add entry
+		l.entries = append(l.entries, streamLogEntry{
+			position: l.size + streamLogHeader,
+			length:   length,
+			time:     record.Time,
+		})
+
+		// advance
+		l.size += int64(streamLogHeader + length)
+	}
+
+	// remove incomplete records
+	return l.file.Truncate(l.size)
+}
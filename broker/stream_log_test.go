@@ -0,0 +1,245 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReplayTopic(t *testing.T) {
+	position, filter, ok := ParseReplayTopic("$replay/10/foo/#")
+	assert.True(t, ok)
+	assert.Equal(t, StreamPosition{Offset: 10}, position)
+	assert.Equal(t, "foo/#", filter)
+
+	position, filter, ok = ParseReplayTopic("$replay/2018-01-02T03:04:05Z/foo")
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC), position.Time)
+	assert.Equal(t, "foo", filter)
+
+	for _, topic := range []string{"foo", "$replay/foo", "$replay/x/foo", "$replay/-1/foo", "$replay/10/"} {
+		_, _, ok = ParseReplayTopic(topic)
+		assert.False(t, ok, topic)
+	}
+}
+
+func TestStreamLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "stream")
+
+	log, err := NewStreamLog(path, "foo/#")
+	assert.NoError(t, err)
+	assert.True(t, log.Matches("foo/bar"))
+	assert.False(t, log.Matches("bar"))
+	assert.Equal(t, uint64(0), log.Next())
+
+	notify := log.Notify()
+
+	offset, err := log.Append(&packet.Message{Topic: "foo/1"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), offset)
+
+	select {
+	case <-notify:
+	default:
+		assert.Fail(t, "not notified")
+	}
+
+	middle := time.Now()
+
+	offset, err = log.Append(&packet.Message{Topic: "foo/2", UserProperties: packet.UserProperties{
+		{Key: "foo", Value: "bar"},
+		{Key: tracing.TraceParentKey, Value: "00-0102-0304-01"},
+	}})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), offset)
+
+	offset, err = log.Append(&packet.Message{Topic: "foo/3"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), offset)
+
+	records, err := log.Read(1, 1)
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, uint64(1), records[0].Offset)
+	assert.Equal(t, "foo/2", records[0].Message.Topic)
+	assert.Equal(t, packet.UserProperties{{Key: "foo", Value: "bar"}}, records[0].Message.UserProperties)
+
+	assert.Equal(t, uint64(1), log.Seek(middle))
+	assert.Equal(t, uint64(3), log.Seek(time.Now().Add(time.Second)))
+	assert.NoError(t, log.Close())
+
+	_, err = log.Append(&packet.Message{Topic: "foo/4"})
+	assert.Equal(t, ErrStreamLogClosed, err)
+
+	// remove part of the last record
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, info.Size()-3))
+
+	log, err = NewStreamLog(path, "foo/#")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), log.Next())
+
+	offset, err = log.Append(&packet.Message{Topic: "foo/5"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), offset)
+
+	records, err = log.Read(0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, "foo/1", records[0].Message.Topic)
+	assert.Equal(t, "foo/2", records[1].Message.Topic)
+	assert.Equal(t, "foo/5", records[2].Message.Topic)
+	assert.NoError(t, log.Close())
+}
+
+func TestMemoryBackendReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewStreamLog(filepath.Join(dir, "stream"), "devices/#")
+	assert.NoError(t, err)
+	defer log.Close()
+
+	backend := NewMemoryBackend()
+	backend.StreamLog = log
+
+	port, quit, done := Run(NewEngine(backend), "tcp")
+
+	// publish history
+	c1 := client.New()
+	c1.Callback = func(msg *packet.Message, err error) error {
+		assert.Fail(t, "should not be called")
+		return nil
+	}
+
+	cf, err := c1.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	for _, topic := range []string{"devices/1", "other", "devices/2", "devices/3"} {
+		pf, err := c1.Publish(topic, []byte(topic), 1, false)
+		assert.NoError(t, err)
+		assert.NoError(t, pf.Wait(10*time.Second))
+	}
+
+	assert.Equal(t, uint64(3), log.Next())
+
+	// replay from offset
+	c2 := client.New()
+	received := make(chan *packet.Message, 10)
+	c2.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		received <- msg
+		return nil
+	}
+
+	cf, err = c2.Connect(client.NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c2.Subscribe("$replay/1/devices/#", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	pf, err := c1.Publish("devices/4", []byte("devices/4"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	for _, topic := range []string{"devices/2", "devices/3", "devices/4"} {
+		select {
+		case msg := <-received:
+			assert.Equal(t, topic, msg.Topic)
+			assert.Equal(t, uint8(0), msg.QOS)
+		case <-time.After(10 * time.Second):
+			assert.Fail(t, "message not received")
+		}
+	}
+
+	// stop replay
+	uf, err := c2.Unsubscribe("$replay/1/devices/#")
+	assert.NoError(t, err)
+	assert.NoError(t, uf.Wait(10*time.Second))
+
+	pf, err = c1.Publish("devices/5", []byte("devices/5"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	// replay from time
+	sf, err = c2.Subscribe("$replay/"+time.Now().Add(-time.Minute).Format(time.RFC3339)+"/devices/1", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "devices/1", msg.Topic)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "message not received")
+	}
+
+	select {
+	case msg := <-received:
+		assert.Fail(t, "unexpected message", msg.Topic)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.NoError(t, c1.Disconnect())
+	assert.NoError(t, c2.Disconnect())
+
+	close(quit)
+	safeReceive(done)
+}
+
+func TestMemoryBackendReplayTakeover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewStreamLog(filepath.Join(dir, "stream"), "devices/#")
+	assert.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 200; i++ {
+		_, err = log.Append(&packet.Message{Topic: "devices/1", Payload: []byte("1")})
+		assert.NoError(t, err)
+	}
+
+	backend := NewMemoryBackend()
+	backend.StreamLog = log
+
+	for i := 0; i < 10; i++ {
+		// start a replay that fills the queue
+		c1 := &Client{}
+		_, _, err = backend.Setup(c1, "replay")
+		assert.NoError(t, err)
+		assert.NoError(t, backend.replay(c1, &packet.Subscription{Topic: "$replay/0/devices/#"}, StreamPosition{}, "devices/#"))
+
+		time.Sleep(10 * time.Millisecond)
+		r := backend.replays[c1]["$replay/0/devices/#"]
+
+		// take over the session while the replay is blocked
+		c2 := &Client{}
+		_, _, err = backend.Setup(c2, "replay")
+		assert.NoError(t, err)
+		assert.Empty(t, backend.replays[c1])
+
+		// replay must have returned before the queue has been closed
+		select {
+		case <-r.done:
+		default:
+			assert.Fail(t, "replay still running")
+		}
+	}
+}
@@ -0,0 +1,499 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// ErrWebhookQueueFull is reported by the Webhooks if a call has been dropped
+// because the queue is full.
+var ErrWebhookQueueFull = errors.New("webhook queue full")
+
+// A WebhookEvent denotes the type of activity a webhook is notified about.
+type WebhookEvent string
+
+// All available webhook events.
+const (
+	// WebhookConnect is sent when a client has been connected.
+	WebhookConnect WebhookEvent = "connect"
+
+	// WebhookDisconnect is sent when a connected client has gone away.
+	WebhookDisconnect WebhookEvent = "disconnect"
+
+	// WebhookSubscribe is sent when a client subscribes to a topic.
+	WebhookSubscribe WebhookEvent = "subscribe"
+
+	// WebhookPublish is sent when a message is published.
+	WebhookPublish WebhookEvent = "publish"
+)
+
+// A Webhook describes an HTTP endpoint that is notified about activity.
+type Webhook struct {
+	// The URL that is called using a POST request.
+	URL string
+
+	// The Events the webhook is notified about. All events are sent if empty.
+	Events []WebhookEvent
+
+	// The Filters limit the subscribe and publish events to the subscriptions
+	// and messages whose topics are covered by one of the filters. All topics
+	// are included if empty.
+	Filters []string
+
+	// Additional Headers that are sent with every request.
+	Headers map[string]string
+}
+
+// A WebhookPayload is the JSON body that is sent to a webhook.
+type WebhookPayload struct {
+	Event      WebhookEvent `json:"event"`
+	Time       time.Time    `json:"time"`
+	ClientID   string       `json:"client_id,omitempty"`
+	RemoteAddr string       `json:"remote_addr,omitempty"`
+	Topic      string       `json:"topic,omitempty"`
+	QOS        byte         `json:"qos"`
+	Retain     bool         `json:"retain,omitempty"`
+	Payload    []byte       `json:"payload,omitempty"`
+}
+
+// a queued webhook call
+type webhookCall struct {
+	hook    *Webhook
+	payload *WebhookPayload
+}
+
+// Webhooks notify HTTP endpoints about connecting and disconnecting clients,
+// subscriptions and published messages. Calls are queued and performed
+// asynchronously by a number of workers that retry failed calls.
+type Webhooks struct {
+	// The Hooks that are notified.
+	Hooks []*Webhook
+
+	// The Client used to perform the requests.
+	Client *http.Client
+
+	// The number of workers that perform calls. Calls are performed in order
+	// if there is only one worker.
+	Workers int
+
+	// The size of the queue. Calls that do not fit into the queue are dropped.
+	QueueSize int
+
+	// The number of attempts for every call. A call is successful if the
+	// endpoint responds with a 2xx status code.
+	MaxAttempts int
+
+	// The delay before the first retry, which is doubled for every further
+	// retry.
+	RetryDelay time.Duration
+
+	// DropCB is called with every call that has been dropped because the queue
+	// is full or all attempts have failed.
+	DropCB func(hook *Webhook, payload *WebhookPayload, err error)
+
+	queue    chan webhookCall
+	clients  map[*Client]struct{}
+	removers []func()
+	closed   bool
+	mutex    sync.RWMutex
+	wg       sync.WaitGroup
+	once     sync.Once
+}
+
+// NewWebhooks returns new Webhooks for the specified hooks.
+func NewWebhooks(hooks ...*Webhook) *Webhooks {
+	return &Webhooks{
+		Hooks:       hooks,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Workers:     1,
+		QueueSize:   1000,
+		MaxAttempts: 3,
+		RetryDelay:  time.Second,
+		clients:     make(map[*Client]struct{}),
+	}
+}
+
+// Attach will wrap the backend of the engine to observe connects,
+// subscriptions and published messages and observe the event stream of the
+// engine for disconnects. Delayed messages are observed as well if the backend
+// implements the ReleaseBackend interface, an already set releaser is still
+// called to publish them. It will also start the workers.
+//
+// Attach must be called after the backend of the engine has been configured
+// and before the engine accepts connections. The optional backend interfaces
+// are forwarded to the wrapped backend.
+func (w *Webhooks) Attach(engine *Engine) {
+	// wrap backend
+	backend := &webhookBackend{
+		Backend:  engine.Backend,
+		webhooks: w,
+	}
+	engine.Backend = backend
+
+	// keep support for delayed messages
+	if _, ok := backend.Backend.(DelayBackend); ok {
+		engine.Backend = &webhookDelayBackend{
+			webhookBackend: backend,
+		}
+	}
+
+	// observe delayed messages
+	if rb, ok := backend.Backend.(ReleaseBackend); ok {
+		backend.releaser = rb.Releaser()
+		rb.SetReleaser(backend.release)
+	}
+
+	// allocate event stream if missing
+	if engine.Events == nil {
+		engine.Events = NewEventStream()
+	}
+
+	// observe disconnects
+	remove := engine.Events.Observe(w.observe)
+	w.mutex.Lock()
+	w.removers = append(w.removers, remove)
+	w.mutex.Unlock()
+
+	// start workers
+	w.start()
+}
+
+// Close will stop queueing further calls and wait until all queued calls
+// have been performed.
+func (w *Webhooks) Close() {
+	// start workers if not yet started
+	w.start()
+
+	// close queue and stop observing
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	removers := w.removers
+	w.removers = nil
+	w.mutex.Unlock()
+
+	// remove observers
+	for _, remove := range removers {
+		remove()
+	}
+
+	// wait for workers
+	w.wg.Wait()
+}
+
+// notifies about disconnected clients
+func (w *Webhooks) observe(event *Event) {
+	// check event
+	if event.Type != LostConnection || event.Client == nil {
+		return
+	}
+
+	// check client
+	w.mutex.Lock()
+	_, ok := w.clients[event.Client]
+	delete(w.clients, event.Client)
+	w.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	// notify
+	w.notify(&WebhookPayload{
+		Event:      WebhookDisconnect,
+		Time:       event.Time,
+		ClientID:   event.ClientID,
+		RemoteAddr: event.RemoteAddr,
+	})
+}
+
+// starts the workers
+func (w *Webhooks) start() {
+	w.once.Do(func() {
+		// create queue
+		w.queue = make(chan webhookCall, w.QueueSize)
+
+		// start workers
+		for i := 0; i < w.Workers; i++ {
+			w.wg.Add(1)
+			go w.worker()
+		}
+	})
+}
+
+// queues calls for all hooks that are interested in the payload
+func (w *Webhooks) notify(payload *WebhookPayload) {
+	// start workers if not yet started
+	w.start()
+
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	// check state
+	if w.closed {
+		return
+	}
+
+	for _, hook := range w.Hooks {
+		// check hook
+		if !hook.matches(payload) {
+			continue
+		}
+
+		// queue call
+		select {
+		case w.queue <- webhookCall{hook: hook, payload: payload}:
+		default:
+			if w.DropCB != nil {
+				w.DropCB(hook, payload, ErrWebhookQueueFull)
+			}
+		}
+	}
+}
+
+// performs queued calls
+func (w *Webhooks) worker() {
+	defer w.wg.Done()
+
+	for call := range w.queue {
+		// perform call
+		err := w.call(call)
+		if err != nil && w.DropCB != nil {
+			w.DropCB(call.hook, call.payload, err)
+		}
+	}
+}
+
+// performs a call and retries it if necessary
+func (w *Webhooks) call(call webhookCall) error {
+	// encode payload
+	body, err := json.Marshal(call.payload)
+	if err != nil {
+		return err
+	}
+
+	delay := w.RetryDelay
+	for attempt := 1; ; attempt++ {
+		// perform request
+		err = w.request(call.hook, body)
+		if err == nil || attempt >= w.MaxAttempts {
+			return err
+		}
+
+		// wait before retrying
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// performs a single request
+func (w *Webhooks) request(hook *Webhook, body []byte) error {
+	// prepare request
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	// set headers
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range hook.Headers {
+		req.Header.Set(key, value)
+	}
+
+	// perform request
+	res, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	// close body
+	res.Body.Close()
+
+	// check status
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// returns whether the hook is interested in the payload
+func (h *Webhook) matches(payload *WebhookPayload) bool {
+	// check events
+	if len(h.Events) > 0 {
+		found := false
+		for _, event := range h.Events {
+			if event == payload.Event {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	// check filters
+	if len(h.Filters) > 0 && (payload.Event == WebhookSubscribe || payload.Event == WebhookPublish) {
+		for _, filter := range h.Filters {
+			if coversFilter(filter, payload.Topic) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// a backend that notifies the webhooks
+type webhookBackend struct {
+	Backend
+	webhooks *Webhooks
+	releaser func(msg *packet.Message)
+	mutex    sync.Mutex
+}
+
+func (b *webhookBackend) Setup(client *Client, id string) (Session, bool, error) {
+	// setup client
+	session, resumed, err := b.Backend.Setup(client, id)
+	if err != nil {
+		return session, resumed, err
+	}
+
+	// track client
+	b.webhooks.mutex.Lock()
+	b.webhooks.clients[client] = struct{}{}
+	b.webhooks.mutex.Unlock()
+
+	// notify
+	b.webhooks.notify(&WebhookPayload{
+		Event:      WebhookConnect,
+		Time:       time.Now(),
+		ClientID:   id,
+		RemoteAddr: client.RemoteAddr().String(),
+	})
+
+	return session, resumed, nil
+}
+
+func (b *webhookBackend) Subscribe(client *Client, sub *packet.Subscription) error {
+	// subscribe client
+	err := b.Backend.Subscribe(client, sub)
+	if err != nil {
+		return err
+	}
+
+	// notify
+	b.webhooks.notify(&WebhookPayload{
+		Event:      WebhookSubscribe,
+		Time:       time.Now(),
+		ClientID:   client.ClientID(),
+		RemoteAddr: client.RemoteAddr().String(),
+		Topic:      sub.Topic,
+		QOS:        sub.QOS,
+	})
+
+	return nil
+}
+
+func (b *webhookBackend) Publish(client *Client, msg *packet.Message) error {
+	// publish message
+	err := b.Backend.Publish(client, msg)
+	if err != nil {
+		return err
+	}
+
+	// notify
+	b.published(client, msg)
+
+	return nil
+}
+
+func (b *webhookBackend) SetReleaser(fn func(msg *packet.Message)) {
+	b.mutex.Lock()
+	b.releaser = fn
+	b.mutex.Unlock()
+}
+
+func (b *webhookBackend) Releaser() func(msg *packet.Message) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.releaser
+}
+
+// publishes a released delayed message using the chained releaser
+func (b *webhookBackend) release(msg *packet.Message) {
+	// get releaser
+	releaser := b.Releaser()
+
+	// publish message
+	if releaser == nil {
+		b.Publish(nil, msg)
+		return
+	}
+
+	// call releaser
+	releaser(msg)
+
+	// notify
+	b.published(nil, msg)
+}
+
+// notifies about a published message
+func (b *webhookBackend) published(client *Client, msg *packet.Message) {
+	// prepare payload
+	payload := &WebhookPayload{
+		Event:   WebhookPublish,
+		Time:    time.Now(),
+		Topic:   msg.Topic,
+		QOS:     msg.QOS,
+		Retain:  msg.Retain,
+		Payload: msg.Payload,
+	}
+
+	// add client if available
+	if client != nil {
+		payload.ClientID = client.ClientID()
+		payload.RemoteAddr = client.RemoteAddr().String()
+	}
+
+	// notify
+	b.webhooks.notify(payload)
+}
+
+func (b *webhookBackend) StartAuth(client *Client, method string) (AuthExchange, error) {
+	// check backend
+	if ab, ok := b.Backend.(AuthBackend); ok {
+		return ab.StartAuth(client, method)
+	}
+
+	return nil, nil
+}
+
+func (b *webhookBackend) RetainAsPublished() bool {
+	// check backend
+	rap, ok := b.Backend.(RetainAsPublishedBackend)
+
+	return ok && rap.RetainAsPublished()
+}
+
+// a webhook backend that forwards delayed messages
+type webhookDelayBackend struct {
+	*webhookBackend
+}
+
+func (b *webhookDelayBackend) Delay(client *Client, msg *packet.Message, at time.Time) error {
+	return b.Backend.(DelayBackend).Delay(client, msg, at)
+}
@@ -0,0 +1,235 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/client"
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooks(t *testing.T) {
+	calls := make(chan *WebhookPayload, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "secret", r.Header.Get("X-Token"))
+
+		var payload WebhookPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		calls <- &payload
+	}))
+	defer server.Close()
+
+	webhooks := NewWebhooks(&Webhook{
+		URL:     server.URL,
+		Filters: []string{"devices/#"},
+		Headers: map[string]string{"X-Token": "secret"},
+	})
+
+	engine := NewEngine(NewMemoryBackend())
+	webhooks.Attach(engine)
+
+	port, quit, done := Run(engine, "tcp")
+
+	c := client.New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		return nil
+	}
+
+	options := client.NewConfigWithClientID("tcp://localhost:"+port, "webhooks")
+	cf, err := c.Connect(options)
+	assert.NoError(t, err)
+	assert.NoError(t, cf.Wait(10*time.Second))
+
+	sf, err := c.Subscribe("other", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	sf, err = c.Subscribe("devices/+", 1)
+	assert.NoError(t, err)
+	assert.NoError(t, sf.Wait(10*time.Second))
+
+	pf, err := c.Publish("other", []byte("other"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	pf, err = c.Publish("devices/1", []byte("up"), 1, true)
+	assert.NoError(t, err)
+	assert.NoError(t, pf.Wait(10*time.Second))
+
+	assert.NoError(t, c.Disconnect())
+
+	receive := func() *WebhookPayload {
+		select {
+		case payload := <-calls:
+			return payload
+		case <-time.After(10 * time.Second):
+			assert.Fail(t, "webhook not called")
+			return &WebhookPayload{}
+		}
+	}
+
+	payload := receive()
+	assert.Equal(t, WebhookConnect, payload.Event)
+	assert.Equal(t, "webhooks", payload.ClientID)
+	assert.NotEmpty(t, payload.RemoteAddr)
+
+	payload = receive()
+	assert.Equal(t, WebhookSubscribe, payload.Event)
+	assert.Equal(t, "devices/+", payload.Topic)
+	assert.Equal(t, uint8(1), payload.QOS)
+
+	payload = receive()
+	assert.Equal(t, WebhookPublish, payload.Event)
+	assert.Equal(t, "webhooks", payload.ClientID)
+	assert.Equal(t, "devices/1", payload.Topic)
+	assert.Equal(t, []byte("up"), payload.Payload)
+	assert.True(t, payload.Retain)
+
+	payload = receive()
+	assert.Equal(t, WebhookDisconnect, payload.Event)
+	assert.Equal(t, "webhooks", payload.ClientID)
+
+	close(quit)
+	safeReceive(done)
+
+	webhooks.Close()
+	assert.Len(t, calls, 0)
+}
+
+func TestWebhooksDelayed(t *testing.T) {
+	calls := make(chan *WebhookPayload, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		calls <- &payload
+	}))
+	defer server.Close()
+
+	webhooks := NewWebhooks(&Webhook{URL: server.URL})
+
+	backend := NewMemoryBackend()
+
+	released := make(chan *packet.Message, 1)
+	backend.SetReleaser(func(msg *packet.Message) {
+		released <- msg
+	})
+
+	webhooks.Attach(NewEngine(backend))
+
+	err := backend.Delay(nil, &packet.Message{Topic: "test", Payload: []byte("test")}, time.Now())
+	assert.NoError(t, err)
+
+	select {
+	case payload := <-calls:
+		assert.Equal(t, WebhookPublish, payload.Event)
+		assert.Equal(t, "test", payload.Topic)
+		assert.Equal(t, []byte("test"), payload.Payload)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "webhook not called")
+	}
+
+	// the existing releaser is still called
+	select {
+	case msg := <-released:
+		assert.Equal(t, "test", msg.Topic)
+	default:
+		assert.Fail(t, "releaser not called")
+	}
+
+	webhooks.Close()
+}
+
+func TestWebhooksRetry(t *testing.T) {
+	var attempts int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	webhooks := NewWebhooks(&Webhook{
+		URL:    server.URL,
+		Events: []WebhookEvent{WebhookConnect},
+	})
+	webhooks.RetryDelay = 10 * time.Millisecond
+	webhooks.DropCB = func(hook *Webhook, payload *WebhookPayload, err error) {
+		assert.Fail(t, "should not be called")
+	}
+
+	webhooks.notify(&WebhookPayload{Event: WebhookConnect})
+	webhooks.notify(&WebhookPayload{Event: WebhookPublish})
+	webhooks.Close()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	// exhausted attempts
+	atomic.StoreInt32(&attempts, -10)
+
+	var dropped error
+	webhooks = NewWebhooks(&Webhook{URL: server.URL})
+	webhooks.RetryDelay = 10 * time.Millisecond
+	webhooks.DropCB = func(hook *Webhook, payload *WebhookPayload, err error) {
+		dropped = err
+	}
+
+	webhooks.notify(&WebhookPayload{Event: WebhookConnect})
+	webhooks.Close()
+
+	assert.Error(t, dropped)
+	assert.Equal(t, int32(-7), atomic.LoadInt32(&attempts))
+}
+
+func TestWebhooksQueueFull(t *testing.T) {
+	block := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+
+	var dropped int32
+
+	webhooks := NewWebhooks(&Webhook{URL: server.URL})
+	webhooks.QueueSize = 1
+	webhooks.DropCB = func(hook *Webhook, payload *WebhookPayload, err error) {
+		assert.Equal(t, ErrWebhookQueueFull, err)
+		atomic.AddInt32(&dropped, 1)
+	}
+	webhooks.start()
+
+	for i := 0; i < 5; i++ {
+		webhooks.notify(&WebhookPayload{Event: WebhookConnect})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(block)
+	webhooks.Close()
+
+	// one call in flight, one queued
+	assert.Equal(t, int32(3), atomic.LoadInt32(&dropped))
+}
+
+func TestWebhookMatches(t *testing.T) {
+	hook := &Webhook{
+		Events:  []WebhookEvent{WebhookSubscribe, WebhookPublish},
+		Filters: []string{"foo/#"},
+	}
+
+	assert.True(t, hook.matches(&WebhookPayload{Event: WebhookPublish, Topic: "foo/bar"}))
+	assert.True(t, hook.matches(&WebhookPayload{Event: WebhookSubscribe, Topic: "foo/+"}))
+	assert.False(t, hook.matches(&WebhookPayload{Event: WebhookPublish, Topic: "bar"}))
+	assert.False(t, hook.matches(&WebhookPayload{Event: WebhookSubscribe, Topic: "#"}))
+	assert.False(t, hook.matches(&WebhookPayload{Event: WebhookConnect}))
+}
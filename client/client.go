@@ -3,9 +3,12 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"net/url"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +16,8 @@ import (
 	"github.com/256dpi/gomqtt/client/future"
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/session"
+	"github.com/256dpi/gomqtt/topic"
+	"github.com/256dpi/gomqtt/tracing"
 	"github.com/256dpi/gomqtt/transport"
 	"gopkg.in/tomb.v2"
 )
@@ -41,17 +46,30 @@ var ErrClientMissingPong = errors.New("client missing pong")
 // ConnackPacket.
 var ErrClientExpectedConnack = errors.New("client expected connack")
 
+// ErrClientMissingAuthenticator is returned by Reauthenticate if no
+// Authenticator has been provided in the config.
+var ErrClientMissingAuthenticator = errors.New("client missing authenticator")
+
+// ErrClientAlreadyAuthenticating is returned by Reauthenticate if there is
+// already an authentication in progress.
+var ErrClientAlreadyAuthenticating = errors.New("client already authenticating")
+
 // ErrFailedSubscription is returned when a submitted subscription is marked as
 // failed when Config.ValidateSubs must be set to true.
 var ErrFailedSubscription = errors.New("failed subscription")
 
+// ErrMessageNotPending is returned by Acknowledge if the message is not
+// awaiting an acknowledgement.
+var ErrMessageNotPending = errors.New("message not pending")
+
 // A Callback is a function called by the client upon received messages or
 // internal errors. An error can be returned if the callback is not already
 // called with an error to instantly close the client and prevent it from
 // sending any acknowledgments for the specified message.
 //
 // Note: Execution of the client is resumed after the callback returns. This
-// means that waiting on a future inside the callback will deadlock the client.
+// means that waiting on a future inside the callback will deadlock the client,
+// unless the messages are processed by workers.
 type Callback func(msg *packet.Message, err error) error
 
 // A Logger is a function called by the client to log activity.
@@ -66,6 +84,9 @@ const (
 	clientDisconnected
 )
 
+// the number of messages that can be queued per worker
+const workerQueueSize = 100
+
 // A Session is used to persist incoming and outgoing packets.
 type Session interface {
 	// NextID will return the next id for outgoing packets.
@@ -109,7 +130,8 @@ type Client struct {
 	Session Session
 
 	// The callback to be called by the client upon receiving a message or
-	// encountering an error while processing incoming packets.
+	// encountering an error while processing incoming packets. Messages that
+	// match a channel subscription are delivered to the subscription instead.
 	Callback Callback
 
 	// The logger that is used to log low level information about packets
@@ -117,12 +139,49 @@ type Client struct {
 	// automatic keep alive handler.
 	Logger Logger
 
+	// The tracer that is used to trace published and received messages. The
+	// trace context is propagated using the messages user properties.
+	Tracer *tracing.Tracer
+
+	// The number of workers that process received messages concurrently. If
+	// set, the callback is called by the workers and messages with the same
+	// topic are processed in order by the same worker. The acknowledgements
+	// of QOS 1 and QOS 2 messages are sent after the callback has returned.
+	// QOS 2 messages are therefore processed when received and stored until
+	// released to not deliver duplicates again.
+	// Waiting on a future inside the callback will then not deadlock the
+	// client.
+	//
+	// Note: The value must be changed before calling Connect.
+	Workers int
+
+	// If enabled, QOS 1 and QOS 2 messages are not acknowledged after the
+	// callback returns but when Acknowledge is called with the message. Messages
+	// that have not been acknowledged when the connection is lost are delivered
+	// again by the broker if the session is resumed. QOS 2 messages are stored
+	// until they are released and duplicates are not delivered again.
+	//
+	// Note: The value must be changed before calling Connect.
+	ManualAck bool
+
 	clean bool
 
 	keepAlive     time.Duration
 	tracker       *tracker
 	futureStore   *future.Store
 	connectFuture *future.Future
+	channels      *topic.Tree
+	queues        []chan delivery
+
+	filters      map[string]int
+	filtersMutex sync.Mutex
+
+	pending      map[*packet.Message]*packet.PublishPacket
+	pendingMutex sync.Mutex
+
+	authFuture  *future.Future
+	authPending bool
+	authMutex   sync.Mutex
 
 	tomb   tomb.Tomb
 	mutex  sync.Mutex
@@ -135,13 +194,26 @@ func New() *Client {
 		state:       clientInitialized,
 		Session:     session.NewMemorySession(),
 		futureStore: future.NewStore(),
+		channels:    topic.NewTree(),
+		filters:     make(map[string]int),
+		pending:     make(map[*packet.Message]*packet.PublishPacket),
 	}
 }
 
 // Connect opens the connection to the broker and sends a ConnectPacket. It will
 // return a ConnectFuture that gets completed once a ConnackPacket has been
 // received. If the ConnectPacket couldn't be transmitted it will return an error.
+//
+// If an Authenticator is configured, the client will connect using MQTT 5 and
+// perform an enhanced authentication that is started with the ConnectPacket and
+// continued using AuthPackets. The broker is verified with the authentication
+// data of the ConnackPacket.
 func (c *Client) Connect(config *Config) (ConnectFuture, error) {
+	return c.connect(context.Background(), config)
+}
+
+// connects to the broker and dials the connection using the context
+func (c *Client) connect(ctx context.Context, config *Config) (ConnectFuture, error) {
 	if config == nil {
 		panic("no config specified")
 	}
@@ -157,8 +229,14 @@ func (c *Client) Connect(config *Config) (ConnectFuture, error) {
 		return nil, ErrClientAlreadyConnecting
 	}
 
+	// get broker url
+	brokerURL := config.BrokerURL
+	if brokerURL == "" && len(config.BrokerURLs) > 0 {
+		brokerURL = config.BrokerURLs[0]
+	}
+
 	// parse url
-	urlParts, err := url.ParseRequestURI(config.BrokerURL)
+	urlParts, err := url.ParseRequestURI(brokerURL)
 	if err != nil {
 		return nil, err
 	}
@@ -180,12 +258,12 @@ func (c *Client) Connect(config *Config) (ConnectFuture, error) {
 
 	// dial broker (with custom dialer if present)
 	if config.Dialer != nil {
-		c.conn, err = config.Dialer.Dial(config.BrokerURL)
+		c.conn, err = config.Dialer.DialContext(ctx, brokerURL)
 		if err != nil {
 			return nil, err
 		}
 	} else {
-		c.conn, err = transport.Dial(config.BrokerURL)
+		c.conn, err = transport.DialContext(ctx, brokerURL)
 		if err != nil {
 			return nil, err
 		}
@@ -214,6 +292,14 @@ func (c *Client) Connect(config *Config) (ConnectFuture, error) {
 	connect.KeepAlive = uint16(keepAlive.Seconds())
 	connect.CleanSession = config.CleanSession
 
+	// set version
+	if config.ProtocolVersion != 0 {
+		connect.Version = config.ProtocolVersion
+	}
+
+	// set session expiry
+	connect.SessionExpiry = uint32(config.SessionExpiry / time.Second)
+
 	// check for credentials
 	if urlParts.User != nil {
 		connect.Username = urlParts.User.Username()
@@ -223,6 +309,14 @@ func (c *Client) Connect(config *Config) (ConnectFuture, error) {
 	// set will
 	connect.Will = config.WillMessage
 
+	// begin enhanced authentication
+	if config.Authenticator != nil {
+		err = c.beginAuth(connect)
+		if err != nil {
+			return nil, c.cleanup(err, true, false)
+		}
+	}
+
 	// create new ConnectFuture
 	c.connectFuture = future.New()
 
@@ -232,6 +326,18 @@ func (c *Client) Connect(config *Config) (ConnectFuture, error) {
 		return nil, c.cleanup(err, false, false)
 	}
 
+	// start workers
+	if c.Workers > 0 {
+		c.queues = make([]chan delivery, c.Workers)
+		for i := range c.queues {
+			queue := make(chan delivery, workerQueueSize)
+			c.queues[i] = queue
+			c.tomb.Go(func() error {
+				return c.worker(queue)
+			})
+		}
+	}
+
 	// start process routine
 	c.tomb.Go(c.processor)
 
@@ -241,6 +347,44 @@ func (c *Client) Connect(config *Config) (ConnectFuture, error) {
 	return wrappedFuture, nil
 }
 
+// ConnectContext will connect to the broker like Connect and wait until the
+// ConnackPacket has been received or the context is done. The context is also
+// used to dial the connection. If the context is done before the connection
+// has been acknowledged, the client is closed and the context error is
+// returned. If the broker denies the connection, ErrClientConnectionDenied is
+// returned together with the future.
+func (c *Client) ConnectContext(ctx context.Context, config *Config) (ConnectFuture, error) {
+	// check context
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// connect
+	connectFuture, err := c.connect(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// wait for acknowledgement
+	err = connectFuture.WaitContext(ctx)
+	if err == nil {
+		return connectFuture, nil
+	}
+
+	// check if denied
+	if err == future.ErrCanceled && connectFuture.ReturnCode() != packet.ConnectionAccepted {
+		return connectFuture, ErrClientConnectionDenied
+	}
+
+	// close client if the context is done
+	if err == ctx.Err() {
+		c.Close()
+	}
+
+	return nil, err
+}
+
 // Publish will send a PublishPacket containing the passed parameters. It will
 // return a PublishFuture that gets completed once the quality of service flow
 // has been completed.
@@ -271,6 +415,10 @@ func (c *Client) PublishMessage(msg *packet.Message) (GenericFuture, error) {
 	publish := packet.NewPublishPacket()
 	publish.Message = *msg
 
+	// start span and propagate it with the message
+	span := c.startSpan("client.publish", msg)
+	publish.Message.UserProperties = tracing.Inject(span.SpanContext(), msg.UserProperties)
+
 	// set packet id
 	if msg.QOS > 0 {
 		publish.ID = c.Session.NextID()
@@ -286,12 +434,14 @@ func (c *Client) PublishMessage(msg *packet.Message) (GenericFuture, error) {
 	if msg.QOS > 0 {
 		err := c.Session.SavePacket(session.Outgoing, publish)
 		if err != nil {
+			span.Finish(err)
 			return nil, c.cleanup(err, true, false)
 		}
 	}
 
 	// send packet
 	err := c.send(publish, true)
+	span.Finish(err)
 	if err != nil {
 		return nil, c.cleanup(err, false, false)
 	}
@@ -305,6 +455,81 @@ func (c *Client) PublishMessage(msg *packet.Message) (GenericFuture, error) {
 	return publishFuture, nil
 }
 
+// PublishContext will publish a message like Publish and wait until the
+// quality of service flow has been completed or the context is done. If the
+// context is done first, the context error is returned together with the
+// future while the message remains stored in the session and the flow is still
+// completed in the background.
+func (c *Client) PublishContext(ctx context.Context, topic string, payload []byte, qos uint8, retain bool) (GenericFuture, error) {
+	msg := &packet.Message{
+		Topic:   topic,
+		Payload: payload,
+		QOS:     qos,
+		Retain:  retain,
+	}
+
+	return c.PublishMessageContext(ctx, msg)
+}
+
+// PublishMessageContext will publish the passed message like PublishMessage
+// and wait until the quality of service flow has been completed or the context
+// is done.
+func (c *Client) PublishMessageContext(ctx context.Context, msg *packet.Message) (GenericFuture, error) {
+	// check context
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// publish message
+	publishFuture, err := c.PublishMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// wait for completion
+	err = publishFuture.WaitContext(ctx)
+	if err != nil {
+		return publishFuture, err
+	}
+
+	return publishFuture, nil
+}
+
+// SubscribeContext will subscribe like Subscribe and wait until the
+// SubackPacket has been received or the context is done. If the context is
+// done first, the context error is returned while the subscription may still
+// be acknowledged in the background.
+func (c *Client) SubscribeContext(ctx context.Context, topic string, qos uint8) (SubscribeFuture, error) {
+	return c.SubscribeMultipleContext(ctx, []packet.Subscription{
+		{Topic: topic, QOS: qos},
+	})
+}
+
+// SubscribeMultipleContext will subscribe like SubscribeMultiple and wait until
+// the SubackPacket has been received or the context is done.
+func (c *Client) SubscribeMultipleContext(ctx context.Context, subscriptions []packet.Subscription) (SubscribeFuture, error) {
+	// check context
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	// subscribe
+	subscribeFuture, err := c.SubscribeMultiple(subscriptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// wait for acknowledgement
+	err = subscribeFuture.WaitContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return subscribeFuture, nil
+}
+
 // Subscribe will send a SubscribePacket containing one topic to subscribe. It
 // will return a SubscribeFuture that gets completed once a SubackPacket has
 // been received.
@@ -318,6 +543,11 @@ func (c *Client) Subscribe(topic string, qos uint8) (SubscribeFuture, error) {
 // subscribe. It will return a SubscribeFuture that gets completed once a
 // SubackPacket has been received.
 func (c *Client) SubscribeMultiple(subscriptions []packet.Subscription) (SubscribeFuture, error) {
+	return c.subscribeMultiple(subscriptions, nil)
+}
+
+// subscribes and attaches the channel subscription to the future if available
+func (c *Client) subscribeMultiple(subscriptions []packet.Subscription, sub *Subscription) (SubscribeFuture, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
@@ -334,6 +564,21 @@ func (c *Client) SubscribeMultiple(subscriptions []packet.Subscription) (Subscri
 	// create future
 	subFuture := future.New()
 
+	// attach channel subscription
+	if sub != nil {
+		subFuture.Data.Store(subscriptionKey, sub)
+	}
+
+	// reference filters
+	filters := make([]string, 0, len(subscriptions))
+	c.filtersMutex.Lock()
+	for _, s := range subscriptions {
+		filters = append(filters, s.Topic)
+		c.filters[s.Topic]++
+	}
+	c.filtersMutex.Unlock()
+	subFuture.Data.Store(filtersKey, filters)
+
 	// store future
 	c.futureStore.Put(subscribe.ID, subFuture)
 
@@ -359,6 +604,11 @@ func (c *Client) Unsubscribe(topic string) (GenericFuture, error) {
 // UnsubscribeMultiple will send a UnsubscribePacket containing multiple
 // topics to unsubscribe. It will return a UnsubscribeFuture that gets completed
 // once a UnsubackPacket has been received.
+//
+// Filters are reference counted across the callback, channel and router
+// subscriptions of the client. A filter is only unsubscribed once it has been
+// unsubscribed as often as it has been subscribed. The future is completed
+// immediately if all topics are still used.
 func (c *Client) UnsubscribeMultiple(topics []string) (GenericFuture, error) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
@@ -368,9 +618,30 @@ func (c *Client) UnsubscribeMultiple(topics []string) (GenericFuture, error) {
 		return nil, ErrClientNotConnected
 	}
 
+	// release filters and get unused topics
+	var unused []string
+	c.filtersMutex.Lock()
+	for _, topic := range topics {
+		if c.filters[topic] > 1 {
+			c.filters[topic]--
+			continue
+		}
+
+		delete(c.filters, topic)
+		unused = append(unused, topic)
+	}
+	c.filtersMutex.Unlock()
+
+	// complete immediately if all topics are still used
+	if len(unused) == 0 {
+		unsubscribeFuture := future.New()
+		unsubscribeFuture.Complete()
+		return unsubscribeFuture, nil
+	}
+
 	// allocate packet
 	unsubscribe := packet.NewUnsubscribePacket()
-	unsubscribe.Topics = topics
+	unsubscribe.Topics = unused
 	unsubscribe.ID = c.Session.NextID()
 
 	// create future
@@ -388,6 +659,119 @@ func (c *Client) UnsubscribeMultiple(topics []string) (GenericFuture, error) {
 	return unsubscribeFuture, nil
 }
 
+// Reauthenticate will start a re-authentication using the configured
+// Authenticator. It will return a GenericFuture that gets completed once the
+// broker has accepted the authentication. If the authentication fails, the
+// broker closes the connection and the future gets canceled.
+func (c *Client) Reauthenticate() (GenericFuture, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// check if connected
+	if atomic.LoadUint32(&c.state) != clientConnected {
+		return nil, ErrClientNotConnected
+	}
+
+	// check authenticator
+	if c.config.Authenticator == nil {
+		return nil, ErrClientMissingAuthenticator
+	}
+
+	c.authMutex.Lock()
+
+	// check pending authentication
+	if c.authPending {
+		c.authMutex.Unlock()
+		return nil, ErrClientAlreadyAuthenticating
+	}
+
+	// start authentication
+	data, err := c.config.Authenticator.Start()
+	if err != nil {
+		c.authMutex.Unlock()
+		return nil, err
+	}
+
+	// create and store future
+	authFuture := future.New()
+	c.authFuture = authFuture
+	c.authPending = true
+	c.authMutex.Unlock()
+
+	// allocate packet
+	auth := packet.NewAuthPacket()
+	auth.ReasonCode = packet.ReAuthenticate
+	auth.Method = c.config.Authenticator.Method()
+	auth.Data = data
+
+	// send packet
+	err = c.send(auth, false)
+	if err != nil {
+		return nil, c.cleanup(err, false, false)
+	}
+
+	return authFuture, nil
+}
+
+// Acknowledge will send the acknowledgement for a QOS 1 or QOS 2 message that
+// has been received in manual acknowledgement mode. It will return
+// ErrMessageNotPending if the message has already been acknowledged or has been
+// received on a previous connection. The acknowledgement of QOS 0 messages is a
+// no-op.
+func (c *Client) Acknowledge(msg *packet.Message) error {
+	// check qos
+	if msg.QOS == 0 {
+		return nil
+	}
+
+	// get pending message
+	c.pendingMutex.Lock()
+	publish, ok := c.pending[msg]
+	delete(c.pending, msg)
+	c.pendingMutex.Unlock()
+	if !ok {
+		return ErrMessageNotPending
+	}
+
+	// check if connected
+	if atomic.LoadUint32(&c.state) != clientConnected {
+		return ErrClientNotConnected
+	}
+
+	return c.acknowledge(publish)
+}
+
+// sends the PubackPacket or PubrecPacket for a received message
+func (c *Client) acknowledge(publish *packet.PublishPacket) error {
+	// get message
+	msg := &publish.Message
+
+	// prepare puback or pubrec packet
+	var ack packet.GenericPacket
+	if msg.QOS == 1 {
+		puback := packet.NewPubackPacket()
+		puback.ID = publish.ID
+		ack = puback
+	} else {
+		pubrec := packet.NewPubrecPacket()
+		pubrec.ID = publish.ID
+		ack = pubrec
+
+		// overwrite stored PublishPacket with PubrecPacket
+		err := c.Session.SavePacket(session.Incoming, pubrec)
+		if err != nil {
+			return err
+		}
+	}
+
+	// send packet
+	span := c.startSpan("client.ack", msg)
+	err := c.send(ack, true)
+	span.Finish(err)
+
+	return err
+}
+
 // Disconnect will send a DisconnectPacket and close the connection.
 //
 // If a timeout is specified, the client will wait the specified amount of time
@@ -460,6 +844,16 @@ func (c *Client) processor() error {
 		}
 
 		if first {
+			// handle enhanced authentication
+			if auth, ok := pkt.(*packet.AuthPacket); ok {
+				err = c.processAuth(auth)
+				if err != nil {
+					return err // error has already been cleaned
+				}
+
+				continue
+			}
+
 			// get connack
 			connack, ok := pkt.(*packet.ConnackPacket)
 			if !ok {
@@ -485,13 +879,15 @@ func (c *Client) processor() error {
 		case *packet.PublishPacket:
 			err = c.processPublish(typedPkt)
 		case *packet.PubackPacket:
-			err = c.processPubackAndPubcomp(typedPkt.ID)
+			err = c.processPubackAndPubcomp(typedPkt.ID, typedPkt.ReasonCode)
 		case *packet.PubcompPacket:
-			err = c.processPubackAndPubcomp(typedPkt.ID)
+			err = c.processPubackAndPubcomp(typedPkt.ID, typedPkt.ReasonCode)
 		case *packet.PubrecPacket:
-			err = c.processPubrec(typedPkt.ID)
+			err = c.processPubrec(typedPkt.ID, typedPkt.ReasonCode)
 		case *packet.PubrelPacket:
 			err = c.processPubrel(typedPkt.ID)
+		case *packet.AuthPacket:
+			err = c.processAuth(typedPkt)
 		}
 
 		// return eventual error
@@ -508,6 +904,14 @@ func (c *Client) processConnack(connack *packet.ConnackPacket) error {
 		return nil // ignore wrongly sent ConnackPacket
 	}
 
+	// verify broker if the enhanced authentication succeeded
+	if connack.ReturnCode == packet.ConnectionAccepted && c.config.Authenticator != nil {
+		err := c.finishAuth(connack.AuthData)
+		if err != nil {
+			return c.die(err, true, false)
+		}
+	}
+
 	// set state
 	atomic.StoreUint32(&c.state, clientConnacked)
 
@@ -553,6 +957,59 @@ func (c *Client) processConnack(connack *packet.ConnackPacket) error {
 	return nil
 }
 
+// handle an incoming AuthPacket
+func (c *Client) processAuth(auth *packet.AuthPacket) error {
+	c.authMutex.Lock()
+
+	// check pending authentication
+	if !c.authPending {
+		c.authMutex.Unlock()
+		return nil // ignore a wrongly sent AuthPacket
+	}
+
+	// get authenticator
+	authenticator := c.config.Authenticator
+
+	// finish re-authentication
+	if auth.ReasonCode != packet.ContinueAuthentication {
+		reauth := c.authFuture != nil
+		c.authMutex.Unlock()
+
+		// the initial authentication is finished by the connack
+		if !reauth {
+			return c.die(ErrClientExpectedConnack, true, false)
+		}
+
+		err := c.finishAuth(auth.Data)
+		if err != nil {
+			return c.die(err, true, false)
+		}
+
+		return nil
+	}
+
+	// perform step
+	data, err := authenticator.Step(auth.Data)
+	c.authMutex.Unlock()
+	if err != nil {
+		return c.die(err, true, false)
+	}
+
+	// allocate packet
+	res := packet.NewAuthPacket()
+	res.ReasonCode = packet.ContinueAuthentication
+	res.Method = authenticator.Method()
+	res.Data = data
+
+	// send packet
+	err = c.send(res, false)
+	if err != nil {
+		return c.die(err, false, false)
+	}
+
+	return nil
+}
+
 // handle an incoming SubackPacket
 func (c *Client) processSuback(suback *packet.SubackPacket) error {
 	// remove packet from store
@@ -570,6 +1027,19 @@ func (c *Client) processSuback(suback *packet.SubackPacket) error {
 	// remove future from store
 	c.futureStore.Delete(suback.ID)
 
+	// store return codes
+	subscribeFuture.Data.Store(returnCodesKey, suback.ReturnCodes)
+
+	// release rejected filters
+	if filters, ok := subscribeFuture.Data.Load(filtersKey); ok {
+		c.release(filters.([]string), suback.ReturnCodes)
+	}
+
+	// remove rejected channel subscriptions
+	if sub, ok := subscribeFuture.Data.Load(subscriptionKey); ok {
+		sub.(*Subscription).reject(suback.ReturnCodes)
+	}
+
 	// validate subscriptions if requested
 	if c.config.ValidateSubs {
 		for _, code := range suback.ReturnCodes {
@@ -581,12 +1051,26 @@ func (c *Client) processSuback(suback *packet.SubackPacket) error {
 	}
 
 	// complete future
-	subscribeFuture.Data.Store(returnCodesKey, suback.ReturnCodes)
 	subscribeFuture.Complete()
 
 	return nil
 }
 
+// releases the filters that have been rejected by the broker
+func (c *Client) release(filters []string, codes []uint8) {
+	c.filtersMutex.Lock()
+	defer c.filtersMutex.Unlock()
+
+	for i, filter := range filters {
+		if i < len(codes) && codes[i] == packet.QOSFailure && c.filters[filter] > 0 {
+			c.filters[filter]--
+			if c.filters[filter] == 0 {
+				delete(c.filters, filter)
+			}
+		}
+	}
+}
+
 // handle an incoming UnsubackPacket
 func (c *Client) processUnsuback(unsuback *packet.UnsubackPacket) error {
 	// remove packet from store
@@ -612,34 +1096,16 @@ func (c *Client) processUnsuback(unsuback *packet.UnsubackPacket) error {
 
 // handle an incoming PublishPacket
 func (c *Client) processPublish(publish *packet.PublishPacket) error {
-	// call callback for unacknowledged and directly acknowledged messages
-	if publish.Message.QOS <= 1 {
-		if c.Callback != nil {
-			err := c.Callback(&publish.Message, nil)
-			if err != nil {
-				return c.die(err, true, true)
-			}
-		}
-	}
-
-	// handle qos 1 flow
-	if publish.Message.QOS == 1 {
-		// prepare puback packet
-		puback := packet.NewPubackPacket()
-		puback.ID = publish.ID
+	// start span and propagate it with the message
+	span := c.startSpan("client.receive_publish", &publish.Message)
+	publish.Message.UserProperties = tracing.Inject(span.SpanContext(), publish.Message.UserProperties)
 
-		// acknowledge qos 1 publish
-		err := c.send(puback, true)
-		if err != nil {
-			return c.die(err, false, false)
-		}
-	}
-
-	// handle qos 2 flow
-	if publish.Message.QOS == 2 {
+	// handle qos 2 flow unless acknowledged by workers or manually
+	if publish.Message.QOS == 2 && !c.ManualAck && c.queues == nil {
 		// store packet
 		err := c.Session.SavePacket(session.Incoming, publish)
 		if err != nil {
+			span.Finish(err)
 			return c.die(err, true, false)
 		}
 
@@ -648,17 +1114,105 @@ func (c *Client) processPublish(publish *packet.PublishPacket) error {
 		pubrec.ID = publish.ID
 
 		// acknowledge qos 2 publish
+		ackSpan := c.startSpan("client.ack", &publish.Message)
 		err = c.send(pubrec, true)
+		ackSpan.Finish(err)
 		if err != nil {
+			span.Finish(err)
 			return c.die(err, false, false)
 		}
+
+		// finish span
+		span.Finish(nil)
+
+		return nil
 	}
 
-	return nil
+	// store qos 2 publish until released and skip duplicates
+	if publish.Message.QOS == 2 {
+		duplicate, err := c.storePublish(publish)
+		if err != nil || duplicate {
+			span.Finish(err)
+			return err // error has already been cleaned
+		}
+	}
+
+	// await manual acknowledgement or acknowledgement by the workers
+	if publish.Message.QOS == 2 || (c.ManualAck && publish.Message.QOS > 0) {
+		c.pendingMutex.Lock()
+		c.pending[&publish.Message] = publish
+		c.pendingMutex.Unlock()
+	}
+
+	// dispatch unacknowledged and directly acknowledged messages
+	if c.queues != nil {
+		return c.dispatch(publish, span)
+	}
+
+	return c.handlePublish(publish, span)
+}
+
+// stores a QOS 2 publish that is acknowledged manually or by the workers and
+// returns whether it is a duplicate of a message that is pending or has
+// already been acknowledged
+func (c *Client) storePublish(publish *packet.PublishPacket) (bool, error) {
+	// check duplicate
+	if publish.Dup {
+		// get packet from store
+		pkt, err := c.Session.LookupPacket(session.Incoming, publish.ID)
+		if err != nil {
+			return false, c.die(err, true, false)
+		}
+
+		switch pkt.(type) {
+		case *packet.PubrecPacket:
+			// prepare pubrec packet
+			pubrec := packet.NewPubrecPacket()
+			pubrec.ID = publish.ID
+
+			// acknowledge again as the PubrecPacket might have been lost
+			err = c.send(pubrec, true)
+			if err != nil {
+				return false, c.die(err, false, false)
+			}
+
+			return true, nil
+		case *packet.PublishPacket:
+			// skip message if it is still pending
+			if c.isPending(publish.ID) {
+				return true, nil
+			}
+		}
+	}
+
+	// store packet
+	err := c.Session.SavePacket(session.Incoming, publish)
+	if err != nil {
+		return false, c.die(err, true, false)
+	}
+
+	return false, nil
+}
+
+// returns whether a QOS 2 message with the specified id awaits acknowledgement
+func (c *Client) isPending(id packet.ID) bool {
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	for _, publish := range c.pending {
+		if publish.ID == id && publish.Message.QOS == 2 {
+			return true
+		}
+	}
+
+	return false
 }
 
 // handle an incoming PubackPacket or PubcompPacket
-func (c *Client) processPubackAndPubcomp(id packet.ID) error {
+func (c *Client) processPubackAndPubcomp(id packet.ID, code byte) error {
+	// trace acknowledgement
+	c.traceAck(id)
+
 	// remove packet from store
 	err := c.Session.DeletePacket(session.Outgoing, id)
 	if err != nil {
@@ -671,8 +1225,12 @@ func (c *Client) processPubackAndPubcomp(id packet.ID) error {
 		return nil // ignore a wrongly sent PubackPacket or PubcompPacket
 	}
 
-	// complete future
-	publishFuture.Complete()
+	// cancel future if the broker reported a failure
+	if code >= 0x80 {
+		publishFuture.Cancel()
+	} else {
+		publishFuture.Complete()
+	}
 
 	// remove future from store
 	c.futureStore.Delete(id)
@@ -681,7 +1239,15 @@ func (c *Client) processPubackAndPubcomp(id packet.ID) error {
 }
 
 // handle an incoming PubrecPacket
-func (c *Client) processPubrec(id packet.ID) error {
+func (c *Client) processPubrec(id packet.ID, code byte) error {
+	// end flow if the broker reported a failure
+	if code >= 0x80 {
+		return c.processPubackAndPubcomp(id, code)
+	}
+
+	// trace acknowledgement
+	c.traceAck(id)
+
 	// prepare pubrel packet
 	pubrel := packet.NewPubrelPacket()
 	pubrel.ID = id
@@ -703,6 +1269,11 @@ func (c *Client) processPubrec(id packet.ID) error {
 
 // handle an incoming PubrelPacket
 func (c *Client) processPubrel(id packet.ID) error {
+	// complete manually or by the workers acknowledged message
+	if c.ManualAck || c.queues != nil {
+		return c.completePubrel(id)
+	}
+
 	// get packet from store
 	pkt, err := c.Session.LookupPacket(session.Incoming, id)
 	if err != nil {
@@ -715,20 +1286,80 @@ func (c *Client) processPubrel(id packet.ID) error {
 		return nil // ignore a wrongly sent PubrelPacket
 	}
 
+	return c.handlePublish(publish, nil)
+}
+
+// calls the callback with a received message and sends the acknowledgement
+func (c *Client) handlePublish(publish *packet.PublishPacket, span *tracing.Span) error {
+	// check manual acknowledgement
+	manual := c.ManualAck && publish.Message.QOS > 0
+
 	// call callback
-	if c.Callback != nil {
-		err = c.Callback(&publish.Message, nil)
+	if !c.deliver(&publish.Message) && c.Callback != nil {
+		err := c.Callback(&publish.Message, nil)
 		if err != nil {
+			span.Finish(err)
 			return c.die(err, true, true)
 		}
 	}
 
+	// skip acknowledgement
+	if manual {
+		span.Finish(nil)
+		return nil
+	}
+
+	// handle qos 1 flow
+	if publish.Message.QOS == 1 {
+		// prepare puback packet
+		puback := packet.NewPubackPacket()
+		puback.ID = publish.ID
+
+		// acknowledge qos 1 publish
+		ackSpan := c.startSpan("client.ack", &publish.Message)
+		err := c.send(puback, true)
+		ackSpan.Finish(err)
+		if err != nil {
+			span.Finish(err)
+			return c.die(err, false, false)
+		}
+	}
+
+	// acknowledge qos 2 publish processed by the workers
+	if publish.Message.QOS == 2 && c.queues != nil {
+		// forget pending message
+		c.pendingMutex.Lock()
+		delete(c.pending, &publish.Message)
+		c.pendingMutex.Unlock()
+
+		// acknowledge message
+		err := c.acknowledge(publish)
+		if err != nil {
+			span.Finish(err)
+			return c.die(err, false, false)
+		}
+	} else if publish.Message.QOS == 2 {
+		// complete released message
+		err := c.completePubrel(publish.ID)
+		if err != nil {
+			return err // error has already been cleaned
+		}
+	}
+
+	// finish span
+	span.Finish(nil)
+
+	return nil
+}
+
+// sends the PubcompPacket for a released message
+func (c *Client) completePubrel(id packet.ID) error {
 	// prepare pubcomp packet
 	pubcomp := packet.NewPubcompPacket()
-	pubcomp.ID = publish.ID
+	pubcomp.ID = id
 
 	// acknowledge PublishPacket
-	err = c.send(pubcomp, true)
+	err := c.send(pubcomp, true)
 	if err != nil {
 		return c.die(err, false, false)
 	}
@@ -742,6 +1373,45 @@ func (c *Client) processPubrel(id packet.ID) error {
 	return nil
 }
 
+// queues a received message for the worker responsible for its topic
+func (c *Client) dispatch(publish *packet.PublishPacket, span *tracing.Span) error {
+	// select worker
+	hash := fnv.New32a()
+	hash.Write([]byte(publish.Message.Topic))
+	queue := c.queues[hash.Sum32()%uint32(len(c.queues))]
+
+	// queue message
+	select {
+	case queue <- delivery{publish: publish, span: span}:
+		return nil
+	case <-c.tomb.Dying():
+		return tomb.ErrDying
+	}
+}
+
+/* worker goroutines */
+
+// a message queued for a worker
+type delivery struct {
+	publish *packet.PublishPacket
+	span    *tracing.Span
+}
+
+// processes the queued messages in order
+func (c *Client) worker(queue chan delivery) error {
+	for {
+		select {
+		case <-c.tomb.Dying():
+			return tomb.ErrDying
+		case d := <-queue:
+			err := c.handlePublish(d.publish, d.span)
+			if err != nil {
+				return err // error has already been cleaned
+			}
+		}
+	}
+}
+
 /* pinger goroutine */
 
 // manages the sending of ping packets to keep the connection alive
@@ -783,6 +1453,51 @@ func (c *Client) pinger() error {
 
 /* helpers */
 
+// begins the initial enhanced authentication using the connect packet
+func (c *Client) beginAuth(connect *packet.ConnectPacket) error {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+
+	// start authentication
+	data, err := c.config.Authenticator.Start()
+	if err != nil {
+		return err
+	}
+
+	// set method and data
+	connect.Version = packet.Version5
+	connect.AuthMethod = c.config.Authenticator.Method()
+	connect.AuthData = data
+
+	// set pending
+	c.authPending = true
+
+	return nil
+}
+
+// verifies the broker and completes a pending re-authentication
+func (c *Client) finishAuth(data []byte) error {
+	c.authMutex.Lock()
+	defer c.authMutex.Unlock()
+
+	// verify broker
+	err := c.config.Authenticator.Finish(data)
+	if err != nil {
+		return err
+	}
+
+	// finish authentication
+	c.authPending = false
+
+	// complete future
+	if c.authFuture != nil {
+		c.authFuture.Complete()
+		c.authFuture = nil
+	}
+
+	return nil
+}
+
 // sends packet and updates lastSend
 func (c *Client) send(pkt packet.GenericPacket, buffered bool) error {
 	// reset keep alive tracker
@@ -807,6 +1522,40 @@ func (c *Client) send(pkt packet.GenericPacket, buffered bool) error {
 	return nil
 }
 
+// start a span that is a child of the span propagated with the message
+func (c *Client) startSpan(name string, msg *packet.Message) *tracing.Span {
+	// check tracer
+	if c.Tracer == nil {
+		return nil
+	}
+
+	// start span
+	span := c.Tracer.Start(name, tracing.Extract(msg.UserProperties))
+	span.SetAttribute("mqtt.topic", msg.Topic)
+	span.SetAttribute("mqtt.qos", strconv.Itoa(int(msg.QOS)))
+
+	return span
+}
+
+// trace the acknowledgement of a published message
+func (c *Client) traceAck(id packet.ID) {
+	// check tracer
+	if c.Tracer == nil {
+		return
+	}
+
+	// get stored packet
+	pkt, err := c.Session.LookupPacket(session.Outgoing, id)
+	if err != nil {
+		return
+	}
+
+	// trace acknowledgement of publish packets
+	if publish, ok := pkt.(*packet.PublishPacket); ok {
+		c.startSpan("client.receive_ack", &publish.Message).Finish(nil)
+	}
+}
+
 // will try to cleanup as many resources as possible
 func (c *Client) cleanup(err error, doClose bool, possiblyClosed bool) error {
 	// cancel connect future if appropriate
@@ -836,6 +1585,22 @@ func (c *Client) cleanup(err error, doClose bool, possiblyClosed bool) error {
 	// cancel all futures
 	c.futureStore.Clear()
 
+	// cancel pending re-authentication
+	c.authMutex.Lock()
+	if c.authFuture != nil {
+		c.authFuture.Cancel()
+		c.authFuture = nil
+	}
+	c.authMutex.Unlock()
+
+	// close channel subscriptions
+	c.closeChannels()
+
+	// forget pending acknowledgements
+	c.pendingMutex.Lock()
+	c.pending = make(map[*packet.Message]*packet.PublishPacket)
+	c.pendingMutex.Unlock()
+
 	return err
 }
 
@@ -1,9 +1,14 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -11,6 +16,7 @@ import (
 	"github.com/256dpi/gomqtt/client/future"
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/session"
+	"github.com/256dpi/gomqtt/tracing"
 	"github.com/256dpi/gomqtt/transport"
 	"github.com/256dpi/gomqtt/transport/flow"
 	"github.com/stretchr/testify/assert"
@@ -486,6 +492,544 @@ func TestClientPublishSubscribeQOS1(t *testing.T) {
 	assert.Equal(t, 0, len(out))
 }
 
+func TestClientContext(t *testing.T) {
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 1}}
+	subscribe.ID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{1}
+	suback.ID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+	publish.Message.QOS = 1
+	publish.ID = 2
+
+	puback := packet.NewPubackPacket()
+	puback.ID = 2
+
+	acked := make(chan struct{})
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(subscribe).
+		Send(suback).
+		Receive(publish).
+		Delay(50 * time.Millisecond).
+		Send(puback).
+		Run(func() { close(acked) }).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Callback = errorCallback(t)
+
+	connectFuture, err := c.ConnectContext(context.Background(), NewConfig("tcp://localhost:"+port))
+	assert.NoError(t, err)
+	assert.Equal(t, packet.ConnectionAccepted, connectFuture.ReturnCode())
+
+	subscribeFuture, err := c.SubscribeContext(context.Background(), "test", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint8{1}, subscribeFuture.ReturnCodes())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	publishFuture, err := c.PublishContext(ctx, "test", []byte("test"), 1, false)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.NotNil(t, publishFuture)
+
+	out, err := c.Session.AllPackets(session.Outgoing)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(out))
+
+	safeReceive(acked)
+	assert.NoError(t, publishFuture.Wait(10*time.Second))
+
+	publishFuture, err = c.PublishContext(ctx, "test", []byte("test"), 1, false)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, publishFuture)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	out, err = c.Session.AllPackets(session.Outgoing)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(out))
+}
+
+func TestClientConnectContextTimeout(t *testing.T) {
+	broker := flow.New().
+		Receive(connectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	connectFuture, err := c.ConnectContext(ctx, NewConfig("tcp://localhost:"+port))
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, connectFuture)
+
+	safeReceive(done)
+}
+
+func TestClientConnectContextDenied(t *testing.T) {
+	connack := connackPacket()
+	connack.ReturnCode = packet.ErrNotAuthorized
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connack).
+		Close()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.Equal(t, ErrClientConnectionDenied, err)
+		return nil
+	}
+
+	connectFuture, err := c.ConnectContext(context.Background(), NewConfig("tcp://localhost:"+port))
+	assert.Equal(t, ErrClientConnectionDenied, err)
+	assert.Equal(t, packet.ErrNotAuthorized, connectFuture.ReturnCode())
+
+	safeReceive(done)
+}
+
+func TestClientWorkers(t *testing.T) {
+	slow := packet.NewPublishPacket()
+	slow.Message.Topic = "slow"
+	slow.Message.QOS = 1
+	slow.ID = 1
+
+	fast := packet.NewPublishPacket()
+	fast.Message.Topic = "fast"
+	fast.Message.QOS = 2
+	fast.ID = 2
+
+	pubrec := packet.NewPubrecPacket()
+	pubrec.ID = 2
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.ID = 2
+
+	pubcomp := packet.NewPubcompPacket()
+	pubcomp.ID = 2
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "reply"
+	publish.Message.QOS = 1
+	publish.ID = 1
+
+	puback := packet.NewPubackPacket()
+	puback.ID = 1
+
+	released := make(chan struct{})
+	wait := make(chan struct{})
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Send(slow).
+		Send(fast).
+		Receive(pubrec).
+		Send(pubrel).
+		Receive(pubcomp).
+		Run(func() { close(released) }).
+		Receive(publish).
+		Send(puback).
+		Receive(puback).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Workers = 2
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+
+		// wait until the fast message has been completed
+		if msg.Topic == "slow" {
+			safeReceive(released)
+
+			// waiting on a future does not deadlock the client
+			publishFuture, err := c.Publish("reply", nil, 1, false)
+			assert.NoError(t, err)
+			assert.NoError(t, publishFuture.Wait(1*time.Second))
+			close(wait)
+		}
+
+		return nil
+	}
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	safeReceive(wait)
+	time.Sleep(10 * time.Millisecond)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	in, err := c.Session.AllPackets(session.Incoming)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(in))
+}
+
+func TestClientWorkersOrder(t *testing.T) {
+	publish1 := packet.NewPublishPacket()
+	publish1.Message.Topic = "test"
+	publish1.Message.Payload = []byte("1")
+	publish1.Message.QOS = 2
+	publish1.ID = 1
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message.Topic = "test"
+	publish2.Message.Payload = []byte("2")
+	publish2.Message.QOS = 1
+	publish2.ID = 2
+
+	pubrec := packet.NewPubrecPacket()
+	pubrec.ID = 1
+
+	puback := packet.NewPubackPacket()
+	puback.ID = 2
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.ID = 1
+
+	pubcomp := packet.NewPubcompPacket()
+	pubcomp.ID = 1
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Send(publish1).
+		Send(publish2).
+		Receive(pubrec).
+		Receive(puback).
+		Send(pubrel).
+		Receive(pubcomp).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	var mutex sync.Mutex
+	var payloads []string
+
+	c := New()
+	c.Workers = 2
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+
+		// delay first message
+		if string(msg.Payload) == "1" {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		mutex.Lock()
+		payloads = append(payloads, string(msg.Payload))
+		mutex.Unlock()
+
+		return nil
+	}
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	time.Sleep(50 * time.Millisecond)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	mutex.Lock()
+	assert.Equal(t, []string{"1", "2"}, payloads)
+	mutex.Unlock()
+
+	in, err := c.Session.AllPackets(session.Incoming)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(in))
+}
+
+func TestClientManualAck(t *testing.T) {
+	publish1 := packet.NewPublishPacket()
+	publish1.Message.Topic = "test"
+	publish1.Message.QOS = 1
+	publish1.ID = 1
+
+	puback := packet.NewPubackPacket()
+	puback.ID = 1
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message.Topic = "test"
+	publish2.Message.QOS = 2
+	publish2.ID = 2
+
+	pubrec := packet.NewPubrecPacket()
+	pubrec.ID = 2
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.ID = 2
+
+	pubcomp := packet.NewPubcompPacket()
+	pubcomp.ID = 2
+
+	released := make(chan struct{})
+	completed := make(chan struct{})
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Send(publish1).
+		Send(publish2).
+		Receive(pubrec).
+		Send(pubrel).
+		Receive(pubcomp).
+		Run(func() { close(released) }).
+		Receive(puback).
+		Run(func() { close(completed) }).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	received := make(chan *packet.Message, 2)
+
+	c := New()
+	c.ManualAck = true
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		received <- msg
+		return nil
+	}
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	msg1 := <-received
+	msg2 := <-received
+
+	assert.NoError(t, c.Acknowledge(msg2))
+	assert.Equal(t, ErrMessageNotPending, c.Acknowledge(msg2))
+
+	safeReceive(released)
+
+	assert.NoError(t, c.Acknowledge(msg1))
+	assert.NoError(t, c.Acknowledge(&packet.Message{Topic: "test"}))
+
+	safeReceive(completed)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
+
+func TestClientManualAckDuplicates(t *testing.T) {
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.QOS = 2
+	publish.ID = 1
+
+	duplicate := packet.NewPublishPacket()
+	duplicate.Message.Topic = "test"
+	duplicate.Message.QOS = 2
+	duplicate.Dup = true
+	duplicate.ID = 1
+
+	pubrec := packet.NewPubrecPacket()
+	pubrec.ID = 1
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.ID = 1
+
+	pubcomp := packet.NewPubcompPacket()
+	pubcomp.ID = 1
+
+	wait := make(chan struct{})
+	acked := make(chan struct{})
+	completed := make(chan struct{})
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Send(publish).
+		Send(duplicate).
+		Run(func() { close(wait) }).
+		Receive(pubrec).
+		Run(func() { close(acked) }).
+		Send(duplicate).
+		Receive(pubrec).
+		Send(pubrel).
+		Receive(pubcomp).
+		Run(func() { close(completed) }).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	received := make(chan *packet.Message, 2)
+
+	c := New()
+	c.ManualAck = true
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		received <- msg
+		return nil
+	}
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	msg := <-received
+
+	safeReceive(wait)
+	time.Sleep(10 * time.Millisecond)
+
+	in, err := c.Session.AllPackets(session.Incoming)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(in))
+
+	assert.NoError(t, c.Acknowledge(msg))
+
+	safeReceive(acked)
+	safeReceive(completed)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	assert.Len(t, received, 0)
+
+	in, err = c.Session.AllPackets(session.Incoming)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(in))
+}
+
+func TestClientManualAckConnectionLost(t *testing.T) {
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.QOS = 1
+	publish.ID = 1
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Send(publish).
+		Close()
+
+	done, port := fakeBroker(t, broker)
+
+	received := make(chan *packet.Message, 1)
+	lost := make(chan struct{})
+
+	c := New()
+	c.ManualAck = true
+	c.Callback = func(msg *packet.Message, err error) error {
+		if err != nil {
+			close(lost)
+			return nil
+		}
+
+		received <- msg
+		return nil
+	}
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	msg := <-received
+
+	safeReceive(lost)
+	safeReceive(done)
+
+	assert.Equal(t, ErrMessageNotPending, c.Acknowledge(msg))
+}
+
+func TestClientTracing(t *testing.T) {
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+	publish.Message.QOS = 1
+	publish.ID = 1
+
+	puback := packet.NewPubackPacket()
+	puback.ID = 1
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(publish).
+		Send(puback).
+		Send(publish).
+		Receive(puback).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	wait := make(chan struct{})
+
+	exporter := tracing.NewMemoryExporter()
+
+	c := New()
+	c.Tracer = tracing.NewTracer(exporter)
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		assert.True(t, tracing.Extract(msg.UserProperties).IsValid())
+		close(wait)
+		return nil
+	}
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	publishFuture, err := c.Publish("test", []byte("test"), 1, false)
+	assert.NoError(t, err)
+	assert.NoError(t, publishFuture.Wait(1*time.Second))
+
+	safeReceive(wait)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	spans := exporter.Spans()
+	assert.Len(t, spans, 4)
+	assert.Equal(t, "client.publish", spans[0].Name)
+	assert.Equal(t, "client.receive_ack", spans[1].Name)
+	assert.Equal(t, spans[0].SpanContext(), spans[1].Parent)
+	assert.Equal(t, "client.ack", spans[2].Name)
+	assert.Equal(t, "client.receive_publish", spans[3].Name)
+	assert.Equal(t, spans[3].SpanContext(), spans[2].Parent)
+}
+
 func TestClientPublishSubscribeQOS2(t *testing.T) {
 	subscribe := packet.NewSubscribePacket()
 	subscribe.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 2}}
@@ -753,7 +1297,7 @@ func TestClientInvalidPackets(t *testing.T) {
 	assert.NoError(t, err)
 
 	// missing future
-	err = c.processPubackAndPubcomp(0)
+	err = c.processPubackAndPubcomp(0, 0)
 	assert.NoError(t, err)
 }
 
@@ -808,6 +1352,102 @@ func TestClientSessionResumption(t *testing.T) {
 	assert.Equal(t, 0, len(pkts))
 }
 
+func TestClientFileSessionResumption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "session")
+
+	connect := connectPacket()
+	connect.ClientID = "test"
+	connect.CleanSession = false
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+	publish.Message.QOS = 1
+	publish.ID = 1
+
+	broker := flow.New().
+		Receive(connect).
+		Send(connackPacket()).
+		Receive(publish).
+		Close()
+
+	done, port := fakeBroker(t, broker)
+
+	wait := make(chan struct{})
+
+	fileSession, err := session.NewFileSession(path)
+	assert.NoError(t, err)
+
+	c := New()
+	c.Session = fileSession
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.Error(t, err)
+		close(wait)
+		return nil
+	}
+
+	config := NewConfig("tcp://localhost:" + port)
+	config.ClientID = "test"
+	config.CleanSession = false
+
+	connectFuture, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	publishFuture, err := c.Publish("test", []byte("test"), 1, false)
+	assert.NoError(t, err)
+	assert.NotNil(t, publishFuture)
+
+	safeReceive(wait)
+	safeReceive(done)
+
+	// simulate restart
+	assert.NoError(t, fileSession.Close())
+
+	publish.Dup = true
+
+	puback := packet.NewPubackPacket()
+	puback.ID = 1
+
+	broker = flow.New().
+		Receive(connect).
+		Send(connackPacket()).
+		Receive(publish).
+		Send(puback).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port = fakeBroker(t, broker)
+
+	fileSession, err = session.NewFileSession(path)
+	assert.NoError(t, err)
+
+	c = New()
+	c.Session = fileSession
+	c.Callback = errorCallback(t)
+
+	config.BrokerURL = "tcp://localhost:" + port
+	connectFuture, err = c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	time.Sleep(20 * time.Millisecond)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+
+	pkts, err := fileSession.AllPackets(session.Outgoing)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(pkts))
+	assert.NoError(t, fileSession.Close())
+}
+
 func TestClientUnexpectedClose(t *testing.T) {
 	broker := flow.New().
 		Receive(connectPacket()).
@@ -986,6 +1626,144 @@ func TestClientLogger(t *testing.T) {
 	assert.Equal(t, uint32(8), counter)
 }
 
+type testAuthenticator struct {
+	finish error
+}
+
+func (a *testAuthenticator) Method() string {
+	return "test"
+}
+
+func (a *testAuthenticator) Start() ([]byte, error) {
+	return []byte("start"), nil
+}
+
+func (a *testAuthenticator) Step(data []byte) ([]byte, error) {
+	return append([]byte("step-"), data...), nil
+}
+
+func (a *testAuthenticator) Finish(data []byte) error {
+	return a.finish
+}
+
+func authPacket(code packet.AuthCode, data string) *packet.AuthPacket {
+	pkt := packet.NewAuthPacket()
+	pkt.ReasonCode = code
+	pkt.Method = "test"
+	pkt.Data = []byte(data)
+	return pkt
+}
+
+func TestClientEnhancedAuth(t *testing.T) {
+	connect := connectPacket()
+	connect.Version = packet.Version5
+	connect.AuthMethod = "test"
+	connect.AuthData = []byte("start")
+
+	connack := connackPacket()
+	connack.AuthMethod = "test"
+	connack.AuthData = []byte("done")
+
+	disconnect := disconnectPacket()
+	disconnect.Version = packet.Version5
+
+	broker := flow.New().
+		Receive(connect).
+		Send(authPacket(packet.ContinueAuthentication, "challenge")).
+		Receive(authPacket(packet.ContinueAuthentication, "step-challenge")).
+		Send(connack).
+		Receive(authPacket(packet.ReAuthenticate, "start")).
+		Send(authPacket(packet.ContinueAuthentication, "again")).
+		Receive(authPacket(packet.ContinueAuthentication, "step-again")).
+		Send(authPacket(packet.AuthSuccess, "done")).
+		Receive(disconnect).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Callback = errorCallback(t)
+
+	config := NewConfig("tcp://localhost:" + port)
+	config.Authenticator = &testAuthenticator{}
+
+	connectFuture, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+	assert.Equal(t, packet.ConnectionAccepted, connectFuture.ReturnCode())
+
+	authFuture, err := c.Reauthenticate()
+	assert.NoError(t, err)
+	assert.NoError(t, authFuture.Wait(1*time.Second))
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
+
+func TestClientEnhancedAuthInvalidBroker(t *testing.T) {
+	connect := connectPacket()
+	connect.Version = packet.Version5
+
+	connack := connackPacket()
+	connack.AuthMethod = "test"
+	connack.AuthData = []byte("invalid")
+
+	broker := flow.New().
+		Receive(connect).
+		Send(connack).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	wait := make(chan struct{})
+	invalid := errors.New("invalid")
+
+	c := New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.Equal(t, invalid, err)
+		close(wait)
+		return nil
+	}
+
+	config := NewConfig("tcp://localhost:" + port)
+	config.Authenticator = &testAuthenticator{finish: invalid}
+
+	connectFuture, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.Equal(t, future.ErrCanceled, connectFuture.Wait(1*time.Second))
+
+	safeReceive(wait)
+	safeReceive(done)
+}
+
+func TestClientReauthenticateMissingAuthenticator(t *testing.T) {
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Callback = errorCallback(t)
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	authFuture, err := c.Reauthenticate()
+	assert.Equal(t, ErrClientMissingAuthenticator, err)
+	assert.Nil(t, authFuture)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
+
 func BenchmarkClientPublish(b *testing.B) {
 	c := New()
 
@@ -1011,3 +1789,66 @@ func BenchmarkClientPublish(b *testing.B) {
 		panic(err)
 	}
 }
+
+func TestClientPublishFailure(t *testing.T) {
+	connect := connectPacket()
+	connect.Version = packet.Version5
+
+	publish1 := packet.NewPublishPacket()
+	publish1.Message = packet.Message{Topic: "test", QOS: 1}
+	publish1.ID = 1
+
+	puback := packet.NewPubackPacket()
+	puback.ReasonCode = 0x87
+	puback.ID = 1
+
+	publish2 := packet.NewPublishPacket()
+	publish2.Message = packet.Message{Topic: "test", QOS: 2}
+	publish2.ID = 2
+
+	pubrec := packet.NewPubrecPacket()
+	pubrec.ReasonCode = 0x87
+	pubrec.ID = 2
+
+	disconnect := disconnectPacket()
+	disconnect.Version = packet.Version5
+
+	broker := flow.New().
+		Receive(connect).
+		Send(connackPacket()).
+		Receive(publish1).
+		Send(puback).
+		Receive(publish2).
+		Send(pubrec).
+		Receive(disconnect).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Callback = errorCallback(t)
+
+	config := NewConfig("tcp://localhost:" + port)
+	config.ProtocolVersion = packet.Version5
+
+	connectFuture, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	publishFuture, err := c.Publish("test", nil, 1, false)
+	assert.NoError(t, err)
+	assert.Equal(t, future.ErrCanceled, publishFuture.Wait(1*time.Second))
+
+	publishFuture, err = c.Publish("test", nil, 2, false)
+	assert.NoError(t, err)
+	assert.Equal(t, future.ErrCanceled, publishFuture.Wait(1*time.Second))
+
+	out, err := c.Session.AllPackets(session.Outgoing)
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
@@ -1,6 +1,8 @@
 package client
 
 import (
+	"time"
+
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/transport"
 )
@@ -14,6 +16,53 @@ type Config struct {
 	KeepAlive    string
 	WillMessage  *packet.Message
 	ValidateSubs bool
+
+	// BrokerURLs can be set to a list of brokers that is used by a Service
+	// instead of the BrokerURL. The brokers are tried in the order defined by
+	// the Failover strategy. A Client connects to the first broker if no
+	// BrokerURL is set.
+	BrokerURLs []string
+
+	// The Failover strategy used to select the next broker.
+	Failover Failover
+
+	// The FailbackInterval defines how long a failed broker is skipped and
+	// how often a Service connected to a lower priority broker checks whether
+	// a higher priority broker is reachable again. A zero interval disables
+	// failbacks and skips failed brokers until all brokers have failed.
+	FailbackInterval time.Duration
+
+	// The ProtocolVersion can be set to packet.Version5 to connect using MQTT
+	// 5. This is required to exchange the user properties and subscription
+	// identifiers of messages with the broker. Defaults to MQTT 3.1.1.
+	ProtocolVersion byte
+
+	// The SessionExpiry is sent to brokers when connecting using MQTT 5 to
+	// request that a persistent session expires after the interval. The
+	// interval is rounded down to seconds.
+	SessionExpiry time.Duration
+
+	// The Authenticator is used to perform an enhanced authentication before
+	// connecting and to re-authenticate using Client.Reauthenticate.
+	Authenticator Authenticator
+}
+
+// An Authenticator performs the client side of an enhanced authentication.
+// A scram.Client can be used to authenticate using SCRAM-SHA-256.
+type Authenticator interface {
+	// Method should return the name of the authentication method.
+	Method() string
+
+	// Start should begin a new authentication and return the initial data.
+	Start() ([]byte, error)
+
+	// Step should process the data received from the broker and return the
+	// data that is sent back to the broker.
+	Step(data []byte) ([]byte, error)
+
+	// Finish should verify the data received from the broker with the
+	// successful completion of the authentication.
+	Finish(data []byte) error
 }
 
 // NewConfig creates a new Config using the specified URL.
@@ -26,6 +75,14 @@ func NewConfig(url string) *Config {
 	}
 }
 
+// NewConfigWithBrokers creates a new Config using the specified broker URLs.
+func NewConfigWithBrokers(urls ...string) *Config {
+	config := NewConfig("")
+	config.BrokerURLs = urls
+	config.FailbackInterval = time.Minute
+	return config
+}
+
 // NewConfigWithClientID creates a new Config using the specified URL and client ID.
 func NewConfigWithClientID(url, id string) *Config {
 	config := NewConfig(url)
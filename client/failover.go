@@ -0,0 +1,210 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/transport"
+)
+
+// A Failover strategy defines the order in which a Service tries the brokers
+// configured using the BrokerURLs of a Config.
+type Failover int
+
+const (
+	// Priority tries the brokers in the configured order. Brokers that failed
+	// are skipped until the FailbackInterval has passed. A Service that is
+	// connected to a lower priority broker periodically checks whether a
+	// higher priority broker is reachable again and fails back to it.
+	Priority Failover = iota
+
+	// RoundRobin tries the next broker after every failed connection attempt
+	// or lost connection.
+	RoundRobin
+)
+
+// tracks the health of the configured brokers
+type brokerList struct {
+	urls     []string
+	strategy Failover
+	interval time.Duration
+	failures []time.Time
+	current  int
+	mutex    sync.Mutex
+}
+
+// returns a broker list for the specified config
+func newBrokerList(config *Config) *brokerList {
+	// get urls
+	urls := config.BrokerURLs
+	if len(urls) == 0 {
+		urls = []string{config.BrokerURL}
+	}
+
+	return &brokerList{
+		urls:     urls,
+		strategy: config.Failover,
+		interval: config.FailbackInterval,
+		failures: make([]time.Time, len(urls)),
+	}
+}
+
+// returns the index of the broker that should be tried next
+func (l *brokerList) next(now time.Time) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// return current broker if round robin is used
+	if l.strategy == RoundRobin {
+		return l.current
+	}
+
+	// select the first healthy broker or the broker that failed first
+	oldest := 0
+	for i, failure := range l.failures {
+		if l.healthy(i, now) {
+			l.current = i
+			return i
+		}
+
+		if failure.Before(l.failures[oldest]) {
+			oldest = i
+		}
+	}
+
+	l.current = oldest
+
+	return oldest
+}
+
+// marks the broker as failed
+func (l *brokerList) failed(i int, now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// record failure
+	l.failures[i] = now
+
+	// advance to the next broker if round robin is used
+	if l.strategy == RoundRobin {
+		l.current = (i + 1) % len(l.urls)
+	}
+}
+
+// marks the broker as healthy
+func (l *brokerList) recovered(i int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.failures[i] = time.Time{}
+}
+
+// will dial the broker of the config within the connect timeout
+func (s *Service) dial(ctx context.Context, config *Config) (transport.Conn, error) {
+	// apply connect timeout
+	if s.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.ConnectTimeout)
+		defer cancel()
+	}
+
+	// dial broker
+	if config.Dialer != nil {
+		return config.Dialer.DialContext(ctx, config.BrokerURL)
+	}
+
+	return transport.DialContext(ctx, config.BrokerURL)
+}
+
+// returns the higher priority brokers that should be checked for a failback
+func (l *brokerList) candidates(i int) []int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// check strategy and interval
+	if l.strategy != Priority || l.interval <= 0 {
+		return nil
+	}
+
+	// collect brokers
+	var list []int
+	for j := 0; j < i; j++ {
+		list = append(list, j)
+	}
+
+	return list
+}
+
+// returns whether the broker has not failed within the failback interval
+func (l *brokerList) healthy(i int, now time.Time) bool {
+	// check failure
+	if l.failures[i].IsZero() {
+		return true
+	}
+
+	return l.interval > 0 && now.Sub(l.failures[i]) >= l.interval
+}
+
+// will periodically check whether a higher priority broker is reachable again
+// and close the failback channel once one has recovered
+func (s *Service) prober(index int, failback, stop chan struct{}) {
+	// check brokers
+	if len(s.brokers.candidates(index)) == 0 {
+		return
+	}
+
+	// create ticker
+	ticker := time.NewTicker(s.config.FailbackInterval)
+	defer ticker.Stop()
+
+	// prepare context that is canceled when the prober is stopped or the
+	// service is stopping
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+		case <-s.tomb.Dying():
+		case <-ctx.Done():
+		}
+
+		cancel()
+	}()
+
+	for {
+		// wait for next check
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		// check brokers
+		for _, j := range s.brokers.candidates(index) {
+			// prepare config
+			config, err := s.prepare(s.brokers.urls[j])
+			if err != nil {
+				continue
+			}
+
+			// attempt to dial broker
+			conn, err := s.dial(ctx, config)
+			if err != nil {
+				continue
+			}
+
+			// close connection
+			conn.Close()
+
+			s.log(fmt.Sprintf("Failback: %s", s.brokers.urls[j]))
+
+			// mark broker and signal failback
+			s.brokers.recovered(j)
+			close(failback)
+
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrokerListPriority(t *testing.T) {
+	config := NewConfigWithBrokers("a", "b", "c")
+	assert.Equal(t, time.Minute, config.FailbackInterval)
+
+	list := newBrokerList(config)
+	now := time.Now()
+
+	assert.Equal(t, 0, list.next(now))
+
+	list.failed(0, now)
+	assert.Equal(t, 1, list.next(now))
+
+	list.failed(1, now.Add(time.Second))
+	assert.Equal(t, 2, list.next(now.Add(time.Second)))
+	assert.Equal(t, []int{0, 1}, list.candidates(2))
+
+	list.failed(2, now.Add(2*time.Second))
+	assert.Equal(t, 0, list.next(now.Add(2*time.Second)))
+
+	assert.Equal(t, 0, list.next(now.Add(time.Minute)))
+
+	list.failed(0, now.Add(time.Minute))
+	assert.Equal(t, 1, list.next(now.Add(time.Minute)))
+
+	list.recovered(2)
+	assert.Equal(t, 2, list.next(now.Add(time.Minute)))
+
+	config.FailbackInterval = 0
+	list = newBrokerList(config)
+
+	list.failed(0, now)
+	assert.Equal(t, 1, list.next(now.Add(time.Hour)))
+	assert.Empty(t, list.candidates(1))
+}
+
+func TestBrokerListRoundRobin(t *testing.T) {
+	config := NewConfigWithBrokers("a", "b")
+	config.Failover = RoundRobin
+
+	list := newBrokerList(config)
+	now := time.Now()
+
+	assert.Equal(t, 0, list.next(now))
+	assert.Equal(t, 0, list.next(now))
+
+	list.failed(0, now)
+	assert.Equal(t, 1, list.next(now))
+
+	list.failed(1, now)
+	assert.Equal(t, 0, list.next(now))
+	assert.Empty(t, list.candidates(1))
+}
+
+func TestBrokerListSingle(t *testing.T) {
+	list := newBrokerList(NewConfig("a"))
+	assert.Equal(t, []string{"a"}, list.urls)
+
+	list.failed(0, time.Now())
+	assert.Equal(t, 0, list.next(time.Now()))
+}
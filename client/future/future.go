@@ -2,6 +2,7 @@
 package future
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
@@ -58,6 +59,21 @@ func (f *Future) Wait(timeout time.Duration) error {
 	}
 }
 
+// WaitContext will wait until the future has been completed or canceled or
+// the context is done. It will return the context error in the latter case.
+// Returning early does not affect the future, which may still be completed
+// or canceled afterwards.
+func (f *Future) WaitContext(ctx context.Context) error {
+	select {
+	case <-f.completeChannel:
+		return nil
+	case <-f.cancelChannel:
+		return ErrCanceled
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Complete will complete the future.
 func (f *Future) Complete() {
 	// return if future has already been canceled
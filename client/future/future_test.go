@@ -1,6 +1,7 @@
 package future
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -54,6 +55,21 @@ func TestFutureTimeout(t *testing.T) {
 	assert.Equal(t, ErrTimeout, f.Wait(1*time.Millisecond))
 }
 
+func TestFutureWaitContext(t *testing.T) {
+	f := New()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, f.WaitContext(ctx))
+
+	f.Complete()
+	assert.NoError(t, f.WaitContext(context.Background()))
+
+	f = New()
+	f.Cancel()
+	assert.Equal(t, ErrCanceled, f.WaitContext(context.Background()))
+}
+
 func TestFutureBindBefore(t *testing.T) {
 	done := make(chan struct{})
 
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"time"
 
 	"github.com/256dpi/gomqtt/client/future"
@@ -15,6 +16,13 @@ type GenericFuture interface {
 	//
 	// Note: Wait will not return any Client related errors.
 	Wait(timeout time.Duration) error
+
+	// WaitContext will block until the future is completed or canceled or the
+	// context is done. It will return future.ErrCanceled if the future gets
+	// canceled and the context error if the context is done.
+	//
+	// Note: WaitContext will not return any Client related errors.
+	WaitContext(ctx context.Context) error
 }
 
 // A ConnectFuture is returned by the connect method.
@@ -32,7 +40,9 @@ type ConnectFuture interface {
 type SubscribeFuture interface {
 	GenericFuture
 
-	// ReturnCodes will return the suback codes returned by the broker.
+	// ReturnCodes will return the suback codes returned by the broker. The
+	// codes are also available if the future has been canceled because of a
+	// failed subscription.
 	ReturnCodes() []uint8
 }
 
@@ -42,6 +52,8 @@ const (
 	sessionPresentKey futureKey = iota
 	returnCodeKey
 	returnCodesKey
+	subscriptionKey
+	filtersKey
 )
 
 type connectFuture struct {
@@ -0,0 +1,454 @@
+package client
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/client/future"
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// ErrOutboxFull is passed to the DropCallback if a message has been dropped
+// because the outbox was full.
+var ErrOutboxFull = errors.New("outbox full")
+
+// ErrMessageExpired is passed to the DropCallback if a message has been
+// dropped because it expired before it could be published.
+var ErrMessageExpired = errors.New("message expired")
+
+// An OutboxMessage is a message that is buffered in an Outbox.
+type OutboxMessage struct {
+	// The message to be published.
+	Message *packet.Message
+
+	// The time after which the message is dropped. A zero time means that the
+	// message never expires.
+	Expires time.Time
+
+	future *future.Future
+}
+
+// Expired returns whether the message has expired at the specified time.
+func (m *OutboxMessage) Expired(now time.Time) bool {
+	return !m.Expires.IsZero() && now.After(m.Expires)
+}
+
+// An Outbox buffers the messages published using a Service until they have
+// been handed over to a connected client.
+type Outbox interface {
+	// Push should append the message to the outbox.
+	Push(*OutboxMessage) error
+
+	// Peek should return the first message without removing it or nil if the
+	// outbox is empty. The Service only completes the future of a message if
+	// the pushed message itself is returned.
+	Peek() (*OutboxMessage, error)
+
+	// Pop should remove the first message.
+	Pop() error
+
+	// Len should return the number of buffered messages.
+	Len() int
+}
+
+// MemoryOutbox is a basic in-memory Outbox.
+type MemoryOutbox struct {
+	messages []*OutboxMessage
+	mutex    sync.Mutex
+}
+
+// NewMemoryOutbox returns a new MemoryOutbox.
+func NewMemoryOutbox() *MemoryOutbox {
+	return &MemoryOutbox{}
+}
+
+// Push will append the message to the outbox.
+func (o *MemoryOutbox) Push(msg *OutboxMessage) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.messages = append(o.messages, msg)
+
+	return nil
+}
+
+// Peek will return the first message.
+func (o *MemoryOutbox) Peek() (*OutboxMessage, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	// check messages
+	if len(o.messages) == 0 {
+		return nil, nil
+	}
+
+	return o.messages[0], nil
+}
+
+// Pop will remove the first message.
+func (o *MemoryOutbox) Pop() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	// remove message
+	if len(o.messages) > 0 {
+		o.messages[0] = nil
+		o.messages = o.messages[1:]
+	}
+
+	return nil
+}
+
+// Len returns the number of buffered messages.
+func (o *MemoryOutbox) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return len(o.messages)
+}
+
+const (
+	fileOutboxPush byte = iota + 1
+	fileOutboxPop
+)
+
+// the size of a record header (type and length)
+const fileOutboxHeader = 5
+
+// the number of removed messages after which the file is compacted if they
+// outnumber the buffered messages
+var fileOutboxCompaction = 1000
+
+// a buffered message in the file
+type fileOutboxEntry struct {
+	offset int64
+	length int
+	future *future.Future
+}
+
+// FileOutbox is a durable Outbox that stores messages in an append-only file.
+// Only the positions of the buffered messages are kept in memory. The file is
+// truncated once the outbox has been drained and compacted when removed
+// messages outnumber the buffered messages. An existing file is loaded when
+// the outbox is opened, which allows buffered messages to survive restarts.
+type FileOutbox struct {
+	// Sync can be set to flush every write to stable storage.
+	Sync bool
+
+	path    string
+	file    *os.File
+	size    int64
+	removed int
+	entries []fileOutboxEntry
+	mutex   sync.Mutex
+}
+
+// NewFileOutbox opens or creates the file at the specified path and returns a
+// FileOutbox that contains the messages that have been left in the file.
+func NewFileOutbox(path string) (*FileOutbox, error) {
+	// open file
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare outbox
+	o := &FileOutbox{
+		path: path,
+		file: file,
+	}
+
+	// load records
+	err = o.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// Push will append the message to the file.
+func (o *FileOutbox) Push(msg *OutboxMessage) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	// encode message
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	// write record
+	offset := o.size
+	err = o.write(fileOutboxPush, data)
+	if err != nil {
+		return err
+	}
+
+	// add entry
+	o.entries = append(o.entries, fileOutboxEntry{
+		offset: offset + fileOutboxHeader,
+		length: len(data),
+		future: msg.future,
+	})
+
+	return nil
+}
+
+// Peek will read the first message from the file.
+func (o *FileOutbox) Peek() (*OutboxMessage, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	// check entries
+	if len(o.entries) == 0 {
+		return nil, nil
+	}
+
+	// read message
+	entry := o.entries[0]
+	data := make([]byte, entry.length)
+	_, err := o.file.ReadAt(data, entry.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	// decode message
+	var msg OutboxMessage
+	err = json.Unmarshal(data, &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// restore future
+	msg.future = entry.future
+
+	return &msg, nil
+}
+
+// Pop will record the removal of the first message.
+func (o *FileOutbox) Pop() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	// check entries
+	if len(o.entries) == 0 {
+		return nil
+	}
+
+	// truncate file if drained or record removal
+	var err error
+	if len(o.entries) == 1 {
+		err = o.truncate()
+	} else {
+		err = o.write(fileOutboxPop, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	// remove entry
+	o.entries = o.entries[1:]
+	o.removed++
+
+	// compact file, a failed compaction keeps the current file and is retried
+	// once another batch of messages has been removed
+	if o.removed >= fileOutboxCompaction && o.removed > len(o.entries) {
+		err = o.compact()
+		if err != nil {
+			o.removed = 0
+		}
+	}
+
+	return nil
+}
+
+// Len returns the number of buffered messages.
+func (o *FileOutbox) Len() int {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return len(o.entries)
+}
+
+// Close will close the underlying file.
+func (o *FileOutbox) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.file.Close()
+}
+
+func (o *FileOutbox) load() error {
+	// prepare header
+	header := make([]byte, fileOutboxHeader)
+
+	for {
+		// read header
+		_, err := o.file.ReadAt(header, o.size)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// get type and length
+		typ := header[0]
+		length := int(binary.BigEndian.Uint32(header[1:]))
+
+		// handle records
+		if typ == fileOutboxPush {
+			// read message
+			data := make([]byte, length)
+			_, err = o.file.ReadAt(data, o.size+fileOutboxHeader)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			// check message
+			var msg OutboxMessage
+			err = json.Unmarshal(data, &msg)
+			if err != nil {
+				break
+			}
+
+			// add entry
+			o.entries = append(o.entries, fileOutboxEntry{
+				offset: o.size + fileOutboxHeader,
+				length: length,
+			})
+		} else if typ == fileOutboxPop && len(o.entries) > 0 {
+			// remove entry
+			o.entries = o.entries[1:]
+			o.removed++
+		} else {
+			break
+		}
+
+		// advance
+		o.size += int64(fileOutboxHeader + length)
+	}
+
+	// remove incomplete records
+	return o.file.Truncate(o.size)
+}
+
+func (o *FileOutbox) write(typ byte, data []byte) error {
+	// prepare record
+	record := make([]byte, fileOutboxHeader+len(data))
+	record[0] = typ
+	binary.BigEndian.PutUint32(record[1:], uint32(len(data)))
+	copy(record[fileOutboxHeader:], data)
+
+	// write record
+	_, err := o.file.WriteAt(record, o.size)
+	if err != nil {
+		return err
+	}
+
+	// sync file
+	if o.Sync {
+		err = o.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	// advance size
+	o.size += int64(len(record))
+
+	return nil
+}
+
+func (o *FileOutbox) truncate() error {
+	// truncate file
+	err := o.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	// sync file
+	if o.Sync {
+		err = o.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	// reset size
+	o.size = 0
+	o.removed = 0
+
+	return nil
+}
+
+func (o *FileOutbox) compact() error {
+	// create temporary file
+	tmp, err := os.OpenFile(o.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// copy buffered messages
+	var size int64
+	entries := make([]fileOutboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		// copy record
+		record := make([]byte, fileOutboxHeader+entry.length)
+		_, err = o.file.ReadAt(record, entry.offset-fileOutboxHeader)
+		if err == nil {
+			_, err = tmp.WriteAt(record, size)
+		}
+		if err != nil {
+			break
+		}
+
+		// add entry
+		entry.offset = size + fileOutboxHeader
+		entries = append(entries, entry)
+		size += int64(len(record))
+	}
+
+	// sync temporary file
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	// replace file
+	if err == nil {
+		err = os.Rename(o.path+".tmp", o.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(o.path + ".tmp")
+		return err
+	}
+
+	// close old file
+	o.file.Close()
+
+	// set state
+	o.file = tmp
+	o.size = size
+	o.entries = entries
+	o.removed = 0
+
+	// sync directory to persist the rename
+	dir, err := os.Open(filepath.Dir(o.path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	dir.Close()
+
+	return err
+}
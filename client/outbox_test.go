@@ -0,0 +1,119 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryOutbox(t *testing.T) {
+	outbox := NewMemoryOutbox()
+
+	msg, err := outbox.Peek()
+	assert.NoError(t, err)
+	assert.Nil(t, msg)
+	assert.NoError(t, outbox.Pop())
+
+	msg1 := &OutboxMessage{Message: &packet.Message{Topic: "1"}}
+	msg2 := &OutboxMessage{Message: &packet.Message{Topic: "2"}}
+
+	assert.NoError(t, outbox.Push(msg1))
+	assert.NoError(t, outbox.Push(msg2))
+	assert.Equal(t, 2, outbox.Len())
+
+	msg, err = outbox.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, msg1, msg)
+	assert.NoError(t, outbox.Pop())
+
+	msg, err = outbox.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, msg2, msg)
+	assert.NoError(t, outbox.Pop())
+	assert.Equal(t, 0, outbox.Len())
+}
+
+func TestFileOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "outbox")
+
+	outbox, err := NewFileOutbox(path)
+	assert.NoError(t, err)
+
+	expires := time.Now().Add(time.Minute).Round(time.Second).UTC()
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, outbox.Push(&OutboxMessage{
+			Message: &packet.Message{Topic: "test", Payload: []byte{byte(i)}, QOS: 1},
+			Expires: expires,
+		}))
+	}
+
+	assert.NoError(t, outbox.Pop())
+	assert.NoError(t, outbox.Close())
+
+	outbox, err = NewFileOutbox(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, outbox.Len())
+
+	msg, err := outbox.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, &OutboxMessage{
+		Message: &packet.Message{Topic: "test", Payload: []byte{1}, QOS: 1},
+		Expires: expires,
+	}, msg)
+	assert.False(t, msg.Expired(time.Now()))
+	assert.True(t, msg.Expired(expires.Add(time.Second)))
+
+	assert.NoError(t, outbox.Pop())
+	assert.NoError(t, outbox.Pop())
+	assert.Equal(t, 0, outbox.Len())
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	assert.NoError(t, outbox.Close())
+}
+
+func TestFileOutboxCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "outbox")
+
+	outbox, err := NewFileOutbox(path)
+	assert.NoError(t, err)
+
+	for i := 0; i < 2*fileOutboxCompaction+10; i++ {
+		assert.NoError(t, outbox.Push(&OutboxMessage{
+			Message: &packet.Message{Topic: "test", Payload: []byte{byte(i)}},
+		}))
+	}
+
+	for i := 0; i < 2*fileOutboxCompaction; i++ {
+		assert.NoError(t, outbox.Pop())
+	}
+
+	assert.True(t, outbox.removed < fileOutboxCompaction)
+	assert.NoError(t, outbox.Close())
+
+	outbox, err = NewFileOutbox(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, outbox.Len())
+
+	msg, err := outbox.Peek()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{byte(2 * fileOutboxCompaction)}, msg.Message.Payload)
+
+	assert.NoError(t, outbox.Close())
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jpillora/backoff"
+)
+
+// ErrReconnectAborted is emitted using the ErrorCallback if the
+// ReconnectStrategy of a Service stopped reconnecting.
+var ErrReconnectAborted = errors.New("reconnect aborted")
+
+// A ReconnectStrategy decides whether and when a Service attempts to reconnect.
+type ReconnectStrategy interface {
+	// Delay should return the delay before the next connection attempt or
+	// false if the service should stop reconnecting. The attempt is the number
+	// of consecutive failed connection attempts and lost connections, starting
+	// with one.
+	Delay(attempt int) (time.Duration, bool)
+}
+
+// A ConfigCallback is a function that is called by a Service before every
+// connection attempt with a copy of the config. The returned config is used to
+// connect, which allows refreshing credentials or rotating tokens. If an error
+// is returned the attempt is counted as failed.
+//
+// Note: Execution of the service is resumed after the callback returns. This
+// means that waiting on a future inside the callback will deadlock the service.
+type ConfigCallback func(*Config) (*Config, error)
+
+// ExponentialBackoff is a ReconnectStrategy that delays reconnects using an
+// exponential backoff with optional jitter. It can limit the number of
+// attempts and switch to a fixed cool-down delay once a number of consecutive
+// attempts failed.
+type ExponentialBackoff struct {
+	// The minimum and maximum delay between reconnects.
+	Min time.Duration
+	Max time.Duration
+
+	// The factor by which the delay is multiplied for every attempt. A factor
+	// of zero defaults to two.
+	Factor float64
+
+	// If enabled, the delay is randomized between the minimum delay and the
+	// delay of the attempt.
+	Jitter bool
+
+	// The maximum number of consecutive failed attempts after which the service
+	// stops reconnecting. A value of zero reconnects forever.
+	MaxAttempts int
+
+	// The number of consecutive failed attempts after which every further
+	// reconnect is delayed by the fixed BreakerTimeout cool-down until a
+	// connection has been established again. The cool-down is never shorter
+	// than the maximum delay. A threshold of zero disables the cool-down.
+	BreakerThreshold int
+	BreakerTimeout   time.Duration
+}
+
+// Delay implements the ReconnectStrategy interface.
+func (b *ExponentialBackoff) Delay(attempt int) (time.Duration, bool) {
+	// check attempts
+	if b.MaxAttempts > 0 && attempt >= b.MaxAttempts {
+		return 0, false
+	}
+
+	// check cool-down
+	if b.BreakerThreshold > 0 && attempt >= b.BreakerThreshold {
+		if b.BreakerTimeout < b.Max {
+			return b.Max, true
+		}
+
+		return b.BreakerTimeout, true
+	}
+
+	// prepare backoff
+	bo := &backoff.Backoff{
+		Min:    b.Min,
+		Max:    b.Max,
+		Factor: b.Factor,
+		Jitter: b.Jitter,
+	}
+
+	// get delay
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	return bo.ForAttempt(float64(attempt - 1)), true
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	b := &ExponentialBackoff{
+		Min:    10 * time.Millisecond,
+		Max:    50 * time.Millisecond,
+		Factor: 2,
+	}
+
+	for i, delay := range []time.Duration{10, 10, 20, 40, 50, 50} {
+		d, ok := b.Delay(i)
+		assert.True(t, ok)
+		assert.Equal(t, delay*time.Millisecond, d)
+	}
+
+	b.Jitter = true
+
+	for i := 1; i < 10; i++ {
+		d, ok := b.Delay(i)
+		assert.True(t, ok)
+		assert.True(t, d >= 10*time.Millisecond && d <= 50*time.Millisecond)
+	}
+
+	b.MaxAttempts = 3
+	b.BreakerThreshold = 2
+	b.BreakerTimeout = time.Minute
+
+	d, ok := b.Delay(2)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, d)
+
+	b.BreakerTimeout = 0
+
+	d, ok = b.Delay(2)
+	assert.True(t, ok)
+	assert.Equal(t, 50*time.Millisecond, d)
+
+	d, ok = b.Delay(3)
+	assert.False(t, ok)
+	assert.Zero(t, d)
+}
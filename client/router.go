@@ -0,0 +1,217 @@
+package client
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/topic"
+)
+
+// ErrInvalidPattern is returned by Handle if a pattern is invalid.
+var ErrInvalidPattern = errors.New("invalid pattern")
+
+// Params are the parameters extracted from the topic of a routed message.
+type Params map[string]string
+
+// A Handler is called by the Router with messages matching its pattern and
+// the extracted parameters. If an error is returned the client will be
+// prevented from acknowledging the message and closes immediately.
+type Handler func(msg *packet.Message, params Params) error
+
+// A Middleware wraps a Handler to run code before and after the handler is
+// called or to prevent it from being called.
+type Middleware func(Handler) Handler
+
+// a registered route
+type route struct {
+	index   int
+	pattern string
+	filter  string
+	params  []string
+	handler Handler
+}
+
+// A Router dispatches received messages to the handlers registered for the
+// patterns that match the topic of a message. Patterns are topic filters that
+// may contain named single level wildcards in the form "devices/{id}/temp",
+// which are extracted as parameters. A message is dispatched to all matching
+// handlers in the order they have been registered.
+//
+// The router can be used with a Client by setting its Callback and with a
+// Service by setting its MessageCallback.
+type Router struct {
+	// NotFound is called with messages that do not match any pattern.
+	NotFound Handler
+
+	// ErrorCallback is called with errors emitted by a Client.
+	ErrorCallback ErrorCallback
+
+	tree       *topic.Tree
+	routes     []*route
+	middleware []Middleware
+	mutex      sync.RWMutex
+}
+
+// NewRouter returns a new Router.
+func NewRouter() *Router {
+	return &Router{
+		tree: topic.NewTree(),
+	}
+}
+
+// Use will add the specified middleware. Middleware is applied in the order it
+// has been added and wraps the handlers of all routes.
+func (r *Router) Use(middleware ...Middleware) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Handle will register the handler for the specified pattern.
+func (r *Router) Handle(pattern string, handler Handler) error {
+	// split pattern
+	segments := strings.Split(pattern, "/")
+
+	// replace named wildcards
+	params := make([]string, len(segments))
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			params[i] = segment[1 : len(segment)-1]
+			segments[i] = "+"
+
+			// check name
+			if params[i] == "" {
+				return ErrInvalidPattern
+			}
+		}
+	}
+
+	// check filter
+	filter, err := topic.Parse(strings.Join(segments, "/"), true)
+	if err != nil || filter != strings.Join(segments, "/") {
+		return ErrInvalidPattern
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// add route
+	rt := &route{
+		index:   len(r.routes),
+		pattern: pattern,
+		filter:  filter,
+		params:  params,
+		handler: handler,
+	}
+	r.routes = append(r.routes, rt)
+	r.tree.Add(filter, rt)
+
+	return nil
+}
+
+// Subscriptions returns subscriptions with the specified QOS level for the
+// filters of all registered routes.
+func (r *Router) Subscriptions(qos uint8) []packet.Subscription {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	// collect unique filters
+	var subs []packet.Subscription
+	seen := make(map[string]bool)
+	for _, rt := range r.routes {
+		if !seen[rt.filter] {
+			seen[rt.filter] = true
+			subs = append(subs, packet.Subscription{Topic: rt.filter, QOS: qos})
+		}
+	}
+
+	return subs
+}
+
+// Route will dispatch the message to all matching handlers or the NotFound
+// handler if there is none. It returns the first error returned by a handler.
+func (r *Router) Route(msg *packet.Message) error {
+	// get matching routes
+	values := r.tree.Match(msg.Topic)
+
+	r.mutex.RLock()
+	middleware := r.middleware
+	notFound := r.NotFound
+	r.mutex.RUnlock()
+
+	// handle unmatched messages
+	if len(values) == 0 {
+		if notFound == nil {
+			return nil
+		}
+
+		return wrap(notFound, middleware)(msg, Params{})
+	}
+
+	// sort routes by registration
+	routes := make([]*route, 0, len(values))
+	for _, value := range values {
+		routes = append(routes, value.(*route))
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].index < routes[j].index
+	})
+
+	// call handlers
+	segments := strings.Split(msg.Topic, "/")
+	for _, rt := range routes {
+		err := wrap(rt.handler, middleware)(msg, rt.extract(segments))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Callback returns a Callback that routes the received messages and forwards
+// errors to the ErrorCallback.
+func (r *Router) Callback() Callback {
+	return func(msg *packet.Message, err error) error {
+		// handle error
+		if err != nil {
+			if r.ErrorCallback != nil {
+				r.ErrorCallback(err)
+			}
+
+			return nil
+		}
+
+		return r.Route(msg)
+	}
+}
+
+// MessageCallback returns a MessageCallback that routes the received messages.
+func (r *Router) MessageCallback() MessageCallback {
+	return r.Route
+}
+
+// returns the parameters for the specified topic segments
+func (rt *route) extract(segments []string) Params {
+	params := Params{}
+	for i, name := range rt.params {
+		if name != "" && i < len(segments) {
+			params[name] = segments[i]
+		}
+	}
+
+	return params
+}
+
+// wraps the handler with the middleware
+func wrap(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+
+	return handler
+}
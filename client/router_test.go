@@ -0,0 +1,129 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/transport/flow"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouter(t *testing.T) {
+	r := NewRouter()
+
+	var calls []string
+	r.Use(func(next Handler) Handler {
+		return func(msg *packet.Message, params Params) error {
+			calls = append(calls, "mw1")
+			return next(msg, params)
+		}
+	}, func(next Handler) Handler {
+		return func(msg *packet.Message, params Params) error {
+			calls = append(calls, "mw2")
+			return next(msg, params)
+		}
+	})
+
+	assert.NoError(t, r.Handle("devices/{id}/temp", func(msg *packet.Message, params Params) error {
+		calls = append(calls, "temp:"+params["id"])
+		return nil
+	}))
+
+	assert.NoError(t, r.Handle("devices/{id}/#", func(msg *packet.Message, params Params) error {
+		calls = append(calls, "all:"+params["id"])
+		return nil
+	}))
+
+	assert.NoError(t, r.Handle("commands/+/{name}", func(msg *packet.Message, params Params) error {
+		return errors.New(params["name"])
+	}))
+
+	assert.Equal(t, ErrInvalidPattern, r.Handle("foo/{}", nil))
+	assert.Equal(t, ErrInvalidPattern, r.Handle("foo/#/bar", nil))
+	assert.Equal(t, ErrInvalidPattern, r.Handle("foo//bar", nil))
+
+	assert.Equal(t, []packet.Subscription{
+		{Topic: "devices/+/temp", QOS: 1},
+		{Topic: "devices/+/#", QOS: 1},
+		{Topic: "commands/+/+", QOS: 1},
+	}, r.Subscriptions(1))
+
+	assert.NoError(t, r.Route(&packet.Message{Topic: "devices/1/temp"}))
+	assert.Equal(t, []string{"mw1", "mw2", "temp:1", "mw1", "mw2", "all:1"}, calls)
+
+	calls = nil
+	assert.NoError(t, r.Route(&packet.Message{Topic: "devices/2/status"}))
+	assert.Equal(t, []string{"mw1", "mw2", "all:2"}, calls)
+
+	calls = nil
+	assert.NoError(t, r.Route(&packet.Message{Topic: "other"}))
+	assert.Empty(t, calls)
+
+	r.NotFound = func(msg *packet.Message, params Params) error {
+		calls = append(calls, "notfound:"+msg.Topic)
+		return nil
+	}
+
+	assert.NoError(t, r.Route(&packet.Message{Topic: "other"}))
+	assert.Equal(t, []string{"mw1", "mw2", "notfound:other"}, calls)
+
+	assert.EqualError(t, r.Route(&packet.Message{Topic: "commands/1/reboot"}), "reboot")
+}
+
+func TestRouterClient(t *testing.T) {
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "devices/+/temp", QOS: 0}}
+	subscribe.ID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.ID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "devices/1/temp"
+	publish.Message.Payload = []byte("20")
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(subscribe).
+		Send(suback).
+		Send(publish).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	wait := make(chan struct{})
+
+	r := NewRouter()
+	r.ErrorCallback = func(err error) {
+		assert.Fail(t, "should not be called")
+	}
+	assert.NoError(t, r.Handle("devices/{id}/temp", func(msg *packet.Message, params Params) error {
+		assert.Equal(t, Params{"id": "1"}, params)
+		assert.Equal(t, []byte("20"), msg.Payload)
+		close(wait)
+		return nil
+	}))
+
+	c := New()
+	c.Callback = r.Callback()
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	subscribeFuture, err := c.SubscribeMultiple(r.Subscriptions(0))
+	assert.NoError(t, err)
+	assert.NoError(t, subscribeFuture.Wait(1*time.Second))
+
+	safeReceive(wait)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -9,7 +10,7 @@ import (
 	"github.com/256dpi/gomqtt/client/future"
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/session"
-	"github.com/jpillora/backoff"
+	"github.com/256dpi/gomqtt/tracing"
 	"gopkg.in/tomb.v2"
 )
 
@@ -50,6 +51,24 @@ type ErrorCallback func(error)
 // means that waiting on a future inside the callback will deadlock the service.
 type OfflineCallback func()
 
+// A DropCallback is a function that is called when a message has been dropped
+// from the outbox. The error is either ErrOutboxFull or ErrMessageExpired.
+//
+// Note: The callback is called synchronously and should therefore not block.
+type DropCallback func(*packet.Message, error)
+
+// A SubscriptionError is emitted using the ErrorCallback if a subscription
+// could not be restored after a reconnect. The subscription is not restored
+// again on subsequent reconnects.
+type SubscriptionError struct {
+	Subscription packet.Subscription
+}
+
+// Error implements the error interface.
+func (e *SubscriptionError) Error() string {
+	return fmt.Sprintf("failed to restore subscription %q", e.Subscription.Topic)
+}
+
 const (
 	serviceStarted uint32 = iota
 	serviceStopped
@@ -66,9 +85,9 @@ const (
 type Service struct {
 	state uint32
 
-	config *Config
-
-	backoff *backoff.Backoff
+	config   *Config
+	brokers  *brokerList
+	strategy ReconnectStrategy
 
 	// The session used by the client to store unacknowledged packets.
 	Session Session
@@ -85,11 +104,29 @@ type Service struct {
 	// The callback that is used to notify that the service is offline.
 	OfflineCallback OfflineCallback
 
+	// The callback that is used to notify that a message has been dropped
+	// from the outbox.
+	DropCallback DropCallback
+
 	// The logger that is used to log write low level information like packets
 	// that have ben successfully sent and received, details about the
 	// automatic keep alive handler, reconnection and occurring errors.
 	Logger Logger
 
+	// The tracer that is used by the client to trace published and received
+	// messages.
+	Tracer *tracing.Tracer
+
+	// The callback that is used to rewrite the config before every
+	// connection attempt.
+	ConfigCallback ConfigCallback
+
+	// The strategy that is used to delay reconnects. By default an
+	// ExponentialBackoff using the minimum and maximum reconnect delay is used.
+	//
+	// Note: The value must be changed before calling Start.
+	ReconnectStrategy ReconnectStrategy
+
 	// The minimum delay between reconnects.
 	//
 	// Note: The value must be changed before calling Start.
@@ -106,8 +143,43 @@ type Service struct {
 	// The allowed timeout until a connection is forcefully closed.
 	DisconnectTimeout time.Duration
 
-	commandQueue chan *command
-	futureStore  *future.Store
+	// If enabled, the service will track the active subscriptions and restore
+	// them after a reconnect if the session has not been resumed. Failed
+	// subscriptions are emitted as SubscriptionErrors. Enabled by default.
+	Resubscribe bool
+
+	// The outbox that buffers published messages until they have been handed
+	// over to a connected client. If set, publishes are accepted while the
+	// service is offline and sent in order after a reconnect. Subscribe and
+	// unsubscribe commands are not buffered and may overtake buffered
+	// messages. Messages loaded from a durable outbox are published without
+	// completing any futures.
+	//
+	// Note: The value must be changed before calling Start.
+	Outbox Outbox
+
+	// The maximum number of messages buffered in the outbox. A limit of zero
+	// disables the limit.
+	OutboxLimit int
+
+	// The policy that is applied when a message is published while the outbox
+	// is full. Dropped messages cancel their futures. The Block policy drops
+	// new messages while the service is not started.
+	OutboxOverflow OverflowPolicy
+
+	// The default duration after which messages in the outbox expire. Expired
+	// messages are dropped instead of published. A duration of zero keeps
+	// messages until they are published.
+	OutboxExpiry time.Duration
+
+	commandQueue  chan *command
+	futureStore   *future.Store
+	subscriptions map[string]packet.Subscription
+
+	outboxSignal   chan struct{}
+	outboxSpace    chan struct{}
+	outboxInflight bool
+	outboxMutex    sync.Mutex
 
 	mutex sync.Mutex
 	tomb  *tomb.Tomb
@@ -129,8 +201,13 @@ func NewService(queueSize ...int) *Service {
 		MaxReconnectDelay: 32 * time.Second,
 		ConnectTimeout:    5 * time.Second,
 		DisconnectTimeout: 10 * time.Second,
+		Resubscribe:       true,
+		OutboxLimit:       1000,
 		commandQueue:      make(chan *command, qs),
 		futureStore:       future.NewStore(),
+		subscriptions:     make(map[string]packet.Subscription),
+		outboxSignal:      make(chan struct{}, 1),
+		outboxSpace:       make(chan struct{}, 1),
 	}
 }
 
@@ -155,11 +232,17 @@ func (s *Service) Start(config *Config) {
 	// save config
 	s.config = config
 
-	// initialize backoff
-	s.backoff = &backoff.Backoff{
-		Min:    s.MinReconnectDelay,
-		Max:    s.MaxReconnectDelay,
-		Factor: 2,
+	// prepare brokers
+	s.brokers = newBrokerList(config)
+
+	// initialize strategy
+	s.strategy = s.ReconnectStrategy
+	if s.strategy == nil {
+		s.strategy = &ExponentialBackoff{
+			Min:    s.MinReconnectDelay,
+			Max:    s.MaxReconnectDelay,
+			Factor: 2,
+		}
 	}
 
 	// mark future store as protected
@@ -190,6 +273,11 @@ func (s *Service) Publish(topic string, payload []byte, qos uint8, retain bool)
 // return a PublishFuture that gets completed once the quality of service flow
 // has been completed.
 func (s *Service) PublishMessage(msg *packet.Message) GenericFuture {
+	// buffer message if an outbox is available
+	if s.Outbox != nil {
+		return s.buffer(msg, s.OutboxExpiry)
+	}
+
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
@@ -206,6 +294,28 @@ func (s *Service) PublishMessage(msg *packet.Message) GenericFuture {
 	return f
 }
 
+// PublishMessageWithExpiry will buffer the passed message in the outbox like
+// PublishMessage, but drop the message if it has not been published within the
+// specified duration. The expiry is ignored if no outbox is set.
+func (s *Service) PublishMessageWithExpiry(msg *packet.Message, expiry time.Duration) GenericFuture {
+	// publish directly if no outbox is available
+	if s.Outbox == nil {
+		return s.PublishMessage(msg)
+	}
+
+	return s.buffer(msg, expiry)
+}
+
+// OutboxDepth returns the number of messages buffered in the outbox.
+func (s *Service) OutboxDepth() int {
+	// check outbox
+	if s.Outbox == nil {
+		return 0
+	}
+
+	return s.Outbox.Len()
+}
+
 // Subscribe will send a SubscribePacket containing one topic to subscribe. It
 // will return a SubscribeFuture that gets completed once the acknowledgements
 // have been received.
@@ -293,14 +403,20 @@ func (s *Service) Stop(clearFutures bool) {
 // the supervised reconnect loop
 func (s *Service) supervisor() error {
 	first := true
+	attempts := 0
 
 	for {
 		if first {
 			// no delay on first attempt
 			first = false
 		} else {
-			// get backoff duration
-			d := s.backoff.Duration()
+			// get reconnect delay
+			d, ok := s.strategy.Delay(attempts)
+			if !ok {
+				s.err("Reconnect", ErrReconnectAborted)
+				return ErrReconnectAborted
+			}
+
 			s.log(fmt.Sprintf("Delay Reconnect: %v", d))
 
 			// sleep but return on Stop
@@ -316,19 +432,44 @@ func (s *Service) supervisor() error {
 		// prepare the stop channel
 		fail := make(chan struct{})
 
+		// select broker
+		index := s.brokers.next(time.Now())
+
 		// try once to get a client
-		client, resumed := s.connect(fail)
+		client, resumed := s.connect(fail, s.brokers.urls[index])
 		if client == nil {
+			s.brokers.failed(index, time.Now())
+			attempts++
 			continue
 		}
 
+		// restore subscriptions if the session has not been resumed
+		if s.Resubscribe && !resumed && !s.resubscribe(client) {
+			s.brokers.failed(index, time.Now())
+			attempts++
+			continue
+		}
+
+		// reset attempts
+		attempts = 0
+
 		// run callback
 		if s.OnlineCallback != nil {
 			s.OnlineCallback(resumed)
 		}
 
+		// check higher priority brokers
+		failback := make(chan struct{})
+		stop := make(chan struct{})
+		if index > 0 {
+			go s.prober(index, failback, stop)
+		}
+
 		// run dispatcher on client
-		dying := s.dispatcher(client, fail)
+		dying := s.dispatcher(client, fail, failback)
+
+		// stop prober
+		close(stop)
 
 		// run callback
 		if s.OfflineCallback != nil {
@@ -339,15 +480,46 @@ func (s *Service) supervisor() error {
 		if dying {
 			return tomb.ErrDying
 		}
+
+		// reconnect immediately on failback or mark broker as failed
+		select {
+		case <-failback:
+			first = true
+		default:
+			s.brokers.failed(index, time.Now())
+			attempts++
+		}
+	}
+}
+
+// will return the config for the broker using the config callback
+func (s *Service) prepare(url string) (*Config, error) {
+	// copy config
+	config := *s.config
+	config.BrokerURL = url
+
+	// rewrite config
+	if s.ConfigCallback != nil {
+		return s.ConfigCallback(&config)
 	}
+
+	return &config, nil
 }
 
 // will try to connect one client to the broker
-func (s *Service) connect(fail chan struct{}) (*Client, bool) {
+func (s *Service) connect(fail chan struct{}, url string) (*Client, bool) {
+	// prepare config
+	cfg, err := s.prepare(url)
+	if err != nil {
+		s.err("Config", err)
+		return nil, false
+	}
+
 	// prepare new client
 	client := New()
 	client.Session = s.Session
 	client.Logger = s.Logger
+	client.Tracer = s.Tracer
 	client.futureStore = s.futureStore
 
 	// set callback
@@ -367,7 +539,7 @@ func (s *Service) connect(fail chan struct{}) (*Client, bool) {
 	}
 
 	// attempt to connect
-	connectFuture, err := client.Connect(s.config)
+	connectFuture, err := client.Connect(cfg)
 	if err != nil {
 		s.err("Connect", err)
 		return nil, false
@@ -401,10 +573,72 @@ func (s *Service) connect(fail chan struct{}) (*Client, bool) {
 	return client, connectFuture.SessionPresent()
 }
 
+// will restore the tracked subscriptions and report failed subscriptions
+func (s *Service) resubscribe(client *Client) bool {
+	// get subscriptions
+	subscriptions := make([]packet.Subscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		subscriptions = append(subscriptions, sub)
+	}
+
+	// check subscriptions
+	if len(subscriptions) == 0 {
+		return true
+	}
+
+	// sort subscriptions
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].Topic < subscriptions[j].Topic
+	})
+
+	// subscribe
+	subscribeFuture, err := client.SubscribeMultiple(subscriptions)
+	if err != nil {
+		client.Close()
+
+		s.err("Resubscribe", err)
+		return false
+	}
+
+	// wait for suback
+	err = subscribeFuture.Wait(s.ConnectTimeout)
+
+	// report failed subscriptions, the return codes are also available if the
+	// client has been closed because of failed subscriptions
+	for i, code := range subscribeFuture.ReturnCodes() {
+		if code == packet.QOSFailure && i < len(subscriptions) {
+			// forget subscription
+			delete(s.subscriptions, subscriptions[i].Topic)
+
+			s.err("Resubscribe", &SubscriptionError{
+				Subscription: subscriptions[i],
+			})
+		}
+	}
+
+	// check error
+	if err != nil {
+		client.Close()
+
+		s.err("Resubscribe", err)
+		return false
+	}
+
+	return true
+}
+
 // reads from the queues and calls the current client
-func (s *Service) dispatcher(client *Client, fail chan struct{}) bool {
+func (s *Service) dispatcher(client *Client, fail, failback chan struct{}) bool {
+	// drain outbox
+	s.signalOutbox()
+
 	for {
 		select {
+		case <-s.outboxSignal:
+			// publish next buffered message
+			if !s.drain(client) {
+				return false
+			}
 		case cmd := <-s.commandQueue:
 
 			// handle subscribe command
@@ -419,6 +653,11 @@ func (s *Service) dispatcher(client *Client, fail chan struct{}) bool {
 					return false
 				}
 
+				// track subscriptions
+				for _, sub := range cmd.subscriptions {
+					s.subscriptions[sub.Topic] = sub
+				}
+
 				// bind future in a own goroutine. the goroutine will be
 				// ultimately collected when the service is stopped
 				go cmd.future.Bind(f2.(*subscribeFuture).Future)
@@ -436,6 +675,11 @@ func (s *Service) dispatcher(client *Client, fail chan struct{}) bool {
 					return false
 				}
 
+				// forget subscriptions
+				for _, topic := range cmd.topics {
+					delete(s.subscriptions, topic)
+				}
+
 				// bind future in a own goroutine. the goroutine will be
 				// ultimately collected when the service is stopped
 				go cmd.future.Bind(f2.(*future.Future))
@@ -466,11 +710,244 @@ func (s *Service) dispatcher(client *Client, fail chan struct{}) bool {
 
 			return true
 		case <-fail:
+			return false
+		case <-failback:
+			// disconnect client to fail back
+			err := client.Disconnect(s.DisconnectTimeout)
+			if err != nil {
+				s.err("Disconnect", err)
+			}
+
 			return false
 		}
 	}
 }
 
+// will add the message to the outbox and apply the overflow policy
+func (s *Service) buffer(msg *packet.Message, expiry time.Duration) GenericFuture {
+	// allocate future
+	f := future.New()
+
+	// prepare message
+	entry := &OutboxMessage{
+		Message: msg,
+		future:  f,
+	}
+
+	// set expiry
+	if expiry > 0 {
+		entry.Expires = time.Now().Add(expiry)
+	}
+
+	for {
+		s.outboxMutex.Lock()
+
+		// check limit
+		if s.OutboxLimit <= 0 || s.Outbox.Len() < s.OutboxLimit {
+			break
+		}
+
+		// drop new message
+		if s.OutboxOverflow == DropNewest {
+			s.outboxMutex.Unlock()
+
+			// cancel future
+			f.Cancel()
+
+			s.dropped(msg, ErrOutboxFull)
+			return f
+		}
+
+		// drop oldest message if it is not being published
+		if s.OutboxOverflow == DropOldest && !s.outboxInflight {
+			err := s.discard(ErrOutboxFull)
+			s.outboxMutex.Unlock()
+			if err != nil {
+				s.err("Outbox", err)
+
+				// cancel future
+				f.Cancel()
+
+				return f
+			}
+
+			continue
+		}
+
+		s.outboxMutex.Unlock()
+
+		// get tomb
+		s.mutex.Lock()
+		t := s.tomb
+		s.mutex.Unlock()
+
+		// drop new message if the service has not been started
+		if t == nil {
+			// cancel future
+			f.Cancel()
+
+			s.dropped(msg, ErrOutboxFull)
+			return f
+		}
+
+		// otherwise wait for space or until the service is stopped
+		select {
+		case <-s.outboxSpace:
+		case <-t.Dying():
+			// cancel future
+			f.Cancel()
+
+			s.dropped(msg, ErrOutboxFull)
+			return f
+		}
+	}
+
+	defer s.outboxMutex.Unlock()
+
+	// add message
+	err := s.Outbox.Push(entry)
+	if err != nil {
+		s.err("Outbox", err)
+
+		// cancel future
+		f.Cancel()
+
+		return f
+	}
+
+	// notify dispatcher
+	s.signalOutbox()
+
+	return f
+}
+
+// will publish the next buffered message and return false if the client failed
+func (s *Service) drain(client *Client) bool {
+	s.outboxMutex.Lock()
+
+	// get next message
+	entry, err := s.Outbox.Peek()
+	if err != nil {
+		s.outboxMutex.Unlock()
+		s.err("Outbox", err)
+		return true
+	} else if entry == nil {
+		s.outboxMutex.Unlock()
+		return true
+	}
+
+	// continue with the next message afterwards
+	defer s.signalOutbox()
+
+	// drop expired message
+	if entry.Expired(time.Now()) {
+		err = s.discard(ErrMessageExpired)
+		s.outboxMutex.Unlock()
+		if err != nil {
+			s.err("Outbox", err)
+		}
+
+		return true
+	}
+
+	// mark message as inflight to keep it from being dropped while the mutex
+	// is released during the publish
+	s.outboxInflight = true
+	s.outboxMutex.Unlock()
+
+	// publish message
+	f2, err := client.PublishMessage(entry.Message)
+
+	s.outboxMutex.Lock()
+	defer s.outboxMutex.Unlock()
+
+	// clear flag
+	s.outboxInflight = false
+
+	// check error
+	if err != nil {
+		s.err("Publish", err)
+		return false
+	}
+
+	// remove message
+	err = s.shift()
+	if err != nil {
+		s.err("Outbox", err)
+		return true
+	}
+
+	// bind future in a own goroutine. the goroutine will be ultimately
+	// collected when the service is stopped
+	if entry.future != nil {
+		go entry.future.Bind(f2.(*future.Future))
+	}
+
+	return true
+}
+
+// will remove the first buffered message
+func (s *Service) shift() error {
+	// remove message
+	err := s.Outbox.Pop()
+	if err != nil {
+		return err
+	}
+
+	// notify blocked publishers
+	select {
+	case s.outboxSpace <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// will drop the first buffered message
+func (s *Service) discard(reason error) error {
+	// get message
+	entry, err := s.Outbox.Peek()
+	if err != nil || entry == nil {
+		return err
+	}
+
+	// remove message
+	err = s.shift()
+	if err != nil {
+		return err
+	}
+
+	// cancel future
+	if entry.future != nil {
+		entry.future.Cancel()
+	}
+
+	s.dropped(entry.Message, reason)
+
+	return nil
+}
+
+// will notify the dispatcher about buffered messages
+func (s *Service) signalOutbox() {
+	// check outbox
+	if s.Outbox == nil {
+		return
+	}
+
+	select {
+	case s.outboxSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Service) dropped(msg *packet.Message, err error) {
+	s.log(fmt.Sprintf("Dropped Message: %s", err.Error()))
+
+	if s.DropCallback != nil {
+		s.DropCallback(msg, err)
+	}
+}
+
 func (s *Service) err(sys string, err error) {
 	s.log(fmt.Sprintf("%s Error: %s", sys, err.Error()))
 
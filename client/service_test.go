@@ -1,9 +1,12 @@
 package client
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/256dpi/gomqtt/client/future"
 	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/transport/flow"
 	"github.com/stretchr/testify/assert"
@@ -342,3 +345,430 @@ func BenchmarkServicePublish(b *testing.B) {
 
 	safeReceive(done)
 }
+
+func TestServiceResubscribe(t *testing.T) {
+	subscribe1 := packet.NewSubscribePacket()
+	subscribe1.Subscriptions = []packet.Subscription{{Topic: "foo", QOS: 1}, {Topic: "bar", QOS: 0}}
+	subscribe1.ID = 1
+
+	suback1 := packet.NewSubackPacket()
+	suback1.ReturnCodes = []uint8{1, 0}
+	suback1.ID = 1
+
+	subscribe2 := packet.NewSubscribePacket()
+	subscribe2.Subscriptions = []packet.Subscription{{Topic: "bar", QOS: 0}, {Topic: "foo", QOS: 1}}
+	subscribe2.ID = 1
+
+	suback2 := packet.NewSubackPacket()
+	suback2.ReturnCodes = []uint8{packet.QOSFailure, 1}
+	suback2.ID = 1
+
+	subscribe3 := packet.NewSubscribePacket()
+	subscribe3.Subscriptions = []packet.Subscription{{Topic: "foo", QOS: 1}}
+	subscribe3.ID = 1
+
+	suback3 := packet.NewSubackPacket()
+	suback3.ReturnCodes = []uint8{1}
+	suback3.ID = 1
+
+	subscribed := make(chan struct{})
+
+	broker1 := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(subscribe1).
+		Send(suback1).
+		Wait(subscribed).
+		Close()
+
+	broker2 := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(subscribe2).
+		Send(suback2).
+		End()
+
+	broker3 := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(subscribe3).
+		Send(suback3).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker1, broker2, broker3)
+
+	online := make(chan struct{})
+	failed := make(chan error, 1)
+
+	s := NewService()
+	s.MinReconnectDelay = 10 * time.Millisecond
+	s.Resubscribe = true
+
+	s.OnlineCallback = func(resumed bool) {
+		assert.False(t, resumed)
+		online <- struct{}{}
+	}
+
+	s.ErrorCallback = func(err error) {
+		if _, ok := err.(*SubscriptionError); ok {
+			failed <- err
+		}
+	}
+
+	s.Start(NewConfig("tcp://localhost:" + port))
+
+	safeReceive(online)
+
+	assert.NoError(t, s.SubscribeMultiple(subscribe1.Subscriptions).Wait(1*time.Second))
+	close(subscribed)
+
+	safeReceive(online)
+
+	err := <-failed
+	assert.Equal(t, &SubscriptionError{Subscription: packet.Subscription{Topic: "bar", QOS: 0}}, err)
+	assert.Equal(t, `failed to restore subscription "bar"`, err.Error())
+
+	s.Stop(true)
+
+	safeReceive(done)
+}
+
+func TestServiceOutbox(t *testing.T) {
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("3")
+	publish.Message.QOS = 1
+	publish.ID = 1
+
+	puback := packet.NewPubackPacket()
+	puback.ID = 1
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(publish).
+		Send(puback).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	online := make(chan struct{})
+	offline := make(chan struct{})
+
+	var dropped []string
+	var reasons []error
+
+	s := NewService()
+	s.Outbox = NewMemoryOutbox()
+	s.OutboxLimit = 2
+	s.OutboxOverflow = DropOldest
+
+	s.OnlineCallback = func(resumed bool) {
+		close(online)
+	}
+
+	s.OfflineCallback = func() {
+		close(offline)
+	}
+
+	s.DropCallback = func(msg *packet.Message, err error) {
+		dropped = append(dropped, string(msg.Payload))
+		reasons = append(reasons, err)
+	}
+
+	f1 := s.Publish("test", []byte("1"), 1, false)
+	f2 := s.PublishMessageWithExpiry(&packet.Message{
+		Topic:   "test",
+		Payload: []byte("2"),
+		QOS:     1,
+	}, time.Millisecond)
+	f3 := s.Publish("test", []byte("3"), 1, false)
+	assert.Equal(t, 2, s.OutboxDepth())
+
+	time.Sleep(10 * time.Millisecond)
+
+	s.Start(NewConfig("tcp://localhost:" + port))
+
+	safeReceive(online)
+
+	assert.Equal(t, future.ErrCanceled, f1.Wait(1*time.Second))
+	assert.Equal(t, future.ErrCanceled, f2.Wait(1*time.Second))
+	assert.NoError(t, f3.Wait(1*time.Second))
+	assert.Equal(t, 0, s.OutboxDepth())
+
+	s.Stop(true)
+
+	safeReceive(offline)
+	safeReceive(done)
+
+	assert.Equal(t, []string{"1", "2"}, dropped)
+	assert.Equal(t, []error{ErrOutboxFull, ErrMessageExpired}, reasons)
+}
+
+func TestServiceOutboxDropNewest(t *testing.T) {
+	var dropped []string
+
+	s := NewService()
+	s.Outbox = NewMemoryOutbox()
+	s.OutboxLimit = 1
+	s.DropCallback = func(msg *packet.Message, err error) {
+		assert.Equal(t, ErrOutboxFull, err)
+		dropped = append(dropped, string(msg.Payload))
+	}
+
+	f1 := s.Publish("test", []byte("1"), 1, false)
+	f2 := s.Publish("test", []byte("2"), 1, false)
+
+	assert.Equal(t, future.ErrTimeout, f1.Wait(10*time.Millisecond))
+	assert.Equal(t, future.ErrCanceled, f2.Wait(10*time.Millisecond))
+	assert.Equal(t, 1, s.OutboxDepth())
+	assert.Equal(t, []string{"2"}, dropped)
+}
+
+func TestServiceOutboxBlockStop(t *testing.T) {
+	var dropped []string
+
+	s := NewService()
+	s.MinReconnectDelay = 10 * time.Millisecond
+	s.Outbox = NewMemoryOutbox()
+	s.OutboxLimit = 1
+	s.OutboxOverflow = Block
+	s.DropCallback = func(msg *packet.Message, err error) {
+		assert.Equal(t, ErrOutboxFull, err)
+		dropped = append(dropped, string(msg.Payload))
+	}
+
+	s.Start(NewConfig("tcp://localhost:1"))
+
+	f1 := s.Publish("test", []byte("1"), 1, false)
+
+	result := make(chan GenericFuture)
+	go func() {
+		result <- s.Publish("test", []byte("2"), 1, false)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	s.Stop(true)
+
+	f2 := <-result
+	assert.Equal(t, future.ErrCanceled, f2.Wait(10*time.Millisecond))
+	assert.Equal(t, future.ErrTimeout, f1.Wait(10*time.Millisecond))
+	assert.Equal(t, 1, s.OutboxDepth())
+	assert.Equal(t, []string{"2"}, dropped)
+}
+
+func TestServiceOutboxBlockStopped(t *testing.T) {
+	var dropped []string
+
+	s := NewService()
+	s.Outbox = NewMemoryOutbox()
+	s.OutboxLimit = 1
+	s.OutboxOverflow = Block
+	s.DropCallback = func(msg *packet.Message, err error) {
+		assert.Equal(t, ErrOutboxFull, err)
+		dropped = append(dropped, string(msg.Payload))
+	}
+
+	f1 := s.Publish("test", []byte("1"), 1, false)
+	f2 := s.Publish("test", []byte("2"), 1, false)
+
+	assert.Equal(t, future.ErrTimeout, f1.Wait(10*time.Millisecond))
+	assert.Equal(t, future.ErrCanceled, f2.Wait(10*time.Millisecond))
+	assert.Equal(t, 1, s.OutboxDepth())
+	assert.Equal(t, []string{"2"}, dropped)
+}
+
+func TestServiceFailover(t *testing.T) {
+	primary := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Close()
+
+	secondary := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(disconnectPacket()).
+		End()
+
+	done1, port1 := fakeBroker(t, primary)
+	done2, port2 := fakeBroker(t, secondary)
+
+	online := make(chan struct{}, 2)
+
+	s := NewService()
+	s.MinReconnectDelay = 10 * time.Millisecond
+
+	s.OnlineCallback = func(resumed bool) {
+		online <- struct{}{}
+	}
+
+	config := NewConfigWithBrokers("tcp://localhost:"+port1, "tcp://localhost:"+port2)
+	config.FailbackInterval = 0
+
+	s.Start(config)
+
+	<-online
+	safeReceive(done1)
+	<-online
+
+	s.Stop(true)
+
+	safeReceive(done2)
+}
+
+func TestServiceFailback(t *testing.T) {
+	failed := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Close()
+
+	probe := flow.New().
+		End()
+
+	recovered := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(disconnectPacket()).
+		End()
+
+	secondary := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(disconnectPacket()).
+		End()
+
+	done1, port1 := fakeBroker(t, failed, probe, recovered)
+	done2, port2 := fakeBroker(t, secondary)
+
+	online := make(chan struct{}, 3)
+
+	var mutex sync.Mutex
+	var urls []string
+
+	s := NewService()
+	s.MinReconnectDelay = 10 * time.Millisecond
+
+	s.ConfigCallback = func(config *Config) (*Config, error) {
+		mutex.Lock()
+		urls = append(urls, config.BrokerURL)
+		mutex.Unlock()
+		return config, nil
+	}
+
+	s.OnlineCallback = func(resumed bool) {
+		online <- struct{}{}
+	}
+
+	config := NewConfigWithBrokers("tcp://localhost:"+port1, "tcp://localhost:"+port2)
+	config.FailbackInterval = 50 * time.Millisecond
+
+	s.Start(config)
+
+	<-online
+	<-online
+	safeReceive(done2)
+	<-online
+
+	s.Stop(true)
+
+	safeReceive(done1)
+
+	mutex.Lock()
+	assert.Equal(t, []string{
+		"tcp://localhost:" + port1,
+		"tcp://localhost:" + port2,
+		"tcp://localhost:" + port1,
+		"tcp://localhost:" + port1,
+	}, urls)
+	mutex.Unlock()
+}
+
+func TestServiceReconnectAborted(t *testing.T) {
+	done, port := fakeBroker(t)
+	safeReceive(done)
+
+	aborted := make(chan struct{})
+
+	var errs []error
+
+	s := NewService()
+	s.ReconnectStrategy = &ExponentialBackoff{
+		Min:         time.Millisecond,
+		Max:         time.Millisecond,
+		MaxAttempts: 3,
+	}
+
+	s.ErrorCallback = func(err error) {
+		errs = append(errs, err)
+
+		if err == ErrReconnectAborted {
+			close(aborted)
+		}
+	}
+
+	s.Start(NewConfig("tcp://localhost:" + port))
+
+	safeReceive(aborted)
+
+	s.Stop(true)
+
+	assert.Len(t, errs, 4)
+}
+
+func TestServiceConfigCallback(t *testing.T) {
+	connect1 := connectPacket()
+	connect1.ClientID = "client-1"
+	connect1.Username = "token-1"
+
+	connect2 := connectPacket()
+	connect2.ClientID = "client-2"
+	connect2.Username = "token-2"
+
+	broker := flow.New().
+		Receive(connect1).
+		Send(connackPacket()).
+		Close()
+
+	broker2 := flow.New().
+		Receive(connect2).
+		Send(connackPacket()).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker, broker2)
+
+	online := make(chan struct{}, 2)
+
+	config := NewConfig("tcp://localhost:" + port)
+
+	i := 0
+	s := NewService()
+	s.MinReconnectDelay = 10 * time.Millisecond
+	s.ConfigCallback = func(cfg *Config) (*Config, error) {
+		assert.False(t, cfg == config)
+
+		i++
+		cfg.ClientID = fmt.Sprintf("client-%d", i)
+		cfg.BrokerURL = fmt.Sprintf("tcp://token-%d@localhost:%s", i, port)
+		return cfg, nil
+	}
+
+	s.OnlineCallback = func(resumed bool) {
+		online <- struct{}{}
+	}
+
+	s.Start(config)
+
+	<-online
+	<-online
+
+	s.Stop(true)
+
+	safeReceive(done)
+
+	assert.Equal(t, "tcp://localhost:"+port, config.BrokerURL)
+	assert.Equal(t, "", config.ClientID)
+}
@@ -0,0 +1,223 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// An OverflowPolicy defines how a Subscription handles messages when its
+// buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops new messages while the buffer is full.
+	DropNewest OverflowPolicy = iota
+
+	// DropOldest drops the oldest buffered messages to make room for new ones.
+	DropOldest
+
+	// Block blocks the client until the message has been buffered. This will
+	// also delay keep alives and acknowledgements of other messages.
+	Block
+)
+
+// A Subscription is returned by the channel based subscribe methods and
+// delivers the matching messages using a channel. The embedded SubscribeFuture
+// gets completed once the SubackPacket has been received.
+type Subscription struct {
+	SubscribeFuture
+
+	client   *Client
+	filters  []string
+	policy   OverflowPolicy
+	messages chan *packet.Message
+	done     chan struct{}
+	dropped  uint64
+	closed   bool
+	once     sync.Once
+	mutex    sync.RWMutex
+	fmutex   sync.Mutex
+}
+
+// SubscribeChannel will subscribe to the specified topic and return a
+// Subscription that delivers the matching messages. The buffer defines how many
+// messages are buffered and the policy how further messages are handled.
+//
+// Note: Messages that match a channel subscription are not passed to the
+// Callback.
+func (c *Client) SubscribeChannel(topic string, qos uint8, buffer int, policy OverflowPolicy) (*Subscription, error) {
+	return c.SubscribeMultipleChannel([]packet.Subscription{
+		{Topic: topic, QOS: qos},
+	}, buffer, policy)
+}
+
+// SubscribeMultipleChannel will subscribe to the specified topics and return a
+// single Subscription that delivers the messages matching any of them. Topics
+// that are rejected by the broker are removed from the subscription, which is
+// closed if all of its topics have been rejected.
+func (c *Client) SubscribeMultipleChannel(subscriptions []packet.Subscription, buffer int, policy OverflowPolicy) (*Subscription, error) {
+	// prepare subscription
+	sub := &Subscription{
+		client:   c,
+		policy:   policy,
+		messages: make(chan *packet.Message, buffer),
+		done:     make(chan struct{}),
+	}
+
+	// register subscription before subscribing to receive retained messages
+	for _, s := range subscriptions {
+		sub.filters = append(sub.filters, s.Topic)
+		c.channels.Add(s.Topic, sub)
+	}
+
+	// subscribe
+	subscribeFuture, err := c.subscribeMultiple(subscriptions, sub)
+	if err != nil {
+		sub.close()
+		return nil, err
+	}
+
+	// set future
+	sub.SubscribeFuture = subscribeFuture
+
+	return sub, nil
+}
+
+// Messages returns the channel that receives the messages. The channel is
+// closed when the subscription has been unsubscribed or the client has been
+// closed.
+func (s *Subscription) Messages() <-chan *packet.Message {
+	return s.messages
+}
+
+// Dropped returns the number of messages that have been dropped because the
+// buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Unsubscribe will close the subscription and unsubscribe from the topics that
+// are not used by other callback, channel or router subscriptions. It will
+// return a future that gets completed once the UnsubackPacket has been received
+// or immediately if all topics are still used.
+func (s *Subscription) Unsubscribe() (GenericFuture, error) {
+	// close subscription
+	s.close()
+
+	// take filters to release them only once
+	s.fmutex.Lock()
+	filters := s.filters
+	s.filters = nil
+	s.fmutex.Unlock()
+
+	return s.client.UnsubscribeMultiple(filters)
+}
+
+// removes the filters that have been rejected by the broker and closes the
+// subscription if none remain
+func (s *Subscription) reject(codes []uint8) {
+	s.fmutex.Lock()
+
+	// remove rejected filters
+	var filters []string
+	for i, filter := range s.filters {
+		if i < len(codes) && codes[i] == packet.QOSFailure {
+			s.client.channels.Remove(filter, s)
+			continue
+		}
+
+		filters = append(filters, filter)
+	}
+	s.filters = filters
+
+	s.fmutex.Unlock()
+
+	// close subscription if all filters have been rejected
+	if len(filters) == 0 {
+		s.close()
+	}
+}
+
+// delivers a message according to the policy
+func (s *Subscription) deliver(msg *packet.Message) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	// check state
+	if s.closed {
+		return
+	}
+
+	// block until delivered or closed
+	if s.policy == Block {
+		select {
+		case s.messages <- msg:
+		case <-s.done:
+		}
+
+		return
+	}
+
+	for {
+		// try to deliver
+		select {
+		case s.messages <- msg:
+			return
+		default:
+		}
+
+		// drop message if requested
+		if s.policy == DropNewest {
+			atomic.AddUint64(&s.dropped, 1)
+			return
+		}
+
+		// otherwise drop oldest message and retry
+		select {
+		case <-s.messages:
+			atomic.AddUint64(&s.dropped, 1)
+		default:
+		}
+	}
+}
+
+// removes the subscription and closes the channel
+func (s *Subscription) close() {
+	s.once.Do(func() {
+		// remove subscription
+		s.client.channels.Clear(s)
+
+		// stop blocked deliveries
+		close(s.done)
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		// close channel
+		s.closed = true
+		close(s.messages)
+	})
+}
+
+// delivers the message to matching channel subscriptions and returns whether
+// the message has been delivered
+func (c *Client) deliver(msg *packet.Message) bool {
+	// get subscriptions
+	values := c.channels.Match(msg.Topic)
+
+	// deliver message
+	for _, value := range values {
+		value.(*Subscription).deliver(msg)
+	}
+
+	return len(values) > 0
+}
+
+// closes all channel subscriptions
+func (c *Client) closeChannels() {
+	for _, value := range c.channels.All() {
+		value.(*Subscription).close()
+	}
+}
@@ -0,0 +1,335 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/256dpi/gomqtt/transport/flow"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientSubscribeChannel(t *testing.T) {
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test/+", QOS: 0}}
+	subscribe.ID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.ID = 1
+
+	publish := func(topic, payload string) *packet.PublishPacket {
+		pkt := packet.NewPublishPacket()
+		pkt.Message.Topic = topic
+		pkt.Message.Payload = []byte(payload)
+		return pkt
+	}
+
+	unsubscribe := packet.NewUnsubscribePacket()
+	unsubscribe.Topics = []string{"test/+"}
+	unsubscribe.ID = 2
+
+	unsuback := packet.NewUnsubackPacket()
+	unsuback.ID = 2
+
+	sent := make(chan struct{})
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(subscribe).
+		Send(suback).
+		Send(publish("test/1", "1")).
+		Send(publish("test/2", "2")).
+		Send(publish("test/3", "3")).
+		Send(publish("other", "4")).
+		Receive(unsubscribe).
+		Send(unsuback).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		assert.Equal(t, "other", msg.Topic)
+		close(sent)
+		return nil
+	}
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	sub, err := c.SubscribeChannel("test/+", 0, 1, DropOldest)
+	assert.NoError(t, err)
+	assert.NoError(t, sub.Wait(1*time.Second))
+	assert.Equal(t, []uint8{0}, sub.ReturnCodes())
+
+	safeReceive(sent)
+
+	msg := <-sub.Messages()
+	assert.Equal(t, "test/3", msg.Topic)
+	assert.Equal(t, uint64(2), sub.Dropped())
+
+	unsubscribeFuture, err := sub.Unsubscribe()
+	assert.NoError(t, err)
+	assert.NoError(t, unsubscribeFuture.Wait(1*time.Second))
+
+	_, ok := <-sub.Messages()
+	assert.False(t, ok)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
+
+func TestClientSubscribeChannelClose(t *testing.T) {
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 0}}
+	subscribe.ID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{0}
+	suback.ID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(subscribe).
+		Send(suback).
+		Send(publish).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Callback = errorCallback(t)
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	sub, err := c.SubscribeChannel("test", 0, 0, Block)
+	assert.NoError(t, err)
+	assert.NoError(t, sub.Wait(1*time.Second))
+
+	msg := <-sub.Messages()
+	assert.Equal(t, "test", msg.Topic)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	_, ok := <-sub.Messages()
+	assert.False(t, ok)
+
+	safeReceive(done)
+
+	_, err = c.SubscribeChannel("test", 0, 0, Block)
+	assert.Equal(t, ErrClientNotConnected, err)
+}
+
+func TestClientSubscribeChannelShared(t *testing.T) {
+	subscribe1 := packet.NewSubscribePacket()
+	subscribe1.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 0}}
+	subscribe1.ID = 1
+
+	suback1 := packet.NewSubackPacket()
+	suback1.ReturnCodes = []uint8{0}
+	suback1.ID = 1
+
+	subscribe2 := packet.NewSubscribePacket()
+	subscribe2.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 0}}
+	subscribe2.ID = 2
+
+	suback2 := packet.NewSubackPacket()
+	suback2.ReturnCodes = []uint8{0}
+	suback2.ID = 2
+
+	unsubscribe := packet.NewUnsubscribePacket()
+	unsubscribe.Topics = []string{"test"}
+	unsubscribe.ID = 3
+
+	unsuback := packet.NewUnsubackPacket()
+	unsuback.ID = 3
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(subscribe1).
+		Send(suback1).
+		Receive(subscribe2).
+		Send(suback2).
+		Receive(unsubscribe).
+		Send(unsuback).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Callback = errorCallback(t)
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	sub1, err := c.SubscribeChannel("test", 0, 1, DropNewest)
+	assert.NoError(t, err)
+	assert.NoError(t, sub1.Wait(1*time.Second))
+
+	sub2, err := c.SubscribeChannel("test", 0, 1, DropNewest)
+	assert.NoError(t, err)
+	assert.NoError(t, sub2.Wait(1*time.Second))
+
+	// filter is still used by the second subscription
+	unsubscribeFuture, err := sub1.Unsubscribe()
+	assert.NoError(t, err)
+	assert.NoError(t, unsubscribeFuture.Wait(1*time.Second))
+
+	unsubscribeFuture, err = sub2.Unsubscribe()
+	assert.NoError(t, err)
+	assert.NoError(t, unsubscribeFuture.Wait(1*time.Second))
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
+
+func TestClientSubscribeChannelRejected(t *testing.T) {
+	subscribe := packet.NewSubscribePacket()
+	subscribe.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 0}}
+	subscribe.ID = 1
+
+	suback := packet.NewSubackPacket()
+	suback.ReturnCodes = []uint8{packet.QOSFailure}
+	suback.ID = 1
+
+	publish := packet.NewPublishPacket()
+	publish.Message.Topic = "test"
+	publish.Message.Payload = []byte("test")
+
+	received := make(chan struct{})
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(subscribe).
+		Send(suback).
+		Send(publish).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Callback = func(msg *packet.Message, err error) error {
+		assert.NoError(t, err)
+		assert.Equal(t, "test", msg.Topic)
+		close(received)
+		return nil
+	}
+
+	config := NewConfig("tcp://localhost:" + port)
+	config.ValidateSubs = false
+
+	connectFuture, err := c.Connect(config)
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	sub, err := c.SubscribeChannel("test", 0, 1, DropNewest)
+	assert.NoError(t, err)
+	assert.NoError(t, sub.Wait(1*time.Second))
+	assert.Equal(t, []uint8{packet.QOSFailure}, sub.ReturnCodes())
+
+	_, ok := <-sub.Messages()
+	assert.False(t, ok)
+
+	safeReceive(received)
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
+
+func TestClientSubscribeChannelSharedCallback(t *testing.T) {
+	subscribe1 := packet.NewSubscribePacket()
+	subscribe1.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 0}}
+	subscribe1.ID = 1
+
+	suback1 := packet.NewSubackPacket()
+	suback1.ReturnCodes = []uint8{0}
+	suback1.ID = 1
+
+	subscribe2 := packet.NewSubscribePacket()
+	subscribe2.Subscriptions = []packet.Subscription{{Topic: "test", QOS: 0}}
+	subscribe2.ID = 2
+
+	suback2 := packet.NewSubackPacket()
+	suback2.ReturnCodes = []uint8{0}
+	suback2.ID = 2
+
+	unsubscribe := packet.NewUnsubscribePacket()
+	unsubscribe.Topics = []string{"test"}
+	unsubscribe.ID = 3
+
+	unsuback := packet.NewUnsubackPacket()
+	unsuback.ID = 3
+
+	broker := flow.New().
+		Receive(connectPacket()).
+		Send(connackPacket()).
+		Receive(subscribe1).
+		Send(suback1).
+		Receive(subscribe2).
+		Send(suback2).
+		Receive(unsubscribe).
+		Send(unsuback).
+		Receive(disconnectPacket()).
+		End()
+
+	done, port := fakeBroker(t, broker)
+
+	c := New()
+	c.Callback = errorCallback(t)
+
+	connectFuture, err := c.Connect(NewConfig("tcp://localhost:" + port))
+	assert.NoError(t, err)
+	assert.NoError(t, connectFuture.Wait(1*time.Second))
+
+	subscribeFuture, err := c.Subscribe("test", 0)
+	assert.NoError(t, err)
+	assert.NoError(t, subscribeFuture.Wait(1*time.Second))
+
+	sub, err := c.SubscribeChannel("test", 0, 1, DropNewest)
+	assert.NoError(t, err)
+	assert.NoError(t, sub.Wait(1*time.Second))
+
+	// filter is still used by the callback subscription
+	unsubscribeFuture, err := sub.Unsubscribe()
+	assert.NoError(t, err)
+	assert.NoError(t, unsubscribeFuture.Wait(1*time.Second))
+
+	// unsubscribing twice does not release the filter again
+	unsubscribeFuture, err = sub.Unsubscribe()
+	assert.NoError(t, err)
+	assert.NoError(t, unsubscribeFuture.Wait(1*time.Second))
+
+	unsubscribeFuture, err = c.Unsubscribe("test")
+	assert.NoError(t, err)
+	assert.NoError(t, unsubscribeFuture.Wait(1*time.Second))
+
+	err = c.Disconnect()
+	assert.NoError(t, err)
+
+	safeReceive(done)
+}
@@ -13,7 +13,6 @@ import (
 	"time"
 
 	"github.com/256dpi/gomqtt/broker"
-	"github.com/256dpi/gomqtt/packet"
 	"github.com/256dpi/gomqtt/transport"
 )
 
@@ -45,13 +44,17 @@ func main() {
 	var published int32
 	var forwarded int32
 
-	engine.Logger = func(event broker.LogEvent, client *broker.Client, pkt packet.GenericPacket, msg *packet.Message, err error) {
-		if event == broker.MessagePublished {
-			atomic.AddInt32(&published, 1)
-		} else if event == broker.MessageForwarded {
-			atomic.AddInt32(&forwarded, 1)
+	events := engine.Events.Subscribe(1000)
+
+	go func() {
+		for event := range events.Events() {
+			if event.Type == broker.MessagePublished {
+				atomic.AddInt32(&published, 1)
+			} else if event.Type == broker.MessageForwarded {
+				atomic.AddInt32(&forwarded, 1)
+			}
 		}
-	}
+	}()
 
 	go func() {
 		for {
@@ -73,11 +76,11 @@ func main() {
 
 	<-finish
 
-	backend.Close()
-
 	server.Close()
 
-	engine.Close()
+	engine.Drain(10 * time.Second)
+
+	backend.Close()
 
 	fmt.Println("Bye!")
 }
@@ -0,0 +1,181 @@
+package packet
+
+import "fmt"
+
+// The AuthCode represents the reason code in an AuthPacket.
+type AuthCode uint8
+
+// All available AuthCodes.
+const (
+	// AuthSuccess indicates that the authentication has been successful.
+	AuthSuccess AuthCode = 0x00
+
+	// ContinueAuthentication indicates that the authentication is continued
+	// with another step.
+	ContinueAuthentication AuthCode = 0x18
+
+	// ReAuthenticate is sent by the client to initiate a re-authentication.
+	ReAuthenticate AuthCode = 0x19
+)
+
+// Valid checks if the AuthCode is valid.
+func (ac AuthCode) Valid() bool {
+	return ac == AuthSuccess || ac == ContinueAuthentication || ac == ReAuthenticate
+}
+
+// String returns the corresponding string for the AuthCode.
+func (ac AuthCode) String() string {
+	switch ac {
+	case AuthSuccess:
+		return "success"
+	case ContinueAuthentication:
+		return "continue authentication"
+	case ReAuthenticate:
+		return "re-authenticate"
+	}
+
+	return "unknown"
+}
+
+// An AuthPacket is exchanged between the client and the server to continue an
+// MQTT 5 enhanced authentication that has been started with a ConnectPacket or
+// to perform a re-authentication. Only the authentication method and data
+// properties are supported. As MQTT 3.1.1 does not define an AUTH packet, the
+// packet is only decoded on connections that use MQTT 5.
+type AuthPacket struct {
+	// The ReasonCode of the authentication step.
+	ReasonCode AuthCode
+
+	// The Method is the name of the authentication method.
+	Method string
+
+	// The Data is the method specific authentication data.
+	Data []byte
+}
+
+// NewAuthPacket creates a new AuthPacket.
+func NewAuthPacket() *AuthPacket {
+	return &AuthPacket{}
+}
+
+// Type returns the packets type.
+func (ap *AuthPacket) Type() Type {
+	return AUTH
+}
+
+// String returns a string representation of the packet.
+func (ap *AuthPacket) String() string {
+	return fmt.Sprintf("<AuthPacket ReasonCode=%d Method=%q Data=%v>",
+		ap.ReasonCode, ap.Method, ap.Data)
+}
+
+// Len returns the byte length of the encoded packet.
+func (ap *AuthPacket) Len() int {
+	ml := ap.len()
+	return headerLen(ml) + ml
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+func (ap *AuthPacket) Decode(src []byte) (int, error) {
+	total := 0
+
+	// decode header
+	hl, _, rl, err := headerDecode(src[total:], AUTH)
+	total += hl
+	if err != nil {
+		return total, err
+	}
+
+	// reset packet
+	ap.ReasonCode = AuthSuccess
+	ap.Method = ""
+	ap.Data = nil
+
+	// a zero remaining length indicates a successful authentication
+	if rl == 0 {
+		return total, nil
+	}
+
+	// get end of packet
+	end := total + rl
+
+	// read reason code
+	ap.ReasonCode = AuthCode(src[total])
+	total++
+
+	// check reason code
+	if !ap.ReasonCode.Valid() {
+		return total, fmt.Errorf("[%s] invalid reason code (%d)", ap.Type(), ap.ReasonCode)
+	}
+
+	// properties may be omitted
+	if total == end {
+		return total, nil
+	}
+
+	// read properties
+	var props properties
+	n, err := props.decode(src[total:end], ap.Type())
+	total += n
+	if err != nil {
+		return total, err
+	}
+
+	// check properties length
+	if total != end {
+		return total, fmt.Errorf("[%s] invalid properties length", ap.Type())
+	}
+
+	// set properties
+	ap.Method = props.authMethod
+	ap.Data = props.authData
+
+	return total, nil
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way. If there is an error, the byte slice should be considered invalid.
+func (ap *AuthPacket) Encode(dst []byte) (int, error) {
+	total := 0
+
+	// check reason code
+	if !ap.ReasonCode.Valid() {
+		return total, fmt.Errorf("[%s] invalid reason code (%d)", ap.Type(), ap.ReasonCode)
+	}
+
+	// encode header
+	n, err := headerEncode(dst[total:], 0, ap.len(), ap.Len(), AUTH)
+	total += n
+	if err != nil {
+		return total, err
+	}
+
+	// write reason code
+	dst[total] = byte(ap.ReasonCode)
+	total++
+
+	// write properties
+	n, err = ap.props().encode(dst[total:], ap.Type())
+	total += n
+	if err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
+
+// Returns the remaining length of the packet.
+func (ap *AuthPacket) len() int {
+	// reason code and properties
+	return 1 + ap.props().size()
+}
+
+// Returns the properties of the packet.
+func (ap *AuthPacket) props() *properties {
+	return &properties{
+		authMethod: ap.Method,
+		authData:   ap.Data,
+	}
+}
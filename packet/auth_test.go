@@ -0,0 +1,189 @@
+package packet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthCodes(t *testing.T) {
+	assert.Equal(t, "success", AuthSuccess.String())
+	assert.Equal(t, "continue authentication", ContinueAuthentication.String())
+	assert.Equal(t, "re-authenticate", ReAuthenticate.String())
+	assert.Equal(t, "unknown", AuthCode(1).String())
+	assert.False(t, AuthCode(1).Valid())
+}
+
+func TestAuthInterface(t *testing.T) {
+	pkt := NewAuthPacket()
+
+	assert.Equal(t, pkt.Type(), AUTH)
+	assert.Equal(t, `<AuthPacket ReasonCode=0 Method="" Data=[]>`, pkt.String())
+}
+
+func TestAuthPacketDecode(t *testing.T) {
+	pktBytes := []byte{
+		byte(AUTH << 4),
+		12,
+		0x18, // continue authentication
+		10,   // properties length
+		0x15, // method
+		0, 2,
+		'm', 'e',
+		0x16, // data
+		0, 2,
+		1, 2,
+	}
+
+	pkt := NewAuthPacket()
+
+	n, err := pkt.Decode(pktBytes)
+
+	assert.NoError(t, err)
+	assert.Equal(t, len(pktBytes), n)
+	assert.Equal(t, ContinueAuthentication, pkt.ReasonCode)
+	assert.Equal(t, "me", pkt.Method)
+	assert.Equal(t, []byte{1, 2}, pkt.Data)
+}
+
+func TestAuthPacketDecodeSuccess(t *testing.T) {
+	pktBytes := []byte{
+		byte(AUTH << 4),
+		0,
+	}
+
+	pkt := NewAuthPacket()
+
+	n, err := pkt.Decode(pktBytes)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, AuthSuccess, pkt.ReasonCode)
+	assert.Empty(t, pkt.Method)
+	assert.Empty(t, pkt.Data)
+}
+
+func TestAuthPacketDecodeError1(t *testing.T) {
+	pktBytes := []byte{
+		byte(AUTH << 4),
+		2,
+		0x01, // < invalid reason code
+		0,
+	}
+
+	pkt := NewAuthPacket()
+
+	_, err := pkt.Decode(pktBytes)
+	assert.Error(t, err)
+}
+
+func TestAuthPacketDecodeError2(t *testing.T) {
+	pktBytes := []byte{
+		byte(AUTH << 4),
+		3,
+		0x18,
+		5, // < wrong properties length
+		0x15,
+	}
+
+	pkt := NewAuthPacket()
+
+	_, err := pkt.Decode(pktBytes)
+	assert.Error(t, err)
+}
+
+func TestAuthPacketDecodeError3(t *testing.T) {
+	pktBytes := []byte{
+		byte(AUTH << 4),
+		4,
+		0x18,
+		2,
+		0x00, // < unknown property
+		0,
+	}
+
+	pkt := NewAuthPacket()
+
+	_, err := pkt.Decode(pktBytes)
+	assert.Error(t, err)
+}
+
+func TestAuthPacketDecodeError4(t *testing.T) {
+	pktBytes := []byte{
+		byte(AUTH << 4),
+		7,
+		0x18,
+		5,
+		0x15,
+		0, 5, // < wrong method length
+		'm', 'e',
+	}
+
+	pkt := NewAuthPacket()
+
+	_, err := pkt.Decode(pktBytes)
+	assert.Error(t, err)
+}
+
+func TestAuthPacketEncode(t *testing.T) {
+	pktBytes := []byte{
+		byte(AUTH << 4),
+		12,
+		0x19, // re-authenticate
+		10,   // properties length
+		0x15, // method
+		0, 2,
+		'm', 'e',
+		0x16, // data
+		0, 2,
+		1, 2,
+	}
+
+	pkt := NewAuthPacket()
+	pkt.ReasonCode = ReAuthenticate
+	pkt.Method = "me"
+	pkt.Data = []byte{1, 2}
+
+	dst := make([]byte, pkt.Len())
+	n, err := pkt.Encode(dst)
+
+	assert.NoError(t, err)
+	assert.Equal(t, len(pktBytes), n)
+	assert.Equal(t, pktBytes, dst[:n])
+}
+
+func TestAuthPacketEncodeError1(t *testing.T) {
+	pkt := NewAuthPacket()
+	pkt.ReasonCode = 0x01 // < invalid reason code
+
+	dst := make([]byte, pkt.Len())
+	_, err := pkt.Encode(dst)
+	assert.Error(t, err)
+}
+
+func TestAuthPacketEncodeError2(t *testing.T) {
+	pkt := NewAuthPacket()
+	pkt.Method = "me"
+
+	dst := make([]byte, 2) // < too small buffer
+	_, err := pkt.Encode(dst)
+	assert.Error(t, err)
+}
+
+func TestAuthEqualDecodeEncode(t *testing.T) {
+	pkt := NewAuthPacket()
+	pkt.ReasonCode = ContinueAuthentication
+	pkt.Method = "SCRAM-SHA-256"
+	pkt.Data = []byte("n,,n=user,r=nonce")
+
+	dst := make([]byte, pkt.Len())
+	n, err := pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, pkt.Len(), n)
+
+	pkt2 := NewAuthPacket()
+	n2, err := pkt2.Decode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, n, n2)
+	assert.Equal(t, pkt, pkt2)
+}
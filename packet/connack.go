@@ -52,6 +52,16 @@ type ConnackPacket struct {
 	// is unable to process it for some reason, then the server should attempt
 	// to send a ConnackPacket containing a non-zero ReturnCode.
 	ReturnCode ConnackCode
+
+	// The AuthMethod and AuthData complete an MQTT 5 enhanced authentication.
+	// They are only encoded if the Version is 5.
+	AuthMethod string
+	AuthData   []byte
+
+	// The Version of the connection. If set to Version5, the packet is encoded
+	// and decoded using MQTT 5 and the ReturnCode is mapped to and from the
+	// MQTT 5 reason codes.
+	Version byte
 }
 
 // NewConnackPacket creates a new ConnackPacket.
@@ -72,7 +82,8 @@ func (cp *ConnackPacket) String() string {
 
 // Len returns the byte length of the encoded packet.
 func (cp *ConnackPacket) Len() int {
-	return headerLen(2) + 2
+	ml := cp.len()
+	return headerLen(ml) + ml
 }
 
 // Decode reads from the byte slice argument. It returns the total number of
@@ -88,7 +99,7 @@ func (cp *ConnackPacket) Decode(src []byte) (int, error) {
 	}
 
 	// check remaining length
-	if rl != 2 {
+	if rl != 2 && (cp.Version != Version5 || rl < 2) {
 		return total, fmt.Errorf("[%s] expected remaining length to be 2", cp.Type())
 	}
 
@@ -106,6 +117,26 @@ func (cp *ConnackPacket) Decode(src []byte) (int, error) {
 	cp.ReturnCode = ConnackCode(src[total])
 	total++
 
+	// read reason code and properties
+	cp.AuthMethod = ""
+	cp.AuthData = nil
+	if cp.Version == Version5 {
+		cp.ReturnCode = connackCodeFromReason(byte(cp.ReturnCode))
+
+		// properties may be omitted
+		if rl > 2 {
+			var props properties
+			n, err := props.decode(src[total:hl+rl], cp.Type())
+			total += n
+			if err != nil {
+				return total, err
+			}
+
+			cp.AuthMethod = props.authMethod
+			cp.AuthData = props.authData
+		}
+	}
+
 	// check return code
 	if !cp.ReturnCode.Valid() {
 		return 0, fmt.Errorf("[%s] invalid return code (%d)", cp.Type(), cp.ReturnCode)
@@ -121,7 +152,7 @@ func (cp *ConnackPacket) Encode(dst []byte) (int, error) {
 	total := 0
 
 	// encode header
-	n, err := headerEncode(dst[total:], 0, 2, cp.Len(), CONNACK)
+	n, err := headerEncode(dst[total:], 0, cp.len(), cp.Len(), CONNACK)
 	total += n
 	if err != nil {
 		return total, err
@@ -141,8 +172,78 @@ func (cp *ConnackPacket) Encode(dst []byte) (int, error) {
 	}
 
 	// set return code
-	dst[total] = byte(cp.ReturnCode)
+	if cp.Version == Version5 {
+		dst[total] = cp.ReturnCode.reason()
+	} else {
+		dst[total] = byte(cp.ReturnCode)
+	}
 	total++
 
+	// write properties
+	if cp.Version == Version5 {
+		n, err = cp.props().encode(dst[total:], cp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
 	return total, nil
 }
+
+// Returns the remaining length of the packet.
+func (cp *ConnackPacket) len() int {
+	// flags and return code
+	total := 2
+
+	// properties
+	if cp.Version == Version5 {
+		total += cp.props().size()
+	}
+
+	return total
+}
+
+// Returns the properties of the packet.
+func (cp *ConnackPacket) props() *properties {
+	return &properties{
+		authMethod: cp.AuthMethod,
+		authData:   cp.AuthData,
+	}
+}
+
+// Returns the MQTT 5 reason code for the ConnackCode.
+func (cc ConnackCode) reason() byte {
+	switch cc {
+	case ErrInvalidProtocolVersion:
+		return 0x84
+	case ErrIdentifierRejected:
+		return 0x85
+	case ErrServerUnavailable:
+		return 0x88
+	case ErrBadUsernameOrPassword:
+		return 0x86
+	case ErrNotAuthorized:
+		return 0x87
+	}
+
+	return byte(cc)
+}
+
+// Returns the ConnackCode for an MQTT 5 reason code.
+func connackCodeFromReason(reason byte) ConnackCode {
+	switch reason {
+	case 0x00:
+		return ConnectionAccepted
+	case 0x84:
+		return ErrInvalidProtocolVersion
+	case 0x85:
+		return ErrIdentifierRejected
+	case 0x86:
+		return ErrBadUsernameOrPassword
+	case 0x87, 0x8C:
+		return ErrNotAuthorized
+	}
+
+	return ErrServerUnavailable
+}
@@ -179,6 +179,43 @@ func TestConnackEqualDecodeEncode(t *testing.T) {
 	assert.Equal(t, 4, n3)
 }
 
+func TestConnackPacketVersion5(t *testing.T) {
+	pkt := NewConnackPacket()
+	pkt.Version = Version5
+	pkt.ReturnCode = ErrNotAuthorized
+
+	dst := make([]byte, pkt.Len())
+	n, err := pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{byte(CONNACK << 4), 3, 0, 0x87, 0}, dst[:n])
+
+	pkt = NewConnackPacket()
+	pkt.Version = Version5
+	_, err = pkt.Decode([]byte{byte(CONNACK << 4), 5, 1, 0x8C, 2, 0x21, 0})
+	assert.Error(t, err)
+
+	_, err = pkt.Decode([]byte{byte(CONNACK << 4), 6, 1, 0x8C, 3, 0x21, 0, 10})
+	assert.NoError(t, err)
+	assert.True(t, pkt.SessionPresent)
+	assert.Equal(t, ErrNotAuthorized, pkt.ReturnCode)
+
+	pkt = NewConnackPacket()
+	pkt.Version = Version5
+	pkt.AuthMethod = "method"
+	pkt.AuthData = []byte("data")
+
+	dst = make([]byte, pkt.Len())
+	n, err = pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, len(dst), n)
+
+	pkt2 := NewConnackPacket()
+	pkt2.Version = Version5
+	_, err = pkt2.Decode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, pkt, pkt2)
+}
+
 func BenchmarkConnackEncode(b *testing.B) {
 	pkt := NewConnackPacket()
 	pkt.ReturnCode = ConnectionAccepted
@@ -8,6 +8,7 @@ import (
 
 // The supported MQTT versions.
 const (
+	Version5   byte = 5
 	Version311 byte = 4
 	Version31  byte = 3
 )
@@ -36,7 +37,17 @@ type ConnectPacket struct {
 	// The will message.
 	Will *Message
 
-	// The MQTT version 3 or 4 (defaults to 4 when 0).
+	// The AuthMethod and AuthData begin an MQTT 5 enhanced authentication.
+	// They are only encoded if the Version is 5.
+	AuthMethod string
+	AuthData   []byte
+
+	// The SessionExpiry is the MQTT 5 session expiry interval in seconds. It
+	// is only encoded if the Version is 5 and omitted when zero.
+	SessionExpiry uint32
+
+	// The MQTT version 3, 4 or 5 (defaults to 4 when 0). If set to 5, the
+	// connection uses the MQTT 5 encoding for all subsequent packets.
 	Version byte
 }
 
@@ -108,7 +119,7 @@ func (cp *ConnectPacket) Decode(src []byte) (int, error) {
 	total++
 
 	// check protocol string and version
-	if versionByte != Version311 && versionByte != Version31 {
+	if versionByte != Version5 && versionByte != Version311 && versionByte != Version31 {
 		return total, fmt.Errorf("[%s] invalid protocol version (%d)", cp.Type(), versionByte)
 	}
 
@@ -171,6 +182,23 @@ func (cp *ConnectPacket) Decode(src []byte) (int, error) {
 	cp.KeepAlive = binary.BigEndian.Uint16(src[total:])
 	total += 2
 
+	// read properties
+	cp.AuthMethod = ""
+	cp.AuthData = nil
+	cp.SessionExpiry = 0
+	if cp.Version == Version5 {
+		var props properties
+		n, err = props.decode(src[total:], cp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		cp.AuthMethod = props.authMethod
+		cp.AuthData = props.authData
+		cp.SessionExpiry = props.sessionExpiry
+	}
+
 	// read client id
 	cp.ClientID, n, err = readLPString(src[total:], cp.Type())
 	total += n
@@ -183,6 +211,18 @@ func (cp *ConnectPacket) Decode(src []byte) (int, error) {
 		return total, fmt.Errorf("[%s] clean session must be 1 if client id is zero length", cp.Type())
 	}
 
+	// read will properties
+	if cp.Will != nil && cp.Version == Version5 {
+		var props properties
+		n, err = props.decode(src[total:], cp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		cp.Will.UserProperties = props.userProperties
+	}
+
 	// read will topic and payload
 	if cp.Will != nil {
 		cp.Will.Topic, n, err = readLPString(src[total:], cp.Type())
@@ -238,12 +278,12 @@ func (cp *ConnectPacket) Encode(dst []byte) (int, error) {
 	}
 
 	// check version byte
-	if cp.Version != Version311 && cp.Version != Version31 {
+	if cp.Version != Version5 && cp.Version != Version311 && cp.Version != Version31 {
 		return total, fmt.Errorf("[%s] unsupported protocol version %d", cp.Type(), cp.Version)
 	}
 
 	// write version string, length has been checked beforehand
-	if cp.Version == Version311 {
+	if cp.Version == Version5 || cp.Version == Version311 {
 		n, _ = writeLPBytes(dst[total:], version311Name, cp.Type())
 		total += n
 	} else if cp.Version == Version31 {
@@ -319,6 +359,15 @@ func (cp *ConnectPacket) Encode(dst []byte) (int, error) {
 	binary.BigEndian.PutUint16(dst[total:], cp.KeepAlive)
 	total += 2
 
+	// write properties
+	if cp.Version == Version5 {
+		n, err = cp.props().encode(dst[total:], cp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
 	// write client id
 	n, err = writeLPString(dst[total:], cp.ClientID, cp.Type())
 	total += n
@@ -326,6 +375,15 @@ func (cp *ConnectPacket) Encode(dst []byte) (int, error) {
 		return total, err
 	}
 
+	// write will properties
+	if cp.Will != nil && cp.Version == Version5 {
+		n, err = cp.willProps().encode(dst[total:], cp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
 	// write will topic and payload
 	if cp.Will != nil {
 		n, err = writeLPString(dst[total:], cp.Will.Topic, cp.Type())
@@ -386,9 +444,19 @@ func (cp *ConnectPacket) len() int {
 	// 2 bytes keep alive timer
 	total += 1 + 2
 
+	// add the properties length
+	if cp.Version == Version5 {
+		total += cp.props().size()
+	}
+
 	// add the clientID length
 	total += 2 + len(cp.ClientID)
 
+	// add the will properties length
+	if cp.Will != nil && cp.Version == Version5 {
+		total += cp.willProps().size()
+	}
+
 	// add the will topic and will message length
 	if cp.Will != nil {
 		total += 2 + len(cp.Will.Topic) + 2 + len(cp.Will.Payload)
@@ -406,3 +474,19 @@ func (cp *ConnectPacket) len() int {
 
 	return total
 }
+
+// Returns the properties of the packet.
+func (cp *ConnectPacket) props() *properties {
+	return &properties{
+		sessionExpiry: cp.SessionExpiry,
+		authMethod:    cp.AuthMethod,
+		authData:      cp.AuthData,
+	}
+}
+
+// Returns the properties of the will message.
+func (cp *ConnectPacket) willProps() *properties {
+	return &properties{
+		userProperties: cp.Will.UserProperties,
+	}
+}
@@ -705,6 +705,33 @@ func TestConnectEqualDecodeEncode(t *testing.T) {
 	assert.Equal(t, len(pktBytes), n3)
 }
 
+func TestConnectPacketVersion5(t *testing.T) {
+	pkt := NewConnectPacket()
+	pkt.Version = Version5
+	pkt.ClientID = "gomqtt"
+	pkt.Username = "user"
+	pkt.AuthMethod = "method"
+	pkt.AuthData = []byte("data")
+	pkt.SessionExpiry = 60
+	pkt.Will = &Message{
+		Topic:          "will",
+		Payload:        []byte("bye"),
+		UserProperties: UserProperties{{Key: "foo", Value: "bar"}},
+	}
+
+	dst := make([]byte, pkt.Len())
+	n, err := pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, len(dst), n)
+	assert.Equal(t, Version5, dst[8])
+
+	pkt2 := NewConnectPacket()
+	n2, err := pkt2.Decode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, n, n2)
+	assert.Equal(t, pkt, pkt2)
+}
+
 func BenchmarkConnectEncode(b *testing.B) {
 	pkt := NewConnectPacket()
 	pkt.Will = &Message{
@@ -5,41 +5,55 @@ import (
 	"fmt"
 )
 
-// Returns the byte length of an identified packet.
-func identifiedPacketLen() int {
+// Returns the byte length of an identified packet. MQTT 5 packets carry an
+// additional reason code if it does not indicate a success.
+func identifiedPacketLen(code byte, version byte) int {
+	if version == Version5 && code != 0 {
+		return headerLen(3) + 3
+	}
+
 	return headerLen(2) + 2
 }
 
-// Decodes an identified packet.
-func identifiedPacketDecode(src []byte, t Type) (int, ID, error) {
+// Decodes an identified packet. MQTT 5 packets may carry a reason code that
+// is returned and properties that are skipped.
+func identifiedPacketDecode(src []byte, t Type, version byte) (int, ID, byte, error) {
 	total := 0
 
 	// decode header
 	hl, _, rl, err := headerDecode(src, t)
 	total += hl
 	if err != nil {
-		return total, 0, err
+		return total, 0, 0, err
 	}
 
 	// check remaining length
-	if rl != 2 {
-		return total, 0, fmt.Errorf("[%s] expected remaining length to be 2", t)
+	if rl != 2 && (version != Version5 || rl < 2) {
+		return total, 0, 0, fmt.Errorf("[%s] expected remaining length to be 2", t)
 	}
 
 	// read packet id
 	packetID := binary.BigEndian.Uint16(src[total:])
 	total += 2
 
+	// read reason code and skip properties
+	var code byte
+	if rl > 2 {
+		code = src[total]
+		total += rl - 2
+	}
+
 	// check packet id
 	if packetID == 0 {
-		return total, 0, fmt.Errorf("[%s] packet id must be grater than zero", t)
+		return total, 0, 0, fmt.Errorf("[%s] packet id must be grater than zero", t)
 	}
 
-	return total, ID(packetID), nil
+	return total, ID(packetID), code, nil
 }
 
-// Encodes an identified packet.
-func identifiedPacketEncode(dst []byte, id ID, t Type) (int, error) {
+// Encodes an identified packet. The reason code is only encoded using MQTT 5
+// if it does not indicate a success.
+func identifiedPacketEncode(dst []byte, id ID, code byte, version byte, t Type) (int, error) {
 	total := 0
 
 	// check packet id
@@ -47,8 +61,14 @@ func identifiedPacketEncode(dst []byte, id ID, t Type) (int, error) {
 		return total, fmt.Errorf("[%s] packet id must be grater than zero", t)
 	}
 
+	// get remaining length
+	rl := 2
+	if version == Version5 && code != 0 {
+		rl = 3
+	}
+
 	// encode header
-	n, err := headerEncode(dst[total:], 0, 2, identifiedPacketLen(), t)
+	n, err := headerEncode(dst[total:], 0, rl, identifiedPacketLen(code, version), t)
 	total += n
 	if err != nil {
 		return total, err
@@ -58,6 +78,12 @@ func identifiedPacketEncode(dst []byte, id ID, t Type) (int, error) {
 	binary.BigEndian.PutUint16(dst[total:], uint16(id))
 	total += 2
 
+	// write reason code
+	if rl > 2 {
+		dst[total] = code
+		total++
+	}
+
 	return total, nil
 }
 
@@ -65,6 +91,13 @@ func identifiedPacketEncode(dst []byte, id ID, t Type) (int, error) {
 type PubackPacket struct {
 	// The packet identifier.
 	ID ID
+
+	// The Version of the connection.
+	Version byte
+
+	// The ReasonCode of the packet. It is only encoded and decoded using MQTT
+	// 5 where codes of 0x80 and above indicate a failure.
+	ReasonCode byte
 }
 
 // NewPubackPacket creates a new PubackPacket.
@@ -79,14 +112,15 @@ func (pp *PubackPacket) Type() Type {
 
 // Len returns the byte length of the encoded packet.
 func (pp *PubackPacket) Len() int {
-	return identifiedPacketLen()
+	return identifiedPacketLen(pp.ReasonCode, pp.Version)
 }
 
 // Decode reads from the byte slice argument. It returns the total number of
 // bytes decoded, and whether there have been any errors during the process.
 func (pp *PubackPacket) Decode(src []byte) (int, error) {
-	n, pid, err := identifiedPacketDecode(src, PUBACK)
+	n, pid, code, err := identifiedPacketDecode(src, PUBACK, pp.Version)
 	pp.ID = pid
+	pp.ReasonCode = code
 	return n, err
 }
 
@@ -94,7 +128,7 @@ func (pp *PubackPacket) Decode(src []byte) (int, error) {
 // returns the number of bytes encoded and whether there's any errors along
 // the way. If there is an error, the byte slice should be considered invalid.
 func (pp *PubackPacket) Encode(dst []byte) (int, error) {
-	return identifiedPacketEncode(dst, pp.ID, PUBACK)
+	return identifiedPacketEncode(dst, pp.ID, pp.ReasonCode, pp.Version, PUBACK)
 }
 
 // String returns a string representation of the packet.
@@ -107,6 +141,13 @@ func (pp *PubackPacket) String() string {
 type PubcompPacket struct {
 	// The packet identifier.
 	ID ID
+
+	// The Version of the connection.
+	Version byte
+
+	// The ReasonCode of the packet. It is only encoded and decoded using MQTT
+	// 5 where codes of 0x80 and above indicate a failure.
+	ReasonCode byte
 }
 
 var _ GenericPacket = (*PubcompPacket)(nil)
@@ -123,14 +164,15 @@ func (pp *PubcompPacket) Type() Type {
 
 // Len returns the byte length of the encoded packet.
 func (pp *PubcompPacket) Len() int {
-	return identifiedPacketLen()
+	return identifiedPacketLen(pp.ReasonCode, pp.Version)
 }
 
 // Decode reads from the byte slice argument. It returns the total number of
 // bytes decoded, and whether there have been any errors during the process.
 func (pp *PubcompPacket) Decode(src []byte) (int, error) {
-	n, pid, err := identifiedPacketDecode(src, PUBCOMP)
+	n, pid, code, err := identifiedPacketDecode(src, PUBCOMP, pp.Version)
 	pp.ID = pid
+	pp.ReasonCode = code
 	return n, err
 }
 
@@ -138,7 +180,7 @@ func (pp *PubcompPacket) Decode(src []byte) (int, error) {
 // returns the number of bytes encoded and whether there's any errors along
 // the way. If there is an error, the byte slice should be considered invalid.
 func (pp *PubcompPacket) Encode(dst []byte) (int, error) {
-	return identifiedPacketEncode(dst, pp.ID, PUBCOMP)
+	return identifiedPacketEncode(dst, pp.ID, pp.ReasonCode, pp.Version, PUBCOMP)
 }
 
 // String returns a string representation of the packet.
@@ -151,6 +193,13 @@ func (pp *PubcompPacket) String() string {
 type PubrecPacket struct {
 	// Shared packet identifier.
 	ID ID
+
+	// The Version of the connection.
+	Version byte
+
+	// The ReasonCode of the packet. It is only encoded and decoded using MQTT
+	// 5 where codes of 0x80 and above indicate a failure.
+	ReasonCode byte
 }
 
 // NewPubrecPacket creates a new PubrecPacket.
@@ -165,14 +214,15 @@ func (pp *PubrecPacket) Type() Type {
 
 // Len returns the byte length of the encoded packet.
 func (pp *PubrecPacket) Len() int {
-	return identifiedPacketLen()
+	return identifiedPacketLen(pp.ReasonCode, pp.Version)
 }
 
 // Decode reads from the byte slice argument. It returns the total number of
 // bytes decoded, and whether there have been any errors during the process.
 func (pp *PubrecPacket) Decode(src []byte) (int, error) {
-	n, pid, err := identifiedPacketDecode(src, PUBREC)
+	n, pid, code, err := identifiedPacketDecode(src, PUBREC, pp.Version)
 	pp.ID = pid
+	pp.ReasonCode = code
 	return n, err
 }
 
@@ -180,7 +230,7 @@ func (pp *PubrecPacket) Decode(src []byte) (int, error) {
 // returns the number of bytes encoded and whether there's any errors along
 // the way. If there is an error, the byte slice should be considered invalid.
 func (pp *PubrecPacket) Encode(dst []byte) (int, error) {
-	return identifiedPacketEncode(dst, pp.ID, PUBREC)
+	return identifiedPacketEncode(dst, pp.ID, pp.ReasonCode, pp.Version, PUBREC)
 }
 
 // String returns a string representation of the packet.
@@ -193,6 +243,13 @@ func (pp *PubrecPacket) String() string {
 type PubrelPacket struct {
 	// Shared packet identifier.
 	ID ID
+
+	// The Version of the connection.
+	Version byte
+
+	// The ReasonCode of the packet. It is only encoded and decoded using MQTT
+	// 5 where codes of 0x80 and above indicate a failure.
+	ReasonCode byte
 }
 
 var _ GenericPacket = (*PubrelPacket)(nil)
@@ -209,14 +266,15 @@ func (pp *PubrelPacket) Type() Type {
 
 // Len returns the byte length of the encoded packet.
 func (pp *PubrelPacket) Len() int {
-	return identifiedPacketLen()
+	return identifiedPacketLen(pp.ReasonCode, pp.Version)
 }
 
 // Decode reads from the byte slice argument. It returns the total number of
 // bytes decoded, and whether there have been any errors during the process.
 func (pp *PubrelPacket) Decode(src []byte) (int, error) {
-	n, pid, err := identifiedPacketDecode(src, PUBREL)
+	n, pid, code, err := identifiedPacketDecode(src, PUBREL, pp.Version)
 	pp.ID = pid
+	pp.ReasonCode = code
 	return n, err
 }
 
@@ -224,52 +282,10 @@ func (pp *PubrelPacket) Decode(src []byte) (int, error) {
 // returns the number of bytes encoded and whether there's any errors along
 // the way. If there is an error, the byte slice should be considered invalid.
 func (pp *PubrelPacket) Encode(dst []byte) (int, error) {
-	return identifiedPacketEncode(dst, pp.ID, PUBREL)
+	return identifiedPacketEncode(dst, pp.ID, pp.ReasonCode, pp.Version, PUBREL)
 }
 
 // String returns a string representation of the packet.
 func (pp *PubrelPacket) String() string {
 	return fmt.Sprintf("<PubrelPacket ID=%d>", pp.ID)
 }
-
-// An UnsubackPacket is sent by the server to the client to confirm receipt of
-// an UnsubscribePacket.
-type UnsubackPacket struct {
-	// Shared packet identifier.
-	ID ID
-}
-
-// NewUnsubackPacket creates a new UnsubackPacket.
-func NewUnsubackPacket() *UnsubackPacket {
-	return &UnsubackPacket{}
-}
-
-// Type returns the packets type.
-func (up *UnsubackPacket) Type() Type {
-	return UNSUBACK
-}
-
-// Len returns the byte length of the encoded packet.
-func (up *UnsubackPacket) Len() int {
-	return identifiedPacketLen()
-}
-
-// Decode reads from the byte slice argument. It returns the total number of
-// bytes decoded, and whether there have been any errors during the process.
-func (up *UnsubackPacket) Decode(src []byte) (int, error) {
-	n, pid, err := identifiedPacketDecode(src, UNSUBACK)
-	up.ID = pid
-	return n, err
-}
-
-// Encode writes the packet bytes into the byte slice from the argument. It
-// returns the number of bytes encoded and whether there's any errors along
-// the way. If there is an error, the byte slice should be considered invalid.
-func (up *UnsubackPacket) Encode(dst []byte) (int, error) {
-	return identifiedPacketEncode(dst, up.ID, UNSUBACK)
-}
-
-// String returns a string representation of the packet.
-func (up *UnsubackPacket) String() string {
-	return fmt.Sprintf("<UnsubackPacket ID=%d>", up.ID)
-}
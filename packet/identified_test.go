@@ -15,7 +15,7 @@ func TestIdentifiedPacketDecode(t *testing.T) {
 		7, // packet ID LSB
 	}
 
-	n, pid, err := identifiedPacketDecode(pktBytes, PUBACK)
+	n, pid, _, err := identifiedPacketDecode(pktBytes, PUBACK, 0)
 	assert.NoError(t, err)
 	assert.Equal(t, 4, n)
 	assert.Equal(t, ID(7), pid)
@@ -29,7 +29,7 @@ func TestIdentifiedPacketDecodeError1(t *testing.T) {
 		7, // packet ID LSB
 	}
 
-	n, pid, err := identifiedPacketDecode(pktBytes, PUBACK)
+	n, pid, _, err := identifiedPacketDecode(pktBytes, PUBACK, 0)
 	assert.Error(t, err)
 	assert.Equal(t, 2, n)
 	assert.Equal(t, ID(0), pid)
@@ -43,7 +43,7 @@ func TestIdentifiedPacketDecodeError2(t *testing.T) {
 		// < insufficient bytes
 	}
 
-	n, pid, err := identifiedPacketDecode(pktBytes, PUBACK)
+	n, pid, _, err := identifiedPacketDecode(pktBytes, PUBACK, 0)
 	assert.Error(t, err)
 	assert.Equal(t, 2, n)
 	assert.Equal(t, ID(0), pid)
@@ -57,7 +57,7 @@ func TestIdentifiedPacketDecodeError3(t *testing.T) {
 		0, // packet ID MSB < zero id
 	}
 
-	n, pid, err := identifiedPacketDecode(pktBytes, PUBACK)
+	n, pid, _, err := identifiedPacketDecode(pktBytes, PUBACK, 0)
 	assert.Error(t, err)
 	assert.Equal(t, 4, n)
 	assert.Equal(t, ID(0), pid)
@@ -71,8 +71,8 @@ func TestIdentifiedPacketEncode(t *testing.T) {
 		7, // packet ID LSB
 	}
 
-	dst := make([]byte, identifiedPacketLen())
-	n, err := identifiedPacketEncode(dst, 7, PUBACK)
+	dst := make([]byte, identifiedPacketLen(0, 0))
+	n, err := identifiedPacketEncode(dst, 7, 0, 0, PUBACK)
 
 	assert.NoError(t, err)
 	assert.Equal(t, 4, n)
@@ -81,15 +81,15 @@ func TestIdentifiedPacketEncode(t *testing.T) {
 
 func TestIdentifiedPacketEncodeError1(t *testing.T) {
 	dst := make([]byte, 3) // < insufficient buffer
-	n, err := identifiedPacketEncode(dst, 7, PUBACK)
+	n, err := identifiedPacketEncode(dst, 7, 0, 0, PUBACK)
 
 	assert.Error(t, err)
 	assert.Equal(t, 0, n)
 }
 
 func TestIdentifiedPacketEncodeError2(t *testing.T) {
-	dst := make([]byte, identifiedPacketLen())
-	n, err := identifiedPacketEncode(dst, 0, PUBACK) // < zero id
+	dst := make([]byte, identifiedPacketLen(0, 0))
+	n, err := identifiedPacketEncode(dst, 0, 0, 0, PUBACK) // < zero id
 
 	assert.Error(t, err)
 	assert.Equal(t, 0, n)
@@ -110,18 +110,92 @@ func TestIdentifiedPacketEqualDecodeEncode(t *testing.T) {
 	assert.Equal(t, 4, n)
 
 	dst := make([]byte, 100)
-	n2, err := identifiedPacketEncode(dst, 7, PUBACK)
+	n2, err := identifiedPacketEncode(dst, 7, 0, 0, PUBACK)
 
 	assert.NoError(t, err)
 	assert.Equal(t, 4, n2)
 	assert.Equal(t, pktBytes, dst[:n2])
 
-	n3, pid, err := identifiedPacketDecode(pktBytes, PUBACK)
+	n3, pid, _, err := identifiedPacketDecode(pktBytes, PUBACK, 0)
 	assert.NoError(t, err)
 	assert.Equal(t, 4, n3)
 	assert.Equal(t, ID(7), pid)
 }
 
+func TestIdentifiedPacketDecodeVersion5(t *testing.T) {
+	pktBytes := []byte{
+		byte(PUBACK << 4),
+		4,
+		0,    // packet ID MSB
+		7,    // packet ID LSB
+		0x10, // reason code
+		0,    // properties length
+	}
+
+	_, _, _, err := identifiedPacketDecode(pktBytes, PUBACK, 0)
+	assert.Error(t, err)
+
+	n, pid, code, err := identifiedPacketDecode(pktBytes, PUBACK, Version5)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, n)
+	assert.Equal(t, ID(7), pid)
+	assert.Equal(t, byte(0x10), code)
+}
+
+func TestIdentifiedPacketReasonCode(t *testing.T) {
+	pktBytes := []byte{
+		byte(PUBACK << 4),
+		3,
+		0,    // packet ID MSB
+		7,    // packet ID LSB
+		0x87, // reason code
+	}
+
+	pkt := NewPubackPacket()
+	pkt.Version = Version5
+	n, err := pkt.Decode(pktBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+	assert.Equal(t, ID(7), pkt.ID)
+	assert.Equal(t, byte(0x87), pkt.ReasonCode)
+
+	dst := make([]byte, pkt.Len())
+	n2, err := pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, pktBytes, dst[:n2])
+
+	// reason codes are not encoded using MQTT 3.1.1
+	pkt.Version = 0
+	dst = make([]byte, pkt.Len())
+	n2, err = pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{byte(PUBACK << 4), 2, 0, 7}, dst[:n2])
+}
+
+func TestUnsubackPacketVersion5(t *testing.T) {
+	pktBytes := []byte{
+		byte(UNSUBACK << 4),
+		5,
+		0,          // packet ID MSB
+		7,          // packet ID LSB
+		0,          // properties length
+		0x00, 0x11, // reason codes
+	}
+
+	pkt := NewUnsubackPacket()
+	pkt.Version = Version5
+	n, err := pkt.Decode(pktBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, len(pktBytes), n)
+	assert.Equal(t, ID(7), pkt.ID)
+	assert.Equal(t, []byte{0x00, 0x11}, pkt.ReasonCodes)
+
+	dst := make([]byte, pkt.Len())
+	n2, err := pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, pktBytes, dst[:n2])
+}
+
 func BenchmarkIdentifiedPacketEncode(b *testing.B) {
 	pkt := &PubackPacket{}
 	pkt.ID = 1
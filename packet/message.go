@@ -17,6 +17,37 @@ type Message struct {
 	// so that it can be delivered to future subscribers whose subscriptions
 	// match its topic name.
 	Retain bool
+
+	// The UserProperties are MQTT 5 user properties that are attached to the
+	// message. They are only encoded on connections that use MQTT 5 and are
+	// dropped when the message is sent using MQTT 3.1.1.
+	UserProperties UserProperties
+
+	// The SubscriptionIdentifiers are the MQTT 5 subscription identifiers of
+	// all subscriptions that matched the message when it was forwarded. Like
+	// user properties, they are only encoded on connections that use MQTT 5.
+	SubscriptionIdentifiers []uint32
+}
+
+// A UserProperty is a single MQTT 5 user property.
+type UserProperty struct {
+	Key   string
+	Value string
+}
+
+// UserProperties is an ordered list of MQTT 5 user properties. The same key
+// may appear multiple times and the order is retained when encoded.
+type UserProperties []UserProperty
+
+// Get will return the value of the first property with the specified key.
+func (p UserProperties) Get(key string) (string, bool) {
+	for _, prop := range p {
+		if prop.Key == key {
+			return prop.Value, true
+		}
+	}
+
+	return "", false
 }
 
 // String returns a string representation of the message.
@@ -28,7 +28,11 @@ func nakedPacketEncode(dst []byte, t Type) (int, error) {
 
 // A DisconnectPacket is sent from the client to the server.
 // It indicates that the client is disconnecting cleanly.
-type DisconnectPacket struct{}
+type DisconnectPacket struct {
+	// The Version of the connection. If set to Version5, an eventual reason
+	// code and properties are skipped when decoded.
+	Version byte
+}
 
 // NewDisconnectPacket creates a new DisconnectPacket.
 func NewDisconnectPacket() *DisconnectPacket {
@@ -48,7 +52,19 @@ func (dp *DisconnectPacket) Len() int {
 // Decode reads from the byte slice argument. It returns the total number of
 // bytes decoded, and whether there have been any errors during the process.
 func (dp *DisconnectPacket) Decode(src []byte) (int, error) {
-	return nakedPacketDecode(src, DISCONNECT)
+	// decode 3.1.1 packets
+	if dp.Version != Version5 {
+		return nakedPacketDecode(src, DISCONNECT)
+	}
+
+	// decode header
+	hl, _, rl, err := headerDecode(src, DISCONNECT)
+	if err != nil {
+		return hl, err
+	}
+
+	// skip reason code and properties
+	return hl + rl, nil
 }
 
 // Encode writes the packet bytes into the byte slice from the argument. It
@@ -91,6 +91,136 @@ func GetID(packet GenericPacket) (ID, bool) {
 	return 0, false
 }
 
+// GetVersion returns the version of the connection that is used to encode and
+// decode the packet. Packets that are encoded the same way in all versions
+// return zero and the AuthPacket always returns Version5.
+func GetVersion(packet GenericPacket) byte {
+	switch pkt := packet.(type) {
+	case *ConnectPacket:
+		return pkt.Version
+	case *ConnackPacket:
+		return pkt.Version
+	case *PublishPacket:
+		return pkt.Version
+	case *PubackPacket:
+		return pkt.Version
+	case *PubrecPacket:
+		return pkt.Version
+	case *PubrelPacket:
+		return pkt.Version
+	case *PubcompPacket:
+		return pkt.Version
+	case *SubscribePacket:
+		return pkt.Version
+	case *SubackPacket:
+		return pkt.Version
+	case *UnsubscribePacket:
+		return pkt.Version
+	case *UnsubackPacket:
+		return pkt.Version
+	case *DisconnectPacket:
+		return pkt.Version
+	case *AuthPacket:
+		return Version5
+	}
+
+	return 0
+}
+
+// SetVersion sets the version of the connection that is used to encode and
+// decode the packet. Packets that are encoded the same way in all versions are
+// not modified.
+func SetVersion(packet GenericPacket, version byte) {
+	switch pkt := packet.(type) {
+	case *ConnectPacket:
+		pkt.Version = version
+	case *ConnackPacket:
+		pkt.Version = version
+	case *PublishPacket:
+		pkt.Version = version
+	case *PubackPacket:
+		pkt.Version = version
+	case *PubrecPacket:
+		pkt.Version = version
+	case *PubrelPacket:
+		pkt.Version = version
+	case *PubcompPacket:
+		pkt.Version = version
+	case *SubscribePacket:
+		pkt.Version = version
+	case *SubackPacket:
+		pkt.Version = version
+	case *UnsubscribePacket:
+		pkt.Version = version
+	case *UnsubackPacket:
+		pkt.Version = version
+	case *DisconnectPacket:
+		pkt.Version = version
+	}
+}
+
+// returns a copy of the packet that uses the specified version or the packet
+// itself if it already uses the version or does not depend on it
+func withVersion(packet GenericPacket, version byte) GenericPacket {
+	// check version
+	if version != Version5 {
+		version = 0
+	}
+
+	// check packet
+	current := GetVersion(packet)
+	if current != Version5 {
+		current = 0
+	}
+	if current == version || packet.Type() == CONNECT || packet.Type() == AUTH {
+		return packet
+	}
+
+	// copy packet
+	switch pkt := packet.(type) {
+	case *ConnackPacket:
+		c := *pkt
+		packet = &c
+	case *PublishPacket:
+		c := *pkt
+		packet = &c
+	case *PubackPacket:
+		c := *pkt
+		packet = &c
+	case *PubrecPacket:
+		c := *pkt
+		packet = &c
+	case *PubrelPacket:
+		c := *pkt
+		packet = &c
+	case *PubcompPacket:
+		c := *pkt
+		packet = &c
+	case *SubscribePacket:
+		c := *pkt
+		packet = &c
+	case *SubackPacket:
+		c := *pkt
+		packet = &c
+	case *UnsubscribePacket:
+		c := *pkt
+		packet = &c
+	case *UnsubackPacket:
+		c := *pkt
+		packet = &c
+	case *DisconnectPacket:
+		c := *pkt
+		packet = &c
+	default:
+		return packet
+	}
+
+	// set version
+	SetVersion(packet, version)
+
+	return packet
+}
+
 // Fuzz is a basic fuzzing test that works with https://github.com/dvyukov/go-fuzz:
 //
 //		$ go-fuzz-build github.com/gomqtt/packet
@@ -0,0 +1,284 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// the MQTT 5 property identifiers
+const (
+	payloadFormatProperty          byte = 0x01
+	messageExpiryProperty          byte = 0x02
+	contentTypeProperty            byte = 0x03
+	responseTopicProperty          byte = 0x08
+	correlationDataProperty        byte = 0x09
+	subscriptionIdentifierProperty byte = 0x0B
+	sessionExpiryProperty          byte = 0x11
+	assignedClientIDProperty       byte = 0x12
+	serverKeepAliveProperty        byte = 0x13
+	authMethodProperty             byte = 0x15
+	authDataProperty               byte = 0x16
+	requestProblemProperty         byte = 0x17
+	willDelayProperty              byte = 0x18
+	requestResponseProperty        byte = 0x19
+	responseInfoProperty           byte = 0x1A
+	serverReferenceProperty        byte = 0x1C
+	reasonStringProperty           byte = 0x1F
+	receiveMaximumProperty         byte = 0x21
+	topicAliasMaximumProperty      byte = 0x22
+	topicAliasProperty             byte = 0x23
+	maximumQOSProperty             byte = 0x24
+	retainAvailableProperty        byte = 0x25
+	userProperty                   byte = 0x26
+	maximumPacketSizeProperty      byte = 0x27
+	wildcardAvailableProperty      byte = 0x28
+	identifierAvailableProperty    byte = 0x29
+	sharedAvailableProperty        byte = 0x2A
+)
+
+// The properties are the MQTT 5 properties that are supported by the packets.
+// All other properties are skipped when decoded.
+type properties struct {
+	userProperties          UserProperties
+	subscriptionIdentifiers []uint32
+	sessionExpiry           uint32
+	authMethod              string
+	authData                []byte
+}
+
+// Returns the length of the encoded properties including the length prefix.
+func (p *properties) size() int {
+	pl := p.len()
+	return uvarintLen(pl) + pl
+}
+
+// Returns the length of the encoded properties.
+func (p *properties) len() int {
+	total := 0
+
+	// user properties
+	for _, prop := range p.userProperties {
+		total += 1 + 2 + len(prop.Key) + 2 + len(prop.Value)
+	}
+
+	// subscription identifiers
+	for _, id := range p.subscriptionIdentifiers {
+		total += 1 + uvarintLen(int(id))
+	}
+
+	// session expiry
+	if p.sessionExpiry > 0 {
+		total += 1 + 4
+	}
+
+	// auth method
+	if len(p.authMethod) > 0 {
+		total += 1 + 2 + len(p.authMethod)
+	}
+
+	// auth data
+	if len(p.authData) > 0 {
+		total += 1 + 2 + len(p.authData)
+	}
+
+	return total
+}
+
+// Decodes the properties including the length prefix.
+func (p *properties) decode(src []byte, t Type) (int, error) {
+	total := 0
+
+	// read properties length
+	_pl, n := binary.Uvarint(src)
+	pl := int(_pl)
+	total += n
+
+	// check properties length
+	if n <= 0 || pl > len(src)-total {
+		return total, fmt.Errorf("[%s] invalid properties length", t)
+	}
+
+	// get end of properties
+	end := total + pl
+
+	// read properties
+	for total < end {
+		// read identifier
+		id := src[total]
+		total++
+
+		// read property
+		var err error
+		switch id {
+		case userProperty:
+			var key, value string
+			key, n, err = readLPString(src[total:end], t)
+			total += n
+			if err != nil {
+				return total, err
+			}
+
+			value, n, err = readLPString(src[total:end], t)
+			total += n
+			if err != nil {
+				return total, err
+			}
+
+			// add property
+			p.userProperties = append(p.userProperties, UserProperty{
+				Key:   key,
+				Value: value,
+			})
+		case subscriptionIdentifierProperty:
+			var sid uint64
+			sid, n = binary.Uvarint(src[total:end])
+			total += n
+			if n <= 0 || sid == 0 {
+				return total, fmt.Errorf("[%s] invalid subscription identifier", t)
+			}
+
+			p.subscriptionIdentifiers = append(p.subscriptionIdentifiers, uint32(sid))
+		case sessionExpiryProperty:
+			if end-total < 4 {
+				return total, fmt.Errorf("[%s] insufficient buffer size, expected %d, got %d", t, 4, end-total)
+			}
+
+			p.sessionExpiry = binary.BigEndian.Uint32(src[total:])
+			total += 4
+		case authMethodProperty:
+			p.authMethod, n, err = readLPString(src[total:end], t)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		case authDataProperty:
+			p.authData, n, err = readLPBytes(src[total:end], true, t)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		default:
+			n, err = skipProperty(src[total:end], id, t)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+
+	return total, nil
+}
+
+// Encodes the properties including the length prefix.
+func (p *properties) encode(dst []byte, t Type) (int, error) {
+	total := 0
+
+	// write properties length
+	n := binary.PutUvarint(dst[total:], uint64(p.len()))
+	total += n
+
+	// write user properties
+	var err error
+	for _, prop := range p.userProperties {
+		dst[total] = userProperty
+		total++
+
+		n, err = writeLPString(dst[total:], prop.Key, t)
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		n, err = writeLPString(dst[total:], prop.Value, t)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
+	// write subscription identifiers
+	for _, id := range p.subscriptionIdentifiers {
+		if id == 0 {
+			return total, fmt.Errorf("[%s] invalid subscription identifier", t)
+		}
+
+		dst[total] = subscriptionIdentifierProperty
+		total++
+
+		n = binary.PutUvarint(dst[total:], uint64(id))
+		total += n
+	}
+
+	// write session expiry
+	if p.sessionExpiry > 0 {
+		dst[total] = sessionExpiryProperty
+		total++
+
+		binary.BigEndian.PutUint32(dst[total:], p.sessionExpiry)
+		total += 4
+	}
+
+	// write auth method
+	if len(p.authMethod) > 0 {
+		dst[total] = authMethodProperty
+		total++
+
+		n, err = writeLPString(dst[total:], p.authMethod, t)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
+	// write auth data
+	if len(p.authData) > 0 {
+		dst[total] = authDataProperty
+		total++
+
+		n, err = writeLPBytes(dst[total:], p.authData, t)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
+	return total, nil
+}
+
+// Skips the value of an unsupported property.
+func skipProperty(src []byte, id byte, t Type) (int, error) {
+	// get value length
+	var length int
+	switch id {
+	case payloadFormatProperty, requestProblemProperty, requestResponseProperty,
+		maximumQOSProperty, retainAvailableProperty, wildcardAvailableProperty,
+		identifierAvailableProperty, sharedAvailableProperty:
+		length = 1
+	case serverKeepAliveProperty, receiveMaximumProperty, topicAliasMaximumProperty,
+		topicAliasProperty:
+		length = 2
+	case messageExpiryProperty, willDelayProperty,
+		maximumPacketSizeProperty:
+		length = 4
+	case contentTypeProperty, responseTopicProperty, correlationDataProperty,
+		assignedClientIDProperty, responseInfoProperty, serverReferenceProperty,
+		reasonStringProperty:
+		_, n, err := readLPBytes(src, false, t)
+		return n, err
+	default:
+		return 0, fmt.Errorf("[%s] unknown property (%d)", t, id)
+	}
+
+	// check buffer length
+	if len(src) < length {
+		return len(src), fmt.Errorf("[%s] insufficient buffer size, expected %d, got %d", t, length, len(src))
+	}
+
+	return length, nil
+}
+
+// returns the length of an encoded variable byte integer
+func uvarintLen(n int) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], uint64(n))
+}
@@ -19,6 +19,10 @@ type PublishPacket struct {
 
 	// The packet identifier.
 	ID ID
+
+	// The Version of the connection. If set to Version5, the packet is encoded
+	// and decoded using MQTT 5 and carries the user properties of the message.
+	Version byte
 }
 
 // NewPublishPacket creates a new PublishPacket.
@@ -95,6 +99,21 @@ func (pp *PublishPacket) Decode(src []byte) (int, error) {
 		}
 	}
 
+	// read properties
+	pp.Message.UserProperties = nil
+	pp.Message.SubscriptionIdentifiers = nil
+	if pp.Version == Version5 {
+		var props properties
+		n, err = props.decode(src[total:hl+rl], pp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		pp.Message.UserProperties = props.userProperties
+		pp.Message.SubscriptionIdentifiers = props.subscriptionIdentifiers
+	}
+
 	// calculate payload length
 	l := int(rl) - (total - hl)
 
@@ -168,6 +187,15 @@ func (pp *PublishPacket) Encode(dst []byte) (int, error) {
 		total += 2
 	}
 
+	// write properties
+	if pp.Version == Version5 {
+		n, err = pp.props().encode(dst[total:], pp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
 	// write payload
 	copy(dst[total:], pp.Message.Payload)
 	total += len(pp.Message.Payload)
@@ -182,5 +210,17 @@ func (pp *PublishPacket) len() int {
 		total += 2
 	}
 
+	if pp.Version == Version5 {
+		total += pp.props().size()
+	}
+
 	return total
 }
+
+// Returns the properties of the packet.
+func (pp *PublishPacket) props() *properties {
+	return &properties{
+		userProperties:          pp.Message.UserProperties,
+		subscriptionIdentifiers: pp.Message.SubscriptionIdentifiers,
+	}
+}
@@ -280,6 +280,78 @@ func TestPublishEqualDecodeEncode(t *testing.T) {
 	assert.Equal(t, len(pktBytes), n3)
 }
 
+func TestPublishPacketVersion5(t *testing.T) {
+	pktBytes := []byte{
+		byte(PUBLISH<<4) | 2,
+		29,
+		0, // topic name MSB
+		3, // topic name LSB
+		'f', 'o', 'o',
+		0,    // packet ID MSB
+		7,    // packet ID LSB
+		18,   // properties length
+		0x26, // user property
+		0, 3, 'k', 'e', 'y',
+		0, 5, 'v', 'a', 'l', 'u', 'e',
+		0x0B, // subscription identifier
+		1,
+		0x0B, // subscription identifier
+		0x80, 0x01,
+		'b', 'a', 'r',
+	}
+
+	pkt := NewPublishPacket()
+	pkt.Version = Version5
+	n, err := pkt.Decode(pktBytes)
+	assert.NoError(t, err)
+	assert.Equal(t, len(pktBytes), n)
+	assert.Equal(t, Message{
+		Topic:                   "foo",
+		Payload:                 []byte("bar"),
+		QOS:                     1,
+		UserProperties:          UserProperties{{Key: "key", Value: "value"}},
+		SubscriptionIdentifiers: []uint32{1, 128},
+	}, pkt.Message)
+
+	dst := make([]byte, pkt.Len())
+	n2, err := pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, pktBytes, dst[:n2])
+
+	pkt.Version = 0
+	dst = make([]byte, pkt.Len())
+	n3, err := pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, len(pktBytes)-19, n3)
+}
+
+func TestPublishPacketDuplicateUserProperties(t *testing.T) {
+	pkt := NewPublishPacket()
+	pkt.Version = Version5
+	pkt.Message.Topic = "foo"
+	pkt.Message.UserProperties = UserProperties{
+		{Key: "b", Value: "1"},
+		{Key: "a", Value: "2"},
+		{Key: "b", Value: "3"},
+	}
+
+	dst := make([]byte, pkt.Len())
+	n, err := pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, len(dst), n)
+
+	pkt2 := NewPublishPacket()
+	pkt2.Version = Version5
+	n2, err := pkt2.Decode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, n, n2)
+	assert.Equal(t, pkt.Message.UserProperties, pkt2.Message.UserProperties)
+
+	value, ok := pkt2.Message.UserProperties.Get("b")
+	assert.True(t, ok)
+	assert.Equal(t, "1", value)
+}
+
 func BenchmarkPublishEncode(b *testing.B) {
 	pkt := NewPublishPacket()
 	pkt.Message.Topic = "t"
@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"errors"
 	"io"
+	"sync/atomic"
 )
 
 // ErrDetectionOverflow is returned by the Decoder if the next packet couldn't
@@ -17,10 +18,15 @@ var ErrDetectionOverflow = errors.New("detection overflow")
 // Note: this error is wrapped in an Error with a NetworkError code.
 var ErrReadLimitExceeded = errors.New("read limit exceeded")
 
+// ErrUnexpectedAuth is returned by the Decoder if an AuthPacket is received on
+// a connection that does not use MQTT 5.
+var ErrUnexpectedAuth = errors.New("unexpected auth packet")
+
 // An Encoder wraps a Writer and continuously encodes packets.
 type Encoder struct {
-	writer *bufio.Writer
-	buffer bytes.Buffer
+	writer  *bufio.Writer
+	buffer  bytes.Buffer
+	version uint32
 }
 
 // NewEncoder creates a new Encoder.
@@ -30,8 +36,19 @@ func NewEncoder(writer io.Writer) *Encoder {
 	}
 }
 
+// SetVersion sets the version that is used to encode packets. Packets that
+// use a different version are copied and encoded using the set version.
+//
+// Note: The method can be called concurrently with Write.
+func (e *Encoder) SetVersion(version byte) {
+	atomic.StoreUint32(&e.version, uint32(version))
+}
+
 // Write encodes and writes the passed packet to the write buffer.
 func (e *Encoder) Write(pkt GenericPacket) error {
+	// apply version
+	pkt = withVersion(pkt, byte(atomic.LoadUint32(&e.version)))
+
 	// reset and eventually grow buffer
 	packetLength := pkt.Len()
 	e.buffer.Reset()
@@ -62,8 +79,9 @@ func (e *Encoder) Flush() error {
 type Decoder struct {
 	Limit int64
 
-	reader *bufio.Reader
-	buffer bytes.Buffer
+	reader  *bufio.Reader
+	buffer  bytes.Buffer
+	version uint32
 }
 
 // NewDecoder returns a new Decoder.
@@ -73,6 +91,13 @@ func NewDecoder(reader io.Reader) *Decoder {
 	}
 }
 
+// SetVersion sets the version that is used to decode packets.
+//
+// Note: The method can be called concurrently with Read.
+func (d *Decoder) SetVersion(version byte) {
+	atomic.StoreUint32(&d.version, uint32(version))
+}
+
 // Read reads the next packet from the buffered reader.
 func (d *Decoder) Read() (GenericPacket, error) {
 	// initial detection length
@@ -108,12 +133,25 @@ func (d *Decoder) Read() (GenericPacket, error) {
 			return nil, ErrReadLimitExceeded
 		}
 
+		// get version
+		version := byte(atomic.LoadUint32(&d.version))
+
+		// check auth packet
+		if packetType == AUTH && version != Version5 {
+			return nil, ErrUnexpectedAuth
+		}
+
 		// create packet
 		pkt, err := packetType.New()
 		if err != nil {
 			return nil, err
 		}
 
+		// set version
+		if packetType != CONNECT && version == Version5 {
+			SetVersion(pkt, version)
+		}
+
 		// reset and eventually grow buffer
 		d.buffer.Reset()
 		d.buffer.Grow(packetLength)
@@ -141,6 +179,12 @@ type Stream struct {
 	Encoder
 }
 
+// SetVersion sets the version that is used to encode and decode packets.
+func (s *Stream) SetVersion(version byte) {
+	s.Encoder.SetVersion(version)
+	s.Decoder.SetVersion(version)
+}
+
 // NewStream creates a new Stream.
 func NewStream(reader io.Reader, writer io.Writer) *Stream {
 	return &Stream{
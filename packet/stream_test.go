@@ -127,6 +127,24 @@ func TestDecoderReadError(t *testing.T) {
 	assert.Nil(t, pkt)
 }
 
+func TestDecoderUnexpectedAuthError(t *testing.T) {
+	buf := new(bytes.Buffer)
+	dec := NewDecoder(buf)
+
+	buf.Write([]byte{0xf0, 0x00})
+
+	pkt, err := dec.Read()
+	assert.Equal(t, ErrUnexpectedAuth, err)
+	assert.Nil(t, pkt)
+
+	dec.SetVersion(Version5)
+	buf.Write([]byte{0xf0, 0x00})
+
+	pkt, err = dec.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, AUTH, pkt.Type())
+}
+
 func TestDecoderDecodeError(t *testing.T) {
 	buf := new(bytes.Buffer)
 	dec := NewDecoder(buf)
@@ -157,3 +175,32 @@ func TestStream(t *testing.T) {
 	assert.NotNil(t, pkt)
 	assert.NoError(t, err)
 }
+
+func TestStreamVersion5(t *testing.T) {
+	in := new(bytes.Buffer)
+	out := new(bytes.Buffer)
+
+	s := NewStream(in, out)
+	s.SetVersion(Version5)
+
+	publish := NewPublishPacket()
+	publish.Message = Message{
+		Topic:          "foo",
+		UserProperties: UserProperties{{Key: "foo", Value: "bar"}},
+	}
+
+	err := s.Write(publish)
+	assert.NoError(t, err)
+	assert.Equal(t, byte(0), publish.Version)
+
+	err = s.Flush()
+	assert.NoError(t, err)
+
+	_, err = io.Copy(in, out)
+	assert.NoError(t, err)
+
+	pkt, err := s.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, Version5, GetVersion(pkt))
+	assert.Equal(t, publish.Message, pkt.(*PublishPacket).Message)
+}
@@ -15,6 +15,11 @@ type SubackPacket struct {
 
 	// The packet identifier.
 	ID ID
+
+	// The Version of the connection. If set to Version5, the packet is encoded
+	// and decoded using MQTT 5 and all failure reason codes are decoded as
+	// QOSFailure.
+	Version byte
 }
 
 // NewSubackPacket creates a new SubackPacket.
@@ -76,8 +81,18 @@ func (sp *SubackPacket) Decode(src []byte) (int, error) {
 		return total, fmt.Errorf("[%s] packet id must be grater than zero", sp.Type())
 	}
 
+	// read properties
+	if sp.Version == Version5 {
+		var props properties
+		n, err := props.decode(src[total:hl+rl], sp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
 	// calculate number of return codes
-	rcl := int(rl) - 2
+	rcl := int(rl) - (total - hl)
 
 	// read return codes
 	sp.ReturnCodes = make([]uint8, rcl)
@@ -86,6 +101,11 @@ func (sp *SubackPacket) Decode(src []byte) (int, error) {
 
 	// validate return codes
 	for i, code := range sp.ReturnCodes {
+		if sp.Version == Version5 && code > QOSFailure {
+			sp.ReturnCodes[i] = QOSFailure
+			continue
+		}
+
 		if !validQOS(code) && code != QOSFailure {
 			return total, fmt.Errorf("[%s] invalid return code %d for topic %d", sp.Type(), code, i)
 		}
@@ -123,6 +143,15 @@ func (sp *SubackPacket) Encode(dst []byte) (int, error) {
 	binary.BigEndian.PutUint16(dst[total:], uint16(sp.ID))
 	total += 2
 
+	// write properties
+	if sp.Version == Version5 {
+		n, err = sp.props().encode(dst[total:], sp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
 	// write return codes
 	copy(dst[total:], sp.ReturnCodes)
 	total += len(sp.ReturnCodes)
@@ -132,5 +161,18 @@ func (sp *SubackPacket) Encode(dst []byte) (int, error) {
 
 // Returns the payload length.
 func (sp *SubackPacket) len() int {
-	return 2 + len(sp.ReturnCodes)
+	// packet ID and return codes
+	total := 2 + len(sp.ReturnCodes)
+
+	// properties
+	if sp.Version == Version5 {
+		total += sp.props().size()
+	}
+
+	return total
+}
+
+// Returns the properties of the packet.
+func (sp *SubackPacket) props() *properties {
+	return &properties{}
 }
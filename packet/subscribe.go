@@ -6,13 +6,49 @@ import (
 	"strings"
 )
 
+// RetainHandling defines when retained messages are sent for a subscription.
+type RetainHandling uint8
+
+const (
+	// SendRetained sends retained messages whenever the subscription is made.
+	SendRetained RetainHandling = iota
+
+	// SendRetainedIfNew sends retained messages only if the subscription did
+	// not exist before.
+	SendRetainedIfNew
+
+	// DontSendRetained never sends retained messages.
+	DontSendRetained
+)
+
 // A Subscription is a single subscription in a SubscribePacket.
+//
+// The NoLocal, RetainAsPublished and RetainHandling options and the Identifier
+// are MQTT 5 subscription options. They are only encoded and decoded in MQTT 5
+// packets, MQTT 3.1.1 packets only carry the requested QOS.
 type Subscription struct {
 	// The topic to subscribe.
 	Topic string
 
 	// The requested maximum QOS level.
 	QOS uint8
+
+	// NoLocal prevents messages published by the subscribing client from being
+	// forwarded to it.
+	NoLocal bool
+
+	// RetainAsPublished keeps the retain flag of forwarded messages as it was
+	// set when the message was published.
+	RetainAsPublished bool
+
+	// RetainHandling defines when retained messages are sent.
+	RetainHandling RetainHandling
+
+	// Identifier is delivered with all messages that match the subscription.
+	// A value of zero indicates no identifier. A SubscribePacket carries a
+	// single identifier for all its subscriptions, which must therefore use
+	// the same identifier.
+	Identifier uint32
 }
 
 func (s *Subscription) String() string {
@@ -28,6 +64,10 @@ type SubscribePacket struct {
 
 	// The packet identifier.
 	ID ID
+
+	// The Version of the connection. If set to Version5, the packet is encoded
+	// and decoded using MQTT 5.
+	Version byte
 }
 
 // NewSubscribePacket creates a new SUBSCRIBE packet.
@@ -84,11 +124,29 @@ func (sp *SubscribePacket) Decode(src []byte) (int, error) {
 		return total, fmt.Errorf("[%s] packet id must be grater than zero", sp.Type())
 	}
 
+	// read properties
+	var identifier uint32
+	if sp.Version == Version5 {
+		var props properties
+		n, err := props.decode(src[total:hl+rl], sp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+
+		// check subscription identifiers
+		if len(props.subscriptionIdentifiers) > 1 {
+			return total, fmt.Errorf("[%s] multiple subscription identifiers", sp.Type())
+		} else if len(props.subscriptionIdentifiers) == 1 {
+			identifier = props.subscriptionIdentifiers[0]
+		}
+	}
+
 	// reset subscriptions
 	sp.Subscriptions = sp.Subscriptions[:0]
 
-	// calculate number of subscriptions
-	sl := int(rl) - 2
+	// calculate length of subscriptions
+	sl := int(rl) - (total - hl)
 
 	for sl > 0 {
 		// read topic
@@ -103,10 +161,27 @@ func (sp *SubscribePacket) Decode(src []byte) (int, error) {
 			return total, fmt.Errorf("[%s] insufficient buffer size, expected %d, got %d", sp.Type(), total+1, len(src))
 		}
 
-		// read qos and add subscription
-		sp.Subscriptions = append(sp.Subscriptions, Subscription{t, src[total]})
+		// read options
+		opts := src[total]
 		total++
 
+		// check reserved bits and retain handling
+		if sp.Version != Version5 && opts&0xFC != 0 {
+			return total, fmt.Errorf("[%s] invalid subscription options", sp.Type())
+		} else if opts&0xC0 != 0 || opts>>4&0x03 > byte(DontSendRetained) {
+			return total, fmt.Errorf("[%s] invalid subscription options", sp.Type())
+		}
+
+		// add subscription
+		sp.Subscriptions = append(sp.Subscriptions, Subscription{
+			Topic:             t,
+			QOS:               opts & 0x03,
+			NoLocal:           opts&0x04 != 0,
+			RetainAsPublished: opts&0x08 != 0,
+			RetainHandling:    RetainHandling(opts >> 4 & 0x03),
+			Identifier:        identifier,
+		})
+
 		// decrement counter
 		sl = sl - n - 1
 	}
@@ -130,6 +205,15 @@ func (sp *SubscribePacket) Encode(dst []byte) (int, error) {
 		return total, fmt.Errorf("[%s] packet id must be grater than zero", sp.Type())
 	}
 
+	// check subscription identifiers
+	if sp.Version == Version5 {
+		for _, t := range sp.Subscriptions {
+			if t.Identifier != sp.Subscriptions[0].Identifier {
+				return total, fmt.Errorf("[%s] subscriptions have different identifiers", sp.Type())
+			}
+		}
+	}
+
 	// encode header
 	n, err := headerEncode(dst[total:], 0, sp.len(), sp.Len(), SUBSCRIBE)
 	total += n
@@ -141,6 +225,15 @@ func (sp *SubscribePacket) Encode(dst []byte) (int, error) {
 	binary.BigEndian.PutUint16(dst[total:], uint16(sp.ID))
 	total += 2
 
+	// write properties
+	if sp.Version == Version5 {
+		n, err = sp.props().encode(dst[total:], sp.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
 	for _, t := range sp.Subscriptions {
 		// write topic
 		n, err := writeLPString(dst[total:], t.Topic, sp.Type())
@@ -149,8 +242,12 @@ func (sp *SubscribePacket) Encode(dst []byte) (int, error) {
 			return total, err
 		}
 
-		// write qos
-		dst[total] = t.QOS
+		// write qos and options
+		if sp.Version == Version5 {
+			dst[total] = t.options()
+		} else {
+			dst[total] = t.QOS
+		}
 
 		total++
 	}
@@ -163,9 +260,42 @@ func (sp *SubscribePacket) len() int {
 	// packet ID
 	total := 2
 
+	// properties
+	if sp.Version == Version5 {
+		total += sp.props().size()
+	}
+
 	for _, t := range sp.Subscriptions {
 		total += 2 + len(t.Topic) + 1
 	}
 
 	return total
 }
+
+// Returns the properties of the packet.
+func (sp *SubscribePacket) props() *properties {
+	// get identifier of first subscription
+	var identifiers []uint32
+	if len(sp.Subscriptions) > 0 && sp.Subscriptions[0].Identifier > 0 {
+		identifiers = []uint32{sp.Subscriptions[0].Identifier}
+	}
+
+	return &properties{
+		subscriptionIdentifiers: identifiers,
+	}
+}
+
+// Returns the encoded qos and options.
+func (s *Subscription) options() byte {
+	opts := s.QOS & 0x03
+
+	if s.NoLocal {
+		opts |= 0x04
+	}
+
+	if s.RetainAsPublished {
+		opts |= 0x08
+	}
+
+	return opts | byte(s.RetainHandling&0x03)<<4
+}
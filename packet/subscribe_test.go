@@ -167,9 +167,9 @@ func TestSubscribePacketEncode(t *testing.T) {
 	pkt := NewSubscribePacket()
 	pkt.ID = 7
 	pkt.Subscriptions = []Subscription{
-		{"gomqtt", 0},
-		{"/a/b/#/c", 1},
-		{"/a/b/#/cdd", 2},
+		{Topic: "gomqtt", QOS: 0},
+		{Topic: "/a/b/#/c", QOS: 1},
+		{Topic: "/a/b/#/cdd", QOS: 2},
 	}
 
 	dst := make([]byte, pkt.Len())
@@ -180,6 +180,123 @@ func TestSubscribePacketEncode(t *testing.T) {
 	assert.Equal(t, pktBytes, dst)
 }
 
+func TestSubscribePacketOptions(t *testing.T) {
+	pkt := NewSubscribePacket()
+	pkt.ID = 7
+	pkt.Version = Version5
+	pkt.Subscriptions = []Subscription{
+		{Topic: "a", QOS: 1, NoLocal: true},
+		{Topic: "b", QOS: 2, RetainAsPublished: true, RetainHandling: SendRetainedIfNew},
+		{Topic: "c", QOS: 0, RetainHandling: DontSendRetained},
+	}
+
+	dst := make([]byte, pkt.Len())
+	n, err := pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, len(dst), n)
+	assert.Equal(t, byte(0x05), dst[8])
+	assert.Equal(t, byte(0x1A), dst[12])
+	assert.Equal(t, byte(0x20), dst[16])
+
+	pkt2 := NewSubscribePacket()
+	pkt2.Version = Version5
+	n, err = pkt2.Decode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, len(dst), n)
+	assert.Equal(t, pkt.Subscriptions, pkt2.Subscriptions)
+
+	pkt.Version = 0
+	dst = make([]byte, pkt.Len())
+	n, err = pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, len(dst), n)
+	assert.Equal(t, byte(0x01), dst[7])
+	assert.Equal(t, byte(0x02), dst[11])
+	assert.Equal(t, byte(0x00), dst[15])
+}
+
+func TestSubscribePacketDecodeInvalidOptions(t *testing.T) {
+	for _, opts := range []byte{0x04, 0x08, 0x10, 0x40, 0x80} {
+		pktBytes := []byte{
+			byte(SUBSCRIBE<<4) | 2,
+			6,
+			0, // packet ID MSB
+			7, // packet ID LSB
+			0, // topic name MSB
+			1, // topic name LSB
+			'a',
+			opts,
+		}
+
+		pkt := NewSubscribePacket()
+		_, err := pkt.Decode(pktBytes)
+		assert.Error(t, err)
+	}
+
+	for _, opts := range []byte{0x40, 0x80, 0x30} {
+		pktBytes := []byte{
+			byte(SUBSCRIBE<<4) | 2,
+			7,
+			0, // packet ID MSB
+			7, // packet ID LSB
+			0, // properties
+			0, // topic name MSB
+			1, // topic name LSB
+			'a',
+			opts,
+		}
+
+		pkt := NewSubscribePacket()
+		pkt.Version = Version5
+		_, err := pkt.Decode(pktBytes)
+		assert.Error(t, err)
+	}
+}
+
+func TestSubscribePacketIdentifier(t *testing.T) {
+	pkt := NewSubscribePacket()
+	pkt.ID = 7
+	pkt.Version = Version5
+	pkt.Subscriptions = []Subscription{
+		{Topic: "a", QOS: 1, Identifier: 128},
+		{Topic: "b", QOS: 2, Identifier: 128},
+	}
+
+	dst := make([]byte, pkt.Len())
+	n, err := pkt.Encode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, len(dst), n)
+	assert.Equal(t, []byte{3, 0x0B, 0x80, 0x01}, dst[4:8])
+
+	pkt2 := NewSubscribePacket()
+	pkt2.Version = Version5
+	n, err = pkt2.Decode(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, len(dst), n)
+	assert.Equal(t, pkt.Subscriptions, pkt2.Subscriptions)
+
+	pkt.Subscriptions[1].Identifier = 1
+	_, err = pkt.Encode(make([]byte, pkt.Len()))
+	assert.Error(t, err)
+
+	pktBytes := []byte{
+		byte(SUBSCRIBE<<4) | 2,
+		11,
+		0, // packet ID MSB
+		7, // packet ID LSB
+		4, // properties length
+		0x0B, 1,
+		0x0B, 2,
+		0, // topic name MSB
+		1, // topic name LSB
+		'a',
+		1,
+	}
+
+	_, err = pkt2.Decode(pktBytes)
+	assert.Error(t, err)
+}
+
 func TestSubscribePacketEncodeError1(t *testing.T) {
 	pkt := NewSubscribePacket()
 	pkt.ID = 7
@@ -194,7 +311,7 @@ func TestSubscribePacketEncodeError2(t *testing.T) {
 	pkt := NewSubscribePacket()
 	pkt.ID = 7
 	pkt.Subscriptions = []Subscription{
-		{string(make([]byte, 65536)), 0}, // too big
+		{Topic: string(make([]byte, 65536)), QOS: 0}, // too big
 	}
 
 	dst := make([]byte, pkt.Len())
@@ -256,7 +373,7 @@ func BenchmarkSubscribeEncode(b *testing.B) {
 	pkt := NewSubscribePacket()
 	pkt.ID = 7
 	pkt.Subscriptions = []Subscription{
-		{"t", 0},
+		{Topic: "t", QOS: 0},
 	}
 
 	buf := make([]byte, pkt.Len())
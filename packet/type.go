@@ -22,6 +22,7 @@ const (
 	PINGREQ
 	PINGRESP
 	DISCONNECT
+	AUTH
 )
 
 // String returns the type as a string.
@@ -55,6 +56,8 @@ func (t Type) String() string {
 		return "Pingresp"
 	case DISCONNECT:
 		return "Disconnect"
+	case AUTH:
+		return "Auth"
 	}
 
 	return "Unknown"
@@ -90,6 +93,8 @@ func (t Type) defaultFlags() byte {
 		return 0
 	case DISCONNECT:
 		return 0
+	case AUTH:
+		return 0
 	}
 
 	return 0
@@ -127,6 +132,8 @@ func (t Type) New() (GenericPacket, error) {
 		return NewPingrespPacket(), nil
 	case DISCONNECT:
 		return NewDisconnectPacket(), nil
+	case AUTH:
+		return NewAuthPacket(), nil
 	}
 
 	return nil, fmt.Errorf("[Unknown] invalid packet type %d", t)
@@ -11,6 +11,7 @@ func TestTypeString(t *testing.T) {
 
 func TestTypeValid(t *testing.T) {
 	assert.True(t, CONNECT.Valid())
+	assert.False(t, AUTH.Valid())
 }
 
 func TestTypeNew(t *testing.T) {
@@ -29,6 +30,7 @@ func TestTypeNew(t *testing.T) {
 		PINGREQ,
 		PINGRESP,
 		DISCONNECT,
+		AUTH,
 	}
 
 	for _, tt := range list {
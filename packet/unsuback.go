@@ -0,0 +1,148 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// An UnsubackPacket is sent by the server to the client to confirm receipt of
+// an UnsubscribePacket.
+type UnsubackPacket struct {
+	// Shared packet identifier.
+	ID ID
+
+	// The ReasonCodes for the unsubscribed topics. They are only encoded and
+	// decoded using MQTT 5 where a packet must contain a reason code for every
+	// topic of the UnsubscribePacket.
+	ReasonCodes []byte
+
+	// The Version of the connection. If set to Version5, the packet is encoded
+	// and decoded using MQTT 5.
+	Version byte
+}
+
+// NewUnsubackPacket creates a new UnsubackPacket.
+func NewUnsubackPacket() *UnsubackPacket {
+	return &UnsubackPacket{}
+}
+
+// Type returns the packets type.
+func (up *UnsubackPacket) Type() Type {
+	return UNSUBACK
+}
+
+// Len returns the byte length of the encoded packet.
+func (up *UnsubackPacket) Len() int {
+	if up.Version != Version5 {
+		return identifiedPacketLen(0, up.Version)
+	}
+
+	ml := up.len()
+	return headerLen(ml) + ml
+}
+
+// Decode reads from the byte slice argument. It returns the total number of
+// bytes decoded, and whether there have been any errors during the process.
+func (up *UnsubackPacket) Decode(src []byte) (int, error) {
+	// decode 3.1.1 packets
+	if up.Version != Version5 {
+		n, pid, _, err := identifiedPacketDecode(src, UNSUBACK, up.Version)
+		up.ID = pid
+		return n, err
+	}
+
+	total := 0
+
+	// decode header
+	hl, _, rl, err := headerDecode(src[total:], UNSUBACK)
+	total += hl
+	if err != nil {
+		return total, err
+	}
+
+	// check remaining length
+	if rl < 2 {
+		return total, fmt.Errorf("[%s] expected remaining length to be at least 2", up.Type())
+	}
+
+	// read packet id
+	up.ID = ID(binary.BigEndian.Uint16(src[total:]))
+	total += 2
+
+	// check packet id
+	if up.ID == 0 {
+		return total, fmt.Errorf("[%s] packet id must be grater than zero", up.Type())
+	}
+
+	// read properties
+	var props properties
+	n, err := props.decode(src[total:hl+rl], up.Type())
+	total += n
+	if err != nil {
+		return total, err
+	}
+
+	// read reason codes
+	rcl := rl - (total - hl)
+	up.ReasonCodes = make([]byte, rcl)
+	copy(up.ReasonCodes, src[total:total+rcl])
+	total += rcl
+
+	return total, nil
+}
+
+// Encode writes the packet bytes into the byte slice from the argument. It
+// returns the number of bytes encoded and whether there's any errors along
+// the way. If there is an error, the byte slice should be considered invalid.
+func (up *UnsubackPacket) Encode(dst []byte) (int, error) {
+	// encode 3.1.1 packets
+	if up.Version != Version5 {
+		return identifiedPacketEncode(dst, up.ID, 0, up.Version, UNSUBACK)
+	}
+
+	total := 0
+
+	// check packet id
+	if up.ID == 0 {
+		return total, fmt.Errorf("[%s] packet id must be grater than zero", up.Type())
+	}
+
+	// encode header
+	n, err := headerEncode(dst[total:], 0, up.len(), up.Len(), UNSUBACK)
+	total += n
+	if err != nil {
+		return total, err
+	}
+
+	// write packet id
+	binary.BigEndian.PutUint16(dst[total:], uint16(up.ID))
+	total += 2
+
+	// write properties
+	n, err = up.props().encode(dst[total:], up.Type())
+	total += n
+	if err != nil {
+		return total, err
+	}
+
+	// write reason codes
+	copy(dst[total:], up.ReasonCodes)
+	total += len(up.ReasonCodes)
+
+	return total, nil
+}
+
+// String returns a string representation of the packet.
+func (up *UnsubackPacket) String() string {
+	return fmt.Sprintf("<UnsubackPacket ID=%d>", up.ID)
+}
+
+// Returns the remaining length of the packet.
+func (up *UnsubackPacket) len() int {
+	return 2 + up.props().size() + len(up.ReasonCodes)
+}
+
+// Returns the properties of the packet.
+func (up *UnsubackPacket) props() *properties {
+	return &properties{}
+}
@@ -13,6 +13,10 @@ type UnsubscribePacket struct {
 
 	// The packet identifier.
 	ID ID
+
+	// The Version of the connection. If set to Version5, the packet is encoded
+	// and decoded using MQTT 5.
+	Version byte
 }
 
 // NewUnsubscribePacket creates a new UnsubscribePacket.
@@ -69,8 +73,18 @@ func (up *UnsubscribePacket) Decode(src []byte) (int, error) {
 		return total, fmt.Errorf("[%s] packet id must be grater than zero", up.Type())
 	}
 
+	// read properties
+	if up.Version == Version5 {
+		var props properties
+		n, err := props.decode(src[total:hl+rl], up.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
 	// prepare counter
-	tl := int(rl) - 2
+	tl := int(rl) - (total - hl)
 
 	// reset topics
 	up.Topics = up.Topics[:0]
@@ -120,6 +134,15 @@ func (up *UnsubscribePacket) Encode(dst []byte) (int, error) {
 	binary.BigEndian.PutUint16(dst[total:], uint16(up.ID))
 	total += 2
 
+	// write properties
+	if up.Version == Version5 {
+		n, err = up.props().encode(dst[total:], up.Type())
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+
 	for _, t := range up.Topics {
 		// write topic
 		n, err := writeLPString(dst[total:], t, up.Type())
@@ -137,9 +160,19 @@ func (up *UnsubscribePacket) len() int {
 	// packet ID
 	total := 2
 
+	// properties
+	if up.Version == Version5 {
+		total += up.props().size()
+	}
+
 	for _, t := range up.Topics {
 		total += 2 + len(t)
 	}
 
 	return total
 }
+
+// Returns the properties of the packet.
+func (up *UnsubscribePacket) props() *properties {
+	return &properties{}
+}
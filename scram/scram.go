@@ -0,0 +1,480 @@
+// Package scram implements the SCRAM-SHA-256 authentication mechanism as
+// defined by RFC 5802 and RFC 7677 for use with enhanced authentication.
+package scram
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Method is the name of the authentication method.
+const Method = "SCRAM-SHA-256"
+
+// DefaultIterations is the recommended minimum iteration count.
+const DefaultIterations = 4096
+
+// DefaultMaxIterations is the default maximum iteration count accepted by
+// clients.
+const DefaultMaxIterations = 100000
+
+// ErrInvalidMessage is returned if a message could not be parsed.
+var ErrInvalidMessage = errors.New("invalid message")
+
+// ErrInvalidState is returned if a conversation is continued unexpectedly.
+var ErrInvalidState = errors.New("invalid state")
+
+// ErrInvalidNonce is returned if a nonce does not match the conversation.
+var ErrInvalidNonce = errors.New("invalid nonce")
+
+// ErrUnknownUser is returned by the server if no credentials are available
+// for the user. To not reveal whether a user exists, the conversation is
+// continued using fake credentials and the error is returned at the final
+// step.
+var ErrUnknownUser = errors.New("unknown user")
+
+// ErrTooManyIterations is returned by the client if the server requests more
+// iterations than allowed.
+var ErrTooManyIterations = errors.New("too many iterations")
+
+// ErrInvalidProof is returned by the server if the client proof is invalid.
+var ErrInvalidProof = errors.New("invalid proof")
+
+// ErrInvalidSignature is returned by the client if the server signature is
+// invalid.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// the gs2 header used by clients that do not support channel binding
+const gs2Header = "n,,"
+
+// the generator used for client and server nonces
+var generateNonce = func() (string, error) {
+	buf := make([]byte, 18)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// the key used to derive the fake salts of unknown users
+var fakeSaltKey = func() []byte {
+	buf := make([]byte, 32)
+	_, _ = rand.Read(buf)
+	return buf
+}()
+
+// Credentials are the derived keys of a password that are stored by the
+// server. The password itself is not required to verify a client.
+type Credentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewCredentials derives the credentials for the specified password, salt and
+// iteration count.
+func NewCredentials(password string, salt []byte, iterations int) *Credentials {
+	// derive keys
+	saltedPassword := hi([]byte(password), salt, iterations)
+	clientKey := hmacSum(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	return &Credentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSum(saltedPassword, "Server Key"),
+	}
+}
+
+// A Lookup returns the credentials for the specified user. It should return
+// nil if the user is unknown.
+type Lookup func(username string) (*Credentials, error)
+
+// A Client performs the client side of an authentication.
+type Client struct {
+	// MaxIterations is the maximum iteration count the client accepts from
+	// the server to limit the cost of computing the proof.
+	MaxIterations int
+
+	username string
+	password string
+
+	step            int
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+// NewClient returns a new Client that authenticates using the specified
+// username and password.
+func NewClient(username, password string) *Client {
+	return &Client{
+		MaxIterations: DefaultMaxIterations,
+		username:      username,
+		password:      password,
+	}
+}
+
+// Method returns the name of the authentication method.
+func (c *Client) Method() string {
+	return Method
+}
+
+// Start will begin a new conversation and return the client first message.
+func (c *Client) Start() ([]byte, error) {
+	// generate nonce
+	nonce, err := generateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	// reset state
+	c.step = 1
+	c.nonce = nonce
+	c.clientFirstBare = "n=" + escape(c.username) + ",r=" + nonce
+	c.serverSignature = nil
+
+	return []byte(gs2Header + c.clientFirstBare), nil
+}
+
+// Step will process the server first message and return the client final
+// message.
+func (c *Client) Step(data []byte) ([]byte, error) {
+	// check step
+	if c.step != 1 {
+		return nil, ErrInvalidState
+	}
+
+	// advance
+	c.step = 2
+
+	// parse message
+	attrs, err := parse(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// check nonce
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) <= len(c.nonce) {
+		return nil, ErrInvalidNonce
+	}
+
+	// decode salt
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, ErrInvalidMessage
+	}
+
+	// parse iterations
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations <= 0 {
+		return nil, ErrInvalidMessage
+	}
+
+	// check iterations
+	if c.MaxIterations > 0 && iterations > c.MaxIterations {
+		return nil, ErrTooManyIterations
+	}
+
+	// prepare message
+	clientFinal := "c=" + base64.StdEncoding.EncodeToString([]byte(gs2Header)) + ",r=" + nonce
+	authMessage := c.clientFirstBare + "," + string(data) + "," + clientFinal
+
+	// compute proof
+	saltedPassword := hi([]byte(c.password), salt, iterations)
+	clientKey := hmacSum(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSum(storedKey[:], authMessage)
+	proof := xor(clientKey, clientSignature)
+
+	// save expected server signature
+	c.serverSignature = hmacSum(hmacSum(saltedPassword, "Server Key"), authMessage)
+
+	return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Finish will verify the server final message.
+func (c *Client) Finish(data []byte) error {
+	// check step
+	if c.step != 2 {
+		return ErrInvalidState
+	}
+
+	// advance
+	c.step = 3
+
+	// parse message
+	attrs, err := parse(string(data))
+	if err != nil {
+		return err
+	}
+
+	// check error
+	if e, ok := attrs["e"]; ok {
+		return errors.New(e)
+	}
+
+	// decode signature
+	signature, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil {
+		return ErrInvalidMessage
+	}
+
+	// verify signature
+	if !hmac.Equal(signature, c.serverSignature) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// A Server performs the server side of an authentication. A new server must
+// be created for every conversation.
+type Server struct {
+	lookup Lookup
+
+	step            int
+	username        string
+	nonce           string
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	credentials     *Credentials
+	unknown         bool
+}
+
+// NewServer returns a new Server that uses the specified lookup to get the
+// credentials of users.
+func NewServer(lookup Lookup) *Server {
+	return &Server{
+		lookup: lookup,
+	}
+}
+
+// Username returns the name of the user that is being authenticated.
+func (s *Server) Username() string {
+	return s.username
+}
+
+// Step will process the next client message and return the next server
+// message. The returned boolean indicates whether the authentication has been
+// completed successfully.
+func (s *Server) Step(data []byte) ([]byte, bool, error) {
+	switch s.step {
+	case 0:
+		s.step = 1
+		res, err := s.first(string(data))
+		return res, false, err
+	case 1:
+		s.step = 2
+		res, err := s.final(string(data))
+		return res, err == nil, err
+	}
+
+	return nil, false, ErrInvalidState
+}
+
+func (s *Server) first(msg string) ([]byte, error) {
+	// split gs2 header
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return nil, ErrInvalidMessage
+	}
+
+	// parse message
+	attrs, err := parse(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	// get username
+	username, err := unescape(attrs["n"])
+	if err != nil || username == "" {
+		return nil, ErrInvalidMessage
+	}
+
+	// check nonce
+	clientNonce := attrs["r"]
+	if clientNonce == "" {
+		return nil, ErrInvalidMessage
+	}
+
+	// lookup credentials
+	credentials, err := s.lookup(username)
+	if err != nil {
+		return nil, err
+	}
+
+	// use fake credentials for unknown users
+	if credentials == nil {
+		s.unknown = true
+		credentials = &Credentials{
+			Salt:       hmacSum(fakeSaltKey, username)[:16],
+			Iterations: DefaultIterations,
+		}
+	}
+
+	// generate nonce
+	serverNonce, err := generateNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	// set state
+	s.username = username
+	s.nonce = clientNonce + serverNonce
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+	s.credentials = credentials
+	s.serverFirst = "r=" + s.nonce + ",s=" + base64.StdEncoding.EncodeToString(credentials.Salt) +
+		",i=" + strconv.Itoa(credentials.Iterations)
+
+	return []byte(s.serverFirst), nil
+}
+
+func (s *Server) final(msg string) ([]byte, error) {
+	// split proof
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, ErrInvalidMessage
+	}
+
+	// parse message
+	attrs, err := parse(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// check channel binding
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) {
+		return nil, ErrInvalidMessage
+	}
+
+	// check nonce
+	if attrs["r"] != s.nonce {
+		return nil, ErrInvalidNonce
+	}
+
+	// decode proof
+	proof, err := base64.StdEncoding.DecodeString(attrs["p"])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrInvalidMessage
+	}
+
+	// check user
+	if s.unknown {
+		return nil, ErrUnknownUser
+	}
+
+	// prepare auth message
+	authMessage := s.clientFirstBare + "," + s.serverFirst + "," + msg[:i]
+
+	// recover client key
+	clientSignature := hmacSum(s.credentials.StoredKey, authMessage)
+	clientKey := xor(proof, clientSignature)
+
+	// verify client key
+	storedKey := sha256.Sum256(clientKey)
+	if !hmac.Equal(storedKey[:], s.credentials.StoredKey) {
+		return nil, ErrInvalidProof
+	}
+
+	// compute server signature
+	signature := hmacSum(s.credentials.ServerKey, authMessage)
+
+	return []byte("v=" + base64.StdEncoding.EncodeToString(signature)), nil
+}
+
+// parse the attributes of a message
+func parse(msg string) (map[string]string, error) {
+	attrs := make(map[string]string)
+
+	for _, part := range strings.Split(msg, ",") {
+		if len(part) < 2 || part[1] != '=' {
+			return nil, ErrInvalidMessage
+		}
+
+		attrs[part[:1]] = part[2:]
+	}
+
+	return attrs, nil
+}
+
+// escape the special characters of a username
+func escape(username string) string {
+	username = strings.Replace(username, "=", "=3D", -1)
+	return strings.Replace(username, ",", "=2C", -1)
+}
+
+// unescape the special characters of a username
+func unescape(username string) (string, error) {
+	var out []byte
+
+	for i := 0; i < len(username); i++ {
+		if username[i] != '=' {
+			out = append(out, username[i])
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(username[i:], "=3D"):
+			out = append(out, '=')
+		case strings.HasPrefix(username[i:], "=2C"):
+			out = append(out, ',')
+		default:
+			return "", ErrInvalidMessage
+		}
+
+		i += 2
+	}
+
+	return string(out), nil
+}
+
+// the Hi function defined by RFC 5802, which is PBKDF2 with a single block
+func hi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+
+	// compute first iteration
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+
+	// compute remaining iterations
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+
+	return result
+}
+
+func hmacSum(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
+
+func xor(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+
+	return out
+}
@@ -0,0 +1,177 @@
+package scram
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fixedNonces(nonces ...string) func() {
+	original := generateNonce
+	generateNonce = func() (string, error) {
+		nonce := nonces[0]
+		nonces = nonces[1:]
+		return nonce, nil
+	}
+
+	return func() {
+		generateNonce = original
+	}
+}
+
+func TestRFC7677(t *testing.T) {
+	defer fixedNonces("rOprNGfwEbeRWgbNEkqO", "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0")()
+
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	assert.NoError(t, err)
+
+	credentials := NewCredentials("pencil", salt, 4096)
+
+	client := NewClient("user", "pencil")
+	assert.Equal(t, Method, client.Method())
+
+	server := NewServer(func(username string) (*Credentials, error) {
+		assert.Equal(t, "user", username)
+		return credentials, nil
+	})
+
+	clientFirst, err := client.Start()
+	assert.NoError(t, err)
+	assert.Equal(t, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO", string(clientFirst))
+
+	serverFirst, done, err := server.Step(clientFirst)
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", string(serverFirst))
+
+	clientFinal, err := client.Step(serverFirst)
+	assert.NoError(t, err)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(clientFinal))
+
+	serverFinal, done, err := server.Step(clientFinal)
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", string(serverFinal))
+	assert.Equal(t, "user", server.Username())
+
+	err = client.Finish(serverFinal)
+	assert.NoError(t, err)
+
+	_, _, err = server.Step(clientFinal)
+	assert.Equal(t, ErrInvalidState, err)
+}
+
+func TestWrongPassword(t *testing.T) {
+	credentials := NewCredentials("secret", []byte("salt"), DefaultIterations)
+
+	client := NewClient("user", "wrong")
+	server := NewServer(func(username string) (*Credentials, error) {
+		return credentials, nil
+	})
+
+	clientFirst, err := client.Start()
+	assert.NoError(t, err)
+
+	serverFirst, _, err := server.Step(clientFirst)
+	assert.NoError(t, err)
+
+	clientFinal, err := client.Step(serverFirst)
+	assert.NoError(t, err)
+
+	_, done, err := server.Step(clientFinal)
+	assert.Equal(t, ErrInvalidProof, err)
+	assert.False(t, done)
+}
+
+func TestUnknownUser(t *testing.T) {
+	client := NewClient("user", "secret")
+	server := NewServer(func(username string) (*Credentials, error) {
+		return nil, nil
+	})
+
+	clientFirst, err := client.Start()
+	assert.NoError(t, err)
+
+	serverFirst, done, err := server.Step(clientFirst)
+	assert.NoError(t, err)
+	assert.False(t, done)
+
+	attrs, err := parse(string(serverFirst))
+	assert.NoError(t, err)
+	assert.Equal(t, "4096", attrs["i"])
+
+	server2 := NewServer(func(username string) (*Credentials, error) {
+		return nil, nil
+	})
+
+	serverFirst2, _, err := server2.Step(clientFirst)
+	assert.NoError(t, err)
+
+	attrs2, err := parse(string(serverFirst2))
+	assert.NoError(t, err)
+	assert.Equal(t, attrs["s"], attrs2["s"])
+
+	clientFinal, err := client.Step(serverFirst)
+	assert.NoError(t, err)
+
+	_, done, err = server.Step(clientFinal)
+	assert.Equal(t, ErrUnknownUser, err)
+	assert.False(t, done)
+}
+
+func TestTooManyIterations(t *testing.T) {
+	client := NewClient("user", "secret")
+	client.MaxIterations = DefaultIterations
+
+	_, err := client.Start()
+	assert.NoError(t, err)
+
+	_, err = client.Step([]byte("r=" + client.nonce + "foo,s=c2FsdA==,i=4097"))
+	assert.Equal(t, ErrTooManyIterations, err)
+}
+
+func TestInvalidServerSignature(t *testing.T) {
+	credentials := NewCredentials("secret", []byte("salt"), DefaultIterations)
+
+	client := NewClient("user", "secret")
+	server := NewServer(func(username string) (*Credentials, error) {
+		return credentials, nil
+	})
+
+	clientFirst, err := client.Start()
+	assert.NoError(t, err)
+
+	serverFirst, _, err := server.Step(clientFirst)
+	assert.NoError(t, err)
+
+	_, err = client.Step(serverFirst)
+	assert.NoError(t, err)
+
+	err = client.Finish([]byte("v=" + base64.StdEncoding.EncodeToString(make([]byte, 32))))
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestInvalidServerNonce(t *testing.T) {
+	client := NewClient("user", "secret")
+
+	_, err := client.Step([]byte("r=foo,s=c2FsdA==,i=4096"))
+	assert.Equal(t, ErrInvalidState, err)
+
+	_, err = client.Start()
+	assert.NoError(t, err)
+
+	_, err = client.Step([]byte("r=foo,s=c2FsdA==,i=4096"))
+	assert.Equal(t, ErrInvalidNonce, err)
+}
+
+func TestUsernameEscaping(t *testing.T) {
+	assert.Equal(t, "a=3Db=2Cc", escape("a=b,c"))
+
+	username, err := unescape("a=3Db=2Cc")
+	assert.NoError(t, err)
+	assert.Equal(t, "a=b,c", username)
+
+	_, err = unescape("a=b")
+	assert.Equal(t, ErrInvalidMessage, err)
+}
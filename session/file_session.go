@@ -0,0 +1,532 @@
+package session
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// ErrSessionClosed is returned by the FileSession if it has been closed.
+var ErrSessionClosed = errors.New("session closed")
+
+const (
+	fileSessionSavePacket byte = iota + 1
+	fileSessionDeletePacket
+	fileSessionSaveSubscription
+	fileSessionDeleteSubscription
+	fileSessionSaveWill
+	fileSessionClearWill
+)
+
+// the size of a record header (type, length and checksum)
+const fileSessionHeader = 9
+
+// the number of records after which the file is compacted if they outnumber
+// the stored items twice
+var fileSessionCompaction = 1000
+
+// A FileSession stores packets, subscriptions and the will in memory and
+// records all changes in an append-only file. Every record is protected by a
+// checksum and incomplete or corrupted records at the end of the file are
+// discarded when the session is opened, which allows the session to survive
+// crashes. The file is compacted by atomically replacing it with a snapshot of
+// the current state once outdated records outnumber the stored items.
+//
+// The session implements the client and broker session interfaces. Outgoing
+// packets that have been stored before a restart are resent by the client when
+// it connects with the reopened session.
+type FileSession struct {
+	// Sync can be set to flush every write to stable storage.
+	Sync bool
+
+	path    string
+	file    *os.File
+	size    int64
+	records int
+	memory  *MemorySession
+	closed  bool
+	mutex   sync.Mutex
+}
+
+// NewFileSession opens or creates the file at the specified path and returns
+// a FileSession that contains the state recorded in the file.
+func NewFileSession(path string) (*FileSession, error) {
+	// open file
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// prepare session
+	s := &FileSession{
+		path:   path,
+		file:   file,
+		memory: NewMemorySession(),
+	}
+
+	// load records
+	err = s.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// continue counting after the stored outgoing packets
+	var max packet.ID
+	for _, pkt := range s.memory.outStore.All() {
+		if id, ok := packet.GetID(pkt); ok && id > max {
+			max = id
+		}
+	}
+	s.memory.counter.current = max + 1
+	if s.memory.counter.current == 0 {
+		s.memory.counter.current++
+	}
+
+	return s, nil
+}
+
+// NextID will return the next id for outgoing packets.
+func (s *FileSession) NextID() packet.ID {
+	return s.memory.NextID()
+}
+
+// SavePacket will store a packet in the session. An eventual existing
+// packet with the same id gets quietly overwritten.
+func (s *FileSession) SavePacket(dir Direction, pkt packet.GenericPacket) error {
+	// encode packet
+	data, err := encodeFilePacket(dir, pkt)
+	if err != nil {
+		return err
+	}
+
+	return s.apply(fileSessionSavePacket, data, func() {
+		s.memory.SavePacket(dir, pkt)
+	})
+}
+
+// LookupPacket will retrieve a packet from the session using a packet id.
+func (s *FileSession) LookupPacket(dir Direction, id packet.ID) (packet.GenericPacket, error) {
+	return s.memory.LookupPacket(dir, id)
+}
+
+// DeletePacket will remove a packet from the session. The method must not
+// return an error if no packet with the specified id does exists.
+func (s *FileSession) DeletePacket(dir Direction, id packet.ID) error {
+	// check packet
+	if s.memory.storeForDirection(dir).Lookup(id) == nil {
+		return nil
+	}
+
+	// encode direction and id
+	data := make([]byte, 3)
+	data[0] = byte(dir)
+	binary.BigEndian.PutUint16(data[1:], uint16(id))
+
+	return s.apply(fileSessionDeletePacket, data, func() {
+		s.memory.DeletePacket(dir, id)
+	})
+}
+
+// AllPackets will return all packets currently saved in the session.
+func (s *FileSession) AllPackets(dir Direction) ([]packet.GenericPacket, error) {
+	return s.memory.AllPackets(dir)
+}
+
+// SaveSubscription will store the subscription in the session. An eventual
+// subscription with the same topic gets quietly overwritten.
+func (s *FileSession) SaveSubscription(sub *packet.Subscription) error {
+	// encode subscription
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+
+	return s.apply(fileSessionSaveSubscription, data, func() {
+		s.memory.SaveSubscription(sub)
+	})
+}
+
+// LookupSubscription will match a topic against the stored subscriptions and
+// eventually return the first found subscription.
+func (s *FileSession) LookupSubscription(topic string) (*packet.Subscription, error) {
+	return s.memory.LookupSubscription(topic)
+}
+
+// MatchSubscriptions will match a topic against the stored subscriptions and
+// return all found subscriptions.
+func (s *FileSession) MatchSubscriptions(topic string) ([]*packet.Subscription, error) {
+	return s.memory.MatchSubscriptions(topic)
+}
+
+// DeleteSubscription will remove the subscription from the session. The
+// method will not return an error if no subscription with the specified
+// topic does exist.
+func (s *FileSession) DeleteSubscription(topic string) error {
+	return s.apply(fileSessionDeleteSubscription, []byte(topic), func() {
+		s.memory.DeleteSubscription(topic)
+	})
+}
+
+// AllSubscriptions will return all subscriptions currently saved in the session.
+func (s *FileSession) AllSubscriptions() ([]*packet.Subscription, error) {
+	return s.memory.AllSubscriptions()
+}
+
+// SaveWill will store the will message.
+func (s *FileSession) SaveWill(newWill *packet.Message) error {
+	// encode will
+	data, err := json.Marshal(newWill)
+	if err != nil {
+		return err
+	}
+
+	return s.apply(fileSessionSaveWill, data, func() {
+		s.memory.SaveWill(newWill)
+	})
+}
+
+// LookupWill will retrieve the will message.
+func (s *FileSession) LookupWill() (*packet.Message, error) {
+	return s.memory.LookupWill()
+}
+
+// ClearWill will remove the will message from the store.
+func (s *FileSession) ClearWill() error {
+	return s.apply(fileSessionClearWill, nil, func() {
+		s.memory.ClearWill()
+	})
+}
+
+// Reset will completely reset the session and truncate the file.
+func (s *FileSession) Reset() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check state
+	if s.closed {
+		return ErrSessionClosed
+	}
+
+	// truncate file
+	err := s.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	// sync file
+	if s.Sync {
+		err = s.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	// reset state
+	s.size = 0
+	s.records = 0
+
+	return s.memory.Reset()
+}
+
+// Close will close the underlying file.
+func (s *FileSession) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check state
+	if s.closed {
+		return nil
+	}
+
+	// set flag
+	s.closed = true
+
+	return s.file.Close()
+}
+
+// writes a record and applies the change if successful
+func (s *FileSession) apply(typ byte, data []byte, fn func()) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// check state
+	if s.closed {
+		return ErrSessionClosed
+	}
+
+	// write record
+	err := s.write(s.file, s.size, typ, data)
+	if err != nil {
+		return err
+	}
+
+	// sync file
+	if s.Sync {
+		err = s.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	// advance
+	s.size += int64(fileSessionHeader + len(data))
+	s.records++
+
+	// apply change
+	fn()
+
+	// compact file if outdated records outnumber the stored items, a failed
+	// compaction keeps the current file and is retried with the next change
+	if s.records > fileSessionCompaction && s.records > 2*s.items() {
+		s.compact()
+	}
+
+	return nil
+}
+
+func (s *FileSession) load() error {
+	// prepare header
+	header := make([]byte, fileSessionHeader)
+
+	for {
+		// read header
+		_, err := s.file.ReadAt(header, s.size)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// get type, length and checksum
+		typ := header[0]
+		length := int(binary.BigEndian.Uint32(header[1:]))
+		checksum := binary.BigEndian.Uint32(header[5:])
+
+		// read data
+		data := make([]byte, length)
+		_, err = s.file.ReadAt(data, s.size+fileSessionHeader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		// verify checksum
+		if crc32.ChecksumIEEE(data) != checksum {
+			break
+		}
+
+		// replay record
+		if !s.replay(typ, data) {
+			break
+		}
+
+		// advance
+		s.size += int64(fileSessionHeader + length)
+		s.records++
+	}
+
+	// remove incomplete records
+	return s.file.Truncate(s.size)
+}
+
+// applies a loaded record and returns whether it was valid
+func (s *FileSession) replay(typ byte, data []byte) bool {
+	switch typ {
+	case fileSessionSavePacket:
+		// check length
+		if len(data) < 3 {
+			return false
+		}
+
+		// detect packet
+		_, pt := packet.DetectPacket(data[2:])
+		pkt, err := pt.New()
+		if err != nil {
+			return false
+		}
+
+		// decode packet using the stored version
+		packet.SetVersion(pkt, data[1])
+		_, err = pkt.Decode(data[2:])
+		if err != nil {
+			return false
+		}
+
+		s.memory.SavePacket(Direction(data[0]), pkt)
+	case fileSessionDeletePacket:
+		// check length
+		if len(data) != 3 {
+			return false
+		}
+
+		s.memory.DeletePacket(Direction(data[0]), packet.ID(binary.BigEndian.Uint16(data[1:])))
+	case fileSessionSaveSubscription:
+		// decode subscription
+		var sub packet.Subscription
+		err := json.Unmarshal(data, &sub)
+		if err != nil {
+			return false
+		}
+
+		s.memory.SaveSubscription(&sub)
+	case fileSessionDeleteSubscription:
+		s.memory.DeleteSubscription(string(data))
+	case fileSessionSaveWill:
+		// decode will
+		var will *packet.Message
+		err := json.Unmarshal(data, &will)
+		if err != nil {
+			return false
+		}
+
+		s.memory.SaveWill(will)
+	case fileSessionClearWill:
+		s.memory.ClearWill()
+	default:
+		return false
+	}
+
+	return true
+}
+
+// writes a record at the specified offset
+func (s *FileSession) write(file *os.File, offset int64, typ byte, data []byte) error {
+	// prepare record
+	record := make([]byte, fileSessionHeader+len(data))
+	record[0] = typ
+	binary.BigEndian.PutUint32(record[1:], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[5:], crc32.ChecksumIEEE(data))
+	copy(record[fileSessionHeader:], data)
+
+	// write record
+	_, err := file.WriteAt(record, offset)
+
+	return err
+}
+
+// encodes the direction, version and packet of a packet record
+func encodeFilePacket(dir Direction, pkt packet.GenericPacket) ([]byte, error) {
+	// prepare data
+	data := make([]byte, pkt.Len()+2)
+	data[0] = byte(dir)
+	data[1] = packet.GetVersion(pkt)
+
+	// encode packet
+	_, err := pkt.Encode(data[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// returns the number of stored items
+func (s *FileSession) items() int {
+	count := len(s.memory.incStore.All()) + len(s.memory.outStore.All()) + s.memory.subscriptions.Count()
+	if will, _ := s.memory.LookupWill(); will != nil {
+		count++
+	}
+
+	return count
+}
+
+func (s *FileSession) compact() error {
+	// prepare records
+	var types []byte
+	var list [][]byte
+
+	// add packets
+	for _, dir := range []Direction{Incoming, Outgoing} {
+		for _, pkt := range s.memory.storeForDirection(dir).All() {
+			data, err := encodeFilePacket(dir, pkt)
+			if err != nil {
+				return err
+			}
+
+			types = append(types, fileSessionSavePacket)
+			list = append(list, data)
+		}
+	}
+
+	// add subscriptions
+	subs, _ := s.memory.AllSubscriptions()
+	for _, sub := range subs {
+		data, err := json.Marshal(sub)
+		if err != nil {
+			return err
+		}
+
+		types = append(types, fileSessionSaveSubscription)
+		list = append(list, data)
+	}
+
+	// add will
+	if will, _ := s.memory.LookupWill(); will != nil {
+		data, err := json.Marshal(will)
+		if err != nil {
+			return err
+		}
+
+		types = append(types, fileSessionSaveWill)
+		list = append(list, data)
+	}
+
+	// create temporary file
+	tmp, err := os.OpenFile(s.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	// write records
+	var size int64
+	for i, data := range list {
+		err = s.write(tmp, size, types[i], data)
+		if err != nil {
+			break
+		}
+
+		size += int64(fileSessionHeader + len(data))
+	}
+
+	// sync temporary file
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	// replace file
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(s.path + ".tmp")
+		return err
+	}
+
+	// close old file
+	s.file.Close()
+
+	// set state
+	s.file = tmp
+	s.size = size
+	s.records = len(list)
+
+	// sync directory to persist the rename
+	dir, err := os.Open(filepath.Dir(s.path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	dir.Close()
+
+	return err
+}
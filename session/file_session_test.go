@@ -0,0 +1,222 @@
+package session
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempSessionFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "gomqtt")
+	assert.NoError(t, err)
+
+	return filepath.Join(dir, "session"), func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileSessionPersistence(t *testing.T) {
+	path, cleanup := tempSessionFile(t)
+	defer cleanup()
+
+	session, err := NewFileSession(path)
+	assert.NoError(t, err)
+	assert.Equal(t, packet.ID(1), session.NextID())
+	assert.Equal(t, packet.ID(2), session.NextID())
+
+	publish1 := packet.NewPublishPacket()
+	publish1.ID = 1
+	publish1.Version = packet.Version5
+	publish1.Message = packet.Message{Topic: "foo", Payload: []byte("1"), QOS: 1, UserProperties: packet.UserProperties{{Key: "foo", Value: "bar"}}}
+
+	publish2 := packet.NewPublishPacket()
+	publish2.ID = 2
+	publish2.Message = packet.Message{Topic: "foo", Payload: []byte("2"), QOS: 2}
+
+	pubrel := packet.NewPubrelPacket()
+	pubrel.ID = 2
+
+	assert.NoError(t, session.SavePacket(Outgoing, publish1))
+	assert.NoError(t, session.SavePacket(Outgoing, publish2))
+	assert.NoError(t, session.SavePacket(Outgoing, pubrel))
+	assert.NoError(t, session.SavePacket(Incoming, publish1))
+	assert.NoError(t, session.DeletePacket(Incoming, 1))
+	assert.NoError(t, session.DeletePacket(Incoming, 5))
+
+	subscription := &packet.Subscription{Topic: "foo/#", QOS: 1}
+	assert.NoError(t, session.SaveSubscription(subscription))
+	assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: "bar", QOS: 0}))
+	assert.NoError(t, session.DeleteSubscription("bar"))
+
+	will := &packet.Message{Topic: "will", Payload: []byte("bye"), QOS: 1}
+	assert.NoError(t, session.SaveWill(will))
+	assert.NoError(t, session.Close())
+
+	err = session.SaveWill(will)
+	assert.Equal(t, ErrSessionClosed, err)
+
+	session, err = NewFileSession(path)
+	assert.NoError(t, err)
+	assert.Equal(t, packet.ID(3), session.NextID())
+
+	pkts, err := session.AllPackets(Outgoing)
+	assert.NoError(t, err)
+	assert.Equal(t, []packet.GenericPacket{publish1, pubrel}, pkts)
+
+	pkts, err = session.AllPackets(Incoming)
+	assert.NoError(t, err)
+	assert.Empty(t, pkts)
+
+	subs, err := session.AllSubscriptions()
+	assert.NoError(t, err)
+	assert.Equal(t, []*packet.Subscription{subscription}, subs)
+
+	msg, err := session.LookupWill()
+	assert.NoError(t, err)
+	assert.Equal(t, will, msg)
+
+	assert.NoError(t, session.Reset())
+	assert.NoError(t, session.Close())
+
+	session, err = NewFileSession(path)
+	assert.NoError(t, err)
+
+	pkts, err = session.AllPackets(Outgoing)
+	assert.NoError(t, err)
+	assert.Empty(t, pkts)
+
+	msg, err = session.LookupWill()
+	assert.NoError(t, err)
+	assert.Nil(t, msg)
+
+	assert.NoError(t, session.Close())
+}
+
+func TestFileSessionIncompleteRecord(t *testing.T) {
+	path, cleanup := tempSessionFile(t)
+	defer cleanup()
+
+	session, err := NewFileSession(path)
+	assert.NoError(t, err)
+
+	publish := packet.NewPublishPacket()
+	publish.ID = 1
+	publish.Message = packet.Message{Topic: "foo", QOS: 1}
+
+	assert.NoError(t, session.SavePacket(Outgoing, publish))
+	assert.NoError(t, session.SaveSubscription(&packet.Subscription{Topic: "foo"}))
+	assert.NoError(t, session.Close())
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+
+	// simulate crash during write
+	assert.NoError(t, os.Truncate(path, info.Size()-2))
+
+	session, err = NewFileSession(path)
+	assert.NoError(t, err)
+
+	pkts, err := session.AllPackets(Outgoing)
+	assert.NoError(t, err)
+	assert.Equal(t, []packet.GenericPacket{publish}, pkts)
+
+	subs, err := session.AllSubscriptions()
+	assert.NoError(t, err)
+	assert.Empty(t, subs)
+
+	// write after discarded record
+	assert.NoError(t, session.DeletePacket(Outgoing, 1))
+	assert.NoError(t, session.Close())
+
+	session, err = NewFileSession(path)
+	assert.NoError(t, err)
+
+	pkts, err = session.AllPackets(Outgoing)
+	assert.NoError(t, err)
+	assert.Empty(t, pkts)
+
+	assert.NoError(t, session.Close())
+}
+
+func TestFileSessionCompaction(t *testing.T) {
+	path, cleanup := tempSessionFile(t)
+	defer cleanup()
+
+	session, err := NewFileSession(path)
+	assert.NoError(t, err)
+
+	for i := 0; i < 2*fileSessionCompaction; i++ {
+		publish := packet.NewPublishPacket()
+		publish.ID = session.NextID()
+		publish.Message = packet.Message{Topic: "foo", QOS: 1}
+
+		assert.NoError(t, session.SavePacket(Outgoing, publish))
+		assert.NoError(t, session.DeletePacket(Outgoing, publish.ID))
+	}
+
+	publish := packet.NewPublishPacket()
+	publish.ID = session.NextID()
+	publish.Message = packet.Message{Topic: "foo", QOS: 1}
+	assert.NoError(t, session.SavePacket(Outgoing, publish))
+
+	assert.True(t, session.records <= fileSessionCompaction)
+	assert.NoError(t, session.Close())
+
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+
+	session, err = NewFileSession(path)
+	assert.NoError(t, err)
+
+	pkts, err := session.AllPackets(Outgoing)
+	assert.NoError(t, err)
+	assert.Equal(t, []packet.GenericPacket{publish}, pkts)
+
+	assert.NoError(t, session.Close())
+}
+
+func TestFileSessionCompactionError(t *testing.T) {
+	path, cleanup := tempSessionFile(t)
+	defer cleanup()
+
+	session, err := NewFileSession(path)
+	assert.NoError(t, err)
+
+	// block temporary file
+	assert.NoError(t, os.Mkdir(path+".tmp", 0700))
+
+	for i := 0; i < 2*fileSessionCompaction; i++ {
+		publish := packet.NewPublishPacket()
+		publish.ID = session.NextID()
+		publish.Message = packet.Message{Topic: "foo", QOS: 1}
+
+		assert.NoError(t, session.SavePacket(Outgoing, publish))
+		assert.NoError(t, session.DeletePacket(Outgoing, publish.ID))
+	}
+
+	assert.True(t, session.records > fileSessionCompaction)
+
+	// unblock temporary file
+	assert.NoError(t, os.Remove(path+".tmp"))
+
+	publish := packet.NewPublishPacket()
+	publish.ID = session.NextID()
+	publish.Message = packet.Message{Topic: "foo", QOS: 1}
+	assert.NoError(t, session.SavePacket(Outgoing, publish))
+
+	assert.True(t, session.records <= fileSessionCompaction)
+	assert.NoError(t, session.Close())
+
+	session, err = NewFileSession(path)
+	assert.NoError(t, err)
+
+	pkts, err := session.AllPackets(Outgoing)
+	assert.NoError(t, err)
+	assert.Equal(t, []packet.GenericPacket{publish}, pkts)
+
+	assert.NoError(t, session.Close())
+}
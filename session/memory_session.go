@@ -88,6 +88,18 @@ func (s *MemorySession) LookupSubscription(topic string) (*packet.Subscription,
 	return nil, nil
 }
 
+// MatchSubscriptions will match a topic against the stored subscriptions and
+// return all found subscriptions.
+func (s *MemorySession) MatchSubscriptions(topic string) ([]*packet.Subscription, error) {
+	var all []*packet.Subscription
+
+	for _, value := range s.subscriptions.Match(topic) {
+		all = append(all, value.(*packet.Subscription))
+	}
+
+	return all, nil
+}
+
 // DeleteSubscription will remove the subscription from the session. The
 // method will not return an error if no subscription with the specified
 // topic does exist.
@@ -122,6 +122,28 @@ func TestMemorySessionSubscriptionStore(t *testing.T) {
 	assert.Equal(t, 0, len(subs))
 }
 
+func TestMemorySessionMatchSubscriptions(t *testing.T) {
+	session := NewMemorySession()
+
+	subs, err := session.MatchSubscriptions("foo/bar")
+	assert.NoError(t, err)
+	assert.Empty(t, subs)
+
+	sub1 := &packet.Subscription{Topic: "foo/+", QOS: 1}
+	sub2 := &packet.Subscription{Topic: "foo/#", QOS: 2}
+	sub3 := &packet.Subscription{Topic: "bar", QOS: 0}
+
+	assert.NoError(t, session.SaveSubscription(sub1))
+	assert.NoError(t, session.SaveSubscription(sub2))
+	assert.NoError(t, session.SaveSubscription(sub3))
+
+	subs, err = session.MatchSubscriptions("foo/bar")
+	assert.NoError(t, err)
+	assert.Len(t, subs, 2)
+	assert.Contains(t, subs, sub1)
+	assert.Contains(t, subs, sub2)
+}
+
 func TestMemorySessionWillStore(t *testing.T) {
 	session := NewMemorySession()
 
@@ -0,0 +1,300 @@
+// Package tracing implements a lightweight span based tracing of message flows
+// that can be exported to arbitrary tracing systems.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/256dpi/gomqtt/packet"
+)
+
+// TraceParentKey is the user property key that is used to propagate the
+// trace context using the W3C traceparent format.
+const TraceParentKey = "traceparent"
+
+// A TraceID identifies a trace.
+type TraceID [16]byte
+
+// String returns the hex representation of the id.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// A SpanID identifies a span.
+type SpanID [8]byte
+
+// String returns the hex representation of the id.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// A SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+}
+
+// IsValid returns whether the context has a trace and span id.
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// String returns the W3C traceparent representation of the context.
+func (c SpanContext) String() string {
+	return fmt.Sprintf("00-%s-%s-01", c.TraceID, c.SpanID)
+}
+
+// ParseSpanContext will parse a W3C traceparent representation of a span
+// context. It returns an invalid context if the value cannot be parsed.
+func ParseSpanContext(value string) SpanContext {
+	// split value
+	parts := strings.Split(value, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return SpanContext{}
+	}
+
+	// prepare context
+	var ctx SpanContext
+
+	// decode trace id
+	_, err := hex.Decode(ctx.TraceID[:], []byte(parts[1]))
+	if err != nil {
+		return SpanContext{}
+	}
+
+	// decode span id
+	_, err = hex.Decode(ctx.SpanID[:], []byte(parts[2]))
+	if err != nil {
+		return SpanContext{}
+	}
+
+	return ctx
+}
+
+// Inject will add the span context to the specified user properties and
+// return them. Existing trace parents are replaced and a new list is returned
+// to not modify the original properties.
+func Inject(ctx SpanContext, props packet.UserProperties) packet.UserProperties {
+	// check context
+	if !ctx.IsValid() {
+		return props
+	}
+
+	// copy properties without existing trace parents
+	newProps := make(packet.UserProperties, 0, len(props)+1)
+	for _, prop := range props {
+		if prop.Key != TraceParentKey {
+			newProps = append(newProps, prop)
+		}
+	}
+
+	// add trace parent
+	newProps = append(newProps, packet.UserProperty{
+		Key:   TraceParentKey,
+		Value: ctx.String(),
+	})
+
+	return newProps
+}
+
+// Strip will remove the span context from the specified user properties and
+// return them. A new list is returned to not modify the original properties.
+func Strip(props packet.UserProperties) packet.UserProperties {
+	// check properties
+	if _, ok := props.Get(TraceParentKey); !ok {
+		return props
+	}
+
+	// copy properties
+	var newProps packet.UserProperties
+	for _, prop := range props {
+		if prop.Key != TraceParentKey {
+			newProps = append(newProps, prop)
+		}
+	}
+
+	return newProps
+}
+
+// Extract will return the span context stored in the specified user
+// properties. It returns an invalid context if none is found.
+func Extract(props packet.UserProperties) SpanContext {
+	value, _ := props.Get(TraceParentKey)
+	return ParseSpanContext(value)
+}
+
+// A Span represents a single operation within a trace.
+type Span struct {
+	// The name of the span.
+	Name string
+
+	// The context of the span.
+	Context SpanContext
+
+	// The context of the parent span if available.
+	Parent SpanContext
+
+	// The start and end time of the span.
+	Start time.Time
+	End   time.Time
+
+	// The attributes of the span.
+	Attributes map[string]string
+
+	// The error that occurred during the operation.
+	Error error
+
+	tracer *Tracer
+	mutex  sync.Mutex
+}
+
+// SetAttribute will set the specified attribute on the span.
+func (s *Span) SetAttribute(key, value string) {
+	// check span
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Attributes[key] = value
+}
+
+// SpanContext returns the context of the span. It returns an invalid context
+// if the span is nil.
+func (s *Span) SpanContext() SpanContext {
+	// check span
+	if s == nil {
+		return SpanContext{}
+	}
+
+	return s.Context
+}
+
+// Finish will end the span with the specified error and export it.
+func (s *Span) Finish(err error) {
+	// check span
+	if s == nil {
+		return
+	}
+
+	// set end and error
+	s.mutex.Lock()
+	s.End = time.Now()
+	s.Error = err
+	s.mutex.Unlock()
+
+	// export span
+	s.tracer.Exporter.Export(s)
+}
+
+// An Exporter receives finished spans.
+type Exporter interface {
+	// Export is called with every finished span.
+	//
+	// Note: The call is made synchronously from the traced goroutine and
+	// should therefore not block.
+	Export(*Span)
+}
+
+// A Tracer creates spans and exports them using the configured exporter.
+//
+// All methods of the tracer and the returned spans can be called on a nil
+// tracer, which disables tracing altogether.
+type Tracer struct {
+	Exporter Exporter
+}
+
+// NewTracer returns a new Tracer that uses the specified exporter.
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{
+		Exporter: exporter,
+	}
+}
+
+// Start will start a new span with the specified name. The span will be a
+// child of the parent context if it is valid, otherwise a new trace is started.
+func (t *Tracer) Start(name string, parent SpanContext) *Span {
+	// check tracer
+	if t == nil || t.Exporter == nil {
+		return nil
+	}
+
+	// prepare span
+	span := &Span{
+		Name:       name,
+		Parent:     parent,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+		tracer:     t,
+	}
+
+	// set trace id
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+	} else {
+		_, _ = rand.Read(span.Context.TraceID[:])
+	}
+
+	// set span id
+	_, _ = rand.Read(span.Context.SpanID[:])
+
+	return span
+}
+
+// A MemoryExporter stores all exported spans in memory. It is intended to be
+// used in testing scenarios.
+type MemoryExporter struct {
+	spans []*Span
+	mutex sync.Mutex
+}
+
+// NewMemoryExporter returns a new MemoryExporter.
+func NewMemoryExporter() *MemoryExporter {
+	return &MemoryExporter{}
+}
+
+// Export will store the span.
+func (e *MemoryExporter) Export(span *Span) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.spans = append(e.spans, span)
+}
+
+// Spans returns all stored spans in the order they have been exported.
+func (e *MemoryExporter) Spans() []*Span {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return append([]*Span(nil), e.spans...)
+}
+
+// Trace returns all stored spans that belong to the specified trace.
+func (e *MemoryExporter) Trace(id TraceID) []*Span {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	var list []*Span
+	for _, span := range e.spans {
+		if span.Context.TraceID == id {
+			list = append(list, span)
+		}
+	}
+
+	return list
+}
+
+// Reset will remove all stored spans.
+func (e *MemoryExporter) Reset() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.spans = nil
+}
@@ -0,0 +1,106 @@
+package tracing
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/256dpi/gomqtt/packet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanContext(t *testing.T) {
+	ctx := SpanContext{
+		TraceID: TraceID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16},
+		SpanID:  SpanID{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	assert.True(t, ctx.IsValid())
+	assert.Equal(t, "00-0102030405060708090a0b0c0d0e0f10-0102030405060708-01", ctx.String())
+	assert.Equal(t, ctx, ParseSpanContext(ctx.String()))
+
+	assert.False(t, SpanContext{}.IsValid())
+	assert.False(t, ParseSpanContext("").IsValid())
+	assert.False(t, ParseSpanContext("00-foo-bar-01").IsValid())
+	assert.False(t, ParseSpanContext("00-zz02030405060708090a0b0c0d0e0f10-0102030405060708-01").IsValid())
+}
+
+func TestInjectExtract(t *testing.T) {
+	ctx := SpanContext{
+		TraceID: TraceID{1},
+		SpanID:  SpanID{1},
+	}
+
+	props := packet.UserProperties{{Key: "foo", Value: "bar"}}
+
+	newProps := Inject(ctx, props)
+	assert.Equal(t, packet.UserProperties{{Key: "foo", Value: "bar"}}, props)
+	assert.Equal(t, packet.UserProperties{
+		{Key: "foo", Value: "bar"},
+		{Key: TraceParentKey, Value: ctx.String()},
+	}, newProps)
+	assert.Equal(t, ctx, Extract(newProps))
+
+	assert.Equal(t, props, Inject(SpanContext{}, props))
+	assert.False(t, Extract(nil).IsValid())
+
+	assert.Equal(t, props, Strip(newProps))
+	assert.Equal(t, packet.UserProperties{
+		{Key: "foo", Value: "bar"},
+		{Key: TraceParentKey, Value: ctx.String()},
+	}, newProps)
+	assert.Nil(t, Strip(Inject(ctx, nil)))
+
+	ctx2 := SpanContext{
+		TraceID: TraceID{2},
+		SpanID:  SpanID{2},
+	}
+
+	newProps = Inject(ctx2, newProps)
+	assert.Equal(t, packet.UserProperties{
+		{Key: "foo", Value: "bar"},
+		{Key: TraceParentKey, Value: ctx2.String()},
+	}, newProps)
+	assert.Equal(t, ctx2, Extract(newProps))
+}
+
+func TestTracer(t *testing.T) {
+	exporter := NewMemoryExporter()
+	tracer := NewTracer(exporter)
+
+	root := tracer.Start("root", SpanContext{})
+	assert.True(t, root.SpanContext().IsValid())
+	assert.False(t, root.Parent.IsValid())
+
+	child := tracer.Start("child", root.SpanContext())
+	child.SetAttribute("foo", "bar")
+	assert.Equal(t, root.Context.TraceID, child.Context.TraceID)
+	assert.NotEqual(t, root.Context.SpanID, child.Context.SpanID)
+	assert.Equal(t, root.SpanContext(), child.Parent)
+
+	child.Finish(errors.New("failed"))
+	root.Finish(nil)
+
+	other := tracer.Start("other", SpanContext{})
+	other.Finish(nil)
+
+	spans := exporter.Spans()
+	assert.Equal(t, []*Span{child, root, other}, spans)
+	assert.Equal(t, map[string]string{"foo": "bar"}, child.Attributes)
+	assert.EqualError(t, child.Error, "failed")
+	assert.False(t, child.End.IsZero())
+
+	assert.Equal(t, []*Span{child, root}, exporter.Trace(root.Context.TraceID))
+
+	exporter.Reset()
+	assert.Empty(t, exporter.Spans())
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+
+	span := tracer.Start("foo", SpanContext{})
+	assert.Nil(t, span)
+
+	span.SetAttribute("foo", "bar")
+	span.Finish(nil)
+	assert.False(t, span.SpanContext().IsValid())
+}
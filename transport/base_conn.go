@@ -97,6 +97,11 @@ func (c *BaseConn) BufferedSend(pkt packet.GenericPacket) error {
 }
 
 func (c *BaseConn) write(pkt packet.GenericPacket) error {
+	// use the version requested by the client for all subsequent packets
+	if connect, ok := pkt.(*packet.ConnectPacket); ok {
+		c.stream.SetVersion(connect.Version)
+	}
+
 	err := c.stream.Write(pkt)
 	if err != nil {
 		// ensure connection gets closed
@@ -149,6 +154,11 @@ func (c *BaseConn) Receive() (packet.GenericPacket, error) {
 		return nil, err
 	}
 
+	// use the version requested by the client for all subsequent packets
+	if connect, ok := pkt.(*packet.ConnectPacket); ok {
+		c.stream.SetVersion(connect.Version)
+	}
+
 	// reset timeout
 	c.resetTimeout()
 
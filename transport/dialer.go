@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -48,8 +49,19 @@ func Dial(urlString string) (Conn, error) {
 	return sharedDialer.Dial(urlString)
 }
 
+// DialContext is a shorthand function.
+func DialContext(ctx context.Context, urlString string) (Conn, error) {
+	return sharedDialer.DialContext(ctx, urlString)
+}
+
 // Dial initiates a connection based in information extracted from an URL.
 func (d *Dialer) Dial(urlString string) (Conn, error) {
+	return d.DialContext(context.Background(), urlString)
+}
+
+// DialContext initiates a connection like Dial and aborts the attempt if the
+// context is done before the connection has been established.
+func (d *Dialer) DialContext(ctx context.Context, urlString string) (Conn, error) {
 	urlParts, err := url.ParseRequestURI(urlString)
 	if err != nil {
 		return nil, err
@@ -67,7 +79,8 @@ func (d *Dialer) Dial(urlString string) (Conn, error) {
 			port = d.DefaultTCPPort
 		}
 
-		conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
 		if err != nil {
 			return nil, err
 		}
@@ -78,7 +91,8 @@ func (d *Dialer) Dial(urlString string) (Conn, error) {
 			port = d.DefaultTLSPort
 		}
 
-		conn, err := tls.Dial("tcp", net.JoinHostPort(host, port), d.TLSConfig)
+		dialer := &tls.Dialer{Config: d.TLSConfig}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
 		if err != nil {
 			return nil, err
 		}
@@ -91,7 +105,7 @@ func (d *Dialer) Dial(urlString string) (Conn, error) {
 
 		wsURL := fmt.Sprintf("ws://%s:%s%s", host, port, urlParts.Path)
 
-		conn, _, err := d.webSocketDialer.Dial(wsURL, d.RequestHeader)
+		conn, _, err := d.webSocketDialer.DialContext(ctx, wsURL, d.RequestHeader)
 		if err != nil {
 			return nil, err
 		}
@@ -105,7 +119,7 @@ func (d *Dialer) Dial(urlString string) (Conn, error) {
 		wsURL := fmt.Sprintf("wss://%s:%s%s", host, port, urlParts.Path)
 
 		d.webSocketDialer.TLSClientConfig = d.TLSConfig
-		conn, _, err := d.webSocketDialer.Dial(wsURL, d.RequestHeader)
+		conn, _, err := d.webSocketDialer.DialContext(ctx, wsURL, d.RequestHeader)
 		if err != nil {
 			return nil, err
 		}
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"io"
 	"testing"
 
@@ -49,6 +50,21 @@ func TestDialerUnsupportedProtocol(t *testing.T) {
 	assert.Equal(t, ErrUnsupportedProtocol, err)
 }
 
+func TestDialerContextCanceled(t *testing.T) {
+	server, err := testLauncher.Launch("tcp://localhost:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	conn, err := DialContext(ctx, getURL(server, "tcp"))
+	assert.Nil(t, conn)
+	assert.Error(t, err)
+
+	err = server.Close()
+	assert.NoError(t, err)
+}
+
 func TestDialerTCPError(t *testing.T) {
 	conn, err := Dial("tcp://localhost:1234567")
 	assert.Nil(t, conn)